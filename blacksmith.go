@@ -1,12 +1,16 @@
 package main // import "github.com/cafebazaar/blacksmith"
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -16,6 +20,8 @@ import (
 	"github.com/cafebazaar/blacksmith/dhcp"
 	"github.com/cafebazaar/blacksmith/logging"
 	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/templating"
+	"github.com/cafebazaar/blacksmith/tracing"
 	"github.com/cafebazaar/blacksmith/web"
 	etcd "github.com/coreos/etcd/client"
 )
@@ -30,27 +36,82 @@ const (
 		/config/ignition/main
 		/images/{core-os-version}/coreos_production_pxe_image.cpio.gz
 		/images/{core-os-version}/coreos_production_pxe.vmlinuz
+		/images/{core-os-version}/arm64/... for the arm64 machines
 		/initial.yaml
 `
 	debugTag = "MAIN"
 
 	httpListenFlagDefaultTCPAddress = "interface-ip:8000"
+
+	// Roles of -role
+	rolePrimary = "primary"
+	roleReplica = "replica"
 )
 
 var (
-	versionFlag       = flag.Bool("version", false, "Print version info and exit")
-	debugFlag         = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
-	listenIFFlag      = flag.String("if", "0.0.0.0", "Interface name for DHCP and PXE to listen on")
-	httpListenFlag    = flag.String("http-listen", httpListenFlagDefaultTCPAddress, "IP range to listen on for web requests on :8000")
-	workspacePathFlag = flag.String("workspace", "/workspace", workspacePathHelp)
-	etcdFlag          = flag.String("etcd", "", "Etcd endpoints")
-	clusterNameFlag   = flag.String("cluster-name", "blacksmith", "The name of this cluster. Will be used as etcd path prefixes.")
-	dnsAddressesFlag  = flag.String("dns", "8.8.8.8", "comma separated IPs which will be used as default nameservers for skydns.")
+	versionFlag        = flag.Bool("version", false, "Print version info and exit")
+	validateFlag       = flag.Bool("validate", false, "Check the workspace, the templates and the connection to etcd, and exit")
+	debugFlag          = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
+	listenIFFlag       = flag.String("if", "0.0.0.0", "Interface name for DHCP and PXE to listen on")
+	httpListenFlag     = flag.String("http-listen", httpListenFlagDefaultTCPAddress, "IP range to listen on for web requests on :8000")
+	workspacePathFlag  = flag.String("workspace", "/workspace", workspacePathHelp)
+	etcdFlag           = flag.String("etcd", "", "Etcd endpoints")
+	etcdUserFlag       = flag.String("etcd-username", "", "Username of etcd, for the clusters with authentication enabled. Defaults to $ETCD_USERNAME")
+	etcdPasswordFlag   = flag.String("etcd-password", "", "Password of -etcd-username. Defaults to $ETCD_PASSWORD")
+	etcdMaxConnsFlag   = flag.Int("etcd-max-conns", 64, "Number of the idle connections kept open to each etcd endpoint, which are reused instead of opening new ones under boot storms")
+	etcdDialTOFlag     = flag.Duration("etcd-dial-timeout", 3*time.Second, "Timeout of connecting to an etcd endpoint")
+	clusterNameFlag    = flag.String("cluster-name", "blacksmith", "The name of this cluster. Will be used as etcd path prefixes.")
+	dnsAddressesFlag   = flag.String("dns", "8.8.8.8", "comma separated IPs which will be used as default nameservers for skydns.")
+	secretsDirFlag     = flag.String("secrets-dir", "/run/secrets", "Directory which the secret template func reads from")
+	logFileFlag        = flag.String("log-file", "", "File to write the logs to, instead of stderr")
+	logMaxSizeFlag     = flag.Int("log-max-size", 100, "Size of the log file in megabytes, after which it's rotated")
+	logKeepFlag        = flag.Int("log-keep", 5, "Number of rotated log files to keep")
+	httpHeaderTOFlag   = flag.Duration("http-header-timeout", 10*time.Second, "How long the http servers wait for the headers of a request, which cuts the slow clients holding the connections. Zero means no timeout")
+	httpWriteTOFlag    = flag.Duration("http-write-timeout", time.Minute, "How long the api and the configs may take to be handled, after which 503 is served. Zero means no timeout")
+	imageWriteTOFlag   = flag.Duration("image-write-timeout", 30*time.Minute, "How long sending an image by the http booter, or uploading or downloading a file of /files, may take. Zero means no timeout")
+	httpIdleTOFlag     = flag.Duration("http-idle-timeout", 2*time.Minute, "How long the http servers keep an idle keep-alive connection open. Zero means no timeout")
+	roleFlag           = flag.String("role", rolePrimary, "primary, which takes part in the election of the instance serving DHCP and PXE, or replica, which only serves the configs, the images and the read-only api, to scale the boots")
+	maxUploadFlag      = flag.Int("max-upload-size", 1024, "Size of the largest file accepted by /upload in megabytes")
+	uiDirFlag          = flag.String("ui-dir", "", "Directory to serve the ui from, instead of the embedded one")
+	ipmitoolFlag       = flag.String("ipmitool", "", "Path of ipmitool, used to control the power of the machines whose BMC is set, e.g. on reimage")
+	redfishInsecFlag   = flag.Bool("redfish-insecure", false, "Skip verifying the certificates of the Redfish BMCs, whose addresses are https urls")
+	hostnameTplFlag    = flag.String("hostname-template", "", "Go template of the host name sent as DHCP option 12, with {{.Mac}} (without colons), {{.IP}}, {{.ClusterName}} and the flags of the machine as {{.Flags.name}}. Defaults to node{{.Mac}}.{{.ClusterName}}")
+	cmdlineTplFlag     = flag.String("cmdline-template", "", "Go template of the kernel cmdline, with {{.ServerIP}}, {{.HTTPPort}} and {{.Mac}}, which the bootparams are appended to. Defaults to the cloudconfig and ignition urls of blacksmith")
+	fileRetriesFlag    = flag.Int("file-retries", 3, "Times the http booter retries opening an image file which exists but can't be opened")
+	fileBackoffFlag    = flag.Duration("file-backoff", 200*time.Millisecond, "Backoff before the first retry of -file-retries, which doubles on each retry")
+	gzipInitrdFlag     = flag.Bool("gzip-initrd", false, "Compress the initrds which aren't gzipped already on the fly, for the clients which accept gzip")
+	pxeBootFilesFlag   = flag.String("pxe-boot-files", "", "Comma separated arch=file pairs, mapping the client architectures (DHCP option 93) to the advertised boot files. Defaults to 0=undionly.kpxe,6=ipxe.efi,7=ipxe.efi,9=ipxe.efi")
+	pxeMenuFlag        = flag.String("pxe-menu", "", "Comma separated type=description entries of the PXE boot menu, like 0x8000=Install,0=Boot from disk. Type 0 boots from the local disk. Defaults to a single entry with the version of blacksmith")
+	bootMessageFlag    = flag.String("boot-message", "", "Prompt of the PXE boot menu, and the description of its default entry, like a datacenter name. Defaults to the version of blacksmith")
+	menuTimeoutFlag    = flag.Duration("pxe-menu-timeout", 2*time.Second, "How long the PXE boot menu waits before booting the first entry, up to 254s. A negative one boots it without prompting")
+	strictTplFlag      = flag.Bool("strict-templates", false, "Fail rendering a template if a value of the env or secret template funcs is missing")
+	maxRendersFlag     = flag.Int("max-renders", 0, "Number of the templates rendered at the same time, beyond which the requests of the configs get 503 instead of piling up on etcd. Zero means no limit")
+	onMissingFlag      = flag.String("on-missing-config", "404", "What's served to a machine whose config folder has no main template: 404, or a directory of fallback configs named by kind, like <dir>/cloudconfig")
+	allowlistOnlyFlag  = flag.Bool("allowlist-only", false, "Serve DHCP only to the known machines, and to the hardware address prefixes of -allowlist")
+	machinesTTLFlag    = flag.Duration("machines-cache-ttl", time.Second, "How long the list of the machines is reused before listing them in etcd again. Zero disables the cache")
+	machineShardFlag   = flag.String("machine-sharding", "none", "Layout of the machines in etcd: none, or first-octet for a directory per first octet of the hardware addresses, which keeps listing tens of thousands of machines fast. Existing machines are moved with the migrate-sharding command")
+	strictMachinesFlag = flag.Bool("strict-machines", false, "Fail listing the machines if an entry is malformed, instead of skipping it")
+	noAutoCreateFlag   = flag.Bool("no-autocreate-on-request", false, "NAK the DHCP requests of the unknown machines, instead of creating them with the requested address. The machines are then only created on Discover")
+	probeFlag          = flag.Bool("probe-before-offer", false, "Ping the addresses before offering them, up to 3 for each Discover, and skip the ones which respond for a while")
+	probeTimeoutFlag   = flag.Duration("probe-timeout", 500*time.Millisecond, "How long to wait for a reply to the probe of -probe-before-offer")
+	dhcpOptionsFlag    = dhcp.CustomOptions{}
+	dhcpAuthFlag       = flag.Bool("dhcp-authoritative", true, "NAK the DHCP requests which can't be satisfied. Disable it when blacksmith is a secondary server on a segment, to stay silent instead")
+	enableBOOTPFlag    = flag.Bool("enable-bootp", false, "Answer the legacy BOOTP clients too, which send no DHCP message type, with a permanent address and the boot file")
+	dhcpEventsFlag     = flag.Int("dhcp-events", 100, "Number of the recent DHCP decisions kept for /api/dhcp/events. Zero disables recording them")
+	dhcpServerIDFlag   = flag.String("dhcp-server-id", "", "Address sent as the DHCP server identifier (option 54), e.g. for relays. Defaults to the address blacksmith serves on")
+	flagHistoryFlag    = flag.Int("flag-history", 0, "Number of the values kept per flag of each machine, for /api/node/<mac>/flag/<key>/history. Zero disables the history")
+	ipamURLFlag        = flag.String("ipam-url", "", "URL of an external IPAM service which allocates the addresses instead of the lease pool, see docs/Workspace.md for its API")
+	reconcileFlag      = flag.Duration("reconcile-interval", 10*time.Minute, "How often the claims on the leased ips are rebuilt from the machines, repairing the drift left by crashes. Zero disables the periodic runs, leaving POST /api/reconcile")
+	otelEndpointFlag   = flag.String("otel-endpoint", "", "OTLP/HTTP endpoint (host:port) to export the traces of the etcd calls, the template renders and the http booter requests to. Tracing is disabled if empty")
+	allowlistFlag      = flag.String("allowlist", "", "File of hardware address prefixes (like 00:11:22), one per line, which are served in the allowlist-only mode even if unknown")
 
 	leaseStartFlag  = flag.String("lease-start", "", "Begining of lease starting IP")
 	leaseRangeFlag  = flag.Int("lease-range", 0, "Lease range")
-	leaseSubnetFlag = flag.String("lease-subnet", "", "Subnet of specified lease")
+	leaseSubnetFlag = flag.String("lease-subnet", "", "Subnet mask of the lease, as a mask (255.255.255.0) or a CIDR (192.168.1.0/24)")
+	leasePrefixFlag = flag.Int("lease-prefix", 0, "Prefix length of the subnet of the lease, like 24. Replaces lease-subnet")
 	leaseRouterFlag = flag.String("router", "", "Default router that assigned to DHCP clients")
+	leaseStratFlag  = flag.String("lease-strategy", "lowest", "Order in which the free addresses of the lease pool are assigned: lowest, random, or sticky to prefer the last address of the machine")
+	poolFlag        = flag.String("pool", "", "Lease pool, as start-end/prefix (192.168.1.10-192.168.1.200/24) or a CIDR (192.168.1.0/24). Comma separated pools are refused if they overlap. Replaces lease-start, lease-range and lease-subnet, and infers the router as the first address of the subnet")
 
 	version   string
 	commit    string
@@ -58,6 +119,8 @@ var (
 )
 
 func init() {
+	flag.Var(dhcpOptionsFlag, "dhcp-option", "Custom DHCP option as code=value, like 252=http://192.168.1.1/wpad.dat. The value is text, raw hex with a hex: prefix, or comma separated IPv4 addresses with an ip: prefix. Can be repeated, and overrides the dhcp-options of initial.yaml")
+
 	// If version, commit, or build time are not set, make that clear.
 	if version == "" {
 		version = "unknown"
@@ -75,6 +138,17 @@ func interfaceIP(iface *net.Interface) (net.IP, error) {
 	if err != nil {
 		return nil, err
 	}
+	ip, err := pickIP(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s %s", iface.Name, err)
+	}
+	return ip, nil
+}
+
+// pickIP chooses the address to serve on among the addresses of an
+// interface. It's always an IPv4 one, since DHCP, PXE and TFTP are served on
+// it; the IPv6 addresses are only reported, in the error and on /api/network
+func pickIP(addrs []net.Addr) (net.IP, error) {
 	fs := [](func(net.IP) bool){
 		net.IP.IsGlobalUnicast,
 		net.IP.IsLinkLocalUnicast,
@@ -95,10 +169,79 @@ func interfaceIP(iface *net.Interface) (net.IP, error) {
 			}
 		}
 	}
-	return nil, fmt.Errorf("interface %s has no usable unicast addresses", iface.Name)
+
+	found := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		found = append(found, a.String())
+	}
+	if len(found) == 0 {
+		return nil, errors.New("has no addresses")
+	}
+	return nil, fmt.Errorf("has no usable IPv4 unicast address, which DHCP, PXE and TFTP need (found: %s)",
+		strings.Join(found, ", "))
+}
+
+// etcdCredentials returns the username and password of etcd, from the flags
+// or else from the environment, which keeps the password off the command line
+func etcdCredentials() (string, string) {
+	username, password := *etcdUserFlag, *etcdPasswordFlag
+	if username == "" {
+		username = os.Getenv("ETCD_USERNAME")
+	}
+	if password == "" {
+		password = os.Getenv("ETCD_PASSWORD")
+	}
+	return username, password
+}
+
+// newEtcdTransport returns the transport of the etcd client, which keeps up
+// to maxIdlePerHost connections alive to each endpoint for reuse, instead of
+// opening and closing one per request and running out of ports
+func newEtcdTransport(maxIdlePerHost int, dialTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: maxIdlePerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func newEtcdClient() (etcd.Client, error) {
+	username, password := etcdCredentials()
+	return etcd.New(etcd.Config{
+		Endpoints:               strings.Split(*etcdFlag, ","),
+		Transport:               newEtcdTransport(*etcdMaxConnsFlag, *etcdDialTOFlag),
+		HeaderTimeoutPerRequest: 5 * time.Second,
+		Username:                username,
+		Password:                password,
+	})
+}
+
+// describeEtcdError tells the rejected credentials apart from an unreachable
+// cluster, which look alike to the ones starting blacksmith
+func describeEtcdError(err error) error {
+	switch e := err.(type) {
+	case etcd.Error:
+		if e.Code == etcd.ErrorCodeUnauthorized {
+			return fmt.Errorf("etcd rejected the credentials (check -etcd-username and -etcd-password): %s", e.Message)
+		}
+	case *etcd.ClusterError:
+		return fmt.Errorf("etcd cluster is unreachable: %s", e.Detail())
+	}
+	return err
 }
 
 func gracefulShutdown(etcdDataSource datasource.DataSource) {
+	tracing.Shutdown()
+	// the replicas don't take part in the election
+	if *roleFlag == roleReplica {
+		fmt.Fprint(os.Stderr, "\nBlacksmith is gracefully shutdown\n")
+		os.Exit(0)
+	}
 	err := etcdDataSource.RemoveInstance()
 	if err != nil {
 		log.Printf("\nError while removing the instance: %s\n", err)
@@ -108,10 +251,44 @@ func gracefulShutdown(etcdDataSource datasource.DataSource) {
 	os.Exit(0)
 }
 
+// customDHCPOptions merges the dhcp-options of initial.yaml with the ones
+// given by -dhcp-option, which take precedence
+func customDHCPOptions() (dhcp.CustomOptions, error) {
+	initialOptions, err := datasource.InitialDHCPOptions(*workspacePathFlag)
+	if err != nil {
+		return nil, err
+	}
+	options := dhcp.CustomOptions{}
+	for _, option := range initialOptions {
+		if err := options.Set(option); err != nil {
+			return nil, err
+		}
+	}
+	for code, value := range dhcpOptionsFlag {
+		options[code] = value
+	}
+	return options, nil
+}
+
+// dhcpLabelOverrides reads the dhcp-label-options of initial.yaml
+func dhcpLabelOverrides() ([]dhcp.LabelOverride, error) {
+	options, err := datasource.InitialDHCPLabelOptions(*workspacePathFlag)
+	if err != nil {
+		return nil, err
+	}
+	return dhcp.ParseLabelOverrides(options)
+}
+
 func main() {
 	var err error
 	flag.Parse()
 
+	// before the version banner, so that commands like export can write
+	// to stdout
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	fmt.Printf("Blacksmith (%s)\n", version)
 	fmt.Printf("  Commit:        %s\n", commit)
 	fmt.Printf("  Build Time:    %s\n", buildTime)
@@ -120,6 +297,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *validateFlag {
+		os.Exit(validate())
+	}
+
 	// etcd config
 	if etcdFlag == nil || clusterNameFlag == nil {
 		fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints\n")
@@ -141,7 +322,7 @@ func main() {
 
 	serverIP, err := interfaceIP(dhcpIF)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\nError while trying to get the ip from the interface (%s)\n", dhcpIF)
+		fmt.Fprintf(os.Stderr, "\nError while trying to get the ip from the interface: %s\n", err)
 		os.Exit(1)
 	}
 
@@ -150,7 +331,7 @@ func main() {
 	if *httpListenFlag != httpListenFlagDefaultTCPAddress {
 		splitAddress := strings.Split(*httpListenFlag, ":")
 		if len(splitAddress) > 2 {
-			fmt.Printf("Incorrect tcp address provided: %s", httpListenFlag)
+			fmt.Printf("Incorrect tcp address provided: %s", *httpListenFlag)
 			os.Exit(1)
 		}
 		if len(splitAddress) == 1 {
@@ -161,7 +342,7 @@ func main() {
 		port, err := strconv.ParseInt(splitAddress[1], 10, 64)
 
 		if err != nil {
-			fmt.Printf("Incorrect tcp address provided: %s", httpListenFlag)
+			fmt.Printf("Incorrect tcp address provided: %s", *httpListenFlag)
 			os.Exit(1)
 		}
 		webAddr.Port = int(port)
@@ -177,12 +358,111 @@ func main() {
 	var pxeAddr = net.UDPAddr{IP: serverIP, Port: 4011}
 	// 67 -> dhcp
 
+	var allowedPrefixes []net.HardwareAddr
+	if *allowlistFlag != "" {
+		if !*allowlistOnlyFlag {
+			fmt.Fprint(os.Stderr, "\nThe allowlist is only used with -allowlist-only\n")
+			os.Exit(1)
+		}
+		allowedPrefixes, err = dhcp.ReadAllowlist(*allowlistFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nCouldn't read the allowlist: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	dhcpOptions, err := customDHCPOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid dhcp options: %s\n", err)
+		os.Exit(1)
+	}
+
+	labelOverrides, err := dhcpLabelOverrides()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid dhcp label options: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *roleFlag != rolePrimary && *roleFlag != roleReplica {
+		fmt.Fprintf(os.Stderr, "\nInvalid role %q, expected %s or %s\n", *roleFlag, rolePrimary, roleReplica)
+		os.Exit(1)
+	}
+
+	leaseStrategy, err := datasource.ParseLeaseStrategy(*leaseStratFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid lease strategy: %s\n", err)
+		os.Exit(1)
+	}
+
+	var dhcpServerID net.IP
+	if *dhcpServerIDFlag != "" {
+		dhcpServerID = net.ParseIP(*dhcpServerIDFlag).To4()
+		if dhcpServerID == nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid dhcp server identifier: %q\n", *dhcpServerIDFlag)
+			os.Exit(1)
+		}
+	}
+
+	cmdlineTemplate, err := pxe.ParseCmdlineTemplate(*cmdlineTplFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid cmdline template: %s\n", err)
+		os.Exit(1)
+	}
+
+	hostnameTemplate, err := dhcp.ParseHostnameTemplate(*hostnameTplFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid hostname template: %s\n", err)
+		os.Exit(1)
+	}
+
+	bootMenu, err := dhcp.ParseBootMenu(*pxeMenuFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid pxe menu: %s\n", err)
+		os.Exit(1)
+	}
+	bootMessage := *bootMessageFlag
+	if bootMessage == "" {
+		bootMessage = fmt.Sprintf("Blacksmith (%s)", version)
+	}
+	if err := dhcp.ValidateBootMessage(bootMessage, bootMenu); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid boot message: %s\n", err)
+		os.Exit(1)
+	}
+
+	pxeBootFiles, err := pxe.ParseArchBootFiles(*pxeBootFilesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid pxe boot files: %s\n", err)
+		os.Exit(1)
+	}
+
 	// dhcp setting
 	leaseStart := net.ParseIP(*leaseStartFlag)
 	leaseRange := *leaseRangeFlag
-	leaseSubnet := net.ParseIP(*leaseSubnetFlag)
+	var leaseSubnet net.IP
 	leaseRouter := net.ParseIP(*leaseRouterFlag)
 
+	if *poolFlag != "" {
+		if *leaseStartFlag != "" || *leaseRangeFlag != 0 || *leaseSubnetFlag != "" || *leasePrefixFlag != 0 {
+			fmt.Fprint(os.Stderr, "\nPlease specify either the pool or the lease start, range and subnet\n")
+			os.Exit(1)
+		}
+		pool, err := parsePools(*poolFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid pool: %s\n", err)
+			os.Exit(1)
+		}
+		leaseStart, leaseRange, leaseSubnet = pool.Start, pool.Range, pool.Subnet
+		if leaseRouter == nil {
+			leaseRouter = pool.Router
+		}
+	} else {
+		leaseSubnet, err = parseSubnetMask(*leaseSubnetFlag, *leasePrefixFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nInvalid lease subnet: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	dnsIPStrings := strings.Split(*dnsAddressesFlag, ",")
 	if len(dnsIPStrings) == 0 {
 		fmt.Fprint(os.Stderr, "\nPlease specify an DNS server\n")
@@ -204,26 +484,36 @@ func main() {
 		fmt.Fprint(os.Stderr, "\nLease range should be greater that 1\n")
 		os.Exit(1)
 	}
-	if leaseSubnet == nil {
-		fmt.Fprint(os.Stderr, "\nPlease specify the lease subnet\n")
-		os.Exit(1)
-	}
 	if leaseRouter == nil {
 		fmt.Fprint(os.Stderr, "\nNo network router is defined.\n")
 	}
 
+	network := &web.NetworkInfo{
+		Interface:  dhcpIF.Name,
+		ServerIP:   serverIP,
+		SubnetMask: leaseSubnet,
+		Router:     leaseRouter,
+		DNS:        dnsIPStrings,
+	}
+	if addrs, err := dhcpIF.Addrs(); err == nil {
+		for _, addr := range addrs {
+			network.Addresses = append(network.Addresses, addr.String())
+		}
+	}
+
 	fmt.Printf("Interface IP:    %s\n", serverIP.String())
 	fmt.Printf("Interface Name:  %s\n", dhcpIF.Name)
 
 	// datasources
-	etcdClient, err := etcd.New(etcd.Config{
-		Endpoints:               strings.Split(*etcdFlag, ","),
-		HeaderTimeoutPerRequest: 5 * time.Second,
-	})
+	etcdClient, err := newEtcdClient()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
 		os.Exit(1)
 	}
+	if err := checkEtcd(etcdClient); err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't read from etcd: %s\n", err)
+		os.Exit(1)
+	}
 	kapi := etcd.NewKeysAPI(etcdClient)
 
 	v := datasource.BlacksmithVersion{
@@ -239,13 +529,61 @@ func main() {
 		os.Exit(1)
 	}
 
+	etcdDataSource.(*datasource.EtcdDataSource).SetMachinesCacheTTL(*machinesTTLFlag)
+	etcdDataSource.(*datasource.EtcdDataSource).SetStrictMachines(*strictMachinesFlag)
+	if err := setMachineSharding(etcdDataSource); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid -machine-sharding: %s\n", err)
+		os.Exit(1)
+	}
+	etcdDataSource.(*datasource.EtcdDataSource).SetAutoCreateOnRequest(!*noAutoCreateFlag)
+	etcdDataSource.(*datasource.EtcdDataSource).SetLeaseStrategy(leaseStrategy)
+	etcdDataSource.(*datasource.EtcdDataSource).SetFlagHistory(*flagHistoryFlag)
+	if *ipamURLFlag != "" {
+		etcdDataSource.(*datasource.EtcdDataSource).SetIPAMProvider(datasource.NewHTTPIPAM(*ipamURLFlag))
+	}
+	if *probeFlag {
+		etcdDataSource.(*datasource.EtcdDataSource).SetProbe(datasource.PingProbe(*probeTimeoutFlag))
+	}
+
+	var logWriter io.Writer = os.Stderr
+	if *logFileFlag != "" {
+		logWriter, err = logging.NewRotatingFile(*logFileFlag, int64(*logMaxSizeFlag)<<20, *logKeepFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nCouldn't open the log file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	// the output of the log package, like the errors of net/http, goes to
+	// the same writer
+	log.SetOutput(logWriter)
 	go func() {
-		logging.RecordLogs(log.New(os.Stderr, "", log.LstdFlags), *debugFlag)
+		logging.RecordLogs(log.New(logWriter, "", log.LstdFlags), *debugFlag)
 	}()
 
+	if err := tracing.Configure(*otelEndpointFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't configure the tracing: %s\n", err)
+		os.Exit(1)
+	}
+	templating.Configure(*secretsDirFlag, *strictTplFlag)
+	templating.ConfigureMaxRenders(*maxRendersFlag)
+	if err := templating.ConfigureOnMissingConfig(*onMissingFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid -on-missing-config: %s\n", err)
+		os.Exit(1)
+	}
+	pxe.ConfigureFileRetries(*fileRetriesFlag, *fileBackoffFlag)
+	pxe.ConfigureInitrdCompression(*gzipInitrdFlag)
+	pxe.ConfigureTimeouts(*httpHeaderTOFlag, *imageWriteTOFlag, *httpIdleTOFlag)
+	web.ConfigureTimeouts(*httpHeaderTOFlag, *httpWriteTOFlag, *imageWriteTOFlag, *httpIdleTOFlag)
+	dhcpEvents := dhcp.NewEventLog(*dhcpEventsFlag)
+	web.ConfigureReadOnly(*roleFlag == roleReplica)
+
 	// serving api
 	go func() {
-		err := web.ServeWeb(etcdDataSource, webAddr)
+		bmcs := &web.BMCs{Redfish: web.NewRedfish(*redfishInsecFlag)}
+		if *ipmitoolFlag != "" {
+			bmcs.IPMI = &web.IPMITool{Path: *ipmitoolFlag}
+		}
+		err := web.ServeWeb(etcdDataSource, webAddr, *uiDirFlag, bmcs, &web.WakeOnLAN{Interface: dhcpIF}, network, dhcpEvents, int64(*maxUploadFlag)<<20)
 		log.Fatalf("\nError while serving api: %s\n", err)
 	}()
 
@@ -257,6 +595,30 @@ func main() {
 		}
 	}()
 
+	serveBootFiles := func() {
+		// serving http booter
+		go func() {
+			err := pxe.ServeHTTPBooter(httpBooterAddr, etcdDataSource, webAddr.Port, cmdlineTemplate)
+			log.Fatalf("\nError while serving http booter: %s\n", err)
+		}()
+
+		// serving tftp
+		go func() {
+			err := pxe.ServeTFTP(tftpAddr, filepath.Join(*workspacePathFlag, "boot"))
+			log.Fatalf("\nError while serving tftp: %s\n", err)
+		}()
+	}
+
+	// the replicas serve the files right away, leaving DHCP and PXE, and
+	// so the assignment of the leases, to the master instance
+	if *roleFlag == roleReplica {
+		logging.Debug(debugTag, "Serving as a read-only replica, without DHCP and PXE")
+		// the renders of the bootparams mustn't write to etcd either
+		etcdDataSource = datasource.ReadOnly(etcdDataSource)
+		serveBootFiles()
+		select {}
+	}
+
 	// waiting til we're officially the master instance
 	for !etcdDataSource.IsMaster() {
 		logging.Debug(debugTag, "Not master, waiting to be promoted...")
@@ -265,24 +627,25 @@ func main() {
 
 	logging.Debug(debugTag, "Now we're the master instance. Starting the services...")
 
-	// serving http booter
-	go func() {
-		err := pxe.ServeHTTPBooter(httpBooterAddr, etcdDataSource, webAddr.Port)
-		log.Fatalf("\nError while serving http booter: %s\n", err)
-	}()
-
-	// serving tftp
-	go func() {
-		err := pxe.ServeTFTP(tftpAddr)
-		log.Fatalf("\nError while serving tftp: %s\n", err)
-	}()
+	serveBootFiles()
 
 	// pxe protocol
 	go func() {
-		err := pxe.ServePXE(pxeAddr, serverIP, httpBooterAddr)
+		err := pxe.ServePXE(pxeAddr, serverIP, httpBooterAddr, pxeBootFiles)
 		log.Fatalf("\nError while serving pxe: %s\n", err)
 	}()
 
+	// repairing the claims on the ips
+	if *reconcileFlag > 0 {
+		go func() {
+			for range time.Tick(*reconcileFlag) {
+				if _, err := etcdDataSource.Reconcile(); err != nil {
+					logging.Log(debugTag, "Error while reconciling the leases: %s", err)
+				}
+			}
+		}()
+	}
+
 	// serving dhcp
 	go func() {
 		err := dhcp.ServeDHCP(&dhcp.DHCPSetting{
@@ -290,6 +653,20 @@ func main() {
 			ServerIP:   serverIP,
 			RouterAddr: leaseRouter,
 			SubnetMask: leaseSubnet,
+
+			AllowlistOnly:   *allowlistOnlyFlag,
+			AllowedPrefixes: allowedPrefixes,
+			CustomOptions:   dhcpOptions,
+
+			Authoritative:    *dhcpAuthFlag,
+			ServerIdentifier: dhcpServerID,
+			Events:           dhcpEvents,
+			HostnameTemplate: hostnameTemplate,
+			LabelOverrides:   labelOverrides,
+			BootMenu:         bootMenu,
+			MenuTimeout:      *menuTimeoutFlag,
+			BootMessage:      bootMessage,
+			EnableBOOTP:      *enableBOOTPFlag,
 		}, etcdDataSource)
 		log.Fatalf("\nError while serving dhcp: %s\n", err)
 	}()
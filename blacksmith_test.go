@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+func TestPickIP(t *testing.T) {
+	ipNet := func(cidr string) net.Addr {
+		ip, n, _ := net.ParseCIDR(cidr)
+		n.IP = ip
+		return n
+	}
+	dualStack := []net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::10/64"), ipNet("192.168.1.10/24")}
+	ipv6Only := []net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::10/64")}
+
+	if ip, err := pickIP(dualStack); err != nil || ip.String() != "192.168.1.10" {
+		t.Errorf("pickIP(%v) = %s, %v; expected 192.168.1.10", dualStack, ip, err)
+	}
+
+	// the IPv6 addresses are never served on, only reported
+	_, err := pickIP(ipv6Only)
+	if err == nil || !strings.Contains(err.Error(), "2001:db8::10/64") || !strings.Contains(err.Error(), "IPv4") {
+		t.Errorf("expected an IPv4 error listing the found addresses, got %v", err)
+	}
+	_, err = pickIP([]net.Addr{ipNet("0.0.0.0/0")})
+	if err == nil || !strings.Contains(err.Error(), "0.0.0.0/0") {
+		t.Errorf("expected the found addresses in the error, got %v", err)
+	}
+	if _, err := pickIP(nil); err == nil {
+		t.Error("expected an error for an interface without addresses")
+	}
+}
+
+func TestDescribeEtcdError(t *testing.T) {
+	unauthorized := etcd.Error{Code: etcd.ErrorCodeUnauthorized, Message: "The request requires user authentication"}
+	if err := describeEtcdError(unauthorized); !strings.Contains(err.Error(), "rejected the credentials") {
+		t.Errorf("expected a credentials error, got %q", err)
+	}
+	unreachable := &etcd.ClusterError{Errors: []error{errors.New("dial tcp 127.0.0.1:2379: connection refused")}}
+	if err := describeEtcdError(unreachable); !strings.Contains(err.Error(), "unreachable") ||
+		!strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected an unreachable cluster error, got %q", err)
+	}
+	other := errors.New("other")
+	if err := describeEtcdError(other); err != other {
+		t.Errorf("expected the other errors to be kept, got %q", err)
+	}
+}
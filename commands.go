@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	etcd "github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// runCommand runs the subcommand specified by the non-flag arguments and
+// returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate-prefix":
+		return migratePrefixCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "import-inventory":
+		return importInventoryCommand(args[1:])
+	case "gc":
+		return gcCommand(args[1:])
+	case "migrate-sharding":
+		return migrateShardingCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "\nUnknown command: %s\n", args[0])
+	return 1
+}
+
+func migratePrefixCommand(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> migrate-prefix <old> <new>\n")
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	err = datasource.MigratePrefix(etcd.NewKeysAPI(etcdClient), args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while migrating the prefix: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Copied %s to %s. Remove the old tree once you've verified the new one.\n",
+		args[0], args[1])
+	return 0
+}
+
+func exportCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> -cluster-name <name> export > tree.json\n")
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	tree, err := datasource.ExportTree(etcd.NewKeysAPI(etcdClient), *clusterNameFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while exporting the tree: %s\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(tree); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while writing the tree: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Overwrite the keys which already exist")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> -cluster-name <name> import [-force] tree.json\n")
+		return 1
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while reading the tree: %s\n", err)
+		return 1
+	}
+	var tree datasource.ExportedNode
+	if err := json.Unmarshal(data, &tree); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while parsing the tree: %s\n", err)
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	err = datasource.ImportTree(etcd.NewKeysAPI(etcdClient), &tree, *clusterNameFlag, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while importing the tree: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Imported %s into %s\n", flags.Arg(0), *clusterNameFlag)
+	return 0
+}
+
+func importInventoryCommand(args []string) int {
+	flags := flag.NewFlagSet("import-inventory", flag.ContinueOnError)
+	update := flags.Bool("update", false, "Set the flags of the machines which already exist")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> -cluster-name <name> -workspace <path> import-inventory [-update] inventory.yaml\n")
+		return 1
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while reading the inventory: %s\n", err)
+		return 1
+	}
+	var inventory []datasource.InventoryMachine
+	if err := yaml.Unmarshal(data, &inventory); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while parsing the inventory: %s\n", err)
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	ds, err := datasource.NewEtcdDataSource(etcd.NewKeysAPI(etcdClient), etcdClient,
+		nil, 0, *clusterNameFlag, *workspacePathFlag, nil,
+		strings.Split(*dnsAddressesFlag, ","), datasource.BlacksmithVersion{Version: version})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create runtime configuration: %s\n", err)
+		return 1
+	}
+	if err := setMachineSharding(ds); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid -machine-sharding: %s\n", err)
+		return 1
+	}
+
+	result, err := datasource.ImportInventory(ds, inventory, *update)
+	if result != nil {
+		fmt.Printf("Created %d, updated %d and skipped %d machines\n",
+			result.Created, result.Updated, result.Skipped)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while importing the inventory: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func gcCommand(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 720*time.Hour, "Delete the machines which haven't been seen for this long")
+	dryRun := flags.Bool("dry-run", false, "Only list the machines which would be deleted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *olderThan <= 0 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> -cluster-name <name> -workspace <path> gc [-older-than 720h] [-dry-run]\n")
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	ds, err := datasource.NewEtcdDataSource(etcd.NewKeysAPI(etcdClient), etcdClient,
+		nil, 0, *clusterNameFlag, *workspacePathFlag, nil,
+		strings.Split(*dnsAddressesFlag, ","), datasource.BlacksmithVersion{Version: version})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create runtime configuration: %s\n", err)
+		return 1
+	}
+	if err := setMachineSharding(ds); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid -machine-sharding: %s\n", err)
+		return 1
+	}
+
+	stale, err := datasource.StaleMachines(ds, time.Now().Add(-*olderThan))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while listing the machines: %s\n", err)
+		return 1
+	}
+
+	// a machine which can't be read or deleted is skipped, so it doesn't
+	// keep the rest from being collected
+	deleted, skipped := 0, 0
+	for _, entry := range stale {
+		machineIP, err := entry.Machine.IP()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s, error while reading its IP: %s\n", entry.Machine.Name(), err)
+			skipped++
+			continue
+		}
+		ip := "-"
+		if machineIP != nil {
+			ip = machineIP.String()
+		}
+		fmt.Printf("%s\t%s\t%s\tlast seen %s\n", entry.Machine.Name(), entry.Machine.Mac(),
+			ip, entry.LastSeen.Format(time.RFC3339))
+		if *dryRun {
+			continue
+		}
+		if err := ds.DeleteMachine(entry.Machine.Mac()); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s, error while deleting it: %s\n", entry.Machine.Name(), err)
+			skipped++
+			continue
+		}
+		deleted++
+	}
+
+	if *dryRun {
+		fmt.Printf("%d machines would be deleted\n", len(stale)-skipped)
+	} else {
+		fmt.Printf("Deleted %d machines\n", deleted)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "\nSkipped %d machines\n", skipped)
+		return 1
+	}
+	return 0
+}
+
+// setMachineSharding sets the layout of the machines of -machine-sharding on
+// the etcd datasource
+func setMachineSharding(ds datasource.DataSource) error {
+	sharding, err := datasource.ParseMachineSharding(*machineShardFlag)
+	if err != nil {
+		return err
+	}
+	ds.(*datasource.EtcdDataSource).SetMachineSharding(sharding)
+	return nil
+}
+
+func migrateShardingCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprint(os.Stderr, "\nUsage: blacksmith -etcd <endpoints> -cluster-name <name> -workspace <path> -machine-sharding <layout> migrate-sharding\n")
+		return 1
+	}
+
+	etcdClient, err := newEtcdClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create etcd connection: %s\n", err)
+		return 1
+	}
+
+	ds, err := datasource.NewEtcdDataSource(etcd.NewKeysAPI(etcdClient), etcdClient,
+		nil, 0, *clusterNameFlag, *workspacePathFlag, nil,
+		strings.Split(*dnsAddressesFlag, ","), datasource.BlacksmithVersion{Version: version})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't create runtime configuration: %s\n", err)
+		return 1
+	}
+	if err := setMachineSharding(ds); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid -machine-sharding: %s\n", err)
+		return 1
+	}
+
+	moved, err := ds.(*datasource.EtcdDataSource).MigrateMachineSharding()
+	fmt.Printf("Moved %d machines to the %s layout\n", moved, *machineShardFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError while migrating the machines: %s\n", err)
+		return 1
+	}
+	return 0
+}
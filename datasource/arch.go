@@ -0,0 +1,57 @@
+package datasource
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Architectures of the images, stored in the "arch" flag of the machines
+const (
+	ArchAMD64 = "amd64"
+	ArchARM64 = "arm64"
+
+	// ArchFlag is set from the DHCP option 93 of the last PXE boot of the
+	// machine
+	ArchFlag = "arch"
+)
+
+// ValidArch reports whether there can be images of the arch
+func ValidArch(arch string) bool {
+	return arch == ArchAMD64 || arch == ArchARM64
+}
+
+// ArchFromClientArch maps a client system architecture of DHCP option 93
+// (RFC 4578) to the architecture of the images. Anything other than the
+// arm64 UEFI types is amd64
+func ArchFromClientArch(clientArch uint16) string {
+	switch clientArch {
+	case 11, 19: // arm64 UEFI, arm64 UEFI over HTTP
+		return ArchARM64
+	}
+	return ArchAMD64
+}
+
+// MachineArch returns the architecture of the images of the machine, which
+// is ArchAMD64 unless its arch flag says otherwise
+func MachineArch(m Machine) string {
+	arch, err := m.GetFlag(ArchFlag)
+	if err != nil || !ValidArch(arch) {
+		return ArchAMD64
+	}
+	return arch
+}
+
+// ImageDir returns the folder of the images of the CoreOS version for the
+// arch, images/<version>/<arch> of the workspace. The amd64 images can also
+// be directly in the folder of the version, which was the layout before the
+// other archs
+func ImageDir(workspacePath, version, arch string) string {
+	versionPath := filepath.Join(workspacePath, "images", version)
+	archPath := filepath.Join(versionPath, arch)
+	if arch == ArchAMD64 {
+		if _, err := os.Stat(archPath); os.IsNotExist(err) {
+			return versionPath
+		}
+	}
+	return archPath
+}
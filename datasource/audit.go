@@ -0,0 +1,86 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const auditEtcdDir = "audit"
+
+// AuditEntry records a change of a machine flag
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Mac      string    `json:"mac"`
+	Key      string    `json:"key"`
+	OldValue string    `json:"oldValue"`
+	NewValue string    `json:"newValue"`
+	Deleted  bool      `json:"deleted"`
+	// Source describes who made the change, e.g. "api 10.0.0.1:5432"
+	Source string `json:"source"`
+}
+
+// AuditFlagChange records the change of a machine flag. It's best-effort: a
+// failure is only logged, so that it never blocks the change itself
+func AuditFlagChange(ds DataSource, entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if err := ds.AddAuditEntry(entry); err != nil {
+		logging.Log(debugTag, "Error while auditing the change of flag key=%s for mac=%s: %s",
+			entry.Key, entry.Mac, err)
+	}
+}
+
+// AddAuditEntry appends the entry to the audit log, under audit/<timestamp>
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) AddAuditEntry(entry AuditEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// zero-padded, so that the keys are sorted the same as the times
+	key := path.Join(auditEtcdDir, fmt.Sprintf("%020d", entry.Time.UnixNano()))
+	_, err = ds.keysAPI.Create(ctx, ds.prefixify(key), string(value))
+	return err
+}
+
+// AuditEntries returns the audit log in chronological order. If mac isn't
+// nil, only the entries of that machine are returned
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) AuditEntries(mac net.HardwareAddr) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ret := make([]AuditEntry, 0)
+	response, err := ds.keysAPI.Get(ctx, ds.prefixify(auditEtcdDir), &etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcdError, ok := err.(etcd.Error); ok && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+			return ret, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range response.Node.Nodes {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(node.Value), &entry); err != nil {
+			return nil, fmt.Errorf("Error while reading audit entry %s: %s", node.Key, err)
+		}
+		if mac != nil && entry.Mac != mac.String() {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
@@ -0,0 +1,36 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuditEntries(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	entries, err := ds.AuditEntries(nil)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty audit log, got %v (%v)", entries, err)
+	}
+
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:02")
+	start := time.Unix(1000, 0)
+	AuditFlagChange(ds, AuditEntry{Time: start, Mac: mac1.String(), Key: "a", NewValue: "1", Source: "api"})
+	AuditFlagChange(ds, AuditEntry{Time: start.Add(time.Second), Mac: mac2.String(), Key: "b", NewValue: "2", Source: "api"})
+	AuditFlagChange(ds, AuditEntry{Time: start.Add(2 * time.Second), Mac: mac1.String(), Key: "a", OldValue: "1", Deleted: true, Source: "api"})
+
+	entries, err = ds.AuditEntries(nil)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %v (%v)", entries, err)
+	}
+
+	entries, err = ds.AuditEntries(mac1)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries of %s, got %v (%v)", mac1, entries, err)
+	}
+	if entries[0].NewValue != "1" || !entries[1].Deleted || entries[1].OldValue != "1" {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+}
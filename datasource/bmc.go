@@ -0,0 +1,123 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Internal keys of a machine entry which hold the details of its BMC. They
+// are set only by SetBMC, and the credentials are never listed by ListFlags
+const (
+	bmcAddressKey  = "_bmc_address"
+	bmcUserKey     = "_bmc_user"
+	bmcPasswordKey = "_bmc_password"
+)
+
+// BMCCredentials are the address of the baseboard management controller of
+// a machine, and the credentials of logging into it
+type BMCCredentials struct {
+	Address  string
+	User     string
+	Password string
+}
+
+// ErrInvalidBMCAddress is returned for an address of a BMC which the
+// credentials mustn't be sent to
+var ErrInvalidBMCAddress = errors.New("invalid BMC address")
+
+// ValidateBMCAddress checks the address of a BMC before the credentials are
+// sent to it. It's either an http(s) url of a Redfish BMC with a host and no
+// user info, or the bare host name or IP address of an IPMI one
+func ValidateBMCAddress(address string) error {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidBMCAddress, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%w: unsupported scheme %q", ErrInvalidBMCAddress, u.Scheme)
+		}
+		if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("%w: %s has more than a host and a path", ErrInvalidBMCAddress, address)
+		}
+		address = u.Hostname()
+	}
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+	if address == "" || len(address) > 253 || address[0] == '-' || address[0] == '.' {
+		return fmt.Errorf("%w: invalid host %q", ErrInvalidBMCAddress, address)
+	}
+	for _, c := range address {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return fmt.Errorf("%w: invalid host %q", ErrInvalidBMCAddress, address)
+		}
+	}
+	return nil
+}
+
+// IsCredentialFlag reports whether the key holds a credential of the BMC of
+// the machine, which is left out of the flags everywhere they're read
+func IsCredentialFlag(key string) bool {
+	return key == bmcUserKey || key == bmcPasswordKey
+}
+
+// RedactCredentials deletes the credential keys from the flags
+func RedactCredentials(flags map[string]string) map[string]string {
+	for key := range flags {
+		if IsCredentialFlag(key) {
+			delete(flags, key)
+		}
+	}
+	return flags
+}
+
+// BMC returns the details of the BMC of the machine. Unset ones are empty
+// part of Machine interface implementation
+func (m *EtcdMachine) BMC() (BMCCredentials, error) {
+	var bmc BMCCredentials
+	for key, value := range map[string]*string{
+		bmcAddressKey:  &bmc.Address,
+		bmcUserKey:     &bmc.User,
+		bmcPasswordKey: &bmc.Password,
+	} {
+		v, err := m.selfGet(key)
+		if err != nil && !IsFlagNotFound(err) {
+			return BMCCredentials{}, err
+		}
+		*value = v
+	}
+	return bmc, nil
+}
+
+// SetBMC sets the details of the BMC of the machine, after validating the
+// address. An empty address removes them
+// part of Machine interface implementation
+func (m *EtcdMachine) SetBMC(bmc BMCCredentials) error {
+	if bmc.Address != "" {
+		if err := ValidateBMCAddress(bmc.Address); err != nil {
+			return err
+		}
+	}
+	for key, value := range map[string]string{
+		bmcAddressKey:  bmc.Address,
+		bmcUserKey:     bmc.User,
+		bmcPasswordKey: bmc.Password,
+	} {
+		var err error
+		if bmc.Address == "" || value == "" {
+			if err = m.selfDelete(key); IsFlagNotFound(err) {
+				err = nil
+			}
+		} else {
+			err = m.selfSet(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package datasource
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateBMCAddress(t *testing.T) {
+	for address, valid := range map[string]bool{
+		"10.0.1.10":                    true,
+		"bmc-01.example.com":           true,
+		"fd00::10":                     true,
+		"https://10.0.1.10":            true,
+		"http://bmc-01.example.com/":   true,
+		"https://[fd00::10]:8443":      true,
+		"":                             false,
+		"-oProxyCommand=x":             false,
+		"bmc 01":                       false,
+		"ftp://10.0.1.10":              false,
+		"https://":                     false,
+		"https://admin:x@10.0.1.10":    false,
+		"https://10.0.1.10/?next=evil": false,
+		"file:///etc/passwd":           false,
+	} {
+		err := ValidateBMCAddress(address)
+		if valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", address, err)
+		}
+		if !valid && !errors.Is(err, ErrInvalidBMCAddress) {
+			t.Errorf("%q: expected ErrInvalidBMCAddress, got %v", address, err)
+		}
+	}
+}
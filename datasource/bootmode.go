@@ -0,0 +1,55 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Boot modes of the machines, stored in the "boot_mode" flag
+const (
+	BootModeNormal = "normal"
+	BootModeRescue = "rescue"
+
+	// BootModeFlag selects what the machine boots into on its next PXE
+	// boot. Unset means BootModeNormal
+	BootModeFlag = "boot_mode"
+
+	// RescueImage is the folder of the rescue images under images of the
+	// workspace, which takes the place of the CoreOS version in the layout
+	// and the urls of the images, e.g. images/rescue/arm64 for arm64
+	RescueImage = "rescue"
+
+	// rescueCmdlineFile is the kernel cmdline of the rescue image, in the
+	// folder of its images
+	rescueCmdlineFile = "cmdline"
+)
+
+// ValidBootMode reports whether the machines can boot in the mode
+func ValidBootMode(mode string) bool {
+	return mode == BootModeNormal || mode == BootModeRescue
+}
+
+// MachineBootMode returns the boot mode of the machine, which is
+// BootModeNormal unless its boot_mode flag says otherwise
+func MachineBootMode(m Machine) string {
+	mode, err := m.GetFlag(BootModeFlag)
+	if err != nil || !ValidBootMode(mode) {
+		return BootModeNormal
+	}
+	return mode
+}
+
+// RescueCmdline returns the kernel cmdline of the rescue image for the arch,
+// from the cmdline file next to its images. It's empty if there's no file
+func RescueCmdline(workspacePath, arch string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ImageDir(workspacePath, RescueImage, arch), rescueCmdlineFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
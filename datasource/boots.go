@@ -0,0 +1,89 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Internal keys of the boot attempts of a machine
+const (
+	bootCountKey = "_boot_count"
+	lastBootKey  = "_last_boot"
+)
+
+// maxBootCountRetries is how many times RecordBoot retries incrementing the
+// boot count, when it's changed concurrently by another boot
+const maxBootCountRetries = 10
+
+func (m *EtcdMachine) bootCountPath() string {
+	return path.Join(m.etcd.ClusterName(), m.prefixify(bootCountKey))
+}
+
+// readBootCount returns the boot count of the machine, and the options which
+// make setting the incremented count fail if it's changed in between
+func (m *EtcdMachine) readBootCount() (int, *etcd.SetOptions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := m.keysAPI.Get(ctx, m.bootCountPath(), &etcd.GetOptions{Quorum: true})
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return 0, &etcd.SetOptions{PrevExist: etcd.PrevNoExist}, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := strconv.Atoi(response.Node.Value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed boot count %q", response.Node.Value)
+	}
+	return count, &etcd.SetOptions{PrevValue: response.Node.Value}, nil
+}
+
+// RecordBoot increments the _boot_count entry of this machine with a
+// compare-and-swap, so the concurrent boots aren't lost, and updates its
+// _last_boot entry
+// part of Machine interface implementation
+func (m *EtcdMachine) RecordBoot() error {
+	for i := 0; i < maxBootCountRetries; i++ {
+		count, options, err := m.readBootCount()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, err = m.keysAPI.Set(ctx, m.bootCountPath(), strconv.Itoa(count+1), options)
+		cancel()
+		if err == nil {
+			return m.selfSet(lastBootKey, strconv.FormatInt(time.Now().UnixNano(), 10))
+		}
+		etcdError, found := err.(etcd.Error)
+		if !found || (etcdError.Code != etcd.ErrorCodeTestFailed && etcdError.Code != etcd.ErrorCodeNodeExist) {
+			return err
+		}
+	}
+	return fmt.Errorf("boot count of %s changed concurrently %d times", m.Name(), maxBootCountRetries)
+}
+
+// Boots returns the boot count of this machine, and the time of its last
+// boot, which is zero if it hasn't booted since the counting began
+// part of Machine interface implementation
+func (m *EtcdMachine) Boots() (int, time.Time, error) {
+	count, _, err := m.readBootCount()
+	if err != nil || count == 0 {
+		return 0, time.Time{}, err
+	}
+	unixNanoString, err := m.selfGet(lastBootKey)
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return count, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	last, err := unixNanoStringToTime(unixNanoString)
+	return count, last, err
+}
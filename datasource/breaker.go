@@ -0,0 +1,62 @@
+package datasource
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// DefaultBreakerOpenPeriod is how long the breakers of the HTTP servers stay
+// open after finding etcd unavailable
+const DefaultBreakerOpenPeriod = 5 * time.Second
+
+// ErrUnavailable is returned by Breaker.Do while the breaker is open
+var ErrUnavailable = errors.New("datasource is unavailable")
+
+// IsUnavailable reports whether err means that etcd couldn't be reached, as
+// opposed to e.g. a missing key
+func IsUnavailable(err error) bool {
+	if _, isClusterError := err.(*etcd.ClusterError); isClusterError {
+		return true
+	}
+	return err == ErrUnavailable || err == context.DeadlineExceeded
+}
+
+// Breaker is a circuit breaker around the calls to the datasource. Once a
+// call finds etcd unavailable, the breaker opens for a while, during which
+// the calls fail right away instead of hammering a recovering etcd
+type Breaker struct {
+	openPeriod time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	openUntil time.Time
+}
+
+// NewBreaker returns a closed Breaker which stays open for openPeriod after
+// each failure
+func NewBreaker(openPeriod time.Duration) *Breaker {
+	return &Breaker{openPeriod: openPeriod, now: time.Now}
+}
+
+// Do calls f unless the breaker is open, in which case ErrUnavailable is
+// returned. The breaker is opened if f finds etcd unavailable
+func (b *Breaker) Do(f func() error) error {
+	b.mu.Lock()
+	open := b.now().Before(b.openUntil)
+	b.mu.Unlock()
+	if open {
+		return ErrUnavailable
+	}
+
+	err := f()
+	if IsUnavailable(err) {
+		b.mu.Lock()
+		b.openUntil = b.now().Add(b.openPeriod)
+		b.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package datasource
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBreaker(5 * time.Second)
+	b.now = func() time.Time { return now }
+
+	calls := 0
+	failing := func() error { calls++; return &etcd.ClusterError{} }
+	working := func() error { calls++; return nil }
+
+	if err := b.Do(failing); !IsUnavailable(err) {
+		t.Fatalf("expected an unavailability error, got %v", err)
+	}
+	if err := b.Do(working); err != ErrUnavailable || calls != 1 {
+		t.Errorf("expected the open breaker not to call etcd: err=%v calls=%d", err, calls)
+	}
+
+	now = now.Add(6 * time.Second)
+	if err := b.Do(working); err != nil || calls != 2 {
+		t.Errorf("expected the breaker to close after the open period: err=%v calls=%d", err, calls)
+	}
+
+	if err := b.Do(func() error { return errors.New("not found") }); IsUnavailable(err) {
+		t.Error("expected other errors not to count as unavailability")
+	}
+	if err := b.Do(working); err != nil {
+		t.Errorf("expected other errors not to open the breaker: %v", err)
+	}
+}
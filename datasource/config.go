@@ -0,0 +1,65 @@
+package datasource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// ConfigValue is an entry of the runtime configuration, along with the value
+// it was initialized with at startup
+type ConfigValue struct {
+	Value    string `json:"value"`
+	Initial  string `json:"initial"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+// Config returns the initial values merged with the overrides stored in etcd.
+// Startup-only values are marked as read-only
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) Config() (map[string]ConfigValue, error) {
+	coreOSVersion, err := ds.Get(coreosVersionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseRange := strconv.Itoa(ds.leaseRange)
+	return map[string]ConfigValue{
+		coreosVersionKey: {coreOSVersion, ds.initialCoreOSVersion, false},
+		"cluster-name":   {ds.clusterName, ds.clusterName, true},
+		"workspace-path": {ds.workspacePath, ds.workspacePath, true},
+		"lease-start":    {ds.leaseStart.String(), ds.leaseStart.String(), true},
+		"lease-range":    {leaseRange, leaseRange, true},
+	}, nil
+}
+
+// SetConfig updates a mutable value of the runtime configuration in etcd
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) SetConfig(key, value string) error {
+	config, err := ds.Config()
+	if err != nil {
+		return err
+	}
+	current, exists := config[key]
+	if !exists {
+		return fmt.Errorf("unknown config key: %s", key)
+	}
+	if current.ReadOnly {
+		return fmt.Errorf("config key %s is read-only", key)
+	}
+
+	switch key {
+	case coreosVersionKey:
+		if value == "" || value != filepath.Base(value) {
+			return fmt.Errorf("invalid CoreOS version: %q", value)
+		}
+		imagesPath := filepath.Join(ds.WorkspacePath(), "images", value)
+		files, err := ioutil.ReadDir(imagesPath)
+		if err != nil || len(files) == 0 {
+			return fmt.Errorf("no CoreOS images found for version %s (path=%s)", value, imagesPath)
+		}
+	}
+
+	return ds.Set(key, value)
+}
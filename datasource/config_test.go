@@ -0,0 +1,63 @@
+package datasource
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ds.Set(coreosVersionKey, "1100.0.0")
+
+	config, err := ds.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := config[coreosVersionKey]; version.Value != "1100.0.0" || version.Initial != "1000.0.0" || version.ReadOnly {
+		t.Errorf("unexpected CoreOS version: %+v", version)
+	}
+	if name := config["cluster-name"]; name.Value != "test" || !name.ReadOnly {
+		t.Errorf("unexpected cluster name: %+v", name)
+	}
+	if leaseRange := config["lease-range"]; leaseRange.Value != "10" || !leaseRange.ReadOnly {
+		t.Errorf("unexpected lease range: %+v", leaseRange)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ds.Set(coreosVersionKey, "1000.0.0")
+	images := filepath.Join(ds.WorkspacePath(), "images", "1100.0.0")
+	if err := os.MkdirAll(images, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(images, "coreos_production_pxe.vmlinuz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(ds.WorkspacePath(), "images", "1200.0.0"), 0755)
+
+	if err := ds.SetConfig(coreosVersionKey, "1100.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := ds.Get(coreosVersionKey); version != "1100.0.0" {
+		t.Errorf("expected the CoreOS version to be updated, got %q", version)
+	}
+
+	for _, tt := range []struct{ key, value string }{
+		{"unknown", "x"},
+		{"cluster-name", "other"},
+		{"lease-range", "20"},
+		{coreosVersionKey, ""},
+		{coreosVersionKey, "../1100.0.0"},
+		{coreosVersionKey, "1200.0.0"}, // no images
+		{coreosVersionKey, "1300.0.0"}, // no directory
+	} {
+		if err := ds.SetConfig(tt.key, tt.value); err == nil {
+			t.Errorf("expected an error for %s=%q", tt.key, tt.value)
+		}
+	}
+	if version, _ := ds.Get(coreosVersionKey); version != "1100.0.0" {
+		t.Errorf("expected the rejected values to be left out, got %q", version)
+	}
+}
@@ -0,0 +1,770 @@
+// Package datasourcetest provides a map-backed, in-memory implementation of
+// datasource.DataSource and datasource.Machine, to be used in the tests of
+// the packages which depend on the datasource, without a running etcd
+package datasourcetest // import "github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+var _ datasource.DataSource = &MemoryDataSource{}
+var _ datasource.Machine = &MemoryMachine{}
+
+// MemoryMachine implements datasource.Machine, keeping everything in memory
+type MemoryMachine struct {
+	ds        *MemoryDataSource
+	mac       net.HardwareAddr
+	ip        net.IP
+	firstSeen time.Time
+	lastSeen  time.Time
+	bootCount int
+	lastBoot  time.Time
+	note      string
+	bmc       datasource.BMCCredentials
+	flags     map[string]string
+	history   map[string][]datasource.FlagHistoryEntry
+	// revision is incremented whenever the flags or the IP change
+	revision int
+}
+
+// Mac returns the hardware address of the machine
+func (m *MemoryMachine) Mac() net.HardwareAddr {
+	return m.mac
+}
+
+// IP returns the IP address associated with the machine
+func (m *MemoryMachine) IP() (net.IP, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.ip, nil
+}
+
+// Name returns the hostname of the machine, the same way EtcdMachine does
+func (m *MemoryMachine) Name() string {
+	return strings.Replace("node"+m.mac.String(), ":", "", -1)
+}
+
+// Domain returns the cluster name of the datasource
+func (m *MemoryMachine) Domain() string {
+	return m.ds.ClusterName()
+}
+
+// FirstSeen returns the time upon which the machine has been created
+func (m *MemoryMachine) FirstSeen() (time.Time, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.firstSeen, nil
+}
+
+// LastSeen returns the last time the machine has checked in
+func (m *MemoryMachine) LastSeen() (time.Time, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.lastSeen, nil
+}
+
+// CheckIn updates the last seen time of the machine to now
+func (m *MemoryMachine) CheckIn() error {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	m.lastSeen = m.ds.Now()
+	return nil
+}
+
+// RecordBoot increments the boot count of the machine
+func (m *MemoryMachine) RecordBoot() error {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	m.bootCount++
+	m.lastBoot = m.ds.Now()
+	return nil
+}
+
+// Boots returns the boot count and the last boot time of the machine
+func (m *MemoryMachine) Boots() (int, time.Time, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.bootCount, m.lastBoot, nil
+}
+
+// Note returns the note of the machine
+func (m *MemoryMachine) Note() (string, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.note, nil
+}
+
+// SetNote sets the note of the machine, up to datasource.MaxNoteLength bytes
+func (m *MemoryMachine) SetNote(note string) error {
+	if len(note) > datasource.MaxNoteLength {
+		return fmt.Errorf("note is longer than %d bytes", datasource.MaxNoteLength)
+	}
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	m.note = note
+	return nil
+}
+
+// BMC returns the details of the BMC of the machine
+func (m *MemoryMachine) BMC() (datasource.BMCCredentials, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return m.bmc, nil
+}
+
+// SetBMC sets the details of the BMC of the machine, after validating the
+// address. An empty address removes them
+func (m *MemoryMachine) SetBMC(bmc datasource.BMCCredentials) error {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	if bmc.Address == "" {
+		bmc = datasource.BMCCredentials{}
+	} else if err := datasource.ValidateBMCAddress(bmc.Address); err != nil {
+		return err
+	}
+	m.bmc = bmc
+	return nil
+}
+
+// ListFlags returns a copy of the flags of the machine, without the
+// credentials of its BMC
+func (m *MemoryMachine) ListFlags() (map[string]string, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	ret := make(map[string]string, len(m.flags))
+	for key, value := range m.flags {
+		ret[key] = value
+	}
+	return datasource.RedactCredentials(ret), nil
+}
+
+// GetFlag returns the value of the flag, or an error if it's not set
+func (m *MemoryMachine) GetFlag(key string) (string, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	value, exists := m.flags[key]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", datasource.ErrFlagNotFound, key)
+	}
+	return value, nil
+}
+
+// GetIntFlag returns the value of the flag parsed as an integer
+func (m *MemoryMachine) GetIntFlag(key string) (int, error) {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return 0, err
+	}
+	return datasource.ParseIntFlag(key, value)
+}
+
+// GetBoolFlag returns the value of the flag parsed as a boolean
+func (m *MemoryMachine) GetBoolFlag(key string) (bool, error) {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return false, err
+	}
+	return datasource.ParseBoolFlag(key, value)
+}
+
+// GetJSONFlag unmarshals the value of the flag into out
+func (m *MemoryMachine) GetJSONFlag(key string, out interface{}) error {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return err
+	}
+	return datasource.ParseJSONFlag(key, value, out)
+}
+
+// SetFlag sets the value of the flag
+func (m *MemoryMachine) SetFlag(key, value string) error {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	m.flags[key] = value
+	m.revision++
+	m.recordHistory(key, datasource.FlagHistoryEntry{Time: m.ds.Now(), Value: value})
+	return nil
+}
+
+// CreateFlag sets the value of the flag only if it isn't set
+func (m *MemoryMachine) CreateFlag(key, value string) (bool, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	if _, exists := m.flags[key]; exists {
+		return false, nil
+	}
+	m.flags[key] = value
+	m.revision++
+	m.recordHistory(key, datasource.FlagHistoryEntry{Time: m.ds.Now(), Value: value})
+	return true, nil
+}
+
+// GetAndDeleteFlag returns the value of the flag and deletes it
+func (m *MemoryMachine) GetAndDeleteFlag(key string) (string, error) {
+	if datasource.IsReservedFlag(key) {
+		return "", fmt.Errorf("%w: %s", datasource.ErrReservedFlag, key)
+	}
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	value, exists := m.flags[key]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", datasource.ErrFlagNotFound, key)
+	}
+	delete(m.flags, key)
+	m.revision++
+	m.recordHistory(key, datasource.FlagHistoryEntry{Time: m.ds.Now(), Deleted: true})
+	return value, nil
+}
+
+// DeleteFlag deletes the flag, unless it's reserved
+func (m *MemoryMachine) DeleteFlag(key string) error {
+	if datasource.IsReservedFlag(key) {
+		return fmt.Errorf("%w: %s", datasource.ErrReservedFlag, key)
+	}
+	return m.ForceDeleteFlag(key)
+}
+
+// ForceDeleteFlag deletes the flag, even if it's reserved
+func (m *MemoryMachine) ForceDeleteFlag(key string) error {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	delete(m.flags, key)
+	m.revision++
+	m.recordHistory(key, datasource.FlagHistoryEntry{Time: m.ds.Now(), Deleted: true})
+	return nil
+}
+
+// recordHistory appends the entry to the history of the flag, keeping the
+// last FlagHistory entries of the datasource
+func (m *MemoryMachine) recordHistory(key string, entry datasource.FlagHistoryEntry) {
+	if m.ds.FlagHistory <= 0 {
+		return
+	}
+	if m.history == nil {
+		m.history = make(map[string][]datasource.FlagHistoryEntry)
+	}
+	history := append(m.history[key], entry)
+	if len(history) > m.ds.FlagHistory {
+		history = history[len(history)-m.ds.FlagHistory:]
+	}
+	m.history[key] = history
+}
+
+// FlagHistory returns the recorded values of the flag
+func (m *MemoryMachine) FlagHistory(key string) ([]datasource.FlagHistoryEntry, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return append([]datasource.FlagHistoryEntry{}, m.history[key]...), nil
+}
+
+// FlagsRevision returns the number of the changes to the flags and the IP
+func (m *MemoryMachine) FlagsRevision() (string, error) {
+	m.ds.mu.Lock()
+	defer m.ds.mu.Unlock()
+	return strconv.Itoa(m.revision), nil
+}
+
+// MemoryDataSource implements datasource.DataSource with maps. The exported
+// fields can be altered by the tests before the datasource is used
+type MemoryDataSource struct {
+	Cluster     string
+	Workspace   string
+	CoreOS      string
+	Start       net.IP
+	Range       int
+	DNS         []net.IP
+	Master      bool
+	Endpoints   []datasource.EtcdEndpointHealth
+	VersionInfo datasource.BlacksmithVersion
+	// Now returns the current time, and can be replaced to control the
+	// first seen and last seen times of the machines
+	Now func() time.Time
+	// FlagHistory is the number of the values kept per flag for
+	// Machine.FlagHistory. Zero disables the history
+	FlagHistory int
+	// InMaintenance is the maintenance mode, which makes Assign fail with
+	// datasource.ErrMaintenance. Once the datasource is in use, it's
+	// guarded by mu, through Maintenance and SetMaintenance
+	InMaintenance bool
+
+	mu       sync.Mutex
+	assignMu sync.Mutex
+	machines map[string]*MemoryMachine
+	values   map[string]string
+	audit    []datasource.AuditEntry
+	locks    map[string]memoryLock
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+// New returns an empty MemoryDataSource which leases IPs from leaseStart
+func New(leaseStart net.IP, leaseRange int) *MemoryDataSource {
+	return &MemoryDataSource{
+		Cluster:  "test",
+		CoreOS:   "1000.0.0",
+		Start:    leaseStart,
+		Range:    leaseRange,
+		Master:   true,
+		Now:      time.Now,
+		machines: make(map[string]*MemoryMachine),
+		values:   make(map[string]string),
+		locks:    make(map[string]memoryLock),
+	}
+}
+
+// Version returns the VersionInfo field
+func (ds *MemoryDataSource) Version() datasource.BlacksmithVersion {
+	return ds.VersionInfo
+}
+
+// CoreOSVersion returns the value set by SetConfig, or the CoreOS field
+func (ds *MemoryDataSource) CoreOSVersion() (string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if version, exists := ds.values["coreos-version"]; exists {
+		return version, nil
+	}
+	return ds.CoreOS, nil
+}
+
+// GetMachine returns the machine with the given hardware address
+func (ds *MemoryDataSource) GetMachine(mac net.HardwareAddr) (datasource.Machine, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	machine, exists := ds.machines[mac.String()]
+	if !exists {
+		return nil, false
+	}
+	return machine, true
+}
+
+// GetMachineByIP returns the machine which holds the IP
+func (ds *MemoryDataSource) GetMachineByIP(ip net.IP) (datasource.Machine, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, machine := range ds.machines {
+		if machine.ip != nil && machine.ip.Equal(ip) {
+			return machine, true
+		}
+	}
+	return nil, false
+}
+
+// SetState moves the machine to the given boot state, if the transition is
+// valid. The state is checked and set under the lock, like the compare and
+// set of EtcdDataSource
+func (ds *MemoryDataSource) SetState(mac net.HardwareAddr, state string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	machine, exists := ds.machines[mac.String()]
+	if !exists {
+		return fmt.Errorf("%w: %s", datasource.ErrMachineNotFound, mac)
+	}
+	current, exists := machine.flags[datasource.StateFlag]
+	if !exists {
+		return fmt.Errorf("%w: %s", datasource.ErrFlagNotFound, datasource.StateFlag)
+	}
+	if !datasource.ValidStateTransition(current, state) {
+		return fmt.Errorf("%w for %s: %s -> %s",
+			datasource.ErrInvalidStateTransition, machine.Name(), current, state)
+	}
+	machine.flags[datasource.StateFlag] = state
+	machine.revision++
+	machine.recordHistory(datasource.StateFlag, datasource.FlagHistoryEntry{Time: ds.Now(), Value: state})
+	return nil
+}
+
+// ExportFlags returns all the flags of the machine
+func (ds *MemoryDataSource) ExportFlags(mac net.HardwareAddr) (map[string]string, error) {
+	return datasource.ExportMachineFlags(ds, mac)
+}
+
+// ImportFlags sets the flags on the machine, like the etcd datasource
+func (ds *MemoryDataSource) ImportFlags(mac net.HardwareAddr, flags map[string]string, overwrite bool) error {
+	return datasource.ImportMachineFlags(ds, mac, flags, overwrite)
+}
+
+// CreateMachine creates a machine, unless the hardware address or the IP is
+// already taken
+func (ds *MemoryDataSource) CreateMachine(mac net.HardwareAddr, ip net.IP) (datasource.Machine, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, machine := range ds.machines {
+		if machine.mac.String() == mac.String() || machine.ip.Equal(ip) {
+			return nil, false
+		}
+	}
+	now := ds.Now()
+	machine := &MemoryMachine{
+		ds:        ds,
+		mac:       mac,
+		ip:        ip,
+		firstSeen: now,
+		lastSeen:  now,
+		flags:     map[string]string{"state": datasource.StateUnknown},
+	}
+	ds.machines[mac.String()] = machine
+	return machine, true
+}
+
+// DeleteMachine removes the machine
+func (ds *MemoryDataSource) DeleteMachine(mac net.HardwareAddr) error {
+	ds.assignMu.Lock()
+	defer ds.assignMu.Unlock()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, exists := ds.machines[mac.String()]; !exists {
+		return fmt.Errorf("%w: %s", datasource.ErrMachineNotFound, mac)
+	}
+	delete(ds.machines, mac.String())
+	return nil
+}
+
+// WorkspacePath returns the Workspace field
+func (ds *MemoryDataSource) WorkspacePath() string {
+	return ds.Workspace
+}
+
+// Machines returns the machines, sorted by their names
+func (ds *MemoryDataSource) Machines() ([]datasource.Machine, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ret := make([]datasource.Machine, 0, len(ds.machines))
+	for _, machine := range ds.machines {
+		ret = append(ret, machine)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, nil
+}
+
+// Get returns the value of the key
+func (ds *MemoryDataSource) Get(key string) (string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	value, exists := ds.values[key]
+	if !exists {
+		return "", fmt.Errorf("key not found: %s", key)
+	}
+	return value, nil
+}
+
+// Set sets the value of the key
+func (ds *MemoryDataSource) Set(key, value string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.values[key] = value
+	return nil
+}
+
+// Delete deletes the key
+func (ds *MemoryDataSource) Delete(key string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, exists := ds.values[key]; !exists {
+		return fmt.Errorf("key not found: %s", key)
+	}
+	delete(ds.values, key)
+	return nil
+}
+
+// GetAndDelete returns the value of the key and deletes it
+func (ds *MemoryDataSource) GetAndDelete(key string) (string, error) {
+	value, err := ds.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return value, ds.Delete(key)
+}
+
+// ClusterName returns the Cluster field
+func (ds *MemoryDataSource) ClusterName() string {
+	return ds.Cluster
+}
+
+// Config returns the fields as the runtime configuration. Only the CoreOS
+// version is mutable, like in EtcdDataSource
+func (ds *MemoryDataSource) Config() (map[string]datasource.ConfigValue, error) {
+	coreOSVersion, _ := ds.CoreOSVersion()
+	leaseRange := fmt.Sprint(ds.Range)
+	return map[string]datasource.ConfigValue{
+		"coreos-version": {Value: coreOSVersion, Initial: ds.CoreOS},
+		"cluster-name":   {Value: ds.Cluster, Initial: ds.Cluster, ReadOnly: true},
+		"workspace-path": {Value: ds.Workspace, Initial: ds.Workspace, ReadOnly: true},
+		"lease-start":    {Value: ds.Start.String(), Initial: ds.Start.String(), ReadOnly: true},
+		"lease-range":    {Value: leaseRange, Initial: leaseRange, ReadOnly: true},
+	}, nil
+}
+
+// SetConfig updates a mutable value of the runtime configuration
+func (ds *MemoryDataSource) SetConfig(key, value string) error {
+	config, _ := ds.Config()
+	current, exists := config[key]
+	if !exists {
+		return fmt.Errorf("unknown config key: %s", key)
+	}
+	if current.ReadOnly {
+		return fmt.Errorf("config key %s is read-only", key)
+	}
+	return ds.Set(key, value)
+}
+
+// LeaseStart returns the Start field
+func (ds *MemoryDataSource) LeaseStart() net.IP {
+	return ds.Start
+}
+
+// LeaseRange returns the Range field
+func (ds *MemoryDataSource) LeaseRange() int {
+	return ds.Range
+}
+
+// PoolStats counts the assigned and free IPs of the lease pool. It keeps no
+// claims apart from its machines, so there are no reservations
+func (ds *MemoryDataSource) PoolStats() (*datasource.PoolStats, error) {
+	machines, _ := ds.Machines()
+	assignedIPs := make(map[string]bool)
+	for _, machine := range machines {
+		ip, _ := machine.IP()
+		assignedIPs[ip.String()] = true
+	}
+
+	stats := &datasource.PoolStats{Start: ds.Start, Range: ds.Range}
+	for i := 0; i < ds.Range; i++ {
+		if assignedIPs[dhcp4.IPAdd(ds.Start, i).String()] {
+			stats.Assigned++
+		}
+	}
+	stats.Free = stats.Range - stats.Assigned
+	return stats, nil
+}
+
+// Assign returns the IP of the machine with the given hardware address, or
+// creates the machine with the first unused IP of the lease pool. A machine
+// whose lease has been expired gets the first unused IP too. Returns
+// ErrPoolFull if the pool is full, like EtcdDataSource
+func (ds *MemoryDataSource) Assign(nic string) (net.IP, error) {
+	ds.assignMu.Lock()
+	defer ds.assignMu.Unlock()
+
+	mac, err := net.ParseMAC(nic)
+	if err != nil {
+		return nil, err
+	}
+	if inMaintenance, _ := ds.Maintenance(); inMaintenance {
+		return nil, datasource.ErrMaintenance
+	}
+	machine, exists := ds.GetMachine(mac)
+	if exists {
+		machine.CheckIn()
+		if ip, _ := machine.IP(); ip != nil {
+			return ip, nil
+		}
+	}
+
+	machines, _ := ds.Machines()
+	assignedIPs := make(map[string]bool)
+	for _, machine := range machines {
+		ip, _ := machine.IP()
+		assignedIPs[ip.String()] = true
+	}
+	for i := 0; i < ds.Range; i++ {
+		ip := dhcp4.IPAdd(ds.Start, i)
+		if assignedIPs[ip.String()] {
+			continue
+		}
+		if exists {
+			ds.mu.Lock()
+			machine.(*MemoryMachine).ip = ip
+			machine.(*MemoryMachine).revision++
+			ds.mu.Unlock()
+		} else {
+			ds.CreateMachine(mac, ip)
+		}
+		return ip, nil
+	}
+	return nil, datasource.ErrPoolFull
+}
+
+// Request accepts the requested IP unless it's leased to another hardware
+// address. A known hardware address moves to the requested IP, like in
+// EtcdDataSource
+func (ds *MemoryDataSource) Request(nic string, currentIP net.IP) (net.IP, error) {
+	ds.assignMu.Lock()
+	defer ds.assignMu.Unlock()
+
+	mac, err := net.ParseMAC(nic)
+	if err != nil {
+		return nil, err
+	}
+	machines, _ := ds.Machines()
+	var macMachine *MemoryMachine
+	for _, machine := range machines {
+		ip, _ := machine.IP()
+		ipMatch, macMatch := ip.Equal(currentIP), machine.Mac().String() == mac.String()
+		if ipMatch && macMatch {
+			machine.CheckIn()
+			return currentIP, nil
+		}
+		if ipMatch {
+			return nil, fmt.Errorf("%w: %s", datasource.ErrIPConflict, currentIP)
+		}
+		if macMatch {
+			macMachine = machine.(*MemoryMachine)
+		}
+	}
+	if macMachine != nil {
+		ds.mu.Lock()
+		if !macMachine.ip.Equal(currentIP) {
+			macMachine.ip = currentIP
+			macMachine.revision++
+		}
+		macMachine.lastSeen = ds.Now()
+		ds.mu.Unlock()
+		return currentIP, nil
+	}
+	ds.CreateMachine(mac, currentIP)
+	return currentIP, nil
+}
+
+// ExpireLease removes the IP of the machine, keeping the rest of it
+func (ds *MemoryDataSource) ExpireLease(mac net.HardwareAddr) (net.IP, error) {
+	ds.assignMu.Lock()
+	defer ds.assignMu.Unlock()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	machine, exists := ds.machines[mac.String()]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", datasource.ErrMachineNotFound, mac)
+	}
+	if machine.ip == nil {
+		return nil, datasource.ErrNoLease
+	}
+	ip := machine.ip
+	machine.ip = nil
+	machine.revision++
+	return ip, nil
+}
+
+// DNSAddresses returns the DNS field, marshalled as option 6 (rfc2132)
+func (ds *MemoryDataSource) DNSAddresses() ([]byte, error) {
+	ret := make([]byte, 0, 4*len(ds.DNS))
+	for _, ip := range ds.DNS {
+		ret = append(ret, ip.To4()...)
+	}
+	return ret, nil
+}
+
+// AddAuditEntry appends the entry to the audit log
+func (ds *MemoryDataSource) AddAuditEntry(entry datasource.AuditEntry) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.audit = append(ds.audit, entry)
+	return nil
+}
+
+// AuditEntries returns the audit log, only of the given machine if mac isn't
+// nil
+func (ds *MemoryDataSource) AuditEntries(mac net.HardwareAddr) ([]datasource.AuditEntry, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ret := make([]datasource.AuditEntry, 0, len(ds.audit))
+	for _, entry := range ds.audit {
+		if mac == nil || entry.Mac == mac.String() {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, nil
+}
+
+// EtcdEndpoints returns the Endpoints field
+func (ds *MemoryDataSource) EtcdEndpoints() []datasource.EtcdEndpointHealth {
+	return ds.Endpoints
+}
+
+// Maintenance returns the InMaintenance field
+func (ds *MemoryDataSource) Maintenance() (bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.InMaintenance, nil
+}
+
+// SetMaintenance sets the InMaintenance field
+func (ds *MemoryDataSource) SetMaintenance(enabled bool) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.InMaintenance = enabled
+	return nil
+}
+
+// Reconcile repairs nothing, since the memory datasource keeps no claims
+// apart from its machines
+func (ds *MemoryDataSource) Reconcile() (*datasource.ReconcileReport, error) {
+	return &datasource.ReconcileReport{
+		Restored: make([]datasource.LeaseClaim, 0),
+		Removed:  make([]datasource.LeaseClaim, 0),
+	}, nil
+}
+
+// ReconcileStats returns no runs, since Reconcile repairs nothing
+func (ds *MemoryDataSource) ReconcileStats() datasource.ReconcileStats {
+	return datasource.ReconcileStats{}
+}
+
+// IsMaster returns the Master field
+func (ds *MemoryDataSource) IsMaster() bool {
+	return ds.Master
+}
+
+// RemoveInstance does nothing
+func (ds *MemoryDataSource) RemoveInstance() error {
+	return nil
+}
+
+// AcquireLock takes the lock for the owner, unless another owner holds it
+// and it hasn't expired by the Now func
+func (ds *MemoryDataSource) AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	if err := datasource.ValidateLockName(name); err != nil {
+		return false, err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := ds.Now()
+	if lock, exists := ds.locks[name]; exists && lock.owner != owner && now.Before(lock.expires) {
+		return false, nil
+	}
+	ds.locks[name] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLock releases the lock, if the owner holds it
+func (ds *MemoryDataSource) ReleaseLock(name, owner string) error {
+	if err := datasource.ValidateLockName(name); err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	lock, exists := ds.locks[name]
+	if !exists || !ds.Now().Before(lock.expires) {
+		return nil
+	}
+	if lock.owner != owner {
+		return datasource.ErrLockNotHeld
+	}
+	delete(ds.locks, name)
+	return nil
+}
@@ -0,0 +1,33 @@
+package datasourcetest
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestAssignAndRequest(t *testing.T) {
+	ds := New(net.IPv4(10, 0, 0, 10), 2)
+
+	first, err := ds.Assign("00:00:00:00:00:01")
+	if err != nil || !first.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Fatalf("unexpected first assignment: ip=%s err=%v", first, err)
+	}
+	again, _ := ds.Assign("00:00:00:00:00:01")
+	if !again.Equal(first) {
+		t.Errorf("expected the same ip on re-assignment, got %s", again)
+	}
+	if _, err := ds.Request("00:00:00:00:00:02", first); err == nil {
+		t.Error("expected a mismatch error when requesting a leased ip")
+	}
+	if ip, err := ds.Request("00:00:00:00:00:01", first); err != nil || !ip.Equal(first) {
+		t.Errorf("unexpected request result: ip=%s err=%v", ip, err)
+	}
+
+	ds.Assign("00:00:00:00:00:02")
+	if ip, err := ds.Assign("00:00:00:00:00:03"); ip != nil || !errors.Is(err, datasource.ErrPoolFull) {
+		t.Errorf("expected ErrPoolFull from a full pool, got %s (%v)", ip, err)
+	}
+}
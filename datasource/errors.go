@@ -0,0 +1,26 @@
+package datasource
+
+import "errors"
+
+// The kinds of the errors of the datasources, which are wrapped with the
+// details, e.g. fmt.Errorf("%w: %s", ErrMachineNotFound, mac), so that the
+// callers can tell them apart with errors.Is
+var (
+	// ErrMachineNotFound is returned for a hardware address without a
+	// machine
+	ErrMachineNotFound = errors.New("machine not found")
+	// ErrPoolFull is returned by Assign when no IP of the lease pool is free
+	ErrPoolFull = errors.New("the lease pool is full")
+	// ErrIPConflict is returned when the IP is held by another machine
+	ErrIPConflict = errors.New("Missmatch in lease pool")
+	// ErrInconsistent is returned when the entries of the datasource
+	// contradict each other, like a machine entry which can't be read back
+	ErrInconsistent = errors.New("Inconsistent datasource")
+	// ErrInvalidStateTransition is returned by SetState when the machine
+	// can't move from its state to the requested one, or its state changed
+	// meanwhile
+	ErrInvalidStateTransition = errors.New("invalid state transition")
+	// ErrReadOnly is returned by the writes to a datasource wrapped by
+	// ReadOnly, like on a replica
+	ErrReadOnly = errors.New("the datasource is read-only")
+)
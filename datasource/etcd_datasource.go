@@ -18,6 +18,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/cafebazaar/blacksmith/logging"
+	"github.com/cafebazaar/blacksmith/tracing"
 )
 
 const (
@@ -42,10 +43,21 @@ type EtcdDataSource struct {
 	clusterName          string
 	workspacePath        string
 	initialCoreOSVersion string
-	dhcpAssignLock       *sync.Mutex
 	dhcpDataLock         *sync.Mutex
 	instancesEtcdDir     string // HA
 	serverIP             net.IP
+	excludes             []*net.IPNet
+	probe                Probe
+	conflicts            probeConflicts
+	machinesCache        machinesCache
+	strictMachines       bool
+	leaseStrategy        LeaseStrategy
+	ipam                 IPAMProvider
+	flagHistory          int
+	maintenance          maintenanceCache
+	noAutoCreate         bool
+	machineSharding      MachineSharding
+	reconciled           reconcileTotals
 }
 
 // Version is returns the version details of the current blacksmith instance
@@ -60,34 +72,84 @@ func (ds *EtcdDataSource) WorkspacePath() string {
 	return ds.workspacePath
 }
 
-// Machines returns an array of the recognized machines in etcd datasource
+// Machines returns an array of the recognized machines in etcd datasource,
+// which may be cached for the TTL set by SetMachinesCacheTTL
 // part of GeneralDataSource interface implementation
 func (ds *EtcdDataSource) Machines() ([]Machine, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	span := tracing.Start("datasource.Machines")
+	defer span.End()
 
-	response, err := ds.keysAPI.Get(ctx, ds.prefixify("/machines"), &etcd.GetOptions{Recursive: false})
+	machines, generation, cached := ds.machinesCache.get()
+	if cached {
+		span.SetAttributes("cache", "hit")
+		return machines, nil
+	}
+	machines, err := ds.listMachines()
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	ds.machinesCache.set(machines, generation)
+	return machines, nil
+}
+
+// listMachines lists the machines in etcd, bypassing the cache
+func (ds *EtcdDataSource) listMachines() ([]Machine, error) {
+	entries, err := ds.machineEntries()
 	if err != nil {
 		return nil, err
 	}
 	ret := make([]Machine, 0)
-	for _, ent := range response.Node.Nodes {
+	for _, ent := range entries {
 		pathToMachineDir := ent.Key
 		machineName := pathToMachineDir[strings.LastIndex(pathToMachineDir, "/")+1:]
-		macStr := macFromName(machineName)
-		macAddr, err := net.ParseMAC(macStr)
+		machine, err := ds.machineFromName(machineName, ent.Dir)
 		if err != nil {
-			return nil, err
-		}
-		machine, exist := ds.GetMachine(macAddr)
-		if !exist {
-			return nil, errors.New("Inconsistent datasource")
+			if ds.strictMachines {
+				return nil, err
+			}
+			logging.Log(debugTag, "Skipping the machine entry %s: %s", pathToMachineDir, err)
+			continue
 		}
 		ret = append(ret, machine)
 	}
 	return ret, nil
 }
 
+// machineFromName returns the machine of an entry of the machines directory,
+// or an error if the entry is malformed
+func (ds *EtcdDataSource) machineFromName(machineName string, dir bool) (Machine, error) {
+	if !dir {
+		return nil, errors.New("not a directory")
+	}
+	macStr, err := macFromName(machineName)
+	if err != nil {
+		return nil, err
+	}
+	macAddr, err := parseNIC(macStr)
+	if err != nil {
+		return nil, err
+	}
+	machine, exist := ds.GetMachine(macAddr)
+	if !exist {
+		return nil, fmt.Errorf("%w: %s can't be read back", ErrInconsistent, machineName)
+	}
+	return machine, nil
+}
+
+// SetStrictMachines makes Machines fail on malformed machine entries, instead
+// of skipping them
+func (ds *EtcdDataSource) SetStrictMachines(strict bool) {
+	ds.strictMachines = strict
+}
+
+// SetAutoCreateOnRequest sets whether Request creates the machines of the
+// unknown nics, which is the default. Otherwise they fail with
+// ErrUnknownRequest, and only Assign creates the machines
+func (ds *EtcdDataSource) SetAutoCreateOnRequest(enabled bool) {
+	ds.noAutoCreate = !enabled
+}
+
 // GetMachine returns a Machine interface which is the accessor/getter/setter
 // for a node in the etcd datasource. If an entry associated with the passed
 // mac address does not exist the second return value will be set to false
@@ -97,12 +159,12 @@ func (ds *EtcdDataSource) GetMachine(mac net.HardwareAddr) (Machine, bool) {
 	defer cancel()
 
 	machineName := nameFromMac(mac.String())
-	response, err := ds.keysAPI.Get(ctx, ds.prefixify(path.Join("machines/"+machineName)), nil)
+	response, err := ds.keysAPI.Get(ctx, ds.prefixify(ds.machineDir(mac)), nil)
 	if err != nil {
 		return nil, false
 	}
 	if response.Node.Key[strings.LastIndex(response.Node.Key, "/")+1:] == machineName {
-		return &EtcdMachine{mac, ds, ds.keysAPI}, true
+		return &EtcdMachine{mac, ds, ds.keysAPI, ds.machineDir(mac)}, true
 	}
 	return nil, false
 }
@@ -112,7 +174,8 @@ func (ds *EtcdDataSource) GetMachine(mac net.HardwareAddr) (Machine, bool) {
 // successful
 // part of GeneralDataSource interface implementation
 func (ds *EtcdDataSource) CreateMachine(mac net.HardwareAddr, ip net.IP) (Machine, bool) {
-	machines, err := ds.Machines()
+	// the duplicates must be checked against the latest list
+	machines, err := ds.listMachines()
 
 	if err != nil {
 		return nil, false
@@ -123,40 +186,81 @@ func (ds *EtcdDataSource) CreateMachine(mac net.HardwareAddr, ip net.IP) (Machin
 		}
 		nodeip, err := node.IP()
 		if err != nil {
+			// the ip may be a duplicate, which can't be told
+			logging.Log(debugTag, "Not creating %s, error while reading the IP of %s: %s",
+				mac, node.Name(), err)
 			return nil, false
 		}
 		if nodeip.String() == ip.String() {
 			return nil, false
 		}
 	}
-	machine := &EtcdMachine{mac, ds, ds.keysAPI}
+	machine := &EtcdMachine{mac, ds, ds.keysAPI, ds.machineDir(mac)}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	ds.keysAPI.Set(ctx, ds.prefixify("machines/"+machine.Name()), "", &etcd.SetOptions{Dir: true})
+	ds.keysAPI.Set(ctx, ds.prefixify(ds.machineDir(machine.Mac())), "", &etcd.SetOptions{Dir: true})
+	ds.machinesCache.invalidate()
 	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel1()
-	ds.keysAPI.Set(ctx1, ds.prefixify("machines/"+machine.Name()+"/_IP"), ip.String(), &etcd.SetOptions{})
+	ds.keysAPI.Set(ctx1, ds.prefixify(ds.machineDir(machine.Mac())+"/"+ipKey), ip.String(), &etcd.SetOptions{})
 
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel2()
-	ds.keysAPI.Set(ctx2, ds.prefixify("machines/"+machine.Name()+"/_mac"), machine.Mac().String(), &etcd.SetOptions{})
+	ds.keysAPI.Set(ctx2, ds.prefixify(ds.machineDir(machine.Mac())+"/"+macKey), machine.Mac().String(), &etcd.SetOptions{})
 
 	ctx3, cancel3 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel3()
-	ds.keysAPI.Set(ctx3, ds.prefixify("machines/"+machine.Name()+"/_first_seen"),
+	ds.keysAPI.Set(ctx3, ds.prefixify(ds.machineDir(machine.Mac())+"/"+firstSeenKey),
 		strconv.FormatInt(time.Now().UnixNano(), 10), &etcd.SetOptions{})
 
-	ctx4, cancel4 := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel4()
-	ds.keysAPI.Set(ctx4, "skydns/"+ds.clusterName+"/"+machine.Name(), fmt.Sprintf(`{"host":"%s"}`, ip.String()), nil)
+	ds.setDNSRecord(machine, ip)
 
 	machine.CheckIn()
-	machine.SetFlag("state", "unknown")
+	machine.SetFlag(StateFlag, StateUnknown)
 	return machine, true
 }
 
+// DeleteMachine removes the directory of the machine, its claim on its IP and
+// its dns record
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) DeleteMachine(mac net.HardwareAddr) error {
+	// the machine is looked up under the lock, so its IP can't change
+	// between reading and releasing it
+	ds.lockDHCPData()
+	defer ds.unlockDHCPData()
+
+	machine, exists := ds.GetMachine(mac)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrMachineNotFound, mac)
+	}
+
+	ip, err := machine.IP()
+	if err != nil {
+		return fmt.Errorf("Error while reading the IP of %s: %s", machine.Name(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = ds.keysAPI.Delete(ctx, ds.prefixify(ds.machineDir(machine.Mac())),
+		&etcd.DeleteOptions{Dir: true, Recursive: true})
+	if err != nil {
+		return err
+	}
+	ds.machinesCache.invalidate()
+
+	if ip != nil {
+		ds.releaseIP(ip, mac.String())
+		ds.releaseToIPAM(ip)
+	}
+	ds.forgetLease(mac.String())
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel1()
+	ds.keysAPI.Delete(ctx1, "skydns/"+ds.clusterName+"/"+machine.Name(), nil)
+	return nil
+}
+
 // CoreOSVersion gets the current value from etcd and returns it if the image folder exists
 // if not, the inital CoreOS version will be returned, with the raised error
 // part of GeneralDataSource interface implementation
@@ -184,11 +288,14 @@ func (ds *EtcdDataSource) prefixify(key string) string {
 // Get parses the etcd key and returns it's value
 // part of GeneralDataSource interface implementation
 func (ds *EtcdDataSource) Get(key string) (string, error) {
+	span := tracing.Start("datasource.Get", "key", key)
+	defer span.End()
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	response, err := ds.keysAPI.Get(ctx, ds.prefixify(key), nil)
 	if err != nil {
+		span.SetError(err)
 		return "", err
 	}
 	return response.Node.Value, nil
@@ -197,9 +304,12 @@ func (ds *EtcdDataSource) Get(key string) (string, error) {
 // Set sets and etcd key to a value
 // part of GeneralDataSource interface implementation
 func (ds *EtcdDataSource) Set(key string, value string) error {
+	span := tracing.Start("datasource.Set", "key", key)
+	defer span.End()
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := ds.keysAPI.Set(ctx, ds.prefixify(key), value, nil)
+	span.SetError(err)
 	return err
 }
 
@@ -232,7 +342,92 @@ func (ds *EtcdDataSource) ClusterName() string {
 }
 
 type initialValues struct {
-	CoreOSVersion string `yaml:"coreos-version"`
+	CoreOSVersion    string             `yaml:"coreos-version"`
+	Excludes         []string           `yaml:"excludes"`
+	DHCPOptions      []string           `yaml:"dhcp-options"`
+	DHCPLabelOptions []DHCPLabelOptions `yaml:"dhcp-label-options"`
+}
+
+// DHCPLabelOptions overrides the router and the dns servers sent to the
+// machines whose flag has the value, in the dhcp-label-options of
+// initial.yaml
+type DHCPLabelOptions struct {
+	Flag   string   `yaml:"flag"`
+	Value  string   `yaml:"value"`
+	Router string   `yaml:"router"`
+	DNS    []string `yaml:"dns"`
+}
+
+// readInitialValues reads and validates the initial.yaml of the workspace,
+// failing on the unknown keys
+func readInitialValues(workspacePath string) (*initialValues, []*net.IPNet, error) {
+	data, err := ioutil.ReadFile(filepath.Join(workspacePath, "initial.yaml"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error while trying to read initial data: %s", err)
+	}
+
+	var iVals initialValues
+	// strict, so the misspelled keys aren't silently ignored
+	err = yaml.UnmarshalStrict(data, &iVals)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error while reading initial data: %s", err)
+	}
+	excludes, err := iVals.validate(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error while reading initial data: %s", err)
+	}
+	return &iVals, excludes, nil
+}
+
+// InitialDHCPOptions returns the code=value custom DHCP options of the
+// initial.yaml of the workspace
+func InitialDHCPOptions(workspacePath string) ([]string, error) {
+	iVals, _, err := readInitialValues(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	return iVals.DHCPOptions, nil
+}
+
+// InitialDHCPLabelOptions returns the per label overrides of the DHCP options
+// of the initial.yaml of the workspace
+func InitialDHCPLabelOptions(workspacePath string) ([]DHCPLabelOptions, error) {
+	iVals, _, err := readInitialValues(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	return iVals.DHCPLabelOptions, nil
+}
+
+// parseExcludes parses the excluded IPs and CIDRs of the lease pool
+func parseExcludes(excludes []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(excludes))
+	for _, exclude := range excludes {
+		if strings.Contains(exclude, "/") {
+			_, ipNet, err := net.ParseCIDR(exclude)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in excludes: %q", exclude)
+			}
+			ret = append(ret, ipNet)
+			continue
+		}
+		ip := net.ParseIP(exclude).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP in excludes: %q", exclude)
+		}
+		ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+	}
+	return ret, nil
+}
+
+// isExcluded returns true if the ip is excluded from the lease pool
+func (ds *EtcdDataSource) isExcluded(ip net.IP) bool {
+	for _, ipNet := range ds.excludes {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // LeaseStart returns the first IP address that the DHCP server can offer to a
@@ -249,6 +444,56 @@ func (ds *EtcdDataSource) LeaseRange() int {
 	return ds.leaseRange
 }
 
+// PoolStats describes the utilization of the DHCP lease pool. Reservations
+// are the IPs claimed under leases which no machine holds, like the offers of
+// the handshakes in progress, which can't be given to other nics either
+type PoolStats struct {
+	Start        net.IP `json:"start"`
+	Range        int    `json:"range"`
+	Assigned     int    `json:"assigned"`
+	Excluded     int    `json:"excluded"`
+	Reservations int    `json:"reservations"`
+	Free         int    `json:"free"`
+}
+
+// PoolStats counts the assigned, excluded, reserved and free IPs of the lease
+// pool, according to the IPs of the machines and the claims under leases
+// part of DHCPDataSource interface implementation
+func (ds *EtcdDataSource) PoolStats() (*PoolStats, error) {
+	machines, err := ds.Machines()
+	if err != nil {
+		return nil, err
+	}
+	claims, err := ds.leaseClaims()
+	if err != nil {
+		return nil, err
+	}
+
+	assignedIPs := make(map[string]bool)
+	for _, node := range machines {
+		if ip, err := node.IP(); err == nil && ip != nil {
+			assignedIPs[ip.String()] = true
+		}
+	}
+
+	stats := &PoolStats{
+		Start: ds.LeaseStart(),
+		Range: ds.LeaseRange(),
+	}
+	for i := 0; i < ds.LeaseRange(); i++ {
+		ip := dhcp4.IPAdd(ds.LeaseStart(), i)
+		if assignedIPs[ip.String()] {
+			stats.Assigned++
+		} else if ds.isExcluded(ip) {
+			stats.Excluded++
+		} else if _, claimed := claims[ip.String()]; claimed {
+			stats.Reservations++
+		}
+	}
+	stats.Free = stats.Range - stats.Assigned - stats.Excluded - stats.Reservations
+	return stats, nil
+}
+
 // DNSAddresses returns the ip addresses of the present skydns servers in the
 // network, marshalled as specified in rfc2132 (option 6)
 // part of DHCPDataSource ineterface implementation
@@ -270,14 +515,6 @@ func (ds *EtcdDataSource) DNSAddresses() ([]byte, error) {
 	return ret, nil
 }
 
-func (ds *EtcdDataSource) lockDHCPAssign() {
-	ds.dhcpAssignLock.Lock()
-}
-
-func (ds *EtcdDataSource) unlockdhcpAssign() {
-	ds.dhcpAssignLock.Unlock()
-}
-
 func (ds *EtcdDataSource) lockDHCPData() {
 	ds.dhcpDataLock.Lock()
 }
@@ -286,77 +523,142 @@ func (ds *EtcdDataSource) unlockDHCPData() {
 	ds.dhcpDataLock.Unlock()
 }
 
+// setDNSRecord points the skydns record of the machine to the ip
+func (ds *EtcdDataSource) setDNSRecord(m Machine, ip net.IP) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ds.keysAPI.Set(ctx, "skydns/"+ds.clusterName+"/"+m.Name(), fmt.Sprintf(`{"host":"%s"}`, ip.String()), nil)
+}
+
 func (ds *EtcdDataSource) store(m Machine, ip net.IP) {
 	ds.lockDHCPData()
 	defer ds.unlockDHCPData()
+	ds.storeLocked(m, ip)
+}
 
+// storeLocked is store for the callers which hold the dhcp data lock already
+func (ds *EtcdDataSource) storeLocked(m Machine, ip net.IP) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	ds.keysAPI.Set(ctx, ds.prefixify("machines/"+m.Name()+"/_IP"),
+	ds.keysAPI.Set(ctx, ds.prefixify(ds.machineDir(m.Mac())+"/"+ipKey),
 		ip.String(), &etcd.SetOptions{})
 
 	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel1()
-	ds.keysAPI.Set(ctx1, ds.prefixify("machines/"+m.Name()+"/_last_seen"),
-		strconv.FormatInt(time.Now().UnixNano(), 10), &etcd.SetOptions{})
-
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel2()
-	ds.keysAPI.Set(ctx2, ds.prefixify("machines/"+m.Name()+"/_mac"),
+	ds.keysAPI.Set(ctx1, ds.prefixify(ds.machineDir(m.Mac())+"/"+macKey),
 		m.Mac().String(), &etcd.SetOptions{})
 
+	m.CheckIn()
 }
 
 // Assign assigns an ip to the node with the specified nic
 // Will use etcd machines records as LeasePool
 // part of DHCPDataSource interface implementation
-func (ds *EtcdDataSource) Assign(nic string) (net.IP, error) {
-	ds.lockDHCPAssign()
-	defer ds.unlockdhcpAssign()
-
+func (ds *EtcdDataSource) Assign(nic string) (assigned net.IP, err error) {
+	span := tracing.Start("datasource.Assign", "nic", nic)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	macAddress, err := parseNIC(nic)
+	if err != nil {
+		logging.Log(debugTag, "Skipping the lease of the malformed mac address %q: %s", nic, err)
+		return nil, err
+	}
+	if ds.inMaintenance() {
+		return nil, ErrMaintenance
+	}
+	if ds.ipam != nil {
+		return ds.assignFromIPAM(macAddress)
+	}
 	// TODO: first try to retrieve the machine, if exists (for performance)
 
 	assignedIPs := make(map[string]bool)
 	//find by Mac
+	var macNode Machine
 	machines, _ := ds.Machines()
 	for _, node := range machines {
+		nodeIP, _ := node.IP()
 		if node.Mac().String() == nic {
-			ip, _ := node.IP()
-			ds.store(node, ip)
-			return ip, nil
+			if nodeIP == nil {
+				// its lease has been expired, so it gets a fresh one
+				macNode = node
+				continue
+			}
+			ds.store(node, nodeIP)
+			return nodeIP, nil
 		}
-		nodeIP, _ := node.IP()
 		assignedIPs[nodeIP.String()] = true
 	}
 
-	//find an unused ip
-	for i := 0; i < ds.LeaseRange(); i++ {
+	//find an unused ip, in the order of the lease strategy
+	probes := 0
+	for _, i := range ds.leaseOrder(nic) {
 		ip := dhcp4.IPAdd(ds.LeaseStart(), i)
-		if _, exists := assignedIPs[ip.String()]; !exists {
-			macAddress, _ := net.ParseMAC(nic)
-			ds.CreateMachine(macAddress, ip)
+		if ds.isExcluded(ip) {
+			continue
+		}
+		if _, exists := assignedIPs[ip.String()]; exists {
+			continue
+		}
+		if ds.inConflict(ip, &probes) {
+			continue
+		}
+		claimed, fresh, err := ds.claimIP(ip, nic)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			continue
+		}
+		if macNode != nil {
+			ds.store(macNode, ip)
+			ds.setDNSRecord(macNode, ip)
 			return ip, nil
 		}
+		if _, created := ds.CreateMachine(macAddress, ip); !created {
+			// a concurrent transaction of the same nic may have won, with
+			// the claim of its own left alone
+			if fresh {
+				ds.releaseIP(ip, nic)
+			}
+			if node, exists := ds.GetMachine(macAddress); exists {
+				return leasedIP(node)
+			}
+			continue
+		}
+		return ip, nil
 	}
 
 	//use an expired ip
 	//not implemented
 	logging.Log(debugTag, "DHCP pool is full")
 
-	return nil, nil
+	return nil, ErrPoolFull
 }
 
 // Request answers a dhcp request
 // Uses etcd as backend
 // part of DHCPDataSource interface implementation
 func (ds *EtcdDataSource) Request(nic string, currentIP net.IP) (net.IP, error) {
-	ds.lockDHCPAssign()
-	defer ds.unlockdhcpAssign()
-
+	macAddress, err := parseNIC(nic)
+	if err != nil {
+		logging.Log(debugTag, "Skipping the request of the malformed mac address %q: %s", nic, err)
+		return nil, err
+	}
+	if ds.ipam != nil {
+		ip, err := ds.assignFromIPAM(macAddress)
+		if err != nil {
+			return nil, err
+		}
+		if !ip.Equal(currentIP) {
+			return nil, fmt.Errorf("%w: %s", ErrIPConflict, currentIP)
+		}
+		return currentIP, nil
+	}
 	machines, _ := ds.Machines()
 
-	macExists, ipExists := false, false
-
+	var macNode Machine
 	for _, node := range machines {
 		thisNodeIP, _ := node.IP()
 		ipMatch := thisNodeIP.String() == currentIP.String()
@@ -366,16 +668,60 @@ func (ds *EtcdDataSource) Request(nic string, currentIP net.IP) (net.IP, error)
 			ds.store(node, thisNodeIP)
 			return currentIP, nil
 		}
+		if ipMatch {
+			return nil, fmt.Errorf("%w: %s", ErrIPConflict, currentIP)
+		}
+		if macMatch {
+			macNode = node
+		}
+	}
+	if ds.isExcluded(currentIP) {
+		return nil, errors.New("Requested IP is excluded from the lease pool")
+	}
+	if macNode == nil && ds.noAutoCreate {
+		// the list may be cached from before Assign created the machine
+		if node, exists := ds.GetMachine(macAddress); exists {
+			if nodeIP, _ := node.IP(); nodeIP.Equal(currentIP) {
+				ds.store(node, currentIP)
+				return currentIP, nil
+			}
+		}
+		return nil, ErrUnknownRequest
+	}
 
-		ipExists = ipExists || ipMatch
-		macExists = macExists || macMatch
+	// succeeds if the ip is free, or if it's been offered to this nic by
+	// Assign, even if its machine is missing from the above list yet
+	claimed, fresh, err := ds.claimIP(currentIP, nic)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("%w: %s", ErrIPConflict, currentIP)
+	}
 
+	if macNode != nil {
+		// the nic moves to the requested ip, which is free
+		oldIP, _ := macNode.IP()
+		ds.store(macNode, currentIP)
+		ds.setDNSRecord(macNode, currentIP)
+		if oldIP != nil {
+			ds.releaseIP(oldIP, nic)
+		}
+		return currentIP, nil
 	}
-	if ipExists || macExists {
-		return nil, errors.New("Missmatch in lease pool")
+
+	if _, created := ds.CreateMachine(macAddress, currentIP); !created {
+		if node, exists := ds.GetMachine(macAddress); exists {
+			if nodeIP, _ := node.IP(); nodeIP.Equal(currentIP) {
+				ds.store(node, currentIP)
+				return currentIP, nil
+			}
+		}
+		if fresh {
+			ds.releaseIP(currentIP, nic)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrIPConflict, currentIP)
 	}
-	macAddress, _ := net.ParseMAC(nic)
-	ds.CreateMachine(macAddress, currentIP)
 	return currentIP, nil
 }
 
@@ -385,18 +731,9 @@ func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 	leaseRange int, clusterName, workspacePath string, serverIP net.IP,
 	defaultNameServers []string, version BlacksmithVersion) (DataSource, error) {
 
-	data, err := ioutil.ReadFile(filepath.Join(workspacePath, "initial.yaml"))
-	if err != nil {
-		return nil, fmt.Errorf("Error while trying to read initial data: %s", err)
-	}
-
-	var iVals initialValues
-	err = yaml.Unmarshal(data, &iVals)
+	iVals, excludes, err := readInitialValues(workspacePath)
 	if err != nil {
-		return nil, fmt.Errorf("Error while reading initial data: %s", err)
-	}
-	if iVals.CoreOSVersion == "" {
-		return nil, errors.New("A valid initial CoreOS version is required in initial data")
+		return nil, err
 	}
 
 	fmt.Printf("Initial Values: CoreOSVersion=%s\n", iVals.CoreOSVersion)
@@ -410,10 +747,10 @@ func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 		leaseRange:           leaseRange,
 		workspacePath:        workspacePath,
 		initialCoreOSVersion: iVals.CoreOSVersion,
-		dhcpAssignLock:       &sync.Mutex{},
 		dhcpDataLock:         &sync.Mutex{},
 		instancesEtcdDir:     invalidEtcdKey,
 		serverIP:             serverIP,
+		excludes:             excludes,
 	}
 
 	_, err = instance.CoreOSVersion()
@@ -0,0 +1,412 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestPoolStats(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:02")
+	mac3, _ := net.ParseMAC("00:11:22:33:44:03")
+	ds.CreateMachine(mac1, net.IPv4(10, 0, 0, 10))
+	ds.CreateMachine(mac2, net.IPv4(10, 0, 0, 19))
+	ds.CreateMachine(mac3, net.IPv4(10, 0, 0, 20)) // out of the pool
+
+	stats, err := ds.PoolStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Range != 10 || stats.Assigned != 2 || stats.Reservations != 0 || stats.Free != 8 {
+		t.Errorf("unexpected pool stats: %+v", stats)
+	}
+
+	// an offer in progress, whose machine isn't written yet
+	ds.claimIP(net.IPv4(10, 0, 0, 12), "00:11:22:33:44:04")
+	stats, err = ds.PoolStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Assigned != 2 || stats.Reservations != 1 || stats.Free != 7 {
+		t.Errorf("unexpected pool stats: %+v", stats)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:02")
+	ds.CreateMachine(mac1, net.IPv4(10, 0, 0, 10))
+
+	if err := ds.DeleteMachine(mac2); !errors.Is(err, ErrMachineNotFound) {
+		t.Errorf("expected ErrMachineNotFound, got %v", err)
+	}
+	if _, err := ds.ExpireLease(mac2); !errors.Is(err, ErrMachineNotFound) {
+		t.Errorf("expected ErrMachineNotFound, got %v", err)
+	}
+	if _, err := ds.Request(mac2.String(), net.IPv4(10, 0, 0, 10)); !errors.Is(err, ErrIPConflict) {
+		t.Errorf("expected ErrIPConflict, got %v", err)
+	}
+}
+
+func TestParseExcludes(t *testing.T) {
+	excludes, err := parseExcludes([]string{"10.0.0.12", "10.0.0.16/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &EtcdDataSource{excludes: excludes}
+	for ip, expected := range map[string]bool{
+		"10.0.0.11": false,
+		"10.0.0.12": true,
+		"10.0.0.15": false,
+		"10.0.0.16": true,
+		"10.0.0.19": true,
+		"10.0.0.20": false,
+	} {
+		if ds.isExcluded(net.ParseIP(ip)) != expected {
+			t.Errorf("isExcluded(%s) != %v", ip, expected)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0", "10.0.0.0/33", "nope"} {
+		if _, err := parseExcludes([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestAssignSkipsExcludes(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ds.excludes, _ = parseExcludes([]string{"10.0.0.10/31"})
+
+	ip, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(10, 0, 0, 12)) {
+		t.Errorf("expected 10.0.0.12, got %s", ip)
+	}
+
+	stats, err := ds.PoolStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Assigned != 1 || stats.Excluded != 2 || stats.Free != 7 {
+		t.Errorf("unexpected pool stats: %+v", stats)
+	}
+}
+
+func TestAssignSkipsProbedConflicts(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	probes := make(map[string]int)
+	ds.SetProbe(func(ip net.IP) bool {
+		probes[ip.String()]++
+		return ip.Equal(net.IPv4(10, 0, 0, 10))
+	})
+
+	ip, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(10, 0, 0, 11)) {
+		t.Errorf("expected 10.0.0.11, got %s", ip)
+	}
+
+	if ip, _ := ds.Assign("00:11:22:33:44:02"); !ip.Equal(net.IPv4(10, 0, 0, 12)) {
+		t.Errorf("expected 10.0.0.12, got %s", ip)
+	}
+	if probes["10.0.0.10"] != 1 {
+		t.Errorf("expected the conflicting address to be skipped without probing again, got %d probes", probes["10.0.0.10"])
+	}
+}
+
+func TestAssignCapsProbes(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	probes := 0
+	ds.SetProbe(func(ip net.IP) bool {
+		probes++
+		return true
+	})
+
+	// every address responds, so the one after the cap is offered unprobed
+	ip, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes != MaxProbesPerAssign || !ip.Equal(net.IPv4(10, 0, 0, 10+MaxProbesPerAssign)) {
+		t.Errorf("expected %d probes and the next address, got %d probes and %s", MaxProbesPerAssign, probes, ip)
+	}
+
+	// the expired conflicts are probed again, and dropped
+	ds.conflicts.Lock()
+	for conflict := range ds.conflicts.until {
+		ds.conflicts.until[conflict] = time.Now().Add(-time.Second)
+	}
+	ds.conflicts.Unlock()
+	probes = 0
+	ds.SetProbe(func(ip net.IP) bool {
+		probes++
+		return false
+	})
+	if ip, _ := ds.Assign("00:11:22:33:44:02"); !ip.Equal(net.IPv4(10, 0, 0, 10)) || probes != 1 {
+		t.Errorf("expected the expired conflict to be probed and offered, got %s after %d probes", ip, probes)
+	}
+	ds.conflicts.Lock()
+	defer ds.conflicts.Unlock()
+	if _, exists := ds.conflicts.until["10.0.0.10"]; exists {
+		t.Error("expected the expired conflict to be dropped")
+	}
+}
+
+func TestMalformedMacIsSkipped(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	for _, nic := range []string{"", "00:11:22:33:44:55:66:77", "00:11:22"} {
+		if ip, err := ds.Assign(nic); err == nil || ip != nil {
+			t.Errorf("Assign(%q): expected an error, got %s", nic, ip)
+		}
+		if ip, err := ds.Request(nic, net.IPv4(10, 0, 0, 10)); err == nil || ip != nil {
+			t.Errorf("Request(%q): expected an error, got %s", nic, ip)
+		}
+	}
+
+	machines, err := ds.Machines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 0 {
+		t.Errorf("expected no machines to be created, got %d", len(machines))
+	}
+}
+
+func TestAssignConcurrent(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	ips := make([]net.IP, 8)
+	var wg sync.WaitGroup
+	for i := range ips {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips[i], _ = ds.Assign(fmt.Sprintf("00:11:22:33:44:%02x", i))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i, ip := range ips {
+		if ip == nil || seen[ip.String()] {
+			t.Errorf("unexpected ip for the nic #%d: %s", i, ip)
+		}
+		seen[ip.String()] = true
+	}
+}
+
+func TestRequestClaimedIP(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+
+	if claimed, _, err := ds.claimIP(net.IPv4(10, 0, 0, 15), "00:11:22:33:44:01"); !claimed || err != nil {
+		t.Fatalf("expected to claim the ip: %v", err)
+	}
+	if _, err := ds.Request("00:11:22:33:44:02", net.IPv4(10, 0, 0, 15)); err == nil {
+		t.Error("expected an error when requesting an ip claimed by another nic")
+	}
+	if ip, err := ds.Request("00:11:22:33:44:01", net.IPv4(10, 0, 0, 15)); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 15)) {
+		t.Errorf("expected the claiming nic to get the ip: %s (%v)", ip, err)
+	}
+}
+
+func TestClaimIPFresh(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ip, nic := net.IPv4(10, 0, 0, 15), "00:11:22:33:44:01"
+
+	if claimed, fresh, err := ds.claimIP(ip, nic); !claimed || !fresh || err != nil {
+		t.Errorf("expected a fresh claim, got %v, %v (%v)", claimed, fresh, err)
+	}
+	// the claim of an earlier transaction of the nic isn't the caller's to
+	// release
+	if claimed, fresh, err := ds.claimIP(ip, nic); !claimed || fresh || err != nil {
+		t.Errorf("expected the earlier claim to be found, got %v, %v (%v)", claimed, fresh, err)
+	}
+	if claimed, fresh, err := ds.claimIP(ip, "00:11:22:33:44:02"); claimed || fresh || err != nil {
+		t.Errorf("expected the ip to be taken, got %v, %v (%v)", claimed, fresh, err)
+	}
+}
+
+func TestRequestAfterOffer(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	nic := "00:11:22:33:44:01"
+
+	offered, err := ds.Assign(nic)
+	if err != nil || offered == nil {
+		t.Fatalf("unexpected offer: %s (%v)", offered, err)
+	}
+	for i := 0; i < 2; i++ {
+		if ip, err := ds.Request(nic, offered); err != nil || !ip.Equal(offered) {
+			t.Errorf("expected the offered ip to be acked: %s (%v)", ip, err)
+		}
+	}
+	if _, err := ds.Request("00:11:22:33:44:02", offered); err == nil {
+		t.Error("expected a nak for an ip leased to another nic")
+	}
+}
+
+func TestRequestFreeIPForKnownNic(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	nic := "00:11:22:33:44:01"
+	mac, _ := net.ParseMAC(nic)
+
+	offered, _ := ds.Assign(nic)
+	free := net.IPv4(10, 0, 0, 15)
+	if ip, err := ds.Request(nic, free); err != nil || !ip.Equal(free) {
+		t.Fatalf("expected the free ip to be acked: %s (%v)", ip, err)
+	}
+
+	machine, _ := ds.GetMachine(mac)
+	if ip, _ := machine.IP(); !ip.Equal(free) {
+		t.Errorf("expected the machine to move to %s, got %s", free, ip)
+	}
+	if ip, err := ds.Assign("00:11:22:33:44:02"); err != nil || !ip.Equal(offered) {
+		t.Errorf("expected the previous ip to be released: %s (%v)", ip, err)
+	}
+}
+
+func TestRequestWithoutAutoCreate(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ds.SetAutoCreateOnRequest(false)
+
+	unknown, _ := net.ParseMAC("00:11:22:33:44:02")
+	if _, err := ds.Request(unknown.String(), net.IPv4(10, 0, 0, 15)); err != ErrUnknownRequest {
+		t.Errorf("expected ErrUnknownRequest, got %v", err)
+	}
+	if _, exists := ds.GetMachine(unknown); exists {
+		t.Error("expected the unknown machine not to be created")
+	}
+
+	nic := "00:11:22:33:44:01"
+	offered, _ := ds.Assign(nic)
+	if ip, err := ds.Request(nic, offered); err != nil || !ip.Equal(offered) {
+		t.Errorf("expected the offered ip to be acked: %s (%v)", ip, err)
+	}
+}
+
+func TestMachinesCache(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+	ds.SetMachinesCacheTTL(time.Minute)
+
+	first, _ := net.ParseMAC("00:11:22:33:44:01")
+	if _, created := ds.CreateMachine(first, net.IPv4(10, 0, 0, 10)); !created {
+		t.Fatal("machine wasn't created")
+	}
+	if machines, err := ds.Machines(); err != nil || len(machines) != 1 {
+		t.Fatalf("expected 1 machine, got %d (%v)", len(machines), err)
+	}
+
+	// written behind the back of the datasource, so it's not seen until the
+	// cache is invalidated
+	kapi.Set(context.Background(), ds.prefixify("machines/node001122334402"), "", &etcd.SetOptions{Dir: true})
+	if machines, _ := ds.Machines(); len(machines) != 1 {
+		t.Errorf("expected the cached list, got %d machines", len(machines))
+	}
+
+	third, _ := net.ParseMAC("00:11:22:33:44:03")
+	if _, created := ds.CreateMachine(third, net.IPv4(10, 0, 0, 12)); !created {
+		t.Fatal("machine wasn't created")
+	}
+	if machines, _ := ds.Machines(); len(machines) != 3 {
+		t.Errorf("expected CreateMachine to invalidate the cache, got %d machines", len(machines))
+	}
+}
+
+func TestMachinesSkipsBrokenEntries(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:02")
+	ds.CreateMachine(mac1, net.IPv4(10, 0, 0, 10))
+	ds.CreateMachine(mac2, net.IPv4(10, 0, 0, 11))
+	kapi.Set(context.Background(), ds.prefixify("machines/nodebroken"), "", &etcd.SetOptions{Dir: true})
+	kapi.Set(context.Background(), ds.prefixify("machines/node001122334403"), "not a dir", nil)
+
+	machines, err := ds.Machines()
+	if err != nil {
+		t.Fatalf("Machines: %s", err)
+	}
+	if len(machines) != 2 {
+		t.Errorf("expected the 2 good machines, got %d", len(machines))
+	}
+
+	ds.SetStrictMachines(true)
+	if _, err := ds.Machines(); err == nil {
+		t.Error("expected an error for the broken entries in strict mode")
+	}
+}
+
+func TestExpireLease(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	nic := "00:11:22:33:44:01"
+	mac, _ := net.ParseMAC(nic)
+
+	leased, _ := ds.Assign(nic)
+	machine, _ := ds.GetMachine(mac)
+	machine.SetFlag("role", "worker")
+
+	ip, err := ds.ExpireLease(mac)
+	if err != nil || !ip.Equal(leased) {
+		t.Fatalf("expected %s to be freed: %s (%v)", leased, ip, err)
+	}
+	if ip, err := machine.IP(); ip != nil || err != nil {
+		t.Errorf("expected the machine to have no ip, got %s (%v)", ip, err)
+	}
+	if role, _ := machine.GetFlag("role"); role != "worker" {
+		t.Errorf("expected the flags to be kept, got role=%q", role)
+	}
+	if _, err := ds.ExpireLease(mac); err != ErrNoLease {
+		t.Errorf("expected ErrNoLease, got %v", err)
+	}
+	if ip, err := leasedIP(machine); ip != nil || !errors.Is(err, ErrNoLease) {
+		t.Errorf("expected leasedIP to return ErrNoLease, got %s (%v)", ip, err)
+	}
+
+	if ip, _ := ds.Assign("00:11:22:33:44:02"); !ip.Equal(leased) {
+		t.Errorf("expected the freed ip to be assigned to another nic, got %s", ip)
+	}
+	fresh, err := ds.Assign(nic)
+	if err != nil || fresh == nil || fresh.Equal(leased) {
+		t.Fatalf("expected a fresh ip: %s (%v)", fresh, err)
+	}
+	if ip, _ := machine.IP(); !ip.Equal(fresh) {
+		t.Errorf("expected the machine to get %s, got %s", fresh, ip)
+	}
+}
+
+func TestGetMachineByIP(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	nic := "00:11:22:33:44:01"
+
+	leased, _ := ds.Assign(nic)
+	machine, exists := ds.GetMachineByIP(leased)
+	if !exists || machine.Mac().String() != nic {
+		t.Fatalf("expected the machine of %s, got %v", nic, machine)
+	}
+	if _, exists := ds.GetMachineByIP(net.IPv4(10, 0, 0, 200)); exists {
+		t.Error("expected no machine for an unleased ip")
+	}
+
+	mac, _ := net.ParseMAC(nic)
+	ds.ExpireLease(mac)
+	if _, exists := ds.GetMachineByIP(leased); exists {
+		t.Error("expected no machine for an expired lease")
+	}
+}
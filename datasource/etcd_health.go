@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const endpointProbeTimeout = 2 * time.Second
+
+// EtcdEndpointHealth is the result of probing one of the etcd endpoints
+type EtcdEndpointHealth struct {
+	Endpoint  string `json:"endpoint"`
+	Healthy   bool   `json:"healthy"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+func probeEtcdEndpoint(client *http.Client, endpoint string) EtcdEndpointHealth {
+	start := time.Now()
+	resp, err := client.Get(strings.TrimRight(endpoint, "/") + "/health")
+	health := EtcdEndpointHealth{
+		Endpoint:  endpoint,
+		LatencyMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		return health
+	}
+	resp.Body.Close()
+	health.Healthy = resp.StatusCode == http.StatusOK
+	return health
+}
+
+// EtcdEndpoints probes the configured etcd endpoints concurrently and returns
+// their health and latency
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) EtcdEndpoints() []EtcdEndpointHealth {
+	endpoints := ds.client.Endpoints()
+	client := &http.Client{Timeout: endpointProbeTimeout}
+
+	ret := make([]EtcdEndpointHealth, len(endpoints))
+	var wg sync.WaitGroup
+	for i := range endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ret[i] = probeEtcdEndpoint(client, endpoints[i])
+		}(i)
+	}
+	wg.Wait()
+	return ret
+}
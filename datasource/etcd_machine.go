@@ -3,6 +3,7 @@ package datasource
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"path"
 	"strconv"
@@ -13,12 +14,27 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Internal keys of a machine entry. These can't be altered using SetFlag
+const (
+	ipKey        = "_IP"
+	macKey       = "_mac"
+	firstSeenKey = "_first_seen"
+	lastSeenKey  = "_last_seen"
+	noteKey      = "_note"
+)
+
+// MaxNoteLength is the maximum length of the note of a machine, in bytes
+const MaxNoteLength = 1024
+
 // EtcdMachine implements datasource.Machine interface using etcd as it's
 // datasource
 type EtcdMachine struct {
 	mac     net.HardwareAddr
 	etcd    DataSource
 	keysAPI etcd.KeysAPI
+	// dir is the directory of the machine under the cluster prefix, in the
+	// layout of the machine sharding
+	dir string
 }
 
 // Mac Returns this machine's hardware address
@@ -27,11 +43,14 @@ func (m *EtcdMachine) Mac() net.HardwareAddr {
 	return m.mac
 }
 
-// IP Returns this machine's IP
+// IP Returns this machine's IP, or nil if its lease has been expired
 // queries etcd
 // part of Machine interface implementation
 func (m *EtcdMachine) IP() (net.IP, error) {
-	ipstring, err := m.selfGet("_IP")
+	ipstring, err := m.selfGet(ipKey)
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -63,16 +82,16 @@ func timeError(err error) (time.Time, error) {
 }
 
 // CheckIn updates the _last_seen entry of this machine in etcd
-// part of EtcdMachine interface implementation
-func (m *EtcdMachine) CheckIn() {
-	m.selfSet("_last_seen", strconv.FormatInt(time.Now().UnixNano(), 10))
+// part of Machine interface implementation
+func (m *EtcdMachine) CheckIn() error {
+	return m.selfSet(lastSeenKey, strconv.FormatInt(time.Now().UnixNano(), 10))
 }
 
 // FirstSeen returns the time upon which that the machine has been first seen
 // queries etcd
 // part of Machine interface implementaiton
 func (m *EtcdMachine) FirstSeen() (time.Time, error) {
-	unixNanoString, err := m.selfGet("_first_seen")
+	unixNanoString, err := m.selfGet(firstSeenKey)
 	if err != nil {
 		return timeError(err)
 	}
@@ -82,41 +101,122 @@ func (m *EtcdMachine) FirstSeen() (time.Time, error) {
 // LastSeen returns the last time the machine has  been ???
 // part of Machine interface implementation
 func (m *EtcdMachine) LastSeen() (time.Time, error) {
-	unixNanoString, err := m.selfGet("_last_seen")
+	unixNanoString, err := m.selfGet(lastSeenKey)
 	if err != nil {
 		return timeError(err)
 	}
 	return unixNanoStringToTime(unixNanoString)
 }
 
+// Note returns the note of this machine, which is empty if it hasn't been set
+// part of Machine interface implementation
+func (m *EtcdMachine) Note() (string, error) {
+	note, err := m.selfGet(noteKey)
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return "", nil
+	}
+	return note, err
+}
+
+// SetNote sets the note of this machine
+// part of Machine interface implementation
+func (m *EtcdMachine) SetNote(note string) error {
+	if len(note) > MaxNoteLength {
+		return fmt.Errorf("note is longer than %d bytes", MaxNoteLength)
+	}
+	return m.selfSet(noteKey, note)
+}
+
 // ListFlags returns the list of all the flgas of a machine from Etcd
-// etcd and machine prefix will be added to the path
+// etcd and machine prefix will be added to the path. The directories, like
+// the flag history, aren't flags and are skipped
 // part of Machine interface implementation
 func (m *EtcdMachine) ListFlags() (map[string]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	response, err := m.keysAPI.Get(ctx, path.Join(m.etcd.ClusterName(), "machines", m.Name()), nil)
+	response, err := m.keysAPI.Get(ctx, path.Join(m.etcd.ClusterName(), m.dir), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	flags := make(map[string]string)
 	for i := range response.Node.Nodes {
+		if response.Node.Nodes[i].Dir {
+			continue
+		}
 		_, k := path.Split(response.Node.Nodes[i].Key)
 		flags[k] = response.Node.Nodes[i].Value
 	}
 
-	return flags, nil
+	return RedactCredentials(flags), nil
+}
+
+// FlagsRevision returns the highest modified index among the flags of the
+// machine, along with their number, so deleting a flag changes it too. etcd
+// leaves the internal keys, like the IP and the last seen time, out of the
+// listing, so they don't change it
+// part of Machine interface implementation
+func (m *EtcdMachine) FlagsRevision() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := m.keysAPI.Get(ctx, path.Join(m.etcd.ClusterName(), m.dir), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var maxIndex uint64
+	count := 0
+	for _, node := range response.Node.Nodes {
+		if node.ModifiedIndex > maxIndex {
+			maxIndex = node.ModifiedIndex
+		}
+		count++
+	}
+	return fmt.Sprintf("%d-%d", maxIndex, count), nil
 }
 
 // GetFlag Gets a machine's flag from Etcd
 // etcd and machine prefix will be added to the path
 // part of Machine interface implementation
 func (m *EtcdMachine) GetFlag(key string) (string, error) {
+	if IsCredentialFlag(key) {
+		return "", fmt.Errorf("%w: %s", ErrFlagNotFound, key)
+	}
 	return m.selfGet(key)
 }
 
+// GetIntFlag gets a machine's flag from Etcd, parsed as an integer
+// part of Machine interface implementation
+func (m *EtcdMachine) GetIntFlag(key string) (int, error) {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return 0, err
+	}
+	return ParseIntFlag(key, value)
+}
+
+// GetBoolFlag gets a machine's flag from Etcd, parsed as a boolean
+// part of Machine interface implementation
+func (m *EtcdMachine) GetBoolFlag(key string) (bool, error) {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return false, err
+	}
+	return ParseBoolFlag(key, value)
+}
+
+// GetJSONFlag gets a machine's flag from Etcd, and unmarshals it into out
+// part of Machine interface implementation
+func (m *EtcdMachine) GetJSONFlag(key string, out interface{}) error {
+	value, err := m.GetFlag(key)
+	if err != nil {
+		return err
+	}
+	return ParseJSONFlag(key, value, out)
+}
+
 // SetFlag Sets a machin'es flag in Etcd
 // etcd and machine prefix will be added to the PathPrefix
 // part of Machine interface implementation
@@ -124,13 +224,42 @@ func (m *EtcdMachine) SetFlag(key, value string) error {
 	if len(key) > 0 && key[0] == '_' {
 		return errors.New("NotPermitted")
 	}
-	return m.selfSet(key, value)
+	if err := m.selfSet(key, value); err != nil {
+		return err
+	}
+	m.recordFlagHistory(key, FlagHistoryEntry{Time: time.Now(), Value: value})
+	return nil
+}
+
+// CreateFlag sets a machine's flag in Etcd only if it doesn't exist, so of
+// the concurrent calls only one sets it
+// part of Machine interface implementation
+func (m *EtcdMachine) CreateFlag(key, value string) (bool, error) {
+	if len(key) > 0 && key[0] == '_' {
+		return false, errors.New("NotPermitted")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.keysAPI.Set(ctx, path.Join(m.etcd.ClusterName(), m.prefixify(key)), value,
+		&etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeNodeExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	m.recordFlagHistory(key, FlagHistoryEntry{Time: time.Now(), Value: value})
+	return true, nil
 }
 
 // GetAndDeleteFlag doesn't do an awful lot of magic.
 // just combines GetFlag and DeleteFlag operations
 // part of Machine interface implementation
 func (m *EtcdMachine) GetAndDeleteFlag(key string) (string, error) {
+	if IsReservedFlag(key) {
+		return "", fmt.Errorf("%w: %s", ErrReservedFlag, key)
+	}
 	val, err := m.GetFlag(key)
 	if err != nil {
 		return "", err
@@ -142,11 +271,25 @@ func (m *EtcdMachine) GetAndDeleteFlag(key string) (string, error) {
 // DeleteFlag deletes the record associated with key from Etcd
 // part of Machine interface implementation
 func (m *EtcdMachine) DeleteFlag(key string) error {
-	return m.selfDelete(key)
+	if IsReservedFlag(key) {
+		return fmt.Errorf("%w: %s", ErrReservedFlag, key)
+	}
+	return m.ForceDeleteFlag(key)
+}
+
+// ForceDeleteFlag deletes the record associated with key from Etcd, even if
+// it's one of the internal keys
+// part of Machine interface implementation
+func (m *EtcdMachine) ForceDeleteFlag(key string) error {
+	if err := m.selfDelete(key); err != nil {
+		return err
+	}
+	m.recordFlagHistory(key, FlagHistoryEntry{Time: time.Now(), Deleted: true})
+	return nil
 }
 
 func (m *EtcdMachine) prefixify(str string) string {
-	return "machines/" + m.Name() + "/" + str
+	return m.dir + "/" + str
 }
 
 func (m *EtcdMachine) selfGet(key string) (string, error) {
@@ -165,22 +308,54 @@ func nameFromMac(mac string) string {
 	return strings.Replace("node"+mac, ":", "", -1)
 }
 
-func macFromName(name string) string {
+// ParseMachineName returns the hardware address of a machine name, like
+// node001122334455, or its fqdn, like node001122334455.cluster
+func ParseMachineName(name string) (net.HardwareAddr, error) {
+	mac, err := macFromName(name)
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseMAC(mac)
+}
+
+// macFromName returns the coloned mac address of a machine name, like
+// node001122334455
+func macFromName(name string) (string, error) {
 	name = strings.Split(name, ".")[0]
+	if !strings.HasPrefix(name, "node") {
+		return "", fmt.Errorf("invalid machine name: %q", name)
+	}
 	return colonLessMacToMac(name[len("node"):])
 }
 
-func colonLessMacToMac(colonLess string) string {
-	coloned := colonLess
-	if strings.Index(colonLess, ":") == -1 {
-		var tmpmac bytes.Buffer
-		for i := 0; i < 12; i++ { // colon-less mac address length
-			tmpmac.WriteString(colonLess[i : i+1])
-			if i%2 == 1 {
-				tmpmac.WriteString(":")
-			}
+// colonLessMacToMac adds the colons to a mac address like 001122334455.
+// Addresses which have colons already are returned as they are
+func colonLessMacToMac(colonLess string) (string, error) {
+	if strings.Index(colonLess, ":") != -1 {
+		return colonLess, nil
+	}
+	if len(colonLess) != 12 { // colon-less mac address length
+		return "", fmt.Errorf("invalid colon-less mac address: %q", colonLess)
+	}
+	var tmpmac bytes.Buffer
+	for i := 0; i < 12; i++ {
+		tmpmac.WriteString(colonLess[i : i+1])
+		if i%2 == 1 && i != 11 {
+			tmpmac.WriteString(":")
 		}
-		coloned = tmpmac.String()[:len(tmpmac.String())-1]
 	}
-	return coloned
+	return tmpmac.String(), nil
+}
+
+// parseNIC parses the hardware address of a lease, which must be a 6 byte
+// ethernet address, since the machines are named after it
+func parseNIC(nic string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(nic)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid mac address length %d: %s", len(mac), nic)
+	}
+	return mac, nil
 }
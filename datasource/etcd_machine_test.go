@@ -0,0 +1,279 @@
+package datasource
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMachineSeenRoundTrip(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	before := time.Now()
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	first, err := machine.FirstSeen()
+	if err != nil {
+		t.Fatalf("FirstSeen: %s", err)
+	}
+	last, err := machine.LastSeen()
+	if err != nil {
+		t.Fatalf("LastSeen: %s", err)
+	}
+	if first.Before(before) || last.Before(first) {
+		t.Errorf("unexpected times: before=%s first=%s last=%s", before, first, last)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := machine.CheckIn(); err != nil {
+		t.Fatalf("CheckIn: %s", err)
+	}
+
+	checkedIn, err := machine.LastSeen()
+	if err != nil {
+		t.Fatalf("LastSeen after CheckIn: %s", err)
+	}
+	if !checkedIn.After(last) {
+		t.Errorf("CheckIn didn't update the last seen time: %s <= %s", checkedIn, last)
+	}
+	if again, _ := machine.FirstSeen(); !again.Equal(first) {
+		t.Errorf("CheckIn changed the first seen time: %s != %s", again, first)
+	}
+}
+
+func TestMachineDomain(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	if machine.Domain() != ds.ClusterName() {
+		t.Errorf("expected domain %q, got %q", ds.ClusterName(), machine.Domain())
+	}
+	if machine.Name() != "node001122334455" {
+		t.Errorf("unexpected name: %q", machine.Name())
+	}
+}
+
+func TestMachineNote(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	if note, err := machine.Note(); err != nil || note != "" {
+		t.Errorf("expected an empty note, got %q (%v)", note, err)
+	}
+	if err := machine.SetNote("flaky PSU"); err != nil {
+		t.Fatalf("SetNote: %s", err)
+	}
+	if note, err := machine.Note(); err != nil || note != "flaky PSU" {
+		t.Errorf("unexpected note: %q (%v)", note, err)
+	}
+	if err := machine.SetNote(strings.Repeat("x", MaxNoteLength+1)); err == nil {
+		t.Error("expected an error for a note longer than MaxNoteLength")
+	}
+	if err := machine.SetFlag(noteKey, "nope"); err == nil {
+		t.Error("expected the note not to be settable as a flag")
+	}
+}
+
+func TestMachineBMC(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	if bmc, err := machine.BMC(); err != nil || bmc != (BMCCredentials{}) {
+		t.Errorf("expected no bmc, got %+v (%v)", bmc, err)
+	}
+	bmc := BMCCredentials{Address: "10.0.1.10", User: "admin", Password: "secret"}
+	if err := machine.SetBMC(bmc); err != nil {
+		t.Fatalf("SetBMC: %s", err)
+	}
+	if got, err := machine.BMC(); err != nil || got != bmc {
+		t.Errorf("unexpected bmc: %+v (%v)", got, err)
+	}
+
+	flags, err := machine.ListFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range flags {
+		if value == "secret" || IsCredentialFlag(key) {
+			t.Errorf("expected the credentials not to be listed, got %s=%s", key, value)
+		}
+	}
+	if _, err := machine.GetFlag(bmcPasswordKey); !IsFlagNotFound(err) {
+		t.Errorf("expected the password not to be readable as a flag, got %v", err)
+	}
+	if err := machine.SetFlag(bmcPasswordKey, "nope"); err == nil {
+		t.Error("expected the password not to be settable as a flag")
+	}
+
+	if err := machine.SetBMC(BMCCredentials{Address: "ftp://10.0.1.10"}); !errors.Is(err, ErrInvalidBMCAddress) {
+		t.Errorf("expected an invalid address error, got %v", err)
+	}
+	if got, _ := machine.BMC(); got != bmc {
+		t.Errorf("expected the bmc to be kept after an invalid address, got %+v", got)
+	}
+
+	if err := machine.SetBMC(BMCCredentials{}); err != nil {
+		t.Fatalf("SetBMC: %s", err)
+	}
+	if got, _ := machine.BMC(); got != (BMCCredentials{}) {
+		t.Errorf("expected the bmc to be removed, got %+v", got)
+	}
+}
+
+func TestMachineCreateFlag(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	if created, err := machine.CreateFlag("token", "first"); err != nil || !created {
+		t.Fatalf("expected the flag to be created, got %v (%v)", created, err)
+	}
+	if created, err := machine.CreateFlag("token", "second"); err != nil || created {
+		t.Errorf("expected the existing flag to be kept, got %v (%v)", created, err)
+	}
+	if value, _ := machine.GetFlag("token"); value != "first" {
+		t.Errorf("expected the first value, got %q", value)
+	}
+	if _, err := machine.CreateFlag(noteKey, "nope"); err == nil {
+		t.Error("expected the internal keys not to be creatable")
+	}
+}
+
+func TestMachineTypedFlags(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	machine, created := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	machine.SetFlag("disks", "3")
+	machine.SetFlag("ssd", "true")
+	machine.SetFlag("labels", `{"rack": "a1"}`)
+	if disks, err := machine.GetIntFlag("disks"); err != nil || disks != 3 {
+		t.Errorf("unexpected int flag: %d (%v)", disks, err)
+	}
+	if ssd, err := machine.GetBoolFlag("ssd"); err != nil || !ssd {
+		t.Errorf("unexpected bool flag: %v (%v)", ssd, err)
+	}
+	var labels map[string]string
+	if err := machine.GetJSONFlag("labels", &labels); err != nil || labels["rack"] != "a1" {
+		t.Errorf("unexpected json flag: %v (%v)", labels, err)
+	}
+
+	machine.SetFlag("disks", "three")
+	machine.SetFlag("ssd", "yes")
+	machine.SetFlag("labels", `{"rack":`)
+	if _, err := machine.GetIntFlag("disks"); err == nil {
+		t.Error("expected an error for a malformed int flag")
+	}
+	if _, err := machine.GetBoolFlag("ssd"); err == nil {
+		t.Error("expected an error for a malformed bool flag")
+	}
+	if err := machine.GetJSONFlag("labels", &labels); err == nil {
+		t.Error("expected an error for a malformed json flag")
+	}
+	if _, err := machine.GetIntFlag("missing"); err == nil {
+		t.Error("expected an error for a missing flag")
+	}
+}
+
+func TestMachineDeleteReservedFlag(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	for _, key := range []string{ipKey, macKey, firstSeenKey, lastSeenKey} {
+		if err := machine.DeleteFlag(key); !errors.Is(err, ErrReservedFlag) {
+			t.Errorf("DeleteFlag(%s): expected ErrReservedFlag, got %v", key, err)
+		}
+		if _, err := machine.GetAndDeleteFlag(key); !errors.Is(err, ErrReservedFlag) {
+			t.Errorf("GetAndDeleteFlag(%s): expected ErrReservedFlag, got %v", key, err)
+		}
+	}
+	if _, err := machine.FirstSeen(); err != nil {
+		t.Fatalf("the reserved flag was deleted: %s", err)
+	}
+
+	if err := machine.ForceDeleteFlag(firstSeenKey); err != nil {
+		t.Fatalf("ForceDeleteFlag: %s", err)
+	}
+	if _, err := machine.GetFlag(firstSeenKey); !IsFlagNotFound(err) {
+		t.Errorf("expected the flag to be deleted with force, got %v", err)
+	}
+}
+
+func TestMachineRecordBoot(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	if count, last, err := machine.Boots(); err != nil || count != 0 || !last.IsZero() {
+		t.Fatalf("expected no boots, got %d %s %v", count, last, err)
+	}
+	revision, _ := machine.FlagsRevision()
+
+	// fewer than maxBootCountRetries, so each of them succeeds eventually
+	const boots = 8
+	var wg sync.WaitGroup
+	for i := 0; i < boots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := machine.RecordBoot(); err != nil {
+				t.Errorf("RecordBoot: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, last, err := machine.Boots()
+	if err != nil || count != boots || last.IsZero() {
+		t.Errorf("expected %d boots, got %d %s %v", boots, count, last, err)
+	}
+	if newRevision, _ := machine.FlagsRevision(); newRevision != revision {
+		t.Errorf("booting changed the flags revision: %s -> %s", revision, newRevision)
+	}
+}
+
+func TestColonLessMacToMac(t *testing.T) {
+	mac, err := colonLessMacToMac("001122334455")
+	if err != nil || mac != "00:11:22:33:44:55" {
+		t.Errorf("expected 00:11:22:33:44:55, got %q (%v)", mac, err)
+	}
+	for _, colonLess := range []string{"", "0011223344", "00112233445566"} {
+		if _, err := colonLessMacToMac(colonLess); err == nil {
+			t.Errorf("expected an error for %q", colonLess)
+		}
+	}
+	if _, err := macFromName("node"); err == nil {
+		t.Error("expected an error for a machine name without a mac address")
+	}
+}
@@ -0,0 +1,101 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// ExportedNode is the JSON representation of an etcd node, as produced by
+// ExportTree. Keys are relative to the exported prefix, so that the tree can
+// be imported under another prefix as well
+type ExportedNode struct {
+	Key   string          `json:"key"`
+	Dir   bool            `json:"dir,omitempty"`
+	Value string          `json:"value,omitempty"`
+	TTL   int64           `json:"ttl,omitempty"`
+	Nodes []*ExportedNode `json:"nodes,omitempty"`
+}
+
+func exportNode(node *etcd.Node, prefix string) *ExportedNode {
+	exported := &ExportedNode{
+		Key:   path.Join("/", strings.TrimPrefix(node.Key, prefix)),
+		Dir:   node.Dir,
+		Value: node.Value,
+		TTL:   node.TTL,
+	}
+	for _, child := range node.Nodes {
+		exported.Nodes = append(exported.Nodes, exportNode(child, prefix))
+	}
+	return exported
+}
+
+// ExportTree recursively reads all the keys under prefix, including the
+// hidden keys of the machines, like their IPs, which the listings leave out
+func ExportTree(kapi etcd.KeysAPI, prefix string) (*ExportedNode, error) {
+	prefix = path.Join("/", prefix)
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := kapi.Get(ctx, prefix, &etcd.GetOptions{Recursive: true, Sort: true, Quorum: true})
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading %s: %s", prefix, err)
+	}
+	if err := addHiddenKeys(kapi, response.Node); err != nil {
+		return nil, err
+	}
+	return exportNode(response.Node, prefix), nil
+}
+
+type treeImport struct {
+	keysAPI etcd.KeysAPI
+	prefix  string
+	force   bool
+}
+
+func (i *treeImport) importNode(node *ExportedNode) error {
+	key := path.Join(i.prefix, node.Key)
+	if node.Dir {
+		if len(node.Nodes) == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+			defer cancel()
+			_, err := i.keysAPI.Set(ctx, key, "", &etcd.SetOptions{Dir: true, PrevExist: etcd.PrevNoExist})
+			if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeNodeExist {
+				return nil
+			}
+			return err
+		}
+		for _, child := range node.Nodes {
+			if err := i.importNode(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	options := &etcd.SetOptions{TTL: time.Duration(node.TTL) * time.Second}
+	if !i.force {
+		options.PrevExist = etcd.PrevNoExist
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	if _, err := i.keysAPI.Set(ctx, key, node.Value, options); err != nil {
+		return fmt.Errorf("Error while writing %s: %s", key, err)
+	}
+	return nil
+}
+
+// ImportTree writes a tree produced by ExportTree under prefix. Unless force
+// is set, it stops at the first key which already exists
+func ImportTree(kapi etcd.KeysAPI, tree *ExportedNode, prefix string, force bool) error {
+	i := &treeImport{
+		keysAPI: kapi,
+		prefix:  path.Join("/", prefix),
+		force:   force,
+	}
+	return i.importNode(tree)
+}
@@ -0,0 +1,50 @@
+package datasource
+
+import (
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestExportImportTree(t *testing.T) {
+	kapi := newFakeKeysAPI()
+	ctx := context.Background()
+	kapi.Set(ctx, "/old/coreos-version", "1000.0.0", nil)
+	kapi.Set(ctx, "/old/machines/node001122334401/_IP", "10.0.0.10", nil)
+	kapi.Set(ctx, "/old/machines/node001122334401/_history/role/00000000000000000001", `{"value":"worker"}`, nil)
+	kapi.Set(ctx, "/old/empty", "", &etcd.SetOptions{Dir: true})
+
+	tree, err := ExportTree(kapi, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportTree(kapi, tree, "new", false); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{
+		"/new/coreos-version":                                               "1000.0.0",
+		"/new/machines/node001122334401/_IP":                                "10.0.0.10",
+		"/new/machines/node001122334401/_history/role/00000000000000000001": `{"value":"worker"}`,
+	} {
+		response, err := kapi.Get(ctx, key, nil)
+		if err != nil || response.Node.Value != value {
+			t.Errorf("expected %s=%q, got %v (%v)", key, value, response, err)
+		}
+	}
+	if response, err := kapi.Get(ctx, "/new/empty", nil); err != nil || !response.Node.Dir {
+		t.Errorf("expected the empty directory to be imported: %v", err)
+	}
+
+	kapi.Set(ctx, "/new/coreos-version", "1001.0.0", nil)
+	if err := ImportTree(kapi, tree, "new", false); err == nil {
+		t.Error("expected an error when importing over existing keys without force")
+	}
+	if err := ImportTree(kapi, tree, "new", true); err != nil {
+		t.Fatal(err)
+	}
+	if response, _ := kapi.Get(ctx, "/new/coreos-version", nil); response.Node.Value != "1000.0.0" {
+		t.Errorf("expected the key to be overwritten, got %q", response.Node.Value)
+	}
+}
@@ -0,0 +1,107 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// historyKey is the directory of the flag histories of a machine, like
+// _history/<flag>/<timestamp>
+const historyKey = "_history"
+
+// FlagHistoryEntry is a value a flag of a machine has had
+type FlagHistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Value   string    `json:"value"`
+	Deleted bool      `json:"deleted"`
+}
+
+// SetFlagHistory makes the machines keep the last limit values of each of
+// their flags, for FlagHistory. Zero, the default, disables the history
+func (ds *EtcdDataSource) SetFlagHistory(limit int) {
+	ds.flagHistory = limit
+}
+
+// flagHistoryLimit returns the number of the values kept per flag
+func (m *EtcdMachine) flagHistoryLimit() int {
+	if ds, ok := m.etcd.(*EtcdDataSource); ok {
+		return ds.flagHistory
+	}
+	return 0
+}
+
+func (m *EtcdMachine) historyDir(key string) string {
+	return path.Join(m.etcd.ClusterName(), m.prefixify(historyKey), key)
+}
+
+// recordFlagHistory appends the change of the flag to its history, and drops
+// the values beyond the limit. It's best-effort: a failure is only logged,
+// so that it never fails the change itself
+func (m *EtcdMachine) recordFlagHistory(key string, entry FlagHistoryEntry) {
+	limit := m.flagHistoryLimit()
+	if limit <= 0 || strings.Contains(key, "/") {
+		return
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	dir := m.historyDir(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// zero-padded, so that the keys are sorted the same as the times
+	_, err = m.keysAPI.Create(ctx, fmt.Sprintf("%s/%020d", dir, entry.Time.UnixNano()), string(value))
+	if err != nil {
+		logging.Log(debugTag, "Error while recording the history of flag key=%s for mac=%s: %s",
+			key, m.mac, err)
+		return
+	}
+
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel1()
+	response, err := m.keysAPI.Get(ctx1, dir, &etcd.GetOptions{Sort: true})
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(response.Node.Nodes)-limit; i++ {
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
+		m.keysAPI.Delete(ctx2, response.Node.Nodes[i].Key, nil)
+		cancel2()
+	}
+}
+
+// FlagHistory returns the recorded values of the flag in chronological
+// order, which is empty if the history is disabled
+// part of Machine interface implementation
+func (m *EtcdMachine) FlagHistory(key string) ([]FlagHistoryEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ret := make([]FlagHistoryEntry, 0)
+	response, err := m.keysAPI.Get(ctx, m.historyDir(key),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcdError, ok := err.(etcd.Error); ok && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+			return ret, nil
+		}
+		return nil, err
+	}
+	for _, node := range response.Node.Nodes {
+		var entry FlagHistoryEntry
+		if err := json.Unmarshal([]byte(node.Value), &entry); err != nil {
+			return nil, fmt.Errorf("Error while reading flag history entry %s: %s", node.Key, err)
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
@@ -0,0 +1,54 @@
+package datasource
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestFlagHistory(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	machine.SetFlag("role", "worker")
+	if history, err := machine.FlagHistory("role"); err != nil || len(history) != 0 {
+		t.Fatalf("expected no history while it's disabled, got %v (%v)", history, err)
+	}
+
+	ds.SetFlagHistory(3)
+	revision, _ := machine.FlagsRevision()
+	for i := 0; i < 4; i++ {
+		if err := machine.SetFlag("role", "v"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := machine.DeleteFlag("role"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := machine.FlagHistory("role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected the last 3 values, got %+v", history)
+	}
+	if history[0].Value != "v2" || history[1].Value != "v3" || !history[2].Deleted {
+		t.Errorf("unexpected history: %+v", history)
+	}
+	if history[1].Time.Before(history[0].Time) {
+		t.Errorf("the history isn't in chronological order: %+v", history)
+	}
+
+	flags, _ := machine.ListFlags()
+	if _, exists := flags["role"]; exists {
+		t.Error("the flag still exists after DeleteFlag")
+	}
+	if _, exists := flags[historyKey]; exists {
+		t.Error("expected the history not to be listed as a flag")
+	}
+	if again, _ := machine.FlagsRevision(); again == revision {
+		t.Error("expected the changes of the flag to change the revision")
+	}
+}
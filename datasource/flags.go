@@ -0,0 +1,61 @@
+package datasource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// ErrFlagNotFound is wrapped by the errors of the machines which don't keep
+// their flags in etcd, when the flag isn't set
+var ErrFlagNotFound = errors.New("flag not found")
+
+// ErrReservedFlag is returned by DeleteFlag for the internal keys of the
+// machines, like _IP and _mac, which the machine records depend on
+var ErrReservedFlag = errors.New("flag is reserved for the internals of the machine")
+
+// IsReservedFlag reports whether the key is an internal key of the machines,
+// which all start with an underscore, e.g. _IP, _mac, _first_seen and
+// _last_seen
+func IsReservedFlag(key string) bool {
+	return len(key) > 0 && key[0] == '_'
+}
+
+// IsFlagNotFound reports whether the error of GetFlag means the flag isn't
+// set, rather than a failure to read it
+func IsFlagNotFound(err error) bool {
+	if etcdError, found := err.(etcd.Error); found {
+		return etcdError.Code == etcd.ErrorCodeKeyNotFound
+	}
+	return errors.Is(err, ErrFlagNotFound)
+}
+
+// ParseIntFlag parses the value of the flag as an integer
+func ParseIntFlag(key, value string) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("flag %s isn't an integer: %q", key, value)
+	}
+	return i, nil
+}
+
+// ParseBoolFlag parses the value of the flag as a boolean, accepting the
+// values of strconv.ParseBool like true, false, 1 and 0
+func ParseBoolFlag(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("flag %s isn't a boolean: %q", key, value)
+	}
+	return b, nil
+}
+
+// ParseJSONFlag unmarshals the value of the flag into out
+func ParseJSONFlag(key, value string, out interface{}) error {
+	if err := json.Unmarshal([]byte(value), out); err != nil {
+		return fmt.Errorf("flag %s isn't valid json: %s", key, err)
+	}
+	return nil
+}
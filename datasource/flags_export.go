@@ -0,0 +1,65 @@
+package datasource
+
+import (
+	"fmt"
+	"net"
+)
+
+// ExportMachineFlags returns all the flags of the machine with the hardware
+// address, including the reserved ones, for ExportFlags
+func ExportMachineFlags(ds DataSource, mac net.HardwareAddr) (map[string]string, error) {
+	machine, exist := ds.GetMachine(mac)
+	if !exist {
+		return nil, fmt.Errorf("%w: %s", ErrMachineNotFound, mac)
+	}
+	return machine.ListFlags()
+}
+
+// ImportMachineFlags sets the flags on the machine with the hardware address,
+// for ImportFlags. The reserved flags are skipped, since they belong to the
+// machine they were exported from, and so are the flags the machine has
+// already unless overwrite is set. Each change is audited
+func ImportMachineFlags(ds DataSource, mac net.HardwareAddr, flags map[string]string, overwrite bool) error {
+	machine, exist := ds.GetMachine(mac)
+	if !exist {
+		return fmt.Errorf("%w: %s", ErrMachineNotFound, mac)
+	}
+	for key, value := range flags {
+		if IsReservedFlag(key) {
+			continue
+		}
+		old, err := machine.GetFlag(key)
+		if err != nil && !IsFlagNotFound(err) {
+			return err
+		}
+		exists := err == nil
+		if exists && (!overwrite || old == value) {
+			continue
+		}
+		if err := machine.SetFlag(key, value); err != nil {
+			return fmt.Errorf("Error while importing flag %s: %s", key, err)
+		}
+		AuditFlagChange(ds, AuditEntry{
+			Mac:      mac.String(),
+			Key:      key,
+			OldValue: old,
+			NewValue: value,
+			Source:   "import",
+		})
+	}
+	return nil
+}
+
+// ExportFlags returns all the flags of the machine, including the reserved
+// ones
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) ExportFlags(mac net.HardwareAddr) (map[string]string, error) {
+	return ExportMachineFlags(ds, mac)
+}
+
+// ImportFlags sets the flags on the machine, skipping the reserved ones, and
+// the ones the machine has already unless overwrite is set
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) ImportFlags(mac net.HardwareAddr, flags map[string]string, overwrite bool) error {
+	return ImportMachineFlags(ds, mac, flags, overwrite)
+}
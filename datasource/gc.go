@@ -0,0 +1,36 @@
+package datasource
+
+import (
+	"sort"
+	"time"
+)
+
+// StaleMachine is a machine which hasn't been seen for a while
+type StaleMachine struct {
+	Machine  Machine
+	LastSeen time.Time
+}
+
+// StaleMachines returns the machines which haven't been seen since the
+// threshold, the least recently seen first. The machines whose last seen
+// time can't be read are left out, rather than collected by mistake
+func StaleMachines(ds DataSource, threshold time.Time) ([]StaleMachine, error) {
+	machines, err := ds.Machines()
+	if err != nil {
+		return nil, err
+	}
+	stale := make([]StaleMachine, 0)
+	for _, machine := range machines {
+		lastSeen, err := machine.LastSeen()
+		if err != nil {
+			continue
+		}
+		if lastSeen.Before(threshold) {
+			stale = append(stale, StaleMachine{machine, lastSeen})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].LastSeen.Before(stale[j].LastSeen)
+	})
+	return stale, nil
+}
@@ -0,0 +1,57 @@
+package datasource
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestStaleMachinesAndDeleteMachine(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+
+	oldMac, _ := net.ParseMAC("00:11:22:33:44:01")
+	freshMac, _ := net.ParseMAC("00:11:22:33:44:02")
+	old, _ := ds.CreateMachine(oldMac, net.IPv4(10, 0, 0, 10))
+	ds.CreateMachine(freshMac, net.IPv4(10, 0, 0, 11))
+	if _, _, err := ds.claimIP(net.IPv4(10, 0, 0, 10), oldMac.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	lastSeen := time.Now().Add(-1000 * time.Hour)
+	kapi.Set(context.Background(), ds.prefixify("machines/"+old.Name()+"/"+lastSeenKey),
+		strconv.FormatInt(lastSeen.UnixNano(), 10), nil)
+
+	stale, err := StaleMachines(ds, time.Now().Add(-720*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Machine.Mac().String() != oldMac.String() {
+		t.Fatalf("expected only %s to be stale, got %+v", oldMac, stale)
+	}
+	if !stale[0].LastSeen.Equal(time.Unix(0, lastSeen.UnixNano())) {
+		t.Errorf("unexpected last seen time: %s", stale[0].LastSeen)
+	}
+
+	if err := ds.DeleteMachine(oldMac); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := ds.GetMachine(oldMac); exists {
+		t.Error("the machine still exists after DeleteMachine")
+	}
+	machines, _ := ds.Machines()
+	if len(machines) != 1 {
+		t.Errorf("expected 1 machine to remain, got %d", len(machines))
+	}
+
+	// the freed IP is assignable again
+	if ip, err := ds.Assign("00:11:22:33:44:03"); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("expected the freed 10.0.0.10, got %s (%v)", ip, err)
+	}
+
+	if err := ds.DeleteMachine(oldMac); err == nil {
+		t.Error("expected an error deleting a missing machine")
+	}
+}
@@ -0,0 +1,61 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// hiddenMachineKeys are the internal keys of a machine entry. Their names
+// start with _, so etcd v2 leaves them out of the listings of the machine
+// directory, even the recursive ones, and they're only read by their exact
+// keys
+var hiddenMachineKeys = []string{
+	ipKey, macKey, firstSeenKey, lastSeenKey, noteKey,
+	bootCountKey, lastBootKey, historyKey,
+	bmcAddressKey, bmcUserKey, bmcPasswordKey,
+}
+
+// isMachineEntry reports whether the node is the directory of a machine,
+// like machines/node001122334455
+func isMachineEntry(node *etcd.Node) bool {
+	if !node.Dir {
+		return false
+	}
+	_, err := macFromName(path.Base(node.Key))
+	return err == nil
+}
+
+// addHiddenKeys reads the hidden keys of the machine entries in the tree,
+// which was read by a recursive get, by their exact keys and adds them to
+// the tree, so that the copies and the exports of the tree keep them
+func addHiddenKeys(kapi etcd.KeysAPI, node *etcd.Node) error {
+	if !node.Dir {
+		return nil
+	}
+	if !isMachineEntry(node) {
+		for _, child := range node.Nodes {
+			if err := addHiddenKeys(kapi, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range hiddenMachineKeys {
+		key := path.Join(node.Key, name)
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		response, err := kapi.Get(ctx, key, &etcd.GetOptions{Recursive: true, Sort: true, Quorum: true})
+		cancel()
+		if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error while reading %s: %s", key, err)
+		}
+		node.Nodes = append(node.Nodes, response.Node)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// validate checks the values of initial.yaml, whose content is data, and
+// returns the parsed excludes. The errors name the offending field, and its
+// line in data. The dhcp-options and dhcp-label-options are validated by the
+// dhcp package
+func (iVals *initialValues) validate(data []byte) ([]*net.IPNet, error) {
+	if iVals.CoreOSVersion == "" {
+		return nil, fieldError(data, "coreos-version", errors.New("A valid initial CoreOS version is required"))
+	}
+	if iVals.CoreOSVersion != filepath.Base(iVals.CoreOSVersion) {
+		return nil, fieldError(data, "coreos-version", fmt.Errorf("invalid CoreOS version: %q", iVals.CoreOSVersion))
+	}
+
+	excludes, err := parseExcludes(iVals.Excludes)
+	if err != nil {
+		return nil, fieldError(data, "excludes", err)
+	}
+	for i := range excludes {
+		for j := i + 1; j < len(excludes); j++ {
+			if excludes[i].Contains(excludes[j].IP) || excludes[j].Contains(excludes[i].IP) {
+				return nil, fieldError(data, "excludes", fmt.Errorf("%q overlaps %q", iVals.Excludes[j], iVals.Excludes[i]))
+			}
+		}
+	}
+	return excludes, nil
+}
+
+// fieldError prefixes the error with the field of initial.yaml, and the line
+// of the field in data if it's found
+func fieldError(data []byte, field string, err error) error {
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, field+":") {
+			return fmt.Errorf("line %d: %s: %s", i+1, field, err)
+		}
+	}
+	return fmt.Errorf("%s: %s", field, err)
+}
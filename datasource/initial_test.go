@@ -0,0 +1,34 @@
+package datasource
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadInitialValues(t *testing.T) {
+	dir := t.TempDir()
+	for content, expected := range map[string]string{
+		"coreos-version: 1000.0.0\nexcludes: [10.0.0.12, 10.0.0.16/30]\n": "",
+		"coreos-version: 1000.0.0\nexclude: [10.0.0.12]\n":                "line 2: field exclude not found",
+		"excludes: []\n":                                                     "coreos-version: A valid initial CoreOS version is required",
+		"coreos-version: ../1000.0.0\n":                                      "line 1: coreos-version: invalid CoreOS version",
+		"coreos-version: 1000.0.0\nexcludes: [10.0.0.300]\n":                 `line 2: excludes: invalid IP in excludes: "10.0.0.300"`,
+		"coreos-version: 1000.0.0\nexcludes:\n- 10.0.0.16/30\n- 10.0.0.17\n": `line 2: excludes: "10.0.0.17" overlaps "10.0.0.16/30"`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "initial.yaml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := readInitialValues(dir)
+		if expected == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %s", content, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", content, expected, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package datasource
+
+import (
+	"fmt"
+	"net"
+)
+
+// InventoryMachine is an entry of an inventory of machines whose hardware
+// addresses and IPs are known in advance
+type InventoryMachine struct {
+	Mac   string            `yaml:"mac"`
+	IP    string            `yaml:"ip"`
+	Flags map[string]string `yaml:"flags"`
+}
+
+// InventoryResult counts what ImportInventory has done with the machines
+type InventoryResult struct {
+	Created int
+	Updated int
+	Skipped int
+}
+
+// ImportInventory creates the machines of the inventory and sets their flags,
+// so that Assign hands out the pre-assigned IPs. Existing machines are
+// skipped, unless update is set, in which case only their flags are set.
+// The whole inventory is validated before any machine is created
+func ImportInventory(ds DataSource, inventory []InventoryMachine, update bool) (*InventoryResult, error) {
+	macs := make([]net.HardwareAddr, len(inventory))
+	ips := make([]net.IP, len(inventory))
+	for i, entry := range inventory {
+		mac, err := net.ParseMAC(entry.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac in entry #%d: %q", i+1, entry.Mac)
+		}
+		ip := net.ParseIP(entry.IP).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip in entry #%d: %q", i+1, entry.IP)
+		}
+		macs[i], ips[i] = mac, ip
+	}
+
+	result := &InventoryResult{}
+	for i, entry := range inventory {
+		machine, exists := ds.GetMachine(macs[i])
+		if exists && !update {
+			result.Skipped++
+			continue
+		}
+		if exists {
+			if ip, _ := machine.IP(); !ip.Equal(ips[i]) {
+				return result, fmt.Errorf("%s is already leased %s, not %s", macs[i], ip, ips[i])
+			}
+			result.Updated++
+		} else {
+			var created bool
+			machine, created = ds.CreateMachine(macs[i], ips[i])
+			if !created {
+				return result, fmt.Errorf("couldn't create %s with %s, the ip may be taken", macs[i], ips[i])
+			}
+			result.Created++
+		}
+
+		for key, value := range entry.Flags {
+			if err := machine.SetFlag(key, value); err != nil {
+				return result, fmt.Errorf("Error while setting flag %s of %s: %s", key, macs[i], err)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,45 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+)
+
+func TestImportInventory(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	inventory := []InventoryMachine{
+		{Mac: "00:11:22:33:44:01", IP: "10.0.0.11", Flags: map[string]string{"role": "master"}},
+		{Mac: "00:11:22:33:44:02", IP: "10.0.0.12"},
+	}
+
+	result, err := ImportInventory(ds, inventory, false)
+	if err != nil || result.Created != 2 {
+		t.Fatalf("unexpected result: %+v (%v)", result, err)
+	}
+	if ip, _ := ds.Assign("00:11:22:33:44:01"); !ip.Equal(net.IPv4(10, 0, 0, 11)) {
+		t.Errorf("expected the pre-assigned ip, got %s", ip)
+	}
+
+	inventory[0].Flags["role"] = "worker"
+	result, err = ImportInventory(ds, inventory, false)
+	if err != nil || result.Skipped != 2 {
+		t.Fatalf("unexpected result without update: %+v (%v)", result, err)
+	}
+	result, err = ImportInventory(ds, inventory, true)
+	if err != nil || result.Updated != 2 {
+		t.Fatalf("unexpected result with update: %+v (%v)", result, err)
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	machine, _ := ds.GetMachine(mac)
+	if role, _ := machine.GetFlag("role"); role != "worker" {
+		t.Errorf("expected the flag to be updated, got %q", role)
+	}
+
+	invalid := []InventoryMachine{{Mac: "00:11:22:33:44:03", IP: "10.0.0.13"}, {Mac: "nope", IP: "10.0.0.14"}}
+	if _, err := ImportInventory(ds, invalid, false); err == nil {
+		t.Error("expected an error for an invalid mac")
+	}
+	if _, exists := ds.GetMachine(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x03}); exists {
+		t.Error("expected nothing to be imported from an invalid inventory")
+	}
+}
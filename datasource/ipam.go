@@ -0,0 +1,164 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const ipamTimeout = 5 * time.Second
+
+// IPAMProvider allocates the addresses of the machines, in place of the lease
+// pool of blacksmith, e.g. to keep an external IPAM the source of truth
+type IPAMProvider interface {
+	// Allocate returns the address of the machine. It must return the same
+	// address for the machine until it's released
+	Allocate(mac net.HardwareAddr) (net.IP, error)
+	// Release takes the address back
+	Release(ip net.IP) error
+}
+
+// HTTPIPAM is an IPAMProvider backed by an HTTP service. Allocate posts
+// {"mac": "00:11:22:33:44:55"} to <URL>/allocate and expects
+// {"ip": "192.168.1.11"} in return, and Release posts {"ip": "192.168.1.11"}
+// to <URL>/release. Any non-2xx status is an error
+type HTTPIPAM struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPIPAM returns an HTTPIPAM for the service at url
+func NewHTTPIPAM(url string) *HTTPIPAM {
+	return &HTTPIPAM{
+		URL:    strings.TrimRight(url, "/"),
+		Client: &http.Client{Timeout: ipamTimeout},
+	}
+}
+
+type ipamMessage struct {
+	Mac string `json:"mac,omitempty"`
+	IP  string `json:"ip,omitempty"`
+}
+
+func (p *HTTPIPAM) post(endpoint string, message ipamMessage) (*ipamMessage, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Post(p.URL+"/"+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("ipam %s failed with status %s", endpoint, resp.Status)
+	}
+	var reply ipamMessage
+	if endpoint == "allocate" {
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			return nil, fmt.Errorf("invalid reply of ipam %s: %s", endpoint, err)
+		}
+	}
+	return &reply, nil
+}
+
+// Allocate asks the service for the address of the machine
+// part of IPAMProvider interface implementation
+func (p *HTTPIPAM) Allocate(mac net.HardwareAddr) (net.IP, error) {
+	reply, err := p.post("allocate", ipamMessage{Mac: mac.String()})
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(reply.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip allocated by the ipam for %s: %q", mac, reply.IP)
+	}
+	return ip, nil
+}
+
+// Release gives the address back to the service
+// part of IPAMProvider interface implementation
+func (p *HTTPIPAM) Release(ip net.IP) error {
+	_, err := p.post("release", ipamMessage{IP: ip.String()})
+	return err
+}
+
+// SetIPAMProvider makes Assign and Request take the addresses from the
+// provider, keeping only the machines and their IPs in etcd. Defaults to nil,
+// which is the built-in lease pool
+func (ds *EtcdDataSource) SetIPAMProvider(provider IPAMProvider) {
+	ds.ipam = provider
+}
+
+// assignFromIPAM returns the IP of the machine, which is allocated by the
+// ipam if the machine is new or its lease has been expired. The allocated IP
+// is claimed like the ones of the pool, so GetMachineByIP and Reconcile see
+// it, and it's released back to the ipam if it can't be used
+func (ds *EtcdDataSource) assignFromIPAM(mac net.HardwareAddr) (net.IP, error) {
+	ds.lockDHCPData()
+	defer ds.unlockDHCPData()
+
+	nic := mac.String()
+	machine, exists := ds.GetMachine(mac)
+	if exists {
+		ip, err := machine.IP()
+		if err != nil {
+			return nil, err
+		}
+		if ip != nil {
+			ds.storeLocked(machine, ip)
+			return ip, nil
+		}
+	}
+
+	ip, err := ds.ipam.Allocate(mac)
+	if err != nil {
+		return nil, err
+	}
+	if ds.isExcluded(ip) {
+		ds.releaseToIPAM(ip)
+		return nil, fmt.Errorf("the ipam allocated the excluded ip %s", ip)
+	}
+	claimed, fresh, err := ds.claimIP(ip, nic)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		ds.releaseToIPAM(ip)
+		return nil, fmt.Errorf("%w: %s, allocated by the ipam, is taken", ErrIPConflict, ip)
+	}
+	if exists {
+		ds.storeLocked(machine, ip)
+		ds.setDNSRecord(machine, ip)
+		return ip, nil
+	}
+	if _, created := ds.CreateMachine(mac, ip); !created {
+		// another instance may have created the machine of the same nic. The
+		// ip isn't released, since the ipam gives the same one to both
+		if node, exists := ds.GetMachine(mac); exists {
+			return leasedIP(node)
+		}
+		if fresh {
+			ds.releaseIP(ip, nic)
+			ds.releaseToIPAM(ip)
+		}
+		return nil, fmt.Errorf("%w: %s, allocated by the ipam", ErrIPConflict, ip)
+	}
+	return ip, nil
+}
+
+// releaseToIPAM gives the ip back to the ipam, if there is one
+func (ds *EtcdDataSource) releaseToIPAM(ip net.IP) {
+	if ds.ipam == nil {
+		return
+	}
+	if err := ds.ipam.Release(ip); err != nil {
+		logging.Log(debugTag, "Error while releasing %s to the ipam: %s", ip, err)
+	}
+}
@@ -0,0 +1,125 @@
+package datasource
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeIPAM serves the API of HTTPIPAM, allocating 192.168.1.11 onwards
+type fakeIPAM struct {
+	mu       sync.Mutex
+	next     byte
+	leases   map[string]string
+	released []string
+}
+
+func (f *fakeIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var message ipamMessage
+	json.NewDecoder(r.Body).Decode(&message)
+	switch r.URL.Path {
+	case "/allocate":
+		ip, exists := f.leases[message.Mac]
+		if !exists {
+			f.next++
+			ip = net.IPv4(192, 168, 1, 10+f.next).String()
+			f.leases[message.Mac] = ip
+		}
+		json.NewEncoder(w).Encode(ipamMessage{IP: ip})
+	case "/release":
+		for mac, ip := range f.leases {
+			if ip == message.IP {
+				delete(f.leases, mac)
+			}
+		}
+		f.released = append(f.released, message.IP)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestHTTPIPAM(t *testing.T) {
+	ipam := &fakeIPAM{leases: make(map[string]string)}
+	server := httptest.NewServer(ipam)
+	defer server.Close()
+
+	ds, _ := newTestDataSource(t)
+	ds.SetIPAMProvider(NewHTTPIPAM(server.URL + "/"))
+
+	ip, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 11)) {
+		t.Fatalf("expected the ip of the ipam, got %s", ip)
+	}
+	if ip, err := ds.Request("00:11:22:33:44:01", net.IPv4(192, 168, 1, 11)); err != nil || !ip.Equal(net.IPv4(192, 168, 1, 11)) {
+		t.Errorf("expected the request of the allocated ip to succeed, got %s (%v)", ip, err)
+	}
+	if _, err := ds.Request("00:11:22:33:44:01", net.IPv4(10, 0, 0, 10)); err == nil {
+		t.Error("expected the request of an ip of the pool to fail")
+	}
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	if _, err := ds.ExpireLease(mac); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipam.released) != 1 || ipam.released[0] != "192.168.1.11" {
+		t.Errorf("expected the expired ip to be released to the ipam, got %v", ipam.released)
+	}
+	if ip, _ := ds.Assign("00:11:22:33:44:01"); !ip.Equal(net.IPv4(192, 168, 1, 12)) {
+		t.Errorf("expected a fresh ip of the ipam, got %s", ip)
+	}
+
+	server.Close()
+	if _, err := ds.Assign("00:11:22:33:44:02"); err == nil {
+		t.Error("expected an error when the ipam is unreachable")
+	}
+}
+
+func TestIPAMClaims(t *testing.T) {
+	ipam := &fakeIPAM{leases: make(map[string]string)}
+	server := httptest.NewServer(ipam)
+	defer server.Close()
+
+	ds, _ := newTestDataSource(t)
+	ds.SetIPAMProvider(NewHTTPIPAM(server.URL))
+
+	ip, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machine, exists := ds.GetMachineByIP(ip); !exists || machine.Mac().String() != "00:11:22:33:44:01" {
+		t.Errorf("expected the machine of the ipam address to be found by its ip")
+	}
+	report, err := ds.Reconcile()
+	if err != nil || len(report.Restored) != 0 || len(report.Removed) != 0 {
+		t.Errorf("expected the claims of the ipam to match the machines, got %+v (%v)", report, err)
+	}
+
+	// 192.168.1.12, which the ipam allocates next, is taken
+	if claimed, _, _ := ds.claimIP(net.IPv4(192, 168, 1, 12), "00:11:22:33:44:99"); !claimed {
+		t.Fatal("couldn't claim the ip")
+	}
+	if _, err := ds.Assign("00:11:22:33:44:02"); !errors.Is(err, ErrIPConflict) {
+		t.Errorf("expected a conflict on the taken ip, got %v", err)
+	}
+	if len(ipam.released) != 1 || ipam.released[0] != "192.168.1.12" {
+		t.Errorf("expected the taken ip to be released to the ipam, got %v", ipam.released)
+	}
+
+	// 192.168.1.13 is allocated next
+	ds.excludes, _ = parseExcludes([]string{"192.168.1.13"})
+	if _, err := ds.Assign("00:11:22:33:44:03"); err == nil {
+		t.Error("expected an error for the excluded ip")
+	}
+	if len(ipam.released) != 2 || ipam.released[1] != "192.168.1.13" {
+		t.Errorf("expected the excluded ip to be released to the ipam, got %v", ipam.released)
+	}
+}
@@ -0,0 +1,195 @@
+package datasource
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI is a map-backed etcd.KeysAPI, good enough for testing the
+// EtcdDataSource without a running etcd. Like etcd v2, it leaves the hidden
+// keys, whose names start with _, out of the listings of the directories,
+// and returns them only to the gets of their exact keys
+type fakeKeysAPI struct {
+	mu    sync.Mutex
+	index uint64
+	nodes map[string]*etcd.Node
+}
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{nodes: map[string]*etcd.Node{
+		"/": {Key: "/", Dir: true},
+	}}
+}
+
+func notFound(key string) error {
+	return etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+}
+
+// isHiddenKey reports whether etcd v2 leaves the key out of the listings
+func isHiddenKey(key string) bool {
+	return strings.HasPrefix(path.Base(key), "_")
+}
+
+func (f *fakeKeysAPI) children(key string, recursive bool) etcd.Nodes {
+	var keys []string
+	for k := range f.nodes {
+		if k != key && path.Dir(k) == key && !isHiddenKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	nodes := make(etcd.Nodes, 0, len(keys))
+	for _, k := range keys {
+		node := *f.nodes[k]
+		if node.Dir && recursive {
+			node.Nodes = f.children(k, true)
+		}
+		nodes = append(nodes, &node)
+	}
+	return nodes
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key = path.Join("/", key)
+	node, exists := f.nodes[key]
+	if !exists {
+		return nil, notFound(key)
+	}
+	ret := *node
+	if node.Dir {
+		ret.Nodes = f.children(key, opts != nil && opts.Recursive)
+	}
+	return &etcd.Response{Action: "get", Node: &ret, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if opts == nil {
+		opts = &etcd.SetOptions{}
+	}
+	key = path.Join("/", key)
+	prev, exists := f.nodes[key]
+	switch {
+	case opts.PrevExist == etcd.PrevExist && !exists:
+		return nil, notFound(key)
+	case opts.PrevExist == etcd.PrevNoExist && exists:
+		return nil, etcd.Error{Code: etcd.ErrorCodeNodeExist, Message: "Key already exists", Cause: key}
+	case opts.PrevValue != "" && (!exists || prev.Value != opts.PrevValue):
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed, Message: "Compare failed", Cause: key}
+	case exists && prev.Dir != opts.Dir:
+		return nil, etcd.Error{Code: etcd.ErrorCodeNotFile, Message: "Not a file", Cause: key}
+	}
+
+	for dir := path.Dir(key); dir != "/"; dir = path.Dir(dir) {
+		if parent, exists := f.nodes[dir]; !exists {
+			f.index++
+			f.nodes[dir] = &etcd.Node{Key: dir, Dir: true, CreatedIndex: f.index, ModifiedIndex: f.index}
+		} else if !parent.Dir {
+			return nil, etcd.Error{Code: etcd.ErrorCodeNotDir, Message: "Not a directory", Cause: dir}
+		}
+	}
+
+	f.index++
+	node := &etcd.Node{Key: key, Dir: opts.Dir, Value: value,
+		CreatedIndex: f.index, ModifiedIndex: f.index, TTL: int64(opts.TTL.Seconds())}
+	if exists {
+		node.CreatedIndex = prev.CreatedIndex
+	}
+	f.nodes[key] = node
+	return &etcd.Response{Action: "set", Node: node, PrevNode: prev, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key = path.Join("/", key)
+	node, exists := f.nodes[key]
+	if !exists {
+		return nil, notFound(key)
+	}
+	if opts != nil && ((opts.PrevValue != "" && node.Value != opts.PrevValue) ||
+		(opts.PrevIndex != 0 && node.ModifiedIndex != opts.PrevIndex)) {
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed, Message: "Compare failed", Cause: key}
+	}
+	if node.Dir && (opts == nil || !opts.Recursive) {
+		if f.hasChildren(key) || opts == nil || !opts.Dir {
+			return nil, etcd.Error{Code: etcd.ErrorCodeDirNotEmpty, Message: "Directory not empty", Cause: key}
+		}
+	}
+	for k := range f.nodes {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(f.nodes, k)
+		}
+	}
+	f.index++
+	return &etcd.Response{Action: "delete", PrevNode: node, Index: f.index}, nil
+}
+
+// hasChildren reports whether the directory has any children, including the
+// hidden ones
+func (f *fakeKeysAPI) hasChildren(key string) bool {
+	for k := range f.nodes {
+		if k != key && path.Dir(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return f.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+}
+
+func (f *fakeKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	f.mu.Lock()
+	key := path.Join("/", dir, fmt.Sprintf("%020d", f.index+1))
+	f.mu.Unlock()
+
+	setOpts := &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	if opts != nil {
+		setOpts.TTL = opts.TTL
+	}
+	return f.Set(ctx, key, value, setOpts)
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return f.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevExist})
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	panic("not implemented")
+}
+
+func newTestDataSource(t *testing.T) (*EtcdDataSource, *fakeKeysAPI) {
+	kapi := newFakeKeysAPI()
+	ds := &EtcdDataSource{
+		keysAPI:              kapi,
+		clusterName:          "test",
+		leaseStart:           net.IPv4(10, 0, 0, 10),
+		leaseRange:           10,
+		workspacePath:        t.TempDir(),
+		initialCoreOSVersion: "1000.0.0",
+		dhcpDataLock:         &sync.Mutex{},
+		instancesEtcdDir:     invalidEtcdKey,
+		serverIP:             net.IPv4(10, 0, 0, 1),
+	}
+	if _, err := kapi.Set(context.Background(), ds.prefixify("machines"), "", &etcd.SetOptions{Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	return ds, kapi
+}
@@ -0,0 +1,137 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const leasesEtcdDir = "leases"
+
+// ErrNoLease is returned by ExpireLease and leasedIP for a machine without
+// an IP
+var ErrNoLease = errors.New("The machine has no lease")
+
+// ErrUnknownRequest is returned by Request for a nic without a machine, if
+// the auto-creation of the machines on Request is disabled
+var ErrUnknownRequest = errors.New("Request of an unknown machine, which isn't created on Request")
+
+func (ds *EtcdDataSource) leaseKey(ip net.IP) string {
+	return ds.prefixify(leasesEtcdDir + "/" + ip.String())
+}
+
+// claimIP atomically claims the ip for the nic, by creating its key under
+// leases. Returns false if the ip is already claimed by another nic. This
+// lets the DHCP transactions of different nics run concurrently, contending
+// only when they try the same ip. fresh reports whether this call created
+// the claim, rather than finding an earlier one of the nic, e.g. of the
+// offer; only a fresh claim may be released by the caller on a failure
+func (ds *EtcdDataSource) claimIP(ip net.IP, nic string) (claimed, fresh bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = ds.keysAPI.Set(ctx, ds.leaseKey(ip), nic, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if err == nil {
+		return true, true, nil
+	}
+	etcdError, found := err.(etcd.Error)
+	if !found || etcdError.Code != etcd.ErrorCodeNodeExist {
+		return false, false, err
+	}
+
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel1()
+	response, err := ds.keysAPI.Get(ctx1, ds.leaseKey(ip), &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		return false, false, err
+	}
+	return response.Node.Value == nic, false, nil
+}
+
+// GetMachineByIP returns the machine whose nic has claimed the ip, if the
+// machine still holds it
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) GetMachineByIP(ip net.IP) (Machine, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := ds.keysAPI.Get(ctx, ds.leaseKey(ip), nil)
+	if err != nil {
+		return nil, false
+	}
+	mac, err := net.ParseMAC(response.Node.Value)
+	if err != nil {
+		return nil, false
+	}
+	machine, exists := ds.GetMachine(mac)
+	if !exists {
+		return nil, false
+	}
+	// the claim can be stale, see Reconcile
+	machineIP, err := machine.IP()
+	if err != nil || !machineIP.Equal(ip) {
+		return nil, false
+	}
+	return machine, true
+}
+
+// leasedIP returns the IP of the machine, or ErrNoLease if its lease has
+// been expired, for the callers which hand the IP out
+func leasedIP(machine Machine) (net.IP, error) {
+	ip, err := machine.IP()
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoLease, machine.Mac())
+	}
+	return ip, nil
+}
+
+// releaseIP removes the claim of the nic on the ip, if it still holds it
+func (ds *EtcdDataSource) releaseIP(ip net.IP, nic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ds.keysAPI.Delete(ctx, ds.leaseKey(ip), &etcd.DeleteOptions{PrevValue: nic})
+}
+
+// ExpireLease removes the IP of the machine, its claim on the IP and its dns
+// record, keeping its flags and history
+// part of DHCPDataSource interface implementation
+func (ds *EtcdDataSource) ExpireLease(mac net.HardwareAddr) (net.IP, error) {
+	machine, exists := ds.GetMachine(mac)
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrMachineNotFound, mac)
+	}
+
+	ds.lockDHCPData()
+	defer ds.unlockDHCPData()
+
+	ip, err := machine.IP()
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, ErrNoLease
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = ds.keysAPI.Delete(ctx, ds.prefixify(ds.machineDir(machine.Mac())+"/"+ipKey),
+		&etcd.DeleteOptions{PrevValue: ip.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	ds.releaseIP(ip, mac.String())
+	ds.releaseToIPAM(ip)
+	ds.rememberLease(mac.String(), ip)
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel1()
+	ds.keysAPI.Delete(ctx1, "skydns/"+ds.clusterName+"/"+machine.Name(), nil)
+	return ip, nil
+}
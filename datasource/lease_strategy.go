@@ -0,0 +1,150 @@
+package datasource
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const leaseHistoryEtcdDir = "lease-history"
+
+// LeaseStrategy decides the order in which the offsets of the lease pool are
+// tried by Assign
+type LeaseStrategy struct {
+	// Order returns the offsets of the pool in the order they're tried.
+	// previous is the offset of the last IP the nic had, or -1 if it's
+	// unknown or out of the pool
+	Order func(leaseRange, previous int) []int
+	// UsesPrevious tells Assign to look the previous IP of the nic up in
+	// etcd, otherwise previous is always -1
+	UsesPrevious bool
+}
+
+var (
+	// LowestLeaseStrategy tries the lowest addresses first
+	LowestLeaseStrategy = LeaseStrategy{Order: lowestOrder}
+	// RandomLeaseStrategy tries the addresses in a random order, to spread
+	// the churn over the whole pool
+	RandomLeaseStrategy = LeaseStrategy{Order: randomOrder}
+	// StickyLeaseStrategy tries the previous address of the nic first, and
+	// then the lowest ones, so the machines keep their addresses after their
+	// leases are expired
+	StickyLeaseStrategy = LeaseStrategy{Order: stickyOrder, UsesPrevious: true}
+)
+
+var (
+	strategyRandMu sync.Mutex
+	strategyRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func lowestOrder(leaseRange, previous int) []int {
+	order := make([]int, leaseRange)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func randomOrder(leaseRange, previous int) []int {
+	strategyRandMu.Lock()
+	defer strategyRandMu.Unlock()
+	return strategyRand.Perm(leaseRange)
+}
+
+func stickyOrder(leaseRange, previous int) []int {
+	order := lowestOrder(leaseRange, previous)
+	if previous > 0 && previous < leaseRange {
+		copy(order[1:previous+1], order[:previous])
+		order[0] = previous
+	}
+	return order
+}
+
+// LeaseStrategies are the strategies selectable by name
+var LeaseStrategies = map[string]LeaseStrategy{
+	"lowest": LowestLeaseStrategy,
+	"random": RandomLeaseStrategy,
+	"sticky": StickyLeaseStrategy,
+}
+
+// ParseLeaseStrategy returns the strategy of LeaseStrategies with the name
+func ParseLeaseStrategy(name string) (LeaseStrategy, error) {
+	strategy, exists := LeaseStrategies[name]
+	if !exists {
+		names := make([]string, 0, len(LeaseStrategies))
+		for name := range LeaseStrategies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return LeaseStrategy{}, fmt.Errorf("unknown lease strategy %q, expected one of %s",
+			name, strings.Join(names, ", "))
+	}
+	return strategy, nil
+}
+
+// SetLeaseStrategy sets the order in which Assign tries the free addresses.
+// Defaults to LowestLeaseStrategy
+func (ds *EtcdDataSource) SetLeaseStrategy(strategy LeaseStrategy) {
+	ds.leaseStrategy = strategy
+}
+
+func (ds *EtcdDataSource) leaseHistoryKey(nic string) string {
+	return ds.prefixify(leaseHistoryEtcdDir + "/" + nic)
+}
+
+// rememberLease records the last IP of the nic, which outlives the lease
+func (ds *EtcdDataSource) rememberLease(nic string, ip net.IP) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ds.keysAPI.Set(ctx, ds.leaseHistoryKey(nic), ip.String(), nil)
+}
+
+// forgetLease deletes the last IP of the nic, e.g. when its machine is
+// deleted
+func (ds *EtcdDataSource) forgetLease(nic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ds.keysAPI.Delete(ctx, ds.leaseHistoryKey(nic), nil)
+}
+
+// previousLeaseOffset returns the offset of the last IP of the nic in the
+// lease pool, or -1
+func (ds *EtcdDataSource) previousLeaseOffset(nic string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	response, err := ds.keysAPI.Get(ctx, ds.leaseHistoryKey(nic), nil)
+	if err != nil {
+		return -1
+	}
+	ip := net.ParseIP(response.Node.Value).To4()
+	if ip == nil {
+		return -1
+	}
+	offset := int(binary.BigEndian.Uint32(ip)) - int(binary.BigEndian.Uint32(ds.LeaseStart().To4()))
+	if offset < 0 || offset >= ds.LeaseRange() {
+		return -1
+	}
+	return offset
+}
+
+// leaseOrder returns the offsets of the lease pool in the order Assign tries
+// them for the nic. The previous IP of the nic is only read from etcd for
+// the strategies using it
+func (ds *EtcdDataSource) leaseOrder(nic string) []int {
+	strategy := ds.leaseStrategy
+	if strategy.Order == nil {
+		strategy = LowestLeaseStrategy
+	}
+	previous := -1
+	if strategy.UsesPrevious {
+		previous = ds.previousLeaseOffset(nic)
+	}
+	return strategy.Order(ds.LeaseRange(), previous)
+}
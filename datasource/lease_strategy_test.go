@@ -0,0 +1,88 @@
+package datasource
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLeaseStrategies(t *testing.T) {
+	if order := LowestLeaseStrategy.Order(4, 2); !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+		t.Errorf("unexpected lowest order: %v", order)
+	}
+	if order := StickyLeaseStrategy.Order(4, 2); !reflect.DeepEqual(order, []int{2, 0, 1, 3}) {
+		t.Errorf("unexpected sticky order: %v", order)
+	}
+	if order := StickyLeaseStrategy.Order(4, -1); !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+		t.Errorf("unexpected sticky order without a previous address: %v", order)
+	}
+	order := RandomLeaseStrategy.Order(10, -1)
+	sort.Ints(order)
+	if !reflect.DeepEqual(order, LowestLeaseStrategy.Order(10, -1)) {
+		t.Errorf("expected a permutation of the pool, got %v", order)
+	}
+
+	if _, err := ParseLeaseStrategy("sticky"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseLeaseStrategy("highest"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestAssignSticky(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ds.SetLeaseStrategy(StickyLeaseStrategy)
+	nic := "00:11:22:33:44:01"
+	mac, _ := net.ParseMAC(nic)
+
+	ds.Assign("00:11:22:33:44:00")
+	leased, _ := ds.Assign(nic)
+	if !leased.Equal(net.IPv4(10, 0, 0, 11)) {
+		t.Fatalf("expected 10.0.0.11, got %s", leased)
+	}
+	if _, err := ds.ExpireLease(mac); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := net.ParseMAC("00:11:22:33:44:00")
+	if _, err := ds.ExpireLease(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if ip, err := ds.Assign(nic); err != nil || !ip.Equal(leased) {
+		t.Errorf("expected the previous address %s to be preferred, got %s (%v)", leased, ip, err)
+	}
+}
+
+func TestLeaseHistory(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	ds.CreateMachine(mac, net.IPv4(10, 0, 0, 12))
+	ds.rememberLease(mac.String(), net.IPv4(10, 0, 0, 12))
+
+	previous := 0
+	record := func(leaseRange, p int) []int {
+		previous = p
+		return LowestLeaseStrategy.Order(leaseRange, p)
+	}
+	ds.SetLeaseStrategy(LeaseStrategy{Order: record})
+	ds.leaseOrder(mac.String())
+	if previous != -1 {
+		t.Errorf("expected the previous offset to be read only for the strategies using it, got %d", previous)
+	}
+	ds.SetLeaseStrategy(LeaseStrategy{Order: record, UsesPrevious: true})
+	ds.leaseOrder(mac.String())
+	if previous != 2 {
+		t.Errorf("expected the previous offset 2 for a wrapped strategy using it, got %d", previous)
+	}
+
+	if err := ds.DeleteMachine(mac); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kapi.Get(context.Background(), ds.leaseHistoryKey(mac.String()), nil); err == nil {
+		t.Error("expected the lease history of the deleted machine to be pruned")
+	}
+}
@@ -0,0 +1,90 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const locksEtcdDir = "locks"
+
+// ErrLockNotHeld is returned by ReleaseLock when the lock is held by another
+// owner
+var ErrLockNotHeld = errors.New("The lock is held by another owner")
+
+// ValidateLockName checks that the name of a lock is a single path element
+func ValidateLockName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid lock name: %q", name)
+	}
+	return nil
+}
+
+func (ds *EtcdDataSource) lockKey(name string) string {
+	return ds.prefixify(locksEtcdDir + "/" + name)
+}
+
+// AcquireLock atomically creates the key of the lock with the owner as its
+// value and the ttl, so that the lock of a crashed owner is released. If the
+// owner already holds the lock, its ttl is renewed. Returns false if the lock
+// is held by another owner
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	if err := ValidateLockName(name); err != nil {
+		return false, err
+	}
+	if owner == "" {
+		return false, errors.New("the owner of the lock can't be empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := ds.keysAPI.Set(ctx, ds.lockKey(name), owner,
+		&etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: ttl})
+	if err == nil {
+		return true, nil
+	}
+	etcdError, found := err.(etcd.Error)
+	if !found || etcdError.Code != etcd.ErrorCodeNodeExist {
+		return false, err
+	}
+
+	// renews the lock, if it's still held by the owner
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel1()
+	_, err = ds.keysAPI.Set(ctx1, ds.lockKey(name), owner,
+		&etcd.SetOptions{PrevValue: owner, TTL: ttl})
+	if etcdError, found := err.(etcd.Error); found &&
+		(etcdError.Code == etcd.ErrorCodeTestFailed || etcdError.Code == etcd.ErrorCodeKeyNotFound) {
+		// held by another owner, or expired in between
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLock deletes the key of the lock, if it's held by the owner.
+// Releasing a lock which isn't held, e.g. because it's expired, isn't an
+// error
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) ReleaseLock(name, owner string) error {
+	if err := ValidateLockName(name); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := ds.keysAPI.Delete(ctx, ds.lockKey(name), &etcd.DeleteOptions{PrevValue: owner})
+	if etcdError, found := err.(etcd.Error); found {
+		switch etcdError.Code {
+		case etcd.ErrorCodeKeyNotFound:
+			return nil
+		case etcd.ErrorCodeTestFailed:
+			return ErrLockNotHeld
+		}
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package datasource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+
+	if acquired, err := ds.AcquireLock("disk", "node1", time.Minute); !acquired || err != nil {
+		t.Fatalf("expected to acquire the lock: %v", err)
+	}
+	if node := kapi.nodes["/"+ds.lockKey("disk")]; node == nil || node.TTL != 60 {
+		t.Errorf("expected the lock key with a ttl, got %+v", node)
+	}
+	if acquired, err := ds.AcquireLock("disk", "node2", time.Minute); acquired || err != nil {
+		t.Errorf("expected the lock to be held by node1: %v", err)
+	}
+	if acquired, err := ds.AcquireLock("disk", "node1", time.Minute); !acquired || err != nil {
+		t.Errorf("expected node1 to renew the lock: %v", err)
+	}
+
+	if err := ds.ReleaseLock("disk", "node2"); err != ErrLockNotHeld {
+		t.Errorf("expected ErrLockNotHeld, got %v", err)
+	}
+	if err := ds.ReleaseLock("disk", "node1"); err != nil {
+		t.Errorf("ReleaseLock: %s", err)
+	}
+	if err := ds.ReleaseLock("disk", "node1"); err != nil {
+		t.Errorf("expected releasing a released lock to succeed, got %s", err)
+	}
+	if acquired, err := ds.AcquireLock("disk", "node2", time.Minute); !acquired || err != nil {
+		t.Errorf("expected node2 to acquire the released lock: %v", err)
+	}
+
+	if _, err := ds.AcquireLock("../disk", "node1", time.Minute); err == nil {
+		t.Error("expected an error for an invalid lock name")
+	}
+}
@@ -0,0 +1,56 @@
+package datasource
+
+import (
+	"sync"
+	"time"
+)
+
+// machinesCache keeps the list of the machines for a short while, so the
+// calls to Machines during a boot storm don't each list the machines in etcd
+type machinesCache struct {
+	sync.Mutex
+	ttl      time.Duration
+	machines []Machine
+	expires  time.Time
+	// generation is incremented on each invalidation, so a list fetched
+	// before a machine is created isn't cached after it
+	generation uint64
+}
+
+// get returns a copy of the cached list if it hasn't expired, or else the
+// generation to pass to set along with the fetched list
+func (c *machinesCache) get() ([]Machine, uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.machines == nil || !time.Now().Before(c.expires) {
+		return nil, c.generation, false
+	}
+	return append([]Machine(nil), c.machines...), c.generation, true
+}
+
+func (c *machinesCache) set(machines []Machine, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ttl <= 0 || generation != c.generation {
+		return
+	}
+	c.machines = append([]Machine(nil), machines...)
+	c.expires = time.Now().Add(c.ttl)
+}
+
+func (c *machinesCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.machines = nil
+	c.generation++
+}
+
+// SetMachinesCacheTTL makes Machines reuse the list of the machines for the
+// given duration. The list only holds the handles of the machines, so their
+// IPs and flags are still read from etcd. Zero disables the cache
+func (ds *EtcdDataSource) SetMachinesCacheTTL(ttl time.Duration) {
+	ds.machinesCache.Lock()
+	ds.machinesCache.ttl = ttl
+	ds.machinesCache.Unlock()
+	ds.machinesCache.invalidate()
+}
@@ -0,0 +1,77 @@
+package datasource
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+const (
+	maintenanceKey = "maintenance"
+	// maintenanceTTL is how long Assign reuses the maintenance mode read
+	// from etcd, so the Discovers don't each read it. The other instances
+	// see a toggle after at most this long
+	maintenanceTTL = 2 * time.Second
+)
+
+// ErrMaintenance is returned by Assign while the maintenance mode is on
+var ErrMaintenance = errors.New("in maintenance mode, no new leases are offered")
+
+// maintenanceCache keeps the last maintenance mode read from etcd
+type maintenanceCache struct {
+	sync.Mutex
+	enabled bool
+	expires time.Time
+}
+
+// Maintenance reports whether the maintenance mode is on, reading it from
+// etcd
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) Maintenance() (bool, error) {
+	value, err := ds.Get(maintenanceKey)
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// SetMaintenance turns the maintenance mode on or off for all the instances.
+// While it's on, Assign offers no leases, and the renewals through Request
+// keep working
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) SetMaintenance(enabled bool) error {
+	if err := ds.Set(maintenanceKey, strconv.FormatBool(enabled)); err != nil {
+		return err
+	}
+	ds.maintenance.Lock()
+	ds.maintenance.enabled = enabled
+	ds.maintenance.expires = time.Now().Add(maintenanceTTL)
+	ds.maintenance.Unlock()
+	return nil
+}
+
+// inMaintenance returns the maintenance mode, read from etcd at most once
+// per maintenanceTTL. The last known mode is kept if etcd can't be read
+func (ds *EtcdDataSource) inMaintenance() bool {
+	ds.maintenance.Lock()
+	defer ds.maintenance.Unlock()
+	if time.Now().Before(ds.maintenance.expires) {
+		return ds.maintenance.enabled
+	}
+	enabled, err := ds.Maintenance()
+	if err != nil {
+		logging.Log(debugTag, "Error while reading the maintenance mode: %s", err)
+	} else {
+		ds.maintenance.enabled = enabled
+	}
+	ds.maintenance.expires = time.Now().Add(maintenanceTTL)
+	return ds.maintenance.enabled
+}
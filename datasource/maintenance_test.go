@@ -0,0 +1,39 @@
+package datasource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	leased, err := ds.Assign("00:11:22:33:44:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enabled, err := ds.Maintenance(); enabled || err != nil {
+		t.Fatalf("expected the maintenance mode to be off by default, got %t (%v)", enabled, err)
+	}
+	if err := ds.SetMaintenance(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Assign("00:11:22:33:44:02"); err != ErrMaintenance {
+		t.Errorf("expected ErrMaintenance, got %v", err)
+	}
+	if ip, err := ds.Request("00:11:22:33:44:01", leased); err != nil || !ip.Equal(leased) {
+		t.Errorf("expected the renewal to work in the maintenance mode: %s (%v)", ip, err)
+	}
+
+	// turned off by another instance, seen after the cache expires
+	if err := ds.Set(maintenanceKey, "false"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Assign("00:11:22:33:44:02"); err != ErrMaintenance {
+		t.Errorf("expected the cached maintenance mode, got %v", err)
+	}
+	ds.maintenance.expires = time.Time{}
+	if ip, err := ds.Assign("00:11:22:33:44:02"); err != nil || ip == nil {
+		t.Errorf("expected an offer after the maintenance mode is off: %s (%v)", ip, err)
+	}
+}
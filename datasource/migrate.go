@@ -0,0 +1,129 @@
+package datasource
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+type prefixMigration struct {
+	keysAPI   etcd.KeysAPI
+	oldPrefix string
+	newPrefix string
+}
+
+func countLeaves(node *etcd.Node) int {
+	if !node.Dir {
+		return 1
+	}
+	n := 0
+	for _, child := range node.Nodes {
+		n += countLeaves(child)
+	}
+	return n
+}
+
+// leafValues returns the values of the keys under the node, by their paths
+// relative to prefix
+func leafValues(node *etcd.Node, prefix string) map[string]string {
+	values := make(map[string]string)
+	var walk func(*etcd.Node)
+	walk = func(node *etcd.Node) {
+		if !node.Dir {
+			values[strings.TrimPrefix(node.Key, prefix)] = node.Value
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(node)
+	return values
+}
+
+func (m *prefixMigration) copyNode(node *etcd.Node) error {
+	newKey := path.Join(m.newPrefix, strings.TrimPrefix(node.Key, m.oldPrefix))
+	if node.Dir {
+		if len(node.Nodes) == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+			defer cancel()
+			_, err := m.keysAPI.Set(ctx, newKey, "", &etcd.SetOptions{Dir: true})
+			return err
+		}
+		for _, child := range node.Nodes {
+			if err := m.copyNode(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := m.keysAPI.Set(ctx, newKey, node.Value, &etcd.SetOptions{
+		TTL: time.Duration(node.TTL) * time.Second,
+	})
+	return err
+}
+
+// MigratePrefix recursively copies all the keys under oldPrefix to newPrefix,
+// including the hidden keys of the machines which the listings leave out,
+// and verifies that the number of copied keys matches. The old tree is left
+// untouched, it's up to the operator to delete it afterwards
+func MigratePrefix(kapi etcd.KeysAPI, oldPrefix, newPrefix string) error {
+	m := &prefixMigration{
+		keysAPI:   kapi,
+		oldPrefix: path.Join("/", oldPrefix),
+		newPrefix: path.Join("/", newPrefix),
+	}
+	if m.oldPrefix == m.newPrefix {
+		return fmt.Errorf("old and new prefixes are the same (%s)", m.oldPrefix)
+	}
+
+	getOptions := &etcd.GetOptions{Recursive: true, Quorum: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := kapi.Get(ctx, m.newPrefix, nil)
+	if err == nil {
+		return fmt.Errorf("the new prefix (%s) already exists", m.newPrefix)
+	}
+	if etcdError, found := err.(etcd.Error); !found || etcdError.Code != etcd.ErrorCodeKeyNotFound {
+		return fmt.Errorf("Error while checking the new prefix: %s", err)
+	}
+
+	ctx1, cancel1 := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel1()
+	oldTree, err := kapi.Get(ctx1, m.oldPrefix, getOptions)
+	if err != nil {
+		return fmt.Errorf("Error while reading the old prefix: %s", err)
+	}
+	if err := addHiddenKeys(kapi, oldTree.Node); err != nil {
+		return fmt.Errorf("Error while reading the old prefix: %s", err)
+	}
+
+	if err := m.copyNode(oldTree.Node); err != nil {
+		return fmt.Errorf("Error while copying the keys: %s", err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel2()
+	newTree, err := kapi.Get(ctx2, m.newPrefix, getOptions)
+	if err != nil {
+		return fmt.Errorf("Error while reading the new prefix: %s", err)
+	}
+	if err := addHiddenKeys(kapi, newTree.Node); err != nil {
+		return fmt.Errorf("Error while reading the new prefix: %s", err)
+	}
+
+	oldCount, newCount := countLeaves(oldTree.Node), countLeaves(newTree.Node)
+	if oldCount != newCount {
+		return fmt.Errorf("key count mismatch after the migration: old=%d new=%d",
+			oldCount, newCount)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMigratePrefix(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+	ctx := context.Background()
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("role", "storage")
+	machine.SetNote("rack 4")
+	kapi.Set(ctx, "/test/coreos-version", "1000.0.0", nil)
+
+	if err := MigratePrefix(kapi, "test", "moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{
+		"/moved/coreos-version":                  "1000.0.0",
+		"/moved/machines/node001122334401/role":  "storage",
+		"/moved/machines/node001122334401/_IP":   "10.0.0.10",
+		"/moved/machines/node001122334401/_mac":  "00:11:22:33:44:01",
+		"/moved/machines/node001122334401/_note": "rack 4",
+		"/test/machines/node001122334401/_IP":    "10.0.0.10",
+	} {
+		response, err := kapi.Get(ctx, key, nil)
+		if err != nil || response.Node.Value != value {
+			t.Errorf("expected %s=%q, got %v (%v)", key, value, response, err)
+		}
+	}
+	for _, key := range []string{firstSeenKey, lastSeenKey} {
+		if _, err := kapi.Get(ctx, "/moved/machines/node001122334401/"+key, nil); err != nil {
+			t.Errorf("expected %s to be copied: %s", key, err)
+		}
+	}
+
+	if err := MigratePrefix(kapi, "test", "moved"); err == nil {
+		t.Error("expected an error when the new prefix exists")
+	}
+	if err := MigratePrefix(kapi, "test", "/test/"); err == nil {
+		t.Error("expected an error for the same prefixes")
+	}
+}
@@ -0,0 +1,127 @@
+package datasource
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// ProbeConflictCooldown is how long an address which answered a probe is
+// skipped by Assign
+const ProbeConflictCooldown = 10 * time.Minute
+
+// MaxProbesPerAssign caps the candidates each Assign probes, so a pool full
+// of responding addresses doesn't hold the Discover for a timeout each. The
+// candidates after the cap are offered without a probe
+const MaxProbesPerAssign = 3
+
+// Probe reports whether the address is in use by a device on the network
+type Probe func(ip net.IP) bool
+
+// PingProbe returns a Probe which sends an ICMP echo request to the address,
+// and reports it in use if a reply arrives within the timeout. Errors, like
+// missing privileges for the raw socket, are reported as not in use
+func PingProbe(timeout time.Duration) Probe {
+	return func(ip net.IP) bool {
+		conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+
+		id := os.Getpid() & 0xffff
+		request, err := (&icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("blacksmith")},
+		}).Marshal(nil)
+		if err != nil {
+			return false
+		}
+		if _, err := conn.WriteTo(request, &net.IPAddr{IP: ip}); err != nil {
+			return false
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return false // timed out
+			}
+			if peerAddr, ok := peer.(*net.IPAddr); !ok || !peerAddr.IP.Equal(ip) {
+				continue
+			}
+			reply, err := icmp.ParseMessage(1, buf[:n]) // 1 is the protocol number of ICMP
+			if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id {
+				return true
+			}
+		}
+	}
+}
+
+// probeConflicts keeps the addresses which answered a probe, by the time
+// until which they're skipped
+type probeConflicts struct {
+	sync.Mutex
+	until map[string]time.Time
+}
+
+// SetProbe makes Assign probe the candidate addresses before offering them,
+// skipping the ones in use for ProbeConflictCooldown. A nil probe disables
+// probing
+func (ds *EtcdDataSource) SetProbe(probe Probe) {
+	ds.probe = probe
+}
+
+// inConflict probes the address, unless it's already known to be in use or
+// probes has reached MaxProbesPerAssign, and records it as a conflict if it
+// responds. probes counts the probes of the calling Assign
+func (ds *EtcdDataSource) inConflict(ip net.IP, probes *int) bool {
+	if ds.probe == nil {
+		return false
+	}
+
+	now := time.Now()
+	ds.conflicts.Lock()
+	until, known := ds.conflicts.until[ip.String()]
+	if known && !now.Before(until) {
+		delete(ds.conflicts.until, ip.String())
+		known = false
+	}
+	ds.conflicts.Unlock()
+	if known {
+		return true
+	}
+
+	if *probes >= MaxProbesPerAssign {
+		return false
+	}
+	*probes++
+	if !ds.probe(ip) {
+		return false
+	}
+	logging.Log(debugTag, "%s responded to the probe, skipping it for %s", ip, ProbeConflictCooldown)
+	ds.conflicts.Lock()
+	if ds.conflicts.until == nil {
+		ds.conflicts.until = make(map[string]time.Time)
+	}
+	// the expired conflicts of the addresses which aren't probed again are
+	// dropped here, so the map doesn't grow
+	for conflict, until := range ds.conflicts.until {
+		if !now.Before(until) {
+			delete(ds.conflicts.until, conflict)
+		}
+	}
+	ds.conflicts.until[ip.String()] = now.Add(ProbeConflictCooldown)
+	ds.conflicts.Unlock()
+	return true
+}
@@ -0,0 +1,158 @@
+package datasource
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// readOnlyDataSource refuses the writes to the datasource and its machines
+type readOnlyDataSource struct {
+	DataSource
+}
+
+// ReadOnly wraps the datasource so that it only reads, e.g. on a replica,
+// which must leave etcd to the primary instance. The writes, including the
+// ones to the machines it returns, fail with ErrReadOnly
+func ReadOnly(ds DataSource) DataSource {
+	return readOnlyDataSource{ds}
+}
+
+func (ds readOnlyDataSource) GetMachine(mac net.HardwareAddr) (Machine, bool) {
+	machine, exists := ds.DataSource.GetMachine(mac)
+	if !exists {
+		return nil, false
+	}
+	return ReadOnlyMachine(machine), true
+}
+
+func (ds readOnlyDataSource) GetMachineByIP(ip net.IP) (Machine, bool) {
+	machine, exists := ds.DataSource.GetMachineByIP(ip)
+	if !exists {
+		return nil, false
+	}
+	return ReadOnlyMachine(machine), true
+}
+
+func (ds readOnlyDataSource) Machines() ([]Machine, error) {
+	machines, err := ds.DataSource.Machines()
+	for i := range machines {
+		machines[i] = ReadOnlyMachine(machines[i])
+	}
+	return machines, err
+}
+
+func (ds readOnlyDataSource) SetState(mac net.HardwareAddr, state string) error {
+	return fmt.Errorf("%w: can't set the state of %s", ErrReadOnly, mac)
+}
+
+func (ds readOnlyDataSource) CreateMachine(mac net.HardwareAddr, ip net.IP) (Machine, bool) {
+	return nil, false
+}
+
+func (ds readOnlyDataSource) DeleteMachine(mac net.HardwareAddr) error {
+	return fmt.Errorf("%w: can't delete %s", ErrReadOnly, mac)
+}
+
+func (ds readOnlyDataSource) Set(key, value string) error {
+	return fmt.Errorf("%w: can't set %s", ErrReadOnly, key)
+}
+
+func (ds readOnlyDataSource) Delete(key string) error {
+	return fmt.Errorf("%w: can't delete %s", ErrReadOnly, key)
+}
+
+func (ds readOnlyDataSource) GetAndDelete(key string) (string, error) {
+	return "", fmt.Errorf("%w: can't delete %s", ErrReadOnly, key)
+}
+
+func (ds readOnlyDataSource) SetConfig(key, value string) error {
+	return fmt.Errorf("%w: can't set %s", ErrReadOnly, key)
+}
+
+func (ds readOnlyDataSource) Assign(nic string) (net.IP, error) {
+	return nil, fmt.Errorf("%w: can't assign an IP to %s", ErrReadOnly, nic)
+}
+
+func (ds readOnlyDataSource) Request(nic string, currentIP net.IP) (net.IP, error) {
+	return nil, fmt.Errorf("%w: can't lease %s to %s", ErrReadOnly, currentIP, nic)
+}
+
+func (ds readOnlyDataSource) ExpireLease(mac net.HardwareAddr) (net.IP, error) {
+	return nil, fmt.Errorf("%w: can't expire the lease of %s", ErrReadOnly, mac)
+}
+
+func (ds readOnlyDataSource) ImportFlags(mac net.HardwareAddr, flags map[string]string, overwrite bool) error {
+	return fmt.Errorf("%w: can't import the flags of %s", ErrReadOnly, mac)
+}
+
+func (ds readOnlyDataSource) AddAuditEntry(entry AuditEntry) error {
+	return fmt.Errorf("%w: can't add to the audit log", ErrReadOnly)
+}
+
+func (ds readOnlyDataSource) AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	return false, fmt.Errorf("%w: can't acquire the lock %s", ErrReadOnly, name)
+}
+
+func (ds readOnlyDataSource) ReleaseLock(name, owner string) error {
+	return fmt.Errorf("%w: can't release the lock %s", ErrReadOnly, name)
+}
+
+func (ds readOnlyDataSource) SetMaintenance(enabled bool) error {
+	return fmt.Errorf("%w: can't set the maintenance mode", ErrReadOnly)
+}
+
+func (ds readOnlyDataSource) Reconcile() (*ReconcileReport, error) {
+	return nil, fmt.Errorf("%w: can't reconcile the leases", ErrReadOnly)
+}
+
+func (ds readOnlyDataSource) RemoveInstance() error {
+	return fmt.Errorf("%w: can't remove the instance", ErrReadOnly)
+}
+
+// readOnlyMachine refuses the writes to the machine
+type readOnlyMachine struct {
+	Machine
+}
+
+// ReadOnlyMachine wraps the machine so that its writes fail with
+// ErrReadOnly
+func ReadOnlyMachine(machine Machine) Machine {
+	return readOnlyMachine{machine}
+}
+
+func (m readOnlyMachine) CheckIn() error {
+	return fmt.Errorf("%w: can't check %s in", ErrReadOnly, m.Name())
+}
+
+func (m readOnlyMachine) RecordBoot() error {
+	return fmt.Errorf("%w: can't record the boot of %s", ErrReadOnly, m.Name())
+}
+
+func (m readOnlyMachine) SetNote(note string) error {
+	return fmt.Errorf("%w: can't set the note of %s", ErrReadOnly, m.Name())
+}
+
+func (m readOnlyMachine) SetBMC(bmc BMCCredentials) error {
+	return fmt.Errorf("%w: can't set the BMC of %s", ErrReadOnly, m.Name())
+}
+
+func (m readOnlyMachine) SetFlag(key, value string) error {
+	return fmt.Errorf("%w: can't set %s of %s", ErrReadOnly, key, m.Name())
+}
+
+func (m readOnlyMachine) CreateFlag(key, value string) (bool, error) {
+	return false, fmt.Errorf("%w: can't set %s of %s", ErrReadOnly, key, m.Name())
+}
+
+func (m readOnlyMachine) GetAndDeleteFlag(key string) (string, error) {
+	return "", fmt.Errorf("%w: can't delete %s of %s", ErrReadOnly, key, m.Name())
+}
+
+func (m readOnlyMachine) DeleteFlag(key string) error {
+	return fmt.Errorf("%w: can't delete %s of %s", ErrReadOnly, key, m.Name())
+}
+
+func (m readOnlyMachine) ForceDeleteFlag(key string) error {
+	return fmt.Errorf("%w: can't delete %s of %s", ErrReadOnly, key, m.Name())
+}
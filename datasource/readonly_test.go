@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	written, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	written.SetFlag("role", "storage")
+
+	readOnly := ReadOnly(ds)
+	machine, exists := readOnly.GetMachine(mac)
+	if !exists {
+		t.Fatal("expected the machine to be read")
+	}
+	if value, err := machine.GetFlag("role"); err != nil || value != "storage" {
+		t.Errorf("expected role=storage, got %q (%v)", value, err)
+	}
+
+	for name, err := range map[string]error{
+		"SetFlag":   machine.SetFlag("role", "worker"),
+		"CheckIn":   machine.CheckIn(),
+		"Set":       readOnly.Set("coreos-version", "1000.0.0"),
+		"SetState":  readOnly.SetState(mac, "installing"),
+		"SetConfig": readOnly.SetConfig("coreos-version", "1000.0.0"),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+	if created, err := machine.CreateFlag("id", "1"); created || !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected CreateFlag to fail with ErrReadOnly, got %v (%v)", created, err)
+	}
+	if acquired, err := readOnly.AcquireLock("disk", machine.Name(), time.Minute); acquired || !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected AcquireLock to fail with ErrReadOnly, got %v (%v)", acquired, err)
+	}
+	if _, err := readOnly.Assign("00:11:22:33:44:02"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected Assign to fail with ErrReadOnly, got %v", err)
+	}
+
+	if value, _ := written.GetFlag("role"); value != "storage" {
+		t.Errorf("expected the flag to be left alone, got %q", value)
+	}
+	if _, exists := readOnly.GetMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}); exists {
+		t.Error("expected no machine for an unknown hardware address")
+	}
+}
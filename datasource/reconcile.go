@@ -0,0 +1,231 @@
+package datasource
+
+import (
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// LeaseClaim is the claim of a nic on an ip, kept under leases
+type LeaseClaim struct {
+	IP  string `json:"ip"`
+	Nic string `json:"nic"`
+}
+
+// ReconcileReport lists the claims which Reconcile repaired
+type ReconcileReport struct {
+	// Restored are the claims of the machines which were missing
+	Restored []LeaseClaim `json:"restored"`
+	// Removed are the claims which didn't match any machine
+	Removed []LeaseClaim `json:"removed"`
+}
+
+// ReconcileStats are the totals of the runs of Reconcile by this instance,
+// e.g. to tell how often the claims of the unfinished DHCP handshakes are
+// swept
+type ReconcileStats struct {
+	Runs     int       `json:"runs"`
+	Restored int       `json:"restored"`
+	Removed  int       `json:"removed"`
+	LastRun  time.Time `json:"lastRun"`
+}
+
+// orphanGracePeriod is how long a claim which no machine holds is kept
+// before Reconcile removes it. Assign and Request claim the ip before
+// writing the machine, without holding the lock of Reconcile, so a young
+// claim may belong to a DHCP transaction in progress
+const orphanGracePeriod = time.Minute
+
+// orphanClaim is the first sighting of a claim which no machine holds
+type orphanClaim struct {
+	nic   string
+	index uint64
+	since time.Time
+}
+
+// reconcileTotals accumulates the ReconcileStats, and tracks the claims
+// which no machine holds across the runs
+type reconcileTotals struct {
+	mu      sync.Mutex
+	stats   ReconcileStats
+	orphans map[string]orphanClaim
+}
+
+// orphanExpired reports whether the claim on the ip, which no machine holds,
+// has been seen unchanged by the runs for orphanGracePeriod. A claim made
+// again in between, even by the same nic, has another modified index and
+// starts over
+func (t *reconcileTotals) orphanExpired(ip string, claim *etcd.Node, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.orphans == nil {
+		t.orphans = make(map[string]orphanClaim)
+	}
+	seen, exists := t.orphans[ip]
+	if !exists || seen.nic != claim.Value || seen.index != claim.ModifiedIndex {
+		t.orphans[ip] = orphanClaim{claim.Value, claim.ModifiedIndex, now}
+		return false
+	}
+	return now.Sub(seen.since) >= orphanGracePeriod
+}
+
+// keepOrphans forgets the sightings of the ips which aren't orphaned anymore
+func (t *reconcileTotals) keepOrphans(orphaned map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ip := range t.orphans {
+		if !orphaned[ip] {
+			delete(t.orphans, ip)
+		}
+	}
+}
+
+func (t *reconcileTotals) add(report *ReconcileReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Runs++
+	t.stats.Restored += len(report.Restored)
+	t.stats.Removed += len(report.Removed)
+	t.stats.LastRun = time.Now()
+}
+
+// ReconcileStats returns the totals of the runs of Reconcile since the start
+// part of DataSource interface implementation
+func (ds *EtcdDataSource) ReconcileStats() ReconcileStats {
+	ds.reconciled.mu.Lock()
+	defer ds.reconciled.mu.Unlock()
+	return ds.reconciled.stats
+}
+
+// leaseClaims returns the keys under leases, whose values are the nics, by
+// their ips
+func (ds *EtcdDataSource) leaseClaims() (map[string]*etcd.Node, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	claims := make(map[string]*etcd.Node)
+	response, err := ds.keysAPI.Get(ctx, ds.prefixify(leasesEtcdDir), &etcd.GetOptions{Quorum: true})
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return claims, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range response.Node.Nodes {
+		claims[path.Base(node.Key)] = node
+	}
+	return claims, nil
+}
+
+// Reconcile rebuilds the claims on the ips under leases from the machines,
+// which are the source of truth. The claims and the machines are written by
+// separate requests, so a crash in between leaves a claim without a machine,
+// which keeps its ip out of the pool, or a machine without a claim, whose ip
+// can be given to another nic. An ip held by more than one machine is left
+// alone, since there's no telling which one is right. A claim which no
+// machine holds is removed only once it's been seen unchanged for
+// orphanGracePeriod, since it may be of an Assign or a Request in progress,
+// whose machine isn't written yet
+// part of DataSource interface implementation
+func (ds *EtcdDataSource) Reconcile() (*ReconcileReport, error) {
+	ds.lockDHCPData()
+	defer ds.unlockDHCPData()
+
+	claims, err := ds.leaseClaims()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := ds.listMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make(map[string][]string)
+	for _, machine := range machines {
+		ip, err := machine.IP()
+		if err != nil {
+			return nil, err
+		}
+		if ip != nil {
+			holders[ip.String()] = append(holders[ip.String()], machine.Mac().String())
+		}
+	}
+
+	report := &ReconcileReport{
+		Restored: make([]LeaseClaim, 0),
+		Removed:  make([]LeaseClaim, 0),
+	}
+	now := time.Now()
+	orphaned := make(map[string]bool)
+	defer ds.reconciled.keepOrphans(orphaned)
+	for ip, claim := range claims {
+		nic := claim.Value
+		nics := holders[ip]
+		if len(nics) > 1 || (len(nics) == 1 && nics[0] == nic) {
+			continue
+		}
+		if len(nics) == 0 {
+			orphaned[ip] = true
+			if !ds.reconciled.orphanExpired(ip, claim, now) {
+				continue
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		// only if it hasn't been claimed again in between
+		_, err := ds.keysAPI.Delete(ctx, ds.prefixify(leasesEtcdDir+"/"+ip),
+			&etcd.DeleteOptions{PrevValue: nic, PrevIndex: claim.ModifiedIndex})
+		cancel()
+		if etcdError, found := err.(etcd.Error); found &&
+			(etcdError.Code == etcd.ErrorCodeTestFailed || etcdError.Code == etcd.ErrorCodeKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		logging.Log(debugTag, "Reconcile: removed the claim of %s on %s, which doesn't match the machines", nic, ip)
+		report.Removed = append(report.Removed, LeaseClaim{ip, nic})
+		delete(claims, ip)
+		delete(orphaned, ip)
+		if len(nics) == 0 {
+			// no machine holds it, so an allocation of the ipam is given back
+			ds.releaseToIPAM(net.ParseIP(ip))
+		}
+	}
+
+	for ip, nics := range holders {
+		if len(nics) > 1 {
+			logging.Log(debugTag, "Reconcile: %s is held by more than one machine: %v", ip, nics)
+			continue
+		}
+		if _, exists := claims[ip]; exists {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, err := ds.keysAPI.Set(ctx, ds.prefixify(leasesEtcdDir+"/"+ip), nics[0], &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+		cancel()
+		if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeNodeExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		logging.Log(debugTag, "Reconcile: restored the claim of %s on %s", nics[0], ip)
+		report.Restored = append(report.Restored, LeaseClaim{ip, nics[0]})
+	}
+
+	sortClaims(report.Restored)
+	sortClaims(report.Removed)
+	ds.reconciled.add(report)
+	return report, nil
+}
+
+func sortClaims(claims []LeaseClaim) {
+	sort.Slice(claims, func(i, j int) bool { return claims[i].IP < claims[j].IP })
+}
@@ -0,0 +1,91 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestReconcile(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+
+	unclaimed, _ := net.ParseMAC("00:11:22:33:44:01")
+	misclaimed, _ := net.ParseMAC("00:11:22:33:44:02")
+	ds.CreateMachine(unclaimed, net.IPv4(10, 0, 0, 10))
+	ds.CreateMachine(misclaimed, net.IPv4(10, 0, 0, 11))
+	ds.claimIP(net.IPv4(10, 0, 0, 11), "00:11:22:33:44:03")
+	ds.claimIP(net.IPv4(10, 0, 0, 15), "00:11:22:33:44:04")
+
+	report, err := ds.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := []LeaseClaim{{"10.0.0.10", unclaimed.String()}, {"10.0.0.11", misclaimed.String()}}
+	if len(report.Restored) != 2 || report.Restored[0] != restored[0] || report.Restored[1] != restored[1] {
+		t.Errorf("unexpected restored claims: %v", report.Restored)
+	}
+	// the claim which no machine holds may be of an Assign in progress
+	if len(report.Removed) != 1 || report.Removed[0] != (LeaseClaim{"10.0.0.11", "00:11:22:33:44:03"}) {
+		t.Errorf("unexpected removed claims: %v", report.Removed)
+	}
+	if _, err := kapi.Get(context.Background(), ds.leaseKey(net.IPv4(10, 0, 0, 15)), nil); err != nil {
+		t.Error("expected the young orphaned claim to be kept")
+	}
+
+	// seen for the grace period
+	ds.reconciled.mu.Lock()
+	orphan := ds.reconciled.orphans["10.0.0.15"]
+	orphan.since = orphan.since.Add(-orphanGracePeriod)
+	ds.reconciled.orphans["10.0.0.15"] = orphan
+	ds.reconciled.mu.Unlock()
+
+	report, err = ds.Reconcile()
+	if err != nil || len(report.Restored) != 0 || len(report.Removed) != 1 ||
+		report.Removed[0] != (LeaseClaim{"10.0.0.15", "00:11:22:33:44:04"}) {
+		t.Errorf("expected the orphaned claim to be removed, got %+v (%v)", report, err)
+	}
+
+	claims, _ := ds.leaseClaims()
+	if len(claims) != 2 || claims["10.0.0.10"].Value != unclaimed.String() || claims["10.0.0.11"].Value != misclaimed.String() {
+		t.Errorf("unexpected claims after reconcile: %v", claims)
+	}
+	if _, err := kapi.Get(context.Background(), ds.leaseKey(net.IPv4(10, 0, 0, 15)), nil); err == nil {
+		t.Error("the orphaned claim still exists")
+	}
+
+	report, err = ds.Reconcile()
+	if err != nil || len(report.Restored) != 0 || len(report.Removed) != 0 {
+		t.Errorf("expected nothing to repair the third time, got %+v (%v)", report, err)
+	}
+	if len(ds.reconciled.orphans) != 0 {
+		t.Errorf("expected the sightings of the removed claims to be forgotten, got %v", ds.reconciled.orphans)
+	}
+
+	if stats := ds.ReconcileStats(); stats.Runs != 3 || stats.Restored != 2 || stats.Removed != 2 || stats.LastRun.IsZero() {
+		t.Errorf("unexpected totals: %+v", stats)
+	}
+}
+
+func TestReconcileKeepsReclaimedOrphan(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	ip := net.IPv4(10, 0, 0, 15)
+	ds.claimIP(ip, "00:11:22:33:44:04")
+	if report, _ := ds.Reconcile(); len(report.Removed) != 0 {
+		t.Fatalf("expected the young claim to be kept, got %v", report.Removed)
+	}
+
+	// claimed again meanwhile, by a new transaction of the nic
+	ds.releaseIP(ip, "00:11:22:33:44:04")
+	ds.claimIP(ip, "00:11:22:33:44:04")
+	ds.reconciled.mu.Lock()
+	for key, orphan := range ds.reconciled.orphans {
+		orphan.since = orphan.since.Add(-orphanGracePeriod)
+		ds.reconciled.orphans[key] = orphan
+	}
+	ds.reconciled.mu.Unlock()
+
+	if report, _ := ds.Reconcile(); len(report.Removed) != 0 {
+		t.Errorf("expected the claim made again to start over, got %v", report.Removed)
+	}
+}
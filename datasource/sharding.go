@@ -0,0 +1,182 @@
+package datasource
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// MachineSharding is the layout of the entries of the machines in etcd
+type MachineSharding string
+
+const (
+	// ShardingNone keeps the entries in a flat directory, machines/<name>
+	ShardingNone MachineSharding = "none"
+	// ShardingFirstOctet keeps the entries in a directory per first octet of
+	// their hardware address, like machines/00/node001122334455, so that
+	// listing the machines doesn't read a single huge directory
+	ShardingFirstOctet MachineSharding = "first-octet"
+)
+
+// ParseMachineSharding parses the name of a MachineSharding. Empty means
+// ShardingNone
+func ParseMachineSharding(s string) (MachineSharding, error) {
+	switch MachineSharding(s) {
+	case "", ShardingNone:
+		return ShardingNone, nil
+	case ShardingFirstOctet:
+		return ShardingFirstOctet, nil
+	}
+	return "", fmt.Errorf("unknown machine sharding: %q (none or first-octet)", s)
+}
+
+// machineDir returns the directory of the machine with the hardware address
+// under the cluster prefix, in the layout of the sharding
+func (s MachineSharding) machineDir(mac net.HardwareAddr) string {
+	name := nameFromMac(mac.String())
+	if s == ShardingFirstOctet && len(mac) > 0 {
+		return path.Join("machines", hex.EncodeToString(mac[:1]), name)
+	}
+	return path.Join("machines", name)
+}
+
+// isShard reports whether an entry of the machines directory is the
+// directory of a shard, like 00
+func isShard(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == 1
+}
+
+// SetMachineSharding sets the layout of the entries of the machines. The
+// entries in another layout aren't found, until they're moved by
+// MigrateMachineSharding
+func (ds *EtcdDataSource) SetMachineSharding(sharding MachineSharding) {
+	ds.machineSharding = sharding
+}
+
+func (ds *EtcdDataSource) machineDir(mac net.HardwareAddr) string {
+	return ds.machineSharding.machineDir(mac)
+}
+
+// machineEntries returns the entries of the directories of the machines,
+// without their contents. With the sharding, the shards are read one by one
+func (ds *EtcdDataSource) machineEntries() (etcd.Nodes, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	response, err := ds.keysAPI.Get(ctx, ds.prefixify("/machines"), &etcd.GetOptions{Recursive: false})
+	if err != nil {
+		return nil, err
+	}
+	if ds.machineSharding != ShardingFirstOctet {
+		return response.Node.Nodes, nil
+	}
+
+	var entries etcd.Nodes
+	for _, ent := range response.Node.Nodes {
+		if !ent.Dir || !isShard(path.Base(ent.Key)) {
+			// left in the flat layout, reported by listMachines
+			entries = append(entries, ent)
+			continue
+		}
+		ctx1, cancel1 := context.WithTimeout(context.Background(), 3*time.Second)
+		shard, err := ds.keysAPI.Get(ctx1, ent.Key, &etcd.GetOptions{Recursive: false})
+		cancel1()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, shard.Node.Nodes...)
+	}
+	return entries, nil
+}
+
+// MigrateMachineSharding moves the entries of the machines which are in
+// another layout than the one set by SetMachineSharding, and returns how
+// many it moved. Each entry is copied, along with its hidden keys which the
+// listings leave out, and deleted only once all its keys are found in the
+// copy. The instances of blacksmith should be stopped meanwhile
+func (ds *EtcdDataSource) MigrateMachineSharding() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+
+	response, err := ds.keysAPI.Get(ctx, ds.prefixify("/machines"), &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		return 0, err
+	}
+
+	var entries etcd.Nodes
+	for _, ent := range response.Node.Nodes {
+		if ent.Dir && isShard(path.Base(ent.Key)) {
+			entries = append(entries, ent.Nodes...)
+		} else {
+			entries = append(entries, ent)
+		}
+	}
+
+	moved := 0
+	for _, ent := range entries {
+		macStr, err := macFromName(path.Base(ent.Key))
+		if err != nil {
+			logging.Log(debugTag, "Skipping the machine entry %s: %s", ent.Key, err)
+			continue
+		}
+		mac, err := parseNIC(macStr)
+		if err != nil {
+			logging.Log(debugTag, "Skipping the machine entry %s: %s", ent.Key, err)
+			continue
+		}
+		newDir := path.Join("/", ds.prefixify(ds.machineDir(mac)))
+		if ent.Key == newDir {
+			continue
+		}
+
+		if err := addHiddenKeys(ds.keysAPI, ent); err != nil {
+			return moved, err
+		}
+		m := &prefixMigration{keysAPI: ds.keysAPI, oldPrefix: ent.Key, newPrefix: newDir}
+		if err := m.copyNode(ent); err != nil {
+			return moved, fmt.Errorf("Error while copying %s to %s: %s", ent.Key, newDir, err)
+		}
+		if err := ds.checkMachineCopy(ent, newDir); err != nil {
+			return moved, err
+		}
+		ctx1, cancel1 := context.WithTimeout(context.Background(), etcdTimeout)
+		_, err = ds.keysAPI.Delete(ctx1, ent.Key, &etcd.DeleteOptions{Recursive: true})
+		cancel1()
+		if err != nil {
+			return moved, fmt.Errorf("Error while deleting %s: %s", ent.Key, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// checkMachineCopy verifies that every key of the machine entry, including
+// the hidden ones, has been copied to newDir with its value, so the entry
+// can be deleted
+func (ds *EtcdDataSource) checkMachineCopy(ent *etcd.Node, newDir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := ds.keysAPI.Get(ctx, newDir, &etcd.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		return fmt.Errorf("Error while reading the copy %s: %s", newDir, err)
+	}
+	if err := addHiddenKeys(ds.keysAPI, response.Node); err != nil {
+		return err
+	}
+
+	copied := leafValues(response.Node, newDir)
+	for key, value := range leafValues(ent, ent.Key) {
+		if copiedValue, found := copied[key]; !found || copiedValue != value {
+			return fmt.Errorf("%s wasn't copied to %s, keeping the original", key, newDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMachineSharding(t *testing.T) {
+	ds, kapi := newTestDataSource(t)
+
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("aa:11:22:33:44:02")
+	flat, _ := ds.CreateMachine(mac1, net.IPv4(10, 0, 0, 10))
+	ds.SetFlagHistory(2)
+	flat.SetFlag("role", "storage")
+	flat.SetNote("rack 4")
+	bmc := BMCCredentials{Address: "10.0.1.10", User: "admin", Password: "secret"}
+	if err := flat.SetBMC(bmc); err != nil {
+		t.Fatal(err)
+	}
+	firstSeen, _ := flat.FirstSeen()
+
+	ds.SetMachineSharding(ShardingFirstOctet)
+	if _, exists := ds.GetMachine(mac1); exists {
+		t.Error("expected the flat entry not to be found before the migration")
+	}
+	if _, created := ds.CreateMachine(mac2, net.IPv4(10, 0, 0, 11)); !created {
+		t.Fatal("couldn't create the machine")
+	}
+	if _, err := kapi.Get(context.Background(), ds.prefixify("machines/aa/nodeaa1122334402/_IP"), nil); err != nil {
+		t.Errorf("expected the machine in its shard: %s", err)
+	}
+
+	moved, err := ds.MigrateMachineSharding()
+	if err != nil || moved != 1 {
+		t.Fatalf("expected 1 moved machine, got %d (%v)", moved, err)
+	}
+	if _, err := kapi.Get(context.Background(), ds.prefixify("machines/node001122334401"), nil); err == nil {
+		t.Error("expected the flat entry to be deleted")
+	}
+	machine, exists := ds.GetMachine(mac1)
+	if !exists {
+		t.Fatal("expected the machine in its shard after the migration")
+	}
+	if role, _ := machine.GetFlag("role"); role != "storage" {
+		t.Errorf("expected the flags to be moved, got %q", role)
+	}
+	if ip, _ := machine.IP(); !ip.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("expected the ip to be moved, got %s", ip)
+	}
+	if note, _ := machine.Note(); note != "rack 4" {
+		t.Errorf("expected the note to be moved, got %q", note)
+	}
+	if got, _ := machine.BMC(); got != bmc {
+		t.Errorf("expected the bmc to be moved, got %+v", got)
+	}
+	if seen, err := machine.FirstSeen(); err != nil || !seen.Equal(firstSeen) {
+		t.Errorf("expected the first seen time to be moved, got %s (%v)", seen, err)
+	}
+	if history, _ := machine.FlagHistory("role"); len(history) != 1 || history[0].Value != "storage" {
+		t.Errorf("expected the flag history to be moved, got %+v", history)
+	}
+
+	machines, err := ds.listMachines()
+	if err != nil || len(machines) != 2 {
+		t.Errorf("expected the machines of both shards, got %d (%v)", len(machines), err)
+	}
+
+	if moved, err := ds.MigrateMachineSharding(); err != nil || moved != 0 {
+		t.Errorf("expected nothing to move the second time, got %d (%v)", moved, err)
+	}
+	if _, err := ParseMachineSharding("last-octet"); err == nil {
+		t.Error("expected an error for an unknown sharding")
+	}
+}
@@ -0,0 +1,88 @@
+package datasource
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Boot states of a machine, stored in its "state" flag
+const (
+	StateUnknown    = "unknown"
+	StateInstalling = "installing"
+	StateInstalled  = "installed"
+	StateRunning    = "running"
+
+	// StateFlag is the flag of the boot state, which is only changed by
+	// SetState, so the transitions are checked
+	StateFlag = "state"
+)
+
+// stateTransitions lists the states each state can move to. Going back to
+// installing is allowed for re-installing a machine
+var stateTransitions = map[string][]string{
+	StateUnknown:    {StateInstalling},
+	StateInstalling: {StateInstalled},
+	StateInstalled:  {StateRunning, StateInstalling},
+	StateRunning:    {StateInstalling},
+}
+
+// ValidStateTransition reports whether a machine in state from can be moved to
+// state to
+func ValidStateTransition(from, to string) bool {
+	if from == to {
+		_, known := stateTransitions[to]
+		return known
+	}
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// SetState moves the machine with the given hardware address to the given
+// boot state, if the transition from its current state is valid. The state
+// is compared and set in one write, so of two concurrent transitions from
+// the same state only one succeeds
+// part of GeneralDataSource interface implementation
+func (ds *EtcdDataSource) SetState(mac net.HardwareAddr, state string) error {
+	machine, exist := ds.GetMachine(mac)
+	if !exist {
+		return fmt.Errorf("%w: %s", ErrMachineNotFound, mac)
+	}
+
+	current, err := machine.GetFlag(StateFlag)
+	if err != nil {
+		return err
+	}
+	if !ValidStateTransition(current, state) {
+		return fmt.Errorf("%w for %s: %s -> %s",
+			ErrInvalidStateTransition, machine.Name(), current, state)
+	}
+
+	return machine.(*EtcdMachine).compareAndSetFlag(StateFlag, current, state)
+}
+
+// compareAndSetFlag sets the flag to value only if it's still prev
+func (m *EtcdMachine) compareAndSetFlag(key, prev, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.keysAPI.Set(ctx, path.Join(m.etcd.ClusterName(), m.prefixify(key)), value,
+		&etcd.SetOptions{PrevValue: prev})
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeTestFailed {
+		return fmt.Errorf("%w for %s: %s changed from %s meanwhile",
+			ErrInvalidStateTransition, m.Name(), key, prev)
+	}
+	if err != nil {
+		return err
+	}
+	m.recordFlagHistory(key, FlagHistoryEntry{Time: time.Now(), Value: value})
+	return nil
+}
@@ -0,0 +1,58 @@
+package datasource
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestValidStateTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		valid    bool
+	}{
+		{StateUnknown, StateInstalling, true},
+		{StateUnknown, StateInstalled, false},
+		{StateUnknown, StateRunning, false},
+		{StateInstalling, StateInstalled, true},
+		{StateInstalling, StateRunning, false},
+		{StateInstalled, StateRunning, true},
+		{StateInstalled, StateInstalling, true},
+		{StateRunning, StateInstalling, true},
+		{StateRunning, StateUnknown, false},
+		{StateRunning, StateRunning, true},
+		{"bogus", "bogus", false},
+		{StateUnknown, "bogus", false},
+	} {
+		if valid := ValidStateTransition(tc.from, tc.to); valid != tc.valid {
+			t.Errorf("%s -> %s: expected %t, got %t", tc.from, tc.to, tc.valid, valid)
+		}
+	}
+}
+
+func TestSetState(t *testing.T) {
+	ds, _ := newTestDataSource(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	if err := ds.SetState(mac, StateInstalled); !errors.Is(err, ErrInvalidStateTransition) {
+		t.Errorf("expected an invalid transition, got %v", err)
+	}
+	if err := ds.SetState(mac, StateInstalling); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := machine.GetFlag(StateFlag); state != StateInstalling {
+		t.Errorf("expected the installing state, got %q", state)
+	}
+
+	// a transition checked against a state which changed meanwhile fails
+	err := machine.(*EtcdMachine).compareAndSetFlag(StateFlag, StateUnknown, StateInstalling)
+	if !errors.Is(err, ErrInvalidStateTransition) {
+		t.Errorf("expected the stale transition to fail, got %v", err)
+	}
+
+	other, _ := net.ParseMAC("00:11:22:33:44:56")
+	if err := ds.SetState(other, StateInstalling); !errors.Is(err, ErrMachineNotFound) {
+		t.Errorf("expected ErrMachineNotFound, got %v", err)
+	}
+}
@@ -11,7 +11,8 @@ type Machine interface {
 	// Nic returns the hardware address of the machine
 	Mac() net.HardwareAddr
 
-	// IP reutrns the IP address associated with the machine
+	// IP reutrns the IP address associated with the machine, or nil if its
+	// lease has been expired
 	IP() (net.IP, error)
 
 	// Name returns the hostname of the machine
@@ -27,7 +28,35 @@ type Machine interface {
 	// LastSeen returns the last time the machine has been seen
 	LastSeen() (time.Time, error)
 
-	// ListFlags returns the list of all the flgas of a machine from Etcd
+	// CheckIn updates the last time the machine has been seen to now
+	CheckIn() error
+
+	// RecordBoot increments the boot count of the machine and sets its last
+	// boot time to now. Concurrent calls don't lose increments
+	RecordBoot() error
+
+	// Boots returns the boot count of the machine and the time of its last
+	// boot, which is zero if it has none
+	Boots() (int, time.Time, error)
+
+	// Note returns the free-text note of the machine, or an empty string if
+	// it has none
+	Note() (string, error)
+
+	// SetNote sets the note of the machine, up to MaxNoteLength bytes
+	SetNote(note string) error
+
+	// BMC returns the address and the credentials of the BMC of the
+	// machine, which are empty if unknown
+	BMC() (BMCCredentials, error)
+
+	// SetBMC sets the address and the credentials of the BMC of the
+	// machine, which are kept in reserved keys. An empty address removes
+	// them
+	SetBMC(BMCCredentials) error
+
+	// ListFlags returns the list of all the flgas of a machine from Etcd,
+	// without the credentials of its BMC
 	ListFlags() (map[string]string, error)
 
 	// GetFlag returns the value of the supplied key
@@ -36,12 +65,40 @@ type Machine interface {
 	// SetFlag sets the value of the specified key
 	SetFlag(key string, value string) error
 
+	// CreateFlag sets the value of the specified key only if it isn't set,
+	// atomically. created reports whether the value was set by this call
+	CreateFlag(key string, value string) (created bool, err error)
+
+	// GetIntFlag returns the value of the key parsed as an integer, or an
+	// error if it's malformed
+	GetIntFlag(key string) (int, error)
+
+	// GetBoolFlag returns the value of the key parsed as a boolean, or an
+	// error if it's malformed
+	GetBoolFlag(key string) (bool, error)
+
+	// GetJSONFlag unmarshals the value of the key into out
+	GetJSONFlag(key string, out interface{}) error
+
 	// GetAndDeleteFlag gets the value associated with the key
-	// and erases it afterwards
+	// and erases it afterwards. The reserved keys fail with ErrReservedFlag
 	GetAndDeleteFlag(key string) (string, error)
 
-	// DeleteFlag erases the entry specified by key
+	// DeleteFlag erases the entry specified by key. The reserved keys fail
+	// with ErrReservedFlag
 	DeleteFlag(key string) error
+
+	// ForceDeleteFlag is like DeleteFlag, but erases the reserved keys too
+	ForceDeleteFlag(key string) error
+
+	// FlagHistory returns the recorded values of the flag in chronological
+	// order, up to the retention of the history
+	FlagHistory(key string) ([]FlagHistoryEntry, error)
+
+	// FlagsRevision returns an opaque value which changes whenever the
+	// flags of the machine change. Checking in doesn't change it, and
+	// neither may changing the IP
+	FlagsRevision() (string, error)
 }
 
 // GeneralDataSource provides the interface for querying general information
@@ -55,11 +112,23 @@ type DataSource interface {
 	// address. Returns a flag to specify whether or not the entry exists
 	GetMachine(net.HardwareAddr) (Machine, bool)
 
+	// GetMachineByIP returns the Machine which holds the IP. Returns a flag
+	// to specify whether or not such a machine exists
+	GetMachineByIP(net.IP) (Machine, bool)
+
+	// SetState moves the machine with the specified hardware address to a new
+	// boot state. Returns an error if the transition isn't valid
+	SetState(net.HardwareAddr, string) error
+
 	// CreateMachine creates a machine with the specified hardware address and IP
 	// the second return value will be set to true in case of successful machine
 	// creation and to false in case of duplicate hardware address or IP
 	CreateMachine(net.HardwareAddr, net.IP) (Machine, bool)
 
+	// DeleteMachine removes the machine with the specified hardware address,
+	// its flags and its DNS record, and takes its IP back to the pool
+	DeleteMachine(net.HardwareAddr) error
+
 	// WorkspacePath returns the path to the workspace which is used after the
 	// machines are booted up
 	WorkspacePath() string
@@ -83,23 +152,79 @@ type DataSource interface {
 	// ClusterName returns the name of the ClusterName
 	ClusterName() string
 
+	// Config returns the runtime configuration values, merged from the
+	// initial values and the overrides stored in the datasource
+	Config() (map[string]ConfigValue, error)
+
+	// SetConfig updates a mutable runtime configuration value
+	SetConfig(key, value string) error
+
 	// LeaseStart specifies dhcp pool starting ip
 	LeaseStart() net.IP
 	// LeaseRange specifies number of IPs the dhcp server can assign
 	LeaseRange() int
+	// PoolStats returns the utilization of the dhcp pool
+	PoolStats() (*PoolStats, error)
 
-	// Assign finds an IP for the specified nic
+	// Assign finds an IP for the specified nic. Fails with ErrMaintenance
+	// while the maintenance mode is on
 	Assign(nic string) (net.IP, error)
 
 	// Request is how to client requests to use the Ip address
 	Request(nic string, currentIP net.IP) (net.IP, error)
 
+	// ExpireLease takes the IP of the machine back to the pool, keeping the
+	// rest of the machine, and returns the freed IP. The next Discover of
+	// the machine gets a fresh assignment. Returns ErrNoLease if the
+	// machine has no IP
+	ExpireLease(net.HardwareAddr) (net.IP, error)
+
 	// DNSAddresses returns addresses of the dns servers present in the network which
 	// can answer "what is the ip address of nodeX ?"
 	// a byte slice is returned to be used as option 6 (rfc2132) in a dhcp Request
 	// reply packet
 	DNSAddresses() ([]byte, error)
 
+	// ExportFlags returns all the flags of the machine with the hardware
+	// address, including the reserved ones
+	ExportFlags(net.HardwareAddr) (map[string]string, error)
+	// ImportFlags sets the flags on the machine with the hardware address,
+	// e.g. the ones exported from the machine it replaces. The reserved
+	// flags are skipped, and so are the ones the machine has already unless
+	// overwrite is set
+	ImportFlags(mac net.HardwareAddr, flags map[string]string, overwrite bool) error
+
+	// AddAuditEntry appends an entry to the audit log of flag changes
+	AddAuditEntry(entry AuditEntry) error
+	// AuditEntries returns the audit log of flag changes in chronological
+	// order, only of the specified machine if the hardware address isn't nil
+	AuditEntries(net.HardwareAddr) ([]AuditEntry, error)
+
+	// AcquireLock takes the named lock for the owner, or renews it if the
+	// owner holds it already. The lock is released after the ttl, unless
+	// renewed. Returns false if another owner holds the lock
+	AcquireLock(name, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLock releases the named lock, if the owner holds it. Returns
+	// ErrLockNotHeld if another owner holds it
+	ReleaseLock(name, owner string) error
+
+	// Maintenance reports whether the maintenance mode is on
+	Maintenance() (bool, error)
+	// SetMaintenance turns the maintenance mode on or off. While it's on,
+	// Assign offers no leases, and Request keeps renewing them
+	SetMaintenance(enabled bool) error
+
+	// Reconcile rebuilds the claims on the ips from the machines, removing
+	// the orphaned ones, and returns what it repaired
+	Reconcile() (*ReconcileReport, error)
+	// ReconcileStats returns the totals of the runs of Reconcile by this
+	// instance
+	ReconcileStats() ReconcileStats
+
+	// EtcdEndpoints returns the health of each of the configured etcd
+	// endpoints
+	EtcdEndpoints() []EtcdEndpointHealth
+
 	IsMaster() bool
 	RemoveInstance() error
 }
@@ -0,0 +1,38 @@
+package datasource
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// imageFiles are the files each CoreOS version folder of the images must have
+var imageFiles = []string{
+	"coreos_production_pxe.vmlinuz",
+	"coreos_production_pxe_image.cpio.gz",
+}
+
+// ValidateWorkspace checks the initial.yaml of the workspace, and that the
+// images of its initial CoreOS version are present for amd64, and for arm64
+// if it has a folder, without touching etcd
+func ValidateWorkspace(workspacePath string) []error {
+	iVals, _, err := readInitialValues(workspacePath)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, arch := range []string{ArchAMD64, ArchARM64} {
+		imagePath := ImageDir(workspacePath, iVals.CoreOSVersion, arch)
+		if _, err := os.Stat(imagePath); arch != ArchAMD64 && os.IsNotExist(err) {
+			// the images of the other archs are optional
+			continue
+		}
+		for _, name := range imageFiles {
+			if _, err := os.Stat(filepath.Join(imagePath, name)); err != nil {
+				errs = append(errs, fmt.Errorf("Image of the initial CoreOS version is missing: %s", err))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,34 @@
+package datasource
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	if errs := ValidateWorkspace(dir); len(errs) != 1 {
+		t.Errorf("expected an error for the missing initial.yaml, got %v", errs)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "initial.yaml"), []byte("coreos-version: 1000.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := ValidateWorkspace(dir); len(errs) != len(imageFiles) {
+		t.Errorf("expected an error for each missing image, got %v", errs)
+	}
+
+	versionPath := filepath.Join(dir, "images", "1000.0.0")
+	if err := os.MkdirAll(versionPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range imageFiles {
+		if err := os.WriteFile(filepath.Join(versionPath, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := ValidateWorkspace(dir); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
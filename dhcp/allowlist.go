@@ -0,0 +1,69 @@
+package dhcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// parseMACPrefix parses a hardware address prefix like 00:11:22 or 00-11-22
+func parseMACPrefix(s string) (net.HardwareAddr, error) {
+	octets := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	if len(octets) == 0 || len(octets) > 6 {
+		return nil, fmt.Errorf("invalid hardware address prefix: %q", s)
+	}
+	prefix := make(net.HardwareAddr, len(octets))
+	for i, octet := range octets {
+		b, err := hex.DecodeString(octet)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("invalid hardware address prefix: %q", s)
+		}
+		prefix[i] = b[0]
+	}
+	return prefix, nil
+}
+
+// ReadAllowlist reads the hardware address prefixes from the file, one per
+// line. Empty lines and the lines starting with # are skipped
+func ReadAllowlist(path string) ([]net.HardwareAddr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []net.HardwareAddr
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefix, err := parseMACPrefix(line)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}
+
+// allowed reports whether the client should be served. Unless AllowlistOnly
+// is set, all the clients are served. Otherwise, only the known machines and
+// the hardware addresses matching AllowedPrefixes are
+func (h *DHCPHandler) allowed(mac net.HardwareAddr) bool {
+	if !h.settings.AllowlistOnly {
+		return true
+	}
+	for _, prefix := range h.settings.AllowedPrefixes {
+		if bytes.HasPrefix(mac, prefix) {
+			return true
+		}
+	}
+	_, exists := h.datasource.GetMachine(mac)
+	return exists
+}
@@ -0,0 +1,62 @@
+package dhcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestReadAllowlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist")
+	content := "# lab machines\n00:11:22\n\naa-bb-cc-dd\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prefixes, err := ReadAllowlist(path)
+	if err != nil {
+		t.Fatalf("ReadAllowlist: %s", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "00:11:22" || prefixes[1].String() != "aa:bb:cc:dd" {
+		t.Errorf("unexpected prefixes: %v", prefixes)
+	}
+
+	for _, invalid := range []string{"", "0:1:2", "00:11:zz", "00:11:22:33:44:55:66"} {
+		if _, err := parseMACPrefix(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	known, _ := net.ParseMAC("00:00:00:00:00:01")
+	ds.CreateMachine(known, net.IPv4(10, 0, 0, 10))
+	h := &DHCPHandler{
+		settings: &DHCPSetting{
+			AllowlistOnly:   true,
+			AllowedPrefixes: []net.HardwareAddr{{0x00, 0x11, 0x22}},
+		},
+		datasource: ds,
+	}
+
+	for mac, expected := range map[string]bool{
+		"00:00:00:00:00:01": true,
+		"00:11:22:33:44:55": true,
+		"00:11:23:33:44:55": false,
+	} {
+		hw, _ := net.ParseMAC(mac)
+		if allowed := h.allowed(hw); allowed != expected {
+			t.Errorf("%s: expected allowed=%v, got %v", mac, expected, allowed)
+		}
+	}
+
+	h.settings.AllowlistOnly = false
+	unknown, _ := net.ParseMAC("00:11:23:33:44:55")
+	if !h.allowed(unknown) {
+		t.Error("expected all the clients to be allowed without AllowlistOnly")
+	}
+}
@@ -0,0 +1,157 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+
+	"github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// magicCookie starts the options of the DHCP packets and of the BOOTP
+// packets with the RFC 1497 vendor extensions
+var magicCookie = []byte{99, 130, 83, 99}
+
+// isBOOTP reports whether p is a BOOTP request, which has no DHCP message
+// type option
+func isBOOTP(p dhcp4.Packet) bool {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootRequest || p.HLen() > 16 {
+		return false
+	}
+	if !bytes.Equal(p[236:240], magicCookie) {
+		return true
+	}
+	_, isDHCP := p.ParseOptions()[dhcp4.OptionDHCPMessageType]
+	return !isDHCP
+}
+
+// isDHCPOnly reports whether the option is an extension of DHCP (RFC 2132,
+// section 9), like the lease time, which the BOOTP clients may reject
+func isDHCPOnly(code dhcp4.OptionCode) bool {
+	return code >= dhcp4.OptionRequestedIPAddress && code <= dhcp4.OptionClientIdentifier
+}
+
+// ServeBOOTP answers a BOOTP request with the address of the machine,
+// assigning it one if it's new. BOOTP has no leases, so the address is kept
+// until the lease is expired through the api. The reply carries the boot
+// file in its file field and none of the DHCP extensions
+func (h *DHCPHandler) ServeBOOTP(p dhcp4.Packet) dhcp4.Packet {
+	mac := p.CHAddr()
+	if !h.allowed(mac) {
+		logging.DebugMAC("DHCP", mac, "ignoring the unknown bootp client - CHADDR %s", mac.String())
+		h.recordEvent(EventIgnore, mac, nil, "unknown bootp client in the allowlist-only mode")
+		return nil
+	}
+	dhcpOptions, err := h.networkOptions(mac)
+	if err != nil {
+		logging.Log(debugTag, "Failed to read dns addresses")
+		return nil
+	}
+
+	ip, err := h.datasource.Assign(mac.String())
+	if err != nil {
+		logging.DebugMAC("DHCP", mac, "bootp - err in lease pool - %s", err.Error())
+		h.recordEvent(EventIgnore, mac, nil, err.Error())
+		return nil
+	}
+
+	packet := dhcp4.NewPacket(dhcp4.BootReply)
+	packet.SetXId(p.XId())
+	packet.SetFlags(p.Flags())
+	packet.SetGIAddr(p.GIAddr())
+	packet.SetCHAddr(mac)
+	packet.SetYIAddr(ip)
+	packet.SetSIAddr(h.settings.ServerIP.To4())
+	packet.SetFile([]byte(h.bootFileName()))
+	for _, option := range dhcpOptions.SelectOrderOrAll(nil) {
+		if !isDHCPOnly(option.Code) {
+			packet.AddOption(option.Code, option.Value)
+		}
+	}
+	packet.AddOption(dhcp4.OptionHostName, []byte(h.hostname(mac, ip)))
+	packet.PadToMinSize()
+
+	logging.LogMAC("DHCP", mac, "bootp request - CHADDR %s - IP %s", mac.String(), ip.String())
+	h.recordEvent(EventBOOTP, mac, ip, "")
+	return packet
+}
+
+// bootpConn answers the BOOTP requests itself, since dhcp4.Serve drops the
+// packets without a DHCP message type, and passes the rest to dhcp4.Serve
+type bootpConn struct {
+	dhcp4.ServeConn
+	handler *DHCPHandler
+}
+
+func (c *bootpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.ServeConn.ReadFrom(b)
+		if err != nil || !isBOOTP(dhcp4.Packet(b[:n])) {
+			return n, addr, err
+		}
+		request := append(dhcp4.Packet(nil), b[:n]...)
+		reply := c.handler.ServeBOOTP(request)
+		if reply == nil {
+			continue
+		}
+		// like dhcp4.Serve, the clients without an address get a broadcast
+		ipStr, portStr, err := net.SplitHostPort(addr.String())
+		if err == nil && (net.ParseIP(ipStr).Equal(net.IPv4zero) || request.Broadcast()) {
+			port, _ := strconv.Atoi(portStr)
+			addr = &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+		}
+		if _, err := c.ServeConn.WriteTo(reply, addr); err != nil {
+			logging.DebugMAC("DHCP", request.CHAddr(), "failed to send the bootp reply - %s", err)
+		}
+	}
+}
+
+// ifConn serves the packets of a single interface, like the connection of
+// dhcp4.ServeIf
+type ifConn struct {
+	ifIndex int
+	conn    *ipv4.PacketConn
+	cm      *ipv4.ControlMessage
+}
+
+func (c *ifConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, c.cm, addr, err = c.conn.ReadFrom(b)
+		if err != nil || c.cm == nil || c.cm.IfIndex == c.ifIndex {
+			return
+		}
+	}
+}
+
+func (c *ifConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// the source of the received packet can't be reused for sending
+	c.cm.Src = nil
+	return c.conn.WriteTo(b, c.cm, addr)
+}
+
+// listenAndServeBOOTP serves DHCP and BOOTP on port 67, on the interface if
+// it isn't empty
+func listenAndServeBOOTP(ifName string, handler *DHCPHandler) error {
+	l, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	var conn dhcp4.ServeConn = l
+	if ifName != "" {
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		p := ipv4.NewPacketConn(l)
+		if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			return err
+		}
+		conn = &ifConn{ifIndex: iface.Index, conn: p}
+	}
+	return dhcp4.Serve(&bootpConn{ServeConn: conn, handler: handler}, handler)
+}
@@ -0,0 +1,93 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestIsBOOTP(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+
+	vendorExtensions := dhcp4.NewPacket(dhcp4.BootRequest)
+	vendorExtensions.SetCHAddr(mac)
+	vendorExtensions.PadToMinSize()
+
+	noCookie := make(dhcp4.Packet, 300)
+	noCookie.SetOpCode(dhcp4.BootRequest)
+	noCookie.SetHType(1)
+	noCookie.SetCHAddr(mac)
+
+	discover := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 4}, false, nil)
+
+	reply := dhcp4.NewPacket(dhcp4.BootReply)
+	reply.PadToMinSize()
+
+	for name, tc := range map[string]struct {
+		packet dhcp4.Packet
+		bootp  bool
+	}{
+		"vendor extensions": {vendorExtensions, true},
+		"no cookie":         {noCookie, true},
+		"dhcp discover":     {discover, false},
+		"reply":             {reply, false},
+		"short":             {noCookie[:200], false},
+	} {
+		if bootp := isBOOTP(tc.packet); bootp != tc.bootp {
+			t.Errorf("%s: expected %v, got %v", name, tc.bootp, bootp)
+		}
+	}
+}
+
+func TestServeBOOTP(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	h, _ := newDHCPHandler(&DHCPSetting{
+		ServerIP:   net.IPv4(10, 0, 0, 1),
+		SubnetMask: net.IPv4(255, 255, 255, 0),
+		RouterAddr: net.IPv4(10, 0, 0, 1),
+		CustomOptions: CustomOptions{
+			dhcp4.OptionIPAddressLeaseTime: []byte{0, 0, 0, 60},
+		},
+	}, ds)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	request := dhcp4.NewPacket(dhcp4.BootRequest)
+	request.SetCHAddr(mac)
+	request.SetXId([]byte{1, 2, 3, 4})
+
+	reply := h.ServeBOOTP(request)
+	if reply == nil {
+		t.Fatal("expected a reply")
+	}
+	if len(reply) < 272 || reply.OpCode() != dhcp4.BootReply {
+		t.Fatalf("expected a padded boot reply, got %d bytes", len(reply))
+	}
+	machine, exists := ds.GetMachine(mac)
+	if !exists {
+		t.Fatal("expected the machine to be created")
+	}
+	if ip, _ := machine.IP(); !reply.YIAddr().Equal(ip) {
+		t.Errorf("expected the address of the machine, got %s", reply.YIAddr())
+	}
+	if !reply.SIAddr().Equal(net.IPv4(10, 0, 0, 1)) || string(reply.File()[:len(defaultBootFileName)]) != defaultBootFileName {
+		t.Errorf("unexpected boot server %s and file %q", reply.SIAddr(), reply.File())
+	}
+
+	options := reply.ParseOptions()
+	for _, code := range []dhcp4.OptionCode{dhcp4.OptionDHCPMessageType, dhcp4.OptionServerIdentifier, dhcp4.OptionIPAddressLeaseTime} {
+		if _, exists := options[code]; exists {
+			t.Errorf("expected no DHCP option %d in the reply", code)
+		}
+	}
+	if _, exists := options[dhcp4.OptionSubnetMask]; !exists {
+		t.Error("expected the subnet mask in the reply")
+	}
+
+	again := h.ServeBOOTP(request)
+	if again == nil || !again.YIAddr().Equal(reply.YIAddr()) {
+		t.Error("expected the same address on the next request")
+	}
+}
@@ -0,0 +1,90 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Types of the decisions recorded in the EventLog
+const (
+	EventOffer  = "offer"
+	EventAck    = "ack"
+	EventNak    = "nak"
+	EventIgnore = "ignore"
+	EventBOOTP  = "bootp"
+)
+
+// Event is a decision of the DHCP handler about a client
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Mac    string    `json:"mac"`
+	IP     net.IP    `json:"ip,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// EventLog keeps the last decisions of the DHCP handler in a ring buffer, so
+// they can be inspected without the logs. A nil EventLog records nothing
+type EventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+// NewEventLog returns an EventLog which keeps the last size events, or nil
+// if size isn't positive
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		return nil
+	}
+	return &EventLog{events: make([]Event, size)}
+}
+
+// Add records the event, stamped with the current time if it has none
+func (l *EventLog) Add(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Events returns the recorded events in chronological order
+func (l *EventLog) Events() []Event {
+	if l == nil {
+		return []Event{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event{}, l.events[:l.next]...)
+	}
+	return append(append([]Event{}, l.events[l.next:]...), l.events[:l.next]...)
+}
+
+// recordEvent adds the decision to the event log of the settings. The ip is
+// copied, since it may point into the buffer of the packet, which is reused
+func (h *DHCPHandler) recordEvent(eventType string, mac net.HardwareAddr, ip net.IP, reason string) {
+	var ipCopy net.IP
+	if ip != nil {
+		ipCopy = append(net.IP(nil), ip...)
+	}
+	h.settings.Events.Add(Event{
+		Type:   eventType,
+		Mac:    mac.String(),
+		IP:     ipCopy,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,38 @@
+package dhcp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	l := NewEventLog(3)
+	for i := 0; i < 2; i++ {
+		l.Add(Event{Type: EventOffer, Mac: fmt.Sprintf("00:00:00:00:00:%02x", i)})
+	}
+	if events := l.Events(); len(events) != 2 || events[0].Mac != "00:00:00:00:00:00" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+
+	for i := 2; i < 5; i++ {
+		l.Add(Event{Type: EventOffer, Mac: fmt.Sprintf("00:00:00:00:00:%02x", i)})
+	}
+	events := l.Events()
+	if len(events) != 3 {
+		t.Fatalf("expected the last 3 events, got %+v", events)
+	}
+	for i, e := range events {
+		if expected := fmt.Sprintf("00:00:00:00:00:%02x", i+2); e.Mac != expected || e.Time.IsZero() {
+			t.Errorf("expected the event of %s at %d, got %+v", expected, i, e)
+		}
+	}
+
+	var disabled *EventLog
+	disabled.Add(Event{Type: EventAck})
+	if events := disabled.Events(); len(events) != 0 {
+		t.Errorf("expected no events from a nil log, got %+v", events)
+	}
+	if NewEventLog(0) != nil {
+		t.Error("expected a nil log for a zero size")
+	}
+}
@@ -0,0 +1,67 @@
+package dhcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// DefaultHostnameTemplate names the machines after their hardware addresses,
+// like node001122334455.cluster
+const DefaultHostnameTemplate = "node{{.Mac}}.{{.ClusterName}}"
+
+// maxHostnameLength is the longest value of an option
+const maxHostnameLength = 255
+
+// hostnameContext is passed to the hostname template. Flags are the flags of
+// the machine, which is empty if the machine isn't known
+type hostnameContext struct {
+	Mac         string
+	IP          string
+	ClusterName string
+	Flags       map[string]string
+}
+
+// ParseHostnameTemplate parses the template of the host name sent as option
+// 12. An empty text results in DefaultHostnameTemplate
+func ParseHostnameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultHostnameTemplate
+	}
+	return template.New("hostname").Option("missingkey=zero").Parse(text)
+}
+
+// hostname renders the host name of the client. If the template fails, or
+// renders an empty or too long name, the default name is returned
+func (h *DHCPHandler) hostname(mac net.HardwareAddr, ip net.IP) string {
+	ctx := hostnameContext{
+		Mac:         strings.Replace(mac.String(), ":", "", -1),
+		IP:          ip.String(),
+		ClusterName: h.datasource.ClusterName(),
+		Flags:       map[string]string{},
+	}
+	defaultName := "node" + ctx.Mac + "." + ctx.ClusterName
+	if h.settings.HostnameTemplate == nil {
+		return defaultName
+	}
+
+	if machine, exists := h.datasource.GetMachine(mac); exists {
+		if flags, err := machine.ListFlags(); err == nil {
+			ctx.Flags = flags
+		}
+	}
+	var buf bytes.Buffer
+	err := h.settings.HostnameTemplate.Execute(&buf, ctx)
+	if err == nil && (buf.Len() == 0 || buf.Len() > maxHostnameLength) {
+		err = fmt.Errorf("invalid host name length %d", buf.Len())
+	}
+	if err != nil {
+		logging.LogMAC(debugTag, mac, "Error while rendering the host name, falling back to %s: %s", defaultName, err)
+		return defaultName
+	}
+	return buf.String()
+}
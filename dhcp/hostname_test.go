@@ -0,0 +1,36 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestHostname(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	known, _ := net.ParseMAC("00:11:22:33:44:01")
+	unknown, _ := net.ParseMAC("00:11:22:33:44:02")
+	machine, _ := ds.CreateMachine(known, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("rack", "rack3")
+
+	settings := &DHCPSetting{}
+	h, _ := newDHCPHandler(settings, ds)
+	if name := h.hostname(known, net.IPv4(10, 0, 0, 10)); name != "node001122334401.test" {
+		t.Errorf("unexpected default host name: %s", name)
+	}
+
+	settings.HostnameTemplate, _ = ParseHostnameTemplate("{{.Flags.rack}}-{{.Mac}}")
+	if name := h.hostname(known, net.IPv4(10, 0, 0, 10)); name != "rack3-001122334401" {
+		t.Errorf("unexpected host name: %s", name)
+	}
+
+	settings.HostnameTemplate, _ = ParseHostnameTemplate("{{.Flags.rack}}")
+	if name := h.hostname(unknown, net.IPv4(10, 0, 0, 11)); name != "node001122334402.test" {
+		t.Errorf("expected an empty host name to fall back to the default, got %s", name)
+	}
+
+	if _, err := ParseHostnameTemplate("{{.Mac"); err == nil {
+		t.Error("expected an error for a malformed template")
+	}
+}
@@ -0,0 +1,84 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// LabelOverride replaces the router and the dns servers sent to the machines
+// whose flag has the value. A nil Router or an empty DNS keeps the global one
+type LabelOverride struct {
+	Flag   string
+	Value  string
+	Router net.IP
+	DNS    []net.IP
+}
+
+// ParseLabelOverrides validates the dhcp-label-options of initial.yaml
+func ParseLabelOverrides(options []datasource.DHCPLabelOptions) ([]LabelOverride, error) {
+	overrides := make([]LabelOverride, 0, len(options))
+	for i, option := range options {
+		if option.Flag == "" {
+			return nil, fmt.Errorf("the flag of label option #%d is empty", i+1)
+		}
+		override := LabelOverride{Flag: option.Flag, Value: option.Value}
+		if option.Router != "" {
+			override.Router = net.ParseIP(option.Router).To4()
+			if override.Router == nil {
+				return nil, fmt.Errorf("invalid router of label option #%d: %q", i+1, option.Router)
+			}
+		}
+		for _, dnsStr := range option.DNS {
+			dns := net.ParseIP(dnsStr).To4()
+			if dns == nil {
+				return nil, fmt.Errorf("invalid dns of label option #%d: %q", i+1, dnsStr)
+			}
+			override.DNS = append(override.DNS, dns)
+		}
+		if override.Router == nil && len(override.DNS) == 0 {
+			return nil, fmt.Errorf("label option #%d overrides neither the router nor the dns", i+1)
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+// applyLabelOverrides replaces the router and the dns servers of the options
+// by the first of the LabelOverrides which matches the flags of the machine.
+// The unknown machines and the ones without a matching flag keep the global
+// settings
+func (h *DHCPHandler) applyLabelOverrides(mac net.HardwareAddr, options dhcp4.Options) {
+	if len(h.settings.LabelOverrides) == 0 {
+		return
+	}
+	machine, exists := h.datasource.GetMachine(mac)
+	if !exists {
+		return
+	}
+	flags, err := machine.ListFlags()
+	if err != nil {
+		logging.DebugMAC(debugTag, mac, "failed to read the flags for the label options - %s", err)
+		return
+	}
+	for _, override := range h.settings.LabelOverrides {
+		if value, found := flags[override.Flag]; !found || value != override.Value {
+			continue
+		}
+		if override.Router != nil {
+			options[dhcp4.OptionRouter] = override.Router
+		}
+		if len(override.DNS) > 0 {
+			dns := make([]byte, 0, 4*len(override.DNS))
+			for _, ip := range override.DNS {
+				dns = append(dns, ip...)
+			}
+			options[dhcp4.OptionDomainNameServer] = dns
+		}
+		return
+	}
+}
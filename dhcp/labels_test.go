@@ -0,0 +1,73 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestLabelOverrides(t *testing.T) {
+	overrides, err := ParseLabelOverrides([]datasource.DHCPLabelOptions{
+		{Flag: "zone", Value: "dmz", Router: "10.1.0.1", DNS: []string{"10.1.0.53", "10.1.0.54"}},
+		{Flag: "zone", Value: "lab", DNS: []string{"10.2.0.53"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	dmz, _ := net.ParseMAC("00:11:22:33:44:01")
+	lab, _ := net.ParseMAC("00:11:22:33:44:02")
+	unlabeled, _ := net.ParseMAC("00:11:22:33:44:03")
+	machine, _ := ds.CreateMachine(dmz, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("zone", "dmz")
+	machine, _ = ds.CreateMachine(lab, net.IPv4(10, 0, 0, 11))
+	machine.SetFlag("zone", "lab")
+	ds.CreateMachine(unlabeled, net.IPv4(10, 0, 0, 12))
+
+	h, _ := newDHCPHandler(&DHCPSetting{LabelOverrides: overrides}, ds)
+	globalOptions := func() dhcp4.Options {
+		return dhcp4.Options{
+			dhcp4.OptionRouter:           []byte{10, 0, 0, 1},
+			dhcp4.OptionDomainNameServer: []byte{8, 8, 8, 8},
+		}
+	}
+
+	options := globalOptions()
+	h.applyLabelOverrides(dmz, options)
+	if !net.IP(options[dhcp4.OptionRouter]).Equal(net.IPv4(10, 1, 0, 1)) ||
+		string(options[dhcp4.OptionDomainNameServer]) != string([]byte{10, 1, 0, 53, 10, 1, 0, 54}) {
+		t.Errorf("unexpected options of the dmz machine: %v", options)
+	}
+
+	options = globalOptions()
+	h.applyLabelOverrides(lab, options)
+	if !net.IP(options[dhcp4.OptionRouter]).Equal(net.IPv4(10, 0, 0, 1)) ||
+		string(options[dhcp4.OptionDomainNameServer]) != string([]byte{10, 2, 0, 53}) {
+		t.Errorf("expected the lab machine to keep the global router, got %v", options)
+	}
+
+	for _, mac := range []net.HardwareAddr{unlabeled, {0x00, 0x11, 0x22, 0x33, 0x44, 0x04}} {
+		options = globalOptions()
+		h.applyLabelOverrides(mac, options)
+		if string(options[dhcp4.OptionRouter]) != string([]byte{10, 0, 0, 1}) ||
+			string(options[dhcp4.OptionDomainNameServer]) != string([]byte{8, 8, 8, 8}) {
+			t.Errorf("expected %s to keep the global options, got %v", mac, options)
+		}
+	}
+
+	for _, invalid := range []datasource.DHCPLabelOptions{
+		{Value: "dmz", Router: "10.1.0.1"},
+		{Flag: "zone", Value: "dmz", Router: "router"},
+		{Flag: "zone", Value: "dmz", DNS: []string{"::1"}},
+		{Flag: "zone", Value: "dmz"},
+	} {
+		if _, err := ParseLabelOverrides([]datasource.DHCPLabelOptions{invalid}); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
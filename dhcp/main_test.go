@@ -0,0 +1,17 @@
+package dhcp
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/logging"
+)
+
+// TestMain records the logs into a discarding logger, since logging blocks
+// until its entries are recorded
+func TestMain(m *testing.M) {
+	go logging.RecordLogs(log.New(ioutil.Discard, "", 0), true)
+	os.Exit(m.Run())
+}
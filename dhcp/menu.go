@@ -0,0 +1,148 @@
+package dhcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMenuType is the boot server type of the default menu entry,
+	// the first of the vendor specific types
+	defaultMenuType = 0x8000
+	// defaultMenuTimeout is how long the menu prompt waits for the user
+	defaultMenuTimeout = 2 * time.Second
+)
+
+// MenuEntry is an entry of the PXE boot menu (vendor option 9)
+type MenuEntry struct {
+	// Type is the boot server type of the entry. Type 0 boots from the local
+	// disk, and the types from 0x8000 are vendor specific, which are all
+	// served by blacksmith
+	Type        uint16
+	Description string
+}
+
+// ParseBootMenu parses a comma separated list of type=description pairs,
+// like "0x8000=Install,0=Boot from disk", into the entries of the PXE boot
+// menu, in order. An empty string results in no entries, which is the single
+// default entry
+func ParseBootMenu(s string) ([]MenuEntry, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var entries []MenuEntry
+	// the menu and the boot servers are single vendor options, so neither
+	// can exceed 255 bytes
+	size, serversSize := 0, 0
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid type=description pair: %q", pair)
+		}
+		menuType, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type in %q: %s", pair, err)
+		}
+		for _, entry := range entries {
+			if entry.Type == uint16(menuType) {
+				return nil, fmt.Errorf("duplicate type in %q", pair)
+			}
+		}
+		description := strings.TrimSpace(parts[1])
+		size += 3 + len(description)
+		if menuType != 0 {
+			serversSize += 7
+		}
+		if size > 255 || serversSize > 255 {
+			return nil, fmt.Errorf("the menu is longer than 255 bytes at %q", pair)
+		}
+		entries = append(entries, MenuEntry{uint16(menuType), description})
+	}
+	return entries, nil
+}
+
+// ValidateBootMessage checks that the PXE vendor options with the boot
+// message, which is both the menu prompt and the description of the default
+// entry, and the entries of the boot menu fit in the single byte lengths of
+// their encoding
+func ValidateBootMessage(message string, menu []MenuEntry) error {
+	if len(message) > 254 {
+		return fmt.Errorf("the boot message is longer than 254 bytes: %d", len(message))
+	}
+	if size := len(pxeVendorOptions(menuEntries(menu, message), message, net.IPv4zero, 0)); size > 255 {
+		return fmt.Errorf("the boot message and the menu take %d bytes, more than the 255 of the PXE vendor options", size)
+	}
+	return nil
+}
+
+// menuEntries returns the entries of the boot menu, which default to a
+// single entry with the boot message
+func menuEntries(menu []MenuEntry, message string) []MenuEntry {
+	if len(menu) > 0 {
+		return menu
+	}
+	return []MenuEntry{{defaultMenuType, message}}
+}
+
+// menuTimeout returns the timeout byte of the menu prompt, in seconds. 0
+// boots the first entry without prompting. 255 would wait for the user
+// forever, so the longer timeouts are clamped to 254
+func (h *DHCPHandler) menuTimeout() byte {
+	timeout := h.settings.MenuTimeout
+	if timeout == 0 {
+		timeout = defaultMenuTimeout
+	}
+	seconds := int64(timeout / time.Second)
+	if seconds < 0 {
+		return 0
+	}
+	if seconds > 254 {
+		return 254
+	}
+	return byte(seconds)
+}
+
+// fillPXE returns the PXE vendor options (option 43), with a boot server on
+// ServerIP for each vendor specific entry of the boot menu
+func (h *DHCPHandler) fillPXE() []byte {
+	return pxeVendorOptions(menuEntries(h.settings.BootMenu, h.bootMessage),
+		h.bootMessage, h.settings.ServerIP, h.menuTimeout())
+}
+
+func pxeVendorOptions(entries []MenuEntry, message string, serverIP net.IP, timeout byte) []byte {
+	var pxe bytes.Buffer
+	// Discovery Control - disable broadcast and multicast boot server discovery
+	pxe.Write([]byte{6, 1, 3})
+	// PXE boot servers
+	var servers bytes.Buffer
+	for _, entry := range entries {
+		if entry.Type == 0 {
+			continue
+		}
+		servers.Write([]byte{byte(entry.Type >> 8), byte(entry.Type), 1})
+		servers.Write(serverIP.To4())
+	}
+	if servers.Len() > 0 {
+		pxe.Write([]byte{8, byte(servers.Len())})
+		pxe.Write(servers.Bytes())
+	}
+	// PXE boot menu
+	var menu bytes.Buffer
+	for _, entry := range entries {
+		menu.Write([]byte{byte(entry.Type >> 8), byte(entry.Type), byte(len(entry.Description))})
+		menu.WriteString(entry.Description)
+	}
+	pxe.Write([]byte{9, byte(menu.Len())})
+	pxe.Write(menu.Bytes())
+	// PXE menu prompt+timeout
+	pxe.Write([]byte{10, byte(1 + len(message)), timeout})
+	pxe.WriteString(message)
+	// End vendor options
+	pxe.WriteByte(255)
+	return pxe.Bytes()
+}
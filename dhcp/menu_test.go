@@ -0,0 +1,91 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestParseBootMenu(t *testing.T) {
+	entries, err := ParseBootMenu("0x8000=Install, 0 = Boot from disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MenuEntry{{0x8000, "Install"}, {0, "Boot from disk"}}
+	if len(entries) != len(expected) || entries[0] != expected[0] || entries[1] != expected[1] {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+
+	for _, invalid := range []string{"Install", "x=Install", "0x10000=Install", "1=", "1=a,1=b", "1=" + strings.Repeat("a", 253)} {
+		if _, err := ParseBootMenu(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestValidateBootMessage(t *testing.T) {
+	for _, valid := range []string{"Datacenter 1", strings.Repeat("a", 117)} {
+		if err := ValidateBootMessage(valid, nil); err != nil {
+			t.Errorf("unexpected error for %d bytes: %s", len(valid), err)
+		}
+	}
+	// the default entry repeats the message, unlike a custom menu
+	message := strings.Repeat("a", 118)
+	if err := ValidateBootMessage(message, nil); err == nil {
+		t.Error("expected an error for a message which overflows the vendor options")
+	}
+	if err := ValidateBootMessage(message, []MenuEntry{{0x8000, "Install"}}); err != nil {
+		t.Errorf("unexpected error with a custom menu: %s", err)
+	}
+	if err := ValidateBootMessage(strings.Repeat("a", 255), []MenuEntry{{0x8000, "Install"}}); err == nil {
+		t.Error("expected an error for a message longer than 254 bytes")
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	h, _ := newDHCPHandler(&DHCPSetting{ServerIP: net.IPv4(10, 0, 0, 1), BootMessage: "DC1"}, ds)
+	if h.bootMessage != "DC1" {
+		t.Errorf("expected the configured boot message, got %q", h.bootMessage)
+	}
+}
+
+func TestFillPXE(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	settings := &DHCPSetting{ServerIP: net.IPv4(10, 0, 0, 1)}
+	h, _ := newDHCPHandler(settings, ds)
+	h.bootMessage = "Blacksmith"
+
+	defaultOptions := []byte{
+		6, 1, 3,
+		8, 7, 0x80, 0x00, 1, 10, 0, 0, 1,
+		9, 13, 0x80, 0x00, 10, 'B', 'l', 'a', 'c', 'k', 's', 'm', 'i', 't', 'h',
+		10, 11, 2, 'B', 'l', 'a', 'c', 'k', 's', 'm', 'i', 't', 'h',
+		255,
+	}
+	if pxe := h.fillPXE(); !bytes.Equal(pxe, defaultOptions) {
+		t.Errorf("unexpected default vendor options: %v", pxe)
+	}
+
+	settings.BootMenu = []MenuEntry{{0x8001, "Rescue"}, {0, "Disk"}}
+	settings.MenuTimeout = 10 * time.Second
+	options := []byte{
+		6, 1, 3,
+		8, 7, 0x80, 0x01, 1, 10, 0, 0, 1,
+		9, 16, 0x80, 0x01, 6, 'R', 'e', 's', 'c', 'u', 'e', 0, 0, 4, 'D', 'i', 's', 'k',
+		10, 11, 10, 'B', 'l', 'a', 'c', 'k', 's', 'm', 'i', 't', 'h',
+		255,
+	}
+	if pxe := h.fillPXE(); !bytes.Equal(pxe, options) {
+		t.Errorf("unexpected vendor options: %v", pxe)
+	}
+
+	for timeout, expected := range map[time.Duration]byte{-time.Second: 0, 254 * time.Second: 254, time.Hour: 254} {
+		settings.MenuTimeout = timeout
+		if got := h.menuTimeout(); got != expected {
+			t.Errorf("menu timeout of %s: expected %d, got %d", timeout, expected, got)
+		}
+	}
+}
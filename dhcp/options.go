@@ -0,0 +1,97 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// OptionWPAD is the proxy auto-config url option (252)
+const OptionWPAD dhcp4.OptionCode = 252
+
+// CustomOptions are the DHCP options added to the replies, in addition to
+// the ones the handler fills itself. It implements flag.Value, so that it
+// can be given as a repeatable code=value flag
+type CustomOptions map[dhcp4.OptionCode][]byte
+
+// parseOptionValue encodes the value of a custom option. A value prefixed by
+// hex: is raw hex bytes, one prefixed by ip: is a comma separated list of
+// IPv4 addresses, and anything else is taken as text, like the url of WPAD
+func parseOptionValue(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "hex:"):
+		value, err := hex.DecodeString(strings.Replace(s[len("hex:"):], ":", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value %q", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "ip:"):
+		var value []byte
+		for _, ipStr := range strings.Split(s[len("ip:"):], ",") {
+			ip := net.ParseIP(strings.TrimSpace(ipStr)).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address %q in %q", ipStr, s)
+			}
+			value = append(value, ip...)
+		}
+		return value, nil
+	}
+	return []byte(s), nil
+}
+
+// ParseCustomOption parses a code=value custom option, e.g.
+// 252=http://192.168.1.1/wpad.dat or 42=ip:192.168.1.1,192.168.1.2
+func ParseCustomOption(s string) (dhcp4.OptionCode, []byte, error) {
+	eq := strings.Index(s, "=")
+	if eq == -1 {
+		return 0, nil, fmt.Errorf("missing = in dhcp option %q", s)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(s[:eq]))
+	if err != nil || code < 1 || code > 254 {
+		return 0, nil, fmt.Errorf("invalid option code in dhcp option %q", s)
+	}
+	value, err := parseOptionValue(s[eq+1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid value in dhcp option %q: %s", s, err)
+	}
+	if len(value) == 0 || len(value) > 255 {
+		return 0, nil, fmt.Errorf("value of dhcp option %q must be 1 to 255 bytes", s)
+	}
+	return dhcp4.OptionCode(code), value, nil
+}
+
+func (o CustomOptions) String() string {
+	codes := make([]int, 0, len(o))
+	for code := range o {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	parts := make([]string, len(codes))
+	for i, code := range codes {
+		parts[i] = fmt.Sprintf("%d=hex:%x", code, o[dhcp4.OptionCode(code)])
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set adds a code=value option, replacing the previous value of the code
+func (o CustomOptions) Set(s string) error {
+	code, value, err := ParseCustomOption(s)
+	if err != nil {
+		return err
+	}
+	o[code] = value
+	return nil
+}
+
+// addCustomOptions merges the custom options into the options of a reply,
+// overriding the ones filled by the handler
+func (h *DHCPHandler) addCustomOptions(options dhcp4.Options) {
+	for code, value := range h.settings.CustomOptions {
+		options[code] = value
+	}
+}
@@ -0,0 +1,53 @@
+package dhcp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestParseCustomOption(t *testing.T) {
+	for s, expected := range map[string]string{
+		"252=http://10.0.0.1/wpad.dat": "http://10.0.0.1/wpad.dat",
+		"43=hex:0a:0b0c":               "\x0a\x0b\x0c",
+		"42=ip:10.0.0.1, 10.0.0.2":     "\x0a\x00\x00\x01\x0a\x00\x00\x02",
+	} {
+		_, value, err := ParseCustomOption(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if !bytes.Equal(value, []byte(expected)) {
+			t.Errorf("%s: expected %x, got %x", s, expected, value)
+		}
+	}
+
+	for _, invalid := range []string{"252", "0=x", "255=x", "abc=x", "1=", "43=hex:zz", "42=ip:10.0.0", "42=ip:::1"} {
+		if _, _, err := ParseCustomOption(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestAddCustomOptions(t *testing.T) {
+	custom := CustomOptions{}
+	custom.Set("252=http://10.0.0.1/wpad.dat")
+	custom.Set("6=ip:10.0.0.53")
+	h := &DHCPHandler{settings: &DHCPSetting{CustomOptions: custom}}
+
+	options := dhcp4.Options{
+		dhcp4.OptionDomainNameServer: []byte{8, 8, 8, 8},
+		dhcp4.OptionSubnetMask:       []byte{255, 255, 255, 0},
+	}
+	h.addCustomOptions(options)
+	if string(options[OptionWPAD]) != "http://10.0.0.1/wpad.dat" {
+		t.Errorf("expected the WPAD option, got %q", options[OptionWPAD])
+	}
+	if !bytes.Equal(options[dhcp4.OptionDomainNameServer], []byte{10, 0, 0, 53}) {
+		t.Errorf("expected the custom option to override the dns, got %v", options[dhcp4.OptionDomainNameServer])
+	}
+	if !bytes.Equal(options[dhcp4.OptionSubnetMask], []byte{255, 255, 255, 0}) {
+		t.Errorf("expected the subnet mask to be kept, got %v", options[dhcp4.OptionSubnetMask])
+	}
+}
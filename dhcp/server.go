@@ -1,11 +1,13 @@
 package dhcp // import "github.com/cafebazaar/blacksmith/dhcp"
 
 import (
-	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
-	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/cafebazaar/blacksmith/datasource"
@@ -17,12 +19,21 @@ const (
 	minLeaseHours = 24
 	maxLeaseHours = 48
 
+	// offerTimeout is how long the lease duration of an offer is kept for
+	// the request which follows it
+	offerTimeout = time.Minute
+
 	debugTag = "DHCP"
+
+	// optionClientArch is the client system architecture (RFC 4578)
+	optionClientArch = 93
+
+	// defaultBootFileName is the file served by pxe.ServeTFTP
+	defaultBootFileName = "lpxelinux.0"
 )
 
-func randLeaseDuration() time.Duration {
-	n := (minLeaseHours + rand.Intn(maxLeaseHours-minLeaseHours))
-	return time.Duration(n) * time.Hour
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
 }
 
 type DHCPSetting struct {
@@ -30,6 +41,51 @@ type DHCPSetting struct {
 	ServerIP   net.IP
 	RouterAddr net.IP
 	SubnetMask net.IP
+	// TFTPServerName is sent to the PXE clients as option 66. Defaults to
+	// ServerIP
+	TFTPServerName string
+	// BootFileName is sent to the PXE clients as option 67. Defaults to
+	// lpxelinux.0
+	BootFileName string
+	// AllowlistOnly makes the server silently ignore the clients which
+	// aren't known machines, unless they match AllowedPrefixes
+	AllowlistOnly bool
+	// AllowedPrefixes are the hardware address prefixes of the unknown
+	// clients which are served in the AllowlistOnly mode
+	AllowedPrefixes []net.HardwareAddr
+	// CustomOptions are added to the replies, and override the options of
+	// the same codes filled by the handler
+	CustomOptions CustomOptions
+	// Authoritative makes the server NAK the requests it can't satisfy. A
+	// non-authoritative server stays silent instead, leaving them to the
+	// primary DHCP server of the segment
+	Authoritative bool
+	// ServerIdentifier is sent as option 54, and the requests naming another
+	// server are ignored, e.g. for the address of a relay. Defaults to
+	// ServerIP
+	ServerIdentifier net.IP
+	// Events records the decisions of the handler, if it isn't nil
+	Events *EventLog
+	// HostnameTemplate renders the host name sent as option 12, see
+	// ParseHostnameTemplate. Defaults to DefaultHostnameTemplate
+	HostnameTemplate *template.Template
+	// LabelOverrides replace the router and the dns servers for the machines
+	// with the matching flags, see ParseLabelOverrides
+	LabelOverrides []LabelOverride
+	// BootMenu are the entries of the PXE boot menu, see ParseBootMenu.
+	// Defaults to a single entry with the version of blacksmith
+	BootMenu []MenuEntry
+	// MenuTimeout is how long the PXE menu prompt waits before booting the
+	// first entry. Defaults to 2 seconds, and a negative one boots it without
+	// prompting
+	MenuTimeout time.Duration
+	// BootMessage is the PXE menu prompt, and the description of the default
+	// menu entry, see ValidateBootMessage. Defaults to the version of
+	// blacksmith
+	BootMessage string
+	// EnableBOOTP makes the server answer the BOOTP clients too, which send
+	// no DHCP message type, with the permanent address of their machine
+	EnableBOOTP bool
 }
 
 func ServeDHCP(settings *DHCPSetting, datasource datasource.DataSource) error {
@@ -40,7 +96,9 @@ func ServeDHCP(settings *DHCPSetting, datasource datasource.DataSource) error {
 	}
 	logging.Log("DHCP", "Listening on %s:67 (interface: %s)",
 		settings.ServerIP.String(), settings.IFName)
-	if settings.IFName != "" {
+	if settings.EnableBOOTP {
+		err = listenAndServeBOOTP(settings.IFName, handler)
+	} else if settings.IFName != "" {
 		err = dhcp4.ListenAndServeIf(settings.IFName, handler)
 	} else {
 		err = dhcp4.ListenAndServe(handler)
@@ -49,8 +107,6 @@ func ServeDHCP(settings *DHCPSetting, datasource datasource.DataSource) error {
 		logging.Debug("DHCP", "Error in server - %s", err.Error())
 	}
 
-	rand.Seed(time.Now().UTC().UnixNano())
-
 	return err
 }
 
@@ -61,45 +117,152 @@ type DHCPHandler struct {
 	datasource  datasource.DataSource
 	dhcpOptions dhcp4.Options
 	bootMessage string
+	rand        *rand.Rand
+
+	// offers keeps the lease durations of the recent offers by the client's
+	// hardware address, so that the ACK carries the same lease time
+	offersLock sync.Mutex
+	offers     map[string]offer
+}
+
+type offer struct {
+	leaseDuration time.Duration
+	expires       time.Time
+}
+
+// NewHandler returns the handler which ServeDHCP serves the packets with, e.g.
+// to answer them without a socket in the tests
+func NewHandler(settings *DHCPSetting, datasource datasource.DataSource) (*DHCPHandler, error) {
+	return newDHCPHandler(settings, datasource)
 }
 
 func newDHCPHandler(settings *DHCPSetting, datasource datasource.DataSource) (*DHCPHandler, error) {
 	h := &DHCPHandler{
 		settings:    settings,
 		datasource:  datasource,
-		bootMessage: fmt.Sprintf("Blacksmith (%s)", datasource.Version().Version),
+		bootMessage: settings.BootMessage,
+		rand:        newRand(),
+		offers:      make(map[string]offer),
+	}
+	if h.bootMessage == "" {
+		h.bootMessage = fmt.Sprintf("Blacksmith (%s)", datasource.Version().Version)
 	}
 	return h, nil
 }
 
-func (h *DHCPHandler) fillPXE() []byte {
-	// PXE vendor options
-	var pxe bytes.Buffer
-	var l byte
-	// Discovery Control - disable broadcast and multicast boot server discovery
-	pxe.Write([]byte{6, 1, 3})
-	// PXE boot server
-	pxe.Write([]byte{8, 7, 0x80, 0x00, 1})
-	pxe.Write(h.settings.ServerIP.To4())
-	// PXE boot menu - one entry, pointing to the above PXE boot server
-	l = byte(3 + len(h.bootMessage))
-	pxe.Write([]byte{9, l, 0x80, 0x00, 9})
-	pxe.WriteString(h.bootMessage)
-	// PXE menu prompt+timeout
-	l = byte(1 + len(h.bootMessage))
-	pxe.Write([]byte{10, l, 0x2})
-	pxe.WriteString(h.bootMessage)
-	// End vendor options
-	pxe.WriteByte(255)
-	return pxe.Bytes()
+func (h *DHCPHandler) randLeaseDuration() time.Duration {
+	n := (minLeaseHours + h.rand.Intn(maxLeaseHours-minLeaseHours))
+	return time.Duration(n) * time.Hour
 }
 
-//
-func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+// offerLeaseDuration picks the lease duration offered to the client, and
+// keeps it for requestLeaseDuration
+func (h *DHCPHandler) offerLeaseDuration(mac string) time.Duration {
+	h.offersLock.Lock()
+	defer h.offersLock.Unlock()
+
+	now := time.Now()
+	for k, o := range h.offers {
+		if now.After(o.expires) {
+			delete(h.offers, k)
+		}
+	}
+
+	d := h.randLeaseDuration()
+	h.offers[mac] = offer{leaseDuration: d, expires: now.Add(offerTimeout)}
+	return d
+}
+
+// requestLeaseDuration returns the lease duration previously offered to the
+// client, or a new one if there wasn't an offer (e.g. on a renewal)
+func (h *DHCPHandler) requestLeaseDuration(mac string) time.Duration {
+	h.offersLock.Lock()
+	defer h.offersLock.Unlock()
+
+	o, exists := h.offers[mac]
+	if !exists || time.Now().After(o.expires) {
+		return h.randLeaseDuration()
+	}
+	delete(h.offers, mac)
+	return o.leaseDuration
+}
+
+// addBootOptions adds the TFTP server name and boot file name options (66
+// and 67), for the PXE clients which don't understand the vendor options
+// filled by fillPXE
+func (h *DHCPHandler) addBootOptions(packet dhcp4.Packet) {
+	tftpServerName := h.settings.TFTPServerName
+	if tftpServerName == "" {
+		tftpServerName = h.settings.ServerIP.String()
+	}
+	packet.AddOption(dhcp4.OptionTFTPServerName, []byte(tftpServerName))
+	packet.AddOption(dhcp4.OptionBootFileName, []byte(h.bootFileName()))
+}
+
+// bootFileName returns the file which the clients boot from over TFTP
+func (h *DHCPHandler) bootFileName() string {
+	if h.settings.BootFileName == "" {
+		return defaultBootFileName
+	}
+	return h.settings.BootFileName
+}
+
+// serverIdentifier returns the address sent as option 54
+func (h *DHCPHandler) serverIdentifier() net.IP {
+	if h.settings.ServerIdentifier != nil {
+		return h.settings.ServerIdentifier.To4()
+	}
+	return h.settings.ServerIP.To4()
+}
+
+// replyPacket builds a reply whose option 54 is the server identifier, while
+// its siaddr, the next server which the PXE clients fetch from, stays at
+// ServerIP
+func (h *DHCPHandler) replyPacket(p dhcp4.Packet, msgType dhcp4.MessageType, ip net.IP, leaseDuration time.Duration, options []dhcp4.Option) dhcp4.Packet {
+	packet := dhcp4.ReplyPacket(p, msgType, h.serverIdentifier(), ip, leaseDuration, options)
+	packet.SetSIAddr(h.settings.ServerIP.To4())
+	return packet
+}
+
+// recordBoot counts the Discover of a known machine as a boot attempt, so
+// the reboot loops can be spotted
+func (h *DHCPHandler) recordBoot(mac net.HardwareAddr) {
+	machine, exists := h.datasource.GetMachine(mac)
+	if !exists {
+		return
+	}
+	if err := machine.RecordBoot(); err != nil {
+		logging.DebugMAC(debugTag, mac, "failed to record the boot - %s", err)
+	}
+}
+
+// recordArch keeps the architecture of the client of a PXE Discover in the
+// arch flag of its machine, so the booter serves it the matching images
+func (h *DHCPHandler) recordArch(mac net.HardwareAddr, options dhcp4.Options) {
+	clientArch, exists := options[optionClientArch]
+	if !exists || len(clientArch) < 2 {
+		return
+	}
+	machine, exists := h.datasource.GetMachine(mac)
+	if !exists {
+		return
+	}
+	arch := datasource.ArchFromClientArch(binary.BigEndian.Uint16(clientArch))
+	if current, err := machine.GetFlag(datasource.ArchFlag); err == nil && current == arch {
+		return
+	}
+	if err := machine.SetFlag(datasource.ArchFlag, arch); err != nil {
+		logging.DebugMAC(debugTag, mac, "failed to record the arch - %s", err)
+	}
+}
+
+// networkOptions returns the subnet mask, the router and the dns servers
+// sent to the client, with the overrides of its labels and the custom
+// options applied
+func (h *DHCPHandler) networkOptions(mac net.HardwareAddr) (dhcp4.Options, error) {
 	dns, err := h.datasource.DNSAddresses()
 	if err != nil {
-		logging.Log(debugTag, "Failed to read dns addresses")
-		return nil
+		return nil, err
 	}
 
 	dhcpOptions := dhcp4.Options{
@@ -110,31 +273,57 @@ func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, optio
 	if h.settings.RouterAddr != nil {
 		dhcpOptions[dhcp4.OptionRouter] = h.settings.RouterAddr.To4()
 	}
+	h.applyLabelOverrides(mac, dhcpOptions)
+	h.addCustomOptions(dhcpOptions)
+	return dhcpOptions, nil
+}
 
-	macAddress := strings.Join(strings.Split(p.CHAddr().String(), ":"), "")
+//
+func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+	dhcpOptions, err := h.networkOptions(p.CHAddr())
+	if err != nil {
+		logging.Log(debugTag, "Failed to read dns addresses")
+		return nil
+	}
+
+	if (msgType == dhcp4.Discover || msgType == dhcp4.Request) && !h.allowed(p.CHAddr()) {
+		logging.DebugMAC("DHCP", p.CHAddr(), "ignoring the unknown client - CHADDR %s", p.CHAddr().String())
+		h.recordEvent(EventIgnore, p.CHAddr(), nil, "unknown client in the allowlist-only mode")
+		return nil
+	}
 	switch msgType {
 	case dhcp4.Discover:
+		h.recordBoot(p.CHAddr())
 		ip, err := h.datasource.Assign(p.CHAddr().String())
+		if errors.Is(err, datasource.ErrPoolFull) {
+			logging.LogMAC("DHCP", p.CHAddr(), "no offer, the lease pool is full")
+			h.recordEvent(EventIgnore, p.CHAddr(), nil, err.Error())
+			return nil
+		}
 		if err != nil {
-			logging.Debug("DHCP", "err in lease pool - %s", err.Error())
-			return nil // pool is full
+			logging.DebugMAC("DHCP", p.CHAddr(), "err in lease pool - %s", err.Error())
+			h.recordEvent(EventIgnore, p.CHAddr(), nil, err.Error())
+			return nil
 		}
+		h.recordArch(p.CHAddr(), options)
 		replyOptions := dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
-		packet := dhcp4.ReplyPacket(p, dhcp4.Offer, h.settings.ServerIP, ip, randLeaseDuration(), replyOptions)
+		packet := h.replyPacket(p, dhcp4.Offer, ip, h.offerLeaseDuration(p.CHAddr().String()), replyOptions)
 		// this is a pxe request
 		guidVal, isPxe := options[97]
 		if isPxe {
-			logging.Log("DHCP", "dhcp discover with PXE - CHADDR %s - IP %s - our ip %s", p.CHAddr().String(), ip.String(), h.settings.ServerIP.String())
+			logging.LogMAC("DHCP", p.CHAddr(), "dhcp discover with PXE - CHADDR %s - IP %s - our ip %s", p.CHAddr().String(), ip.String(), h.settings.ServerIP.String())
 			guid := guidVal[1:]
 			packet.AddOption(60, []byte("PXEClient"))
 			packet.AddOption(97, guid)
 			packet.AddOption(43, h.fillPXE())
+			h.addBootOptions(packet)
 		} else {
-			logging.Log("DHCP", "dhcp discover - CHADDR %s - IP %s", p.CHAddr().String(), ip.String())
+			logging.LogMAC("DHCP", p.CHAddr(), "dhcp discover - CHADDR %s - IP %s", p.CHAddr().String(), ip.String())
 		}
+		h.recordEvent(EventOffer, p.CHAddr(), ip, "")
 		return packet
 	case dhcp4.Request:
-		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.settings.ServerIP) {
+		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIdentifier()) {
 			return nil // this message is not ours
 		}
 		requestedIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
@@ -142,30 +331,37 @@ func (h *DHCPHandler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, optio
 			requestedIP = net.IP(p.CIAddr())
 		}
 		if len(requestedIP) != 4 || requestedIP.Equal(net.IPv4zero) {
-			logging.Debug("DHCP", "dhcp request - CHADDR %s - bad request", p.CHAddr().String())
+			logging.DebugMAC("DHCP", p.CHAddr(), "dhcp request - CHADDR %s - bad request", p.CHAddr().String())
+			h.recordEvent(EventIgnore, p.CHAddr(), nil, "no requested IP")
 			return nil
 		}
 		_, err := h.datasource.Request(p.CHAddr().String(), requestedIP)
 		if err != nil {
-			logging.Debug("DHCP", "dhcp request - CHADDR %s - Requested IP %s - NO MATCH", p.CHAddr().String(), requestedIP.String())
-
-			return dhcp4.ReplyPacket(p, dhcp4.NAK, h.settings.ServerIP, nil, 0, nil)
+			logging.DebugMAC("DHCP", p.CHAddr(), "dhcp request - CHADDR %s - Requested IP %s - NO MATCH", p.CHAddr().String(), requestedIP.String())
+			if !h.settings.Authoritative {
+				h.recordEvent(EventIgnore, p.CHAddr(), requestedIP, err.Error()+" (not authoritative)")
+				return nil // the request is left to the authoritative server
+			}
+			h.recordEvent(EventNak, p.CHAddr(), requestedIP, err.Error())
+			return h.replyPacket(p, dhcp4.NAK, nil, 0, nil)
 		}
 
 		replyOptions := dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
-		packet := dhcp4.ReplyPacket(p, dhcp4.ACK, h.settings.ServerIP, requestedIP, randLeaseDuration(), replyOptions)
+		packet := h.replyPacket(p, dhcp4.ACK, requestedIP, h.requestLeaseDuration(p.CHAddr().String()), replyOptions)
 		// this is a pxe request
 		guidVal, isPxe := options[97]
 		if isPxe {
-			logging.Log("DHCP", "dhcp request with PXE - CHADDR %s - Requested IP %s - our ip %s - ACCEPTED", p.CHAddr().String(), requestedIP.String(), h.settings.ServerIP.String())
+			logging.LogMAC("DHCP", p.CHAddr(), "dhcp request with PXE - CHADDR %s - Requested IP %s - our ip %s - ACCEPTED", p.CHAddr().String(), requestedIP.String(), h.settings.ServerIP.String())
 			guid := guidVal[1:]
 			packet.AddOption(60, []byte("PXEClient"))
 			packet.AddOption(97, guid)
 			packet.AddOption(43, h.fillPXE())
+			h.addBootOptions(packet)
 		} else {
-			logging.Log("DHCP", "dhcp request - CHADDR %s - Requested IP %s - ACCEPTED", p.CHAddr().String(), requestedIP.String())
+			logging.LogMAC("DHCP", p.CHAddr(), "dhcp request - CHADDR %s - Requested IP %s - ACCEPTED", p.CHAddr().String(), requestedIP.String())
 		}
-		packet.AddOption(12, []byte("node"+macAddress+"."+h.datasource.ClusterName())) // host name option
+		packet.AddOption(12, []byte(h.hostname(p.CHAddr(), requestedIP))) // host name option
+		h.recordEvent(EventAck, p.CHAddr(), requestedIP, "")
 		return packet
 	case dhcp4.Release, dhcp4.Decline:
 
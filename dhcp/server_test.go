@@ -0,0 +1,185 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestRandLeaseDurationSeeded(t *testing.T) {
+	h1 := &DHCPHandler{rand: newRand()}
+	time.Sleep(time.Millisecond)
+	h2 := &DHCPHandler{rand: newRand()}
+
+	same := true
+	for i := 0; i < 20; i++ {
+		d1, d2 := h1.randLeaseDuration(), h2.randLeaseDuration()
+		if d1 < minLeaseHours*time.Hour || d1 >= maxLeaseHours*time.Hour {
+			t.Errorf("lease duration out of range: %s", d1)
+		}
+		if d1 != d2 {
+			same = false
+		}
+	}
+	if same {
+		t.Error("two handlers produced the same lease duration sequence")
+	}
+}
+
+func TestAddBootOptions(t *testing.T) {
+	h := &DHCPHandler{settings: &DHCPSetting{ServerIP: net.IPv4(10, 0, 0, 1)}}
+	packet := dhcp4.NewPacket(dhcp4.BootReply)
+	h.addBootOptions(packet)
+
+	options := packet.ParseOptions()
+	if name := string(options[dhcp4.OptionTFTPServerName]); name != "10.0.0.1" {
+		t.Errorf("expected the server IP as the TFTP server name, got %q", name)
+	}
+	if file := string(options[dhcp4.OptionBootFileName]); file != defaultBootFileName {
+		t.Errorf("expected %q as the boot file name, got %q", defaultBootFileName, file)
+	}
+
+	h.settings.TFTPServerName = "tftp.example"
+	h.settings.BootFileName = "pxelinux.0"
+	packet = dhcp4.NewPacket(dhcp4.BootReply)
+	h.addBootOptions(packet)
+
+	options = packet.ParseOptions()
+	if name := string(options[dhcp4.OptionTFTPServerName]); name != "tftp.example" {
+		t.Errorf("expected the configured TFTP server name, got %q", name)
+	}
+	if file := string(options[dhcp4.OptionBootFileName]); file != "pxelinux.0" {
+		t.Errorf("expected the configured boot file name, got %q", file)
+	}
+}
+
+func TestRequestReusesOfferedLeaseDuration(t *testing.T) {
+	h := &DHCPHandler{rand: newRand(), offers: make(map[string]offer)}
+	mac := "00:11:22:33:44:01"
+
+	for i := 0; i < 20; i++ {
+		offered := h.offerLeaseDuration(mac)
+		if acked := h.requestLeaseDuration(mac); acked != offered {
+			t.Fatalf("expected the ACK lease duration %s to match the offer, got %s", offered, acked)
+		}
+	}
+	if _, exists := h.offers[mac]; exists {
+		t.Error("expected the offer to be consumed by the request")
+	}
+
+	h.offers[mac] = offer{leaseDuration: time.Nanosecond, expires: time.Now().Add(-time.Second)}
+	if d := h.requestLeaseDuration(mac); d == time.Nanosecond {
+		t.Error("expected an expired offer to be ignored")
+	}
+}
+
+func TestRequestAuthoritative(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	owner, _ := net.ParseMAC("00:11:22:33:44:01")
+	ds.CreateMachine(owner, net.IPv4(10, 0, 0, 10))
+
+	settings := &DHCPSetting{
+		ServerIP:         net.IPv4(10, 0, 0, 1),
+		ServerIdentifier: net.IPv4(10, 0, 1, 1),
+		Authoritative:    true,
+		Events:           NewEventLog(10),
+	}
+	h, _ := newDHCPHandler(settings, ds)
+
+	request := func(serverID net.IP) dhcp4.Packet {
+		p := dhcp4.NewPacket(dhcp4.BootRequest)
+		p.SetCHAddr(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x02})
+		p.AddOption(dhcp4.OptionRequestedIPAddress, net.IPv4(10, 0, 0, 10).To4())
+		if serverID != nil {
+			p.AddOption(dhcp4.OptionServerIdentifier, serverID.To4())
+		}
+		return h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	}
+
+	reply := request(nil)
+	if reply == nil {
+		t.Fatal("expected a NAK from the authoritative server")
+	}
+	options := reply.ParseOptions()
+	if dhcp4.MessageType(options[dhcp4.OptionDHCPMessageType][0]) != dhcp4.NAK {
+		t.Errorf("expected a NAK, got %v", options[dhcp4.OptionDHCPMessageType])
+	}
+	if id := net.IP(options[dhcp4.OptionServerIdentifier]); !id.Equal(settings.ServerIdentifier) {
+		t.Errorf("expected the server identifier %s, got %s", settings.ServerIdentifier, id)
+	}
+
+	if reply := request(settings.ServerIP); reply != nil {
+		t.Error("expected a request naming another server identifier to be ignored")
+	}
+
+	settings.Authoritative = false
+	if reply := request(settings.ServerIdentifier); reply != nil {
+		t.Error("expected the non-authoritative server to stay silent")
+	}
+
+	events := settings.Events.Events()
+	if len(events) != 2 || events[0].Type != EventNak || events[1].Type != EventIgnore ||
+		!events[0].IP.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestServerIdentifierKeepsNextServer(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	settings := &DHCPSetting{
+		ServerIP:         net.IPv4(10, 0, 0, 1),
+		ServerIdentifier: net.IPv4(10, 0, 1, 1),
+		Events:           NewEventLog(10),
+	}
+	h, _ := newDHCPHandler(settings, ds)
+
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	p.SetCHAddr(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x01})
+	offer := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil {
+		t.Fatal("expected an offer")
+	}
+
+	p.AddOption(dhcp4.OptionRequestedIPAddress, offer.YIAddr())
+	p.AddOption(dhcp4.OptionServerIdentifier, settings.ServerIdentifier.To4())
+	ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	if ack == nil {
+		t.Fatal("expected an ACK")
+	}
+
+	for _, reply := range []dhcp4.Packet{offer, ack} {
+		if id := net.IP(reply.ParseOptions()[dhcp4.OptionServerIdentifier]); !id.Equal(settings.ServerIdentifier) {
+			t.Errorf("expected the server identifier %s, got %s", settings.ServerIdentifier, id)
+		}
+		if !reply.SIAddr().Equal(settings.ServerIP) {
+			t.Errorf("expected the next server %s, got %s", settings.ServerIP, reply.SIAddr())
+		}
+	}
+}
+
+func TestRecordArch(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	h, _ := newDHCPHandler(&DHCPSetting{}, ds)
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	h.recordArch(mac, dhcp4.Options{})
+	if arch := datasource.MachineArch(machine); arch != datasource.ArchAMD64 {
+		t.Errorf("expected amd64 without option 93, got %s", arch)
+	}
+
+	h.recordArch(mac, dhcp4.Options{optionClientArch: {0, 11}})
+	if arch, _ := machine.GetFlag(datasource.ArchFlag); arch != datasource.ArchARM64 {
+		t.Errorf("expected the arm64 UEFI client to be recorded as arm64, got %q", arch)
+	}
+
+	h.recordArch(mac, dhcp4.Options{optionClientArch: {0, 7}})
+	if arch, _ := machine.GetFlag(datasource.ArchFlag); arch != datasource.ArchAMD64 {
+		t.Errorf("expected the x64 UEFI client to be recorded as amd64, got %q", arch)
+	}
+}
@@ -1,11 +1,24 @@
 package logging // import "github.com/cafebazaar/blacksmith/logging"
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 )
 
-const logFormat = "%c[%s] %s"
+const (
+	logFormat         = "%c[%s] %s"
+	correlationFormat = "{%s} %s"
+
+	// RequestIDHeader is the response header carrying the correlation id of
+	// the request
+	RequestIDHeader = "X-Request-Id"
+)
+
+type requestIDKey struct{}
 
 type logEntry struct {
 	Subsystem string
@@ -44,8 +57,63 @@ func Debug(subsystem string, msg string, args ...interface{}) {
 	logCh <- logEntry{subsystem, true, fmt.Sprintf(msg, args...)}
 }
 
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDHandler assigns a correlation id to each request, which is returned
+// in the X-Request-Id header and tags the logs written for that request
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the correlation id assigned to the request by
+// RequestIDHandler, or "-" if there isn't any
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// MACCorrelationID returns the correlation id of the protocols which don't
+// have a request, like DHCP, based on the hardware address of the client
+func MACCorrelationID(mac net.HardwareAddr) string {
+	return "mac=" + mac.String()
+}
+
+// LogRequest writes Info level logs to logger, tagged with the correlation id
+// of the request
+func LogRequest(subsystem string, r *http.Request, msg string, args ...interface{}) {
+	logCh <- logEntry{subsystem, false, fmt.Sprintf(correlationFormat, RequestID(r), fmt.Sprintf(msg, args...))}
+}
+
+// DebugRequest writes Debug level logs to logger, tagged with the correlation
+// id of the request
+func DebugRequest(subsystem string, r *http.Request, msg string, args ...interface{}) {
+	logCh <- logEntry{subsystem, true, fmt.Sprintf(correlationFormat, RequestID(r), fmt.Sprintf(msg, args...))}
+}
+
+// LogMAC writes Info level logs to logger, tagged with the correlation id of
+// the hardware address
+func LogMAC(subsystem string, mac net.HardwareAddr, msg string, args ...interface{}) {
+	logCh <- logEntry{subsystem, false, fmt.Sprintf(correlationFormat, MACCorrelationID(mac), fmt.Sprintf(msg, args...))}
+}
+
+// DebugMAC writes Debug level logs to logger, tagged with the correlation id
+// of the hardware address
+func DebugMAC(subsystem string, mac net.HardwareAddr, msg string, args ...interface{}) {
+	logCh <- logEntry{subsystem, true, fmt.Sprintf(correlationFormat, MACCorrelationID(mac), fmt.Sprintf(msg, args...))}
+}
+
 func httpRequestMsg(r *http.Request) string {
-	return fmt.Sprintf("%s RemoteAddr:%s Method:%s Referer:%s UserAgent:%s", r.URL, r.RemoteAddr, r.Method, r.Referer(), r.UserAgent())
+	return fmt.Sprintf(correlationFormat, RequestID(r), fmt.Sprintf("%s RemoteAddr:%s Method:%s Referer:%s UserAgent:%s", r.URL, r.RemoteAddr, r.Method, r.Referer(), r.UserAgent()))
 }
 
 // LogHTTPRequest wrtites Info level logs of HTTP requests to logger
@@ -1,6 +1,8 @@
 package logging
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
@@ -60,3 +62,22 @@ func TestRecordLogsNoDebug(t *testing.T) {
 	logger.wg.Wait()
 	close(logCh)
 }
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	handler := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" || id != seen {
+		t.Errorf("expected the same request id in the header and the request, got %q and %q", id, seen)
+	}
+
+	if id := RequestID(httptest.NewRequest("GET", "/", nil)); id != "-" {
+		t.Errorf("expected no request id, got %q", id)
+	}
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file which is rotated once it grows past a size.
+// The rotated files are named path.1 (the newest) to path.<keep>
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens the log file at path for appending. The file is
+// rotated before a write which would make it larger than maxSize bytes,
+// keeping up to keep rotated files
+func NewRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum log file size: %d", maxSize)
+	}
+	f := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate leaves f.file nil only if the log file couldn't be opened again
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if f.keep <= 0 {
+		os.Remove(f.path)
+		return f.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+	for i := f.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// the original file is opened again, so the logs are written to it
+		// past maxSize rather than lost
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return f.open()
+}
+
+// Write writes p to the log file, rotating it first if needed. If the
+// rotation fails, p is still written to the file if it's open
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "Couldn't rotate the log file: %s\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blacksmith.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"blacksmith.log":   "dddddddd\n",
+		"blacksmith.log.1": "cccccccc\n",
+		"blacksmith.log.2": "bbbbbbbb\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil || string(data) != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", name, expected, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept: %v", err)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blacksmith.log")
+	// a non-empty directory in place of the rotated file fails the rename
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("expected the write to succeed despite the failed rotation: %s", err)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "aaaaaaaa\nbbbbbbbb\n" {
+		t.Errorf("expected the logs to be kept in the original file, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// leasePool is the dhcp pool derived from the --pool flag
+type leasePool struct {
+	Start  net.IP
+	Range  int
+	Subnet net.IP
+	// Router is the first address of the subnet, or nil if it falls into
+	// the lease range
+	Router net.IP
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// parsePool parses a lease pool in either the start-end/prefix form (e.g.
+// 192.168.1.10-192.168.1.200/24) or the CIDR form (e.g. 192.168.1.0/24). In
+// the CIDR form, the first address of the subnet is left for the router and
+// the rest of the host addresses form the pool
+func parsePool(pool string) (*leasePool, error) {
+	slash := strings.LastIndex(pool, "/")
+	if slash == -1 {
+		return nil, fmt.Errorf("missing prefix length in pool %q", pool)
+	}
+	ipRange, prefix := pool[:slash], pool[slash:]
+
+	var startIP, endIP net.IP
+	if dash := strings.Index(ipRange, "-"); dash != -1 {
+		startIP = net.ParseIP(ipRange[:dash]).To4()
+		endIP = net.ParseIP(ipRange[dash+1:]).To4()
+		if startIP == nil || endIP == nil {
+			return nil, fmt.Errorf("invalid IP range in pool %q", pool)
+		}
+	}
+
+	cidrIP := ipRange
+	if startIP != nil {
+		cidrIP = startIP.String()
+	}
+	_, subnet, err := net.ParseCIDR(cidrIP + prefix)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 subnet in pool %q", pool)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("subnet of pool %q is too small", pool)
+	}
+
+	network := ipToUint32(subnet.IP)
+	broadcast := network | ^ipToUint32(net.IP(subnet.Mask))
+	router := network + 1
+
+	var start, end uint32
+	if startIP == nil {
+		start, end = router+1, broadcast-1
+	} else {
+		start, end = ipToUint32(startIP), ipToUint32(endIP)
+		if !subnet.Contains(endIP) {
+			return nil, fmt.Errorf("end of the range isn't in the subnet of pool %q", pool)
+		}
+		if start == network || end == broadcast {
+			return nil, fmt.Errorf("range of pool %q includes the network or broadcast address", pool)
+		}
+	}
+	if start > end {
+		return nil, fmt.Errorf("start of the range is after its end in pool %q", pool)
+	}
+
+	ret := &leasePool{
+		Start:  uint32ToIP(start),
+		Range:  int(end - start + 1),
+		Subnet: net.IP(subnet.Mask),
+	}
+	if router < start || router > end {
+		ret.Router = uint32ToIP(router)
+	}
+	return ret, nil
+}
+
+// parseSubnetMask returns the subnet mask of the lease from either the subnet
+// flag, as a mask (255.255.255.0) or a CIDR (192.168.1.0/24), or the prefix
+// length flag. Exactly one of them must be given
+func parseSubnetMask(subnet string, prefix int) (net.IP, error) {
+	if subnet != "" && prefix != 0 {
+		return nil, fmt.Errorf("specify either the lease subnet or the lease prefix, not both")
+	}
+	if prefix != 0 {
+		if prefix < 1 || prefix > 30 {
+			return nil, fmt.Errorf("invalid lease prefix length %d", prefix)
+		}
+		return net.IP(net.CIDRMask(prefix, 32)), nil
+	}
+	if subnet == "" {
+		return nil, fmt.Errorf("specify the lease subnet or the lease prefix")
+	}
+
+	if strings.Contains(subnet, "/") {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 subnet %q", subnet)
+		}
+		return net.IP(ipNet.Mask), nil
+	}
+	mask := net.ParseIP(subnet).To4()
+	if mask == nil {
+		return nil, fmt.Errorf("invalid subnet mask %q", subnet)
+	}
+	if _, bits := net.IPMask(mask).Size(); bits == 0 {
+		return nil, fmt.Errorf("non-contiguous subnet mask %q", subnet)
+	}
+	return mask, nil
+}
+
+// end returns the last address of the lease range
+func (p *leasePool) end() uint32 {
+	return ipToUint32(p.Start) + uint32(p.Range) - 1
+}
+
+// checkPoolOverlaps returns an error naming the first two pools, by their
+// specs, whose lease ranges intersect. Adjacent ranges don't overlap
+func checkPoolOverlaps(specs []string, pools []*leasePool) error {
+	for i := range pools {
+		for j := i + 1; j < len(pools); j++ {
+			if ipToUint32(pools[i].Start) <= pools[j].end() &&
+				ipToUint32(pools[j].Start) <= pools[i].end() {
+				return fmt.Errorf("pools %q and %q overlap", specs[i], specs[j])
+			}
+		}
+	}
+	return nil
+}
+
+// parsePools parses the comma separated pools of the pool flag, and checks
+// that their lease ranges don't overlap. Only one pool can be served yet, so
+// more than one is an error too
+func parsePools(spec string) (*leasePool, error) {
+	specs := strings.Split(spec, ",")
+	pools := make([]*leasePool, len(specs))
+	for i := range specs {
+		specs[i] = strings.TrimSpace(specs[i])
+		pool, err := parsePool(specs[i])
+		if err != nil {
+			return nil, err
+		}
+		pools[i] = pool
+	}
+	if err := checkPoolOverlaps(specs, pools); err != nil {
+		return nil, err
+	}
+	if len(pools) > 1 {
+		return nil, errors.New("serving more than one pool isn't supported yet")
+	}
+	return pools[0], nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParsePool(t *testing.T) {
+	cases := []struct {
+		pool   string
+		start  string
+		rng    int
+		subnet string
+		router string
+	}{
+		{"192.168.1.0/24", "192.168.1.2", 253, "255.255.255.0", "192.168.1.1"},
+		{"192.168.1.10-192.168.1.200/24", "192.168.1.10", 191, "255.255.255.0", "192.168.1.1"},
+		{"192.168.1.1-192.168.1.254/24", "192.168.1.1", 254, "255.255.255.0", ""},
+		{"10.0.0.6-10.0.0.6/30", "10.0.0.6", 1, "255.255.255.252", "10.0.0.5"},
+		{"10.0.0.0/30", "10.0.0.2", 1, "255.255.255.252", "10.0.0.1"},
+		{"10.0.0.0/8", "10.0.0.2", 1<<24 - 3, "255.0.0.0", "10.0.0.1"},
+	}
+
+	for _, c := range cases {
+		pool, err := parsePool(c.pool)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.pool, err)
+			continue
+		}
+		if !pool.Start.Equal(net.ParseIP(c.start)) || pool.Range != c.rng ||
+			!pool.Subnet.Equal(net.ParseIP(c.subnet)) {
+			t.Errorf("%s: unexpected pool: %+v", c.pool, pool)
+		}
+		if c.router == "" && pool.Router != nil ||
+			c.router != "" && !pool.Router.Equal(net.ParseIP(c.router)) {
+			t.Errorf("%s: unexpected router: %s", c.pool, pool.Router)
+		}
+	}
+}
+
+func TestParsePoolErrors(t *testing.T) {
+	for _, pool := range []string{
+		"192.168.1.0",
+		"192.168.1.0/33",
+		"192.168.1.0/31",
+		"192.168.1.200-192.168.1.10/24",
+		"192.168.1.0-192.168.1.10/24",
+		"192.168.1.10-192.168.1.255/24",
+		"192.168.1.10-192.168.2.10/24",
+		"192.168.1.10-nope/24",
+		"fd00::/64",
+	} {
+		if _, err := parsePool(pool); err == nil {
+			t.Errorf("%s: expected an error", pool)
+		}
+	}
+}
+
+func TestCheckPoolOverlaps(t *testing.T) {
+	cases := []struct {
+		specs   []string
+		overlap bool
+	}{
+		{[]string{"192.168.1.0/24", "192.168.2.0/24"}, false},
+		{[]string{"192.168.1.10-192.168.1.99/24", "192.168.1.100-192.168.1.200/24"}, false},
+		{[]string{"192.168.1.10-192.168.1.100/24", "192.168.1.100-192.168.1.200/24"}, true},
+		{[]string{"10.0.0.0/8", "192.168.1.0/24", "10.1.0.0/16"}, true},
+	}
+
+	for _, c := range cases {
+		pools := make([]*leasePool, len(c.specs))
+		for i, spec := range c.specs {
+			pool, err := parsePool(spec)
+			if err != nil {
+				t.Fatalf("%s: %s", spec, err)
+			}
+			pools[i] = pool
+		}
+		if err := checkPoolOverlaps(c.specs, pools); (err != nil) != c.overlap {
+			t.Errorf("%v: expected overlap=%v, got %v", c.specs, c.overlap, err)
+		}
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	pool, err := parsePools("192.168.1.10-192.168.1.200/24")
+	if err != nil || pool.Start.String() != "192.168.1.10" || pool.Range != 191 {
+		t.Errorf("unexpected pool: %+v (%v)", pool, err)
+	}
+
+	// the startup and -validate abort on the error
+	_, err = parsePools("192.168.1.10-192.168.1.100/24, 192.168.1.100-192.168.1.200/24")
+	if err == nil || !strings.Contains(err.Error(), "overlap") || !strings.Contains(err.Error(), "192.168.1.100-192.168.1.200/24") {
+		t.Errorf("expected the overlapping pools to be named, got %v", err)
+	}
+	if _, err := parsePools("192.168.1.0/24,192.168.2.0/24"); err == nil {
+		t.Error("expected an error for more than one pool")
+	}
+	if _, err := parsePools("192.168.1.0/24,invalid"); err == nil {
+		t.Error("expected an error for an invalid pool")
+	}
+}
+
+func TestParseSubnetMask(t *testing.T) {
+	for _, c := range []struct {
+		subnet string
+		prefix int
+	}{
+		{"255.255.255.0", 0},
+		{"192.168.1.0/24", 0},
+		{"", 24},
+	} {
+		mask, err := parseSubnetMask(c.subnet, c.prefix)
+		if err != nil {
+			t.Errorf("%q, %d: %s", c.subnet, c.prefix, err)
+			continue
+		}
+		if !mask.Equal(net.IPv4(255, 255, 255, 0)) {
+			t.Errorf("%q, %d: expected 255.255.255.0, got %s", c.subnet, c.prefix, mask)
+		}
+	}
+
+	for _, c := range []struct {
+		subnet string
+		prefix int
+	}{
+		{"", 0},
+		{"255.255.255.0", 24},
+		{"255.0.255.0", 0},
+		{"nope", 0},
+		{"fd00::/64", 0},
+		{"", 33},
+		{"", -1},
+	} {
+		if _, err := parseSubnetMask(c.subnet, c.prefix); err == nil {
+			t.Errorf("%q, %d: expected an error", c.subnet, c.prefix)
+		}
+	}
+}
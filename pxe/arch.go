@@ -0,0 +1,77 @@
+package pxe
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultArchBootFiles maps the client system architectures of option 93
+// (RFC 4578) to the network boot programs advertised to them
+var DefaultArchBootFiles = map[uint16]string{
+	0: "undionly.kpxe", // x86 BIOS
+	6: "ipxe.efi",      // x86 UEFI
+	7: "ipxe.efi",      // x64 UEFI
+	9: "ipxe.efi",      // EBC, which is what many x64 UEFI firmwares send
+}
+
+// fallbackBootFile is advertised to the architectures without a boot file.
+// The TFTP server serves pxelinux for any name it doesn't find
+const fallbackBootFile = "boot"
+
+// ParseArchBootFiles parses a comma separated list of arch=file pairs, like
+// "0=undionly.kpxe,7=snponly.efi", into a mapping. An empty string results in
+// DefaultArchBootFiles
+func ParseArchBootFiles(s string) (map[uint16]string, error) {
+	if s == "" {
+		return DefaultArchBootFiles, nil
+	}
+
+	bootFiles := make(map[uint16]string)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid arch=file pair: %q", pair)
+		}
+		arch, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arch in %q: %s", pair, err)
+		}
+		bootFiles[uint16(arch)] = strings.TrimSpace(parts[1])
+	}
+	return bootFiles, nil
+}
+
+func bootFileForArch(bootFiles map[uint16]string, arch uint16) string {
+	if file, exists := bootFiles[arch]; exists {
+		return file
+	}
+	return fallbackBootFile
+}
+
+// openBootFile opens the requested file from the boot files directory, only
+// if it's a regular file directly inside the directory
+func openBootFile(dir, filename string) (*os.File, error) {
+	name := path.Base(strings.Replace(filename, "\\", "/", -1))
+	if dir == "" || name == "." || name == "/" || name == ".." {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
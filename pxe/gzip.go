@@ -0,0 +1,49 @@
+package pxe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gzipMagic are the first bytes of a gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var compressInitrd = false
+
+// ConfigureInitrdCompression sets whether the initrds which aren't gzipped
+// already are compressed on the fly, for the clients which accept gzip
+func ConfigureInitrdCompression(enabled bool) {
+	compressInitrd = enabled
+}
+
+// isGzipped checks the magic bytes of the file, regardless of its name
+func isGzipped(f io.ReaderAt) (bool, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic[:n], gzipMagic), nil
+}
+
+// shouldCompress reports whether the blob is sent gzip encoded. Blobs which
+// are gzipped already are sent as they are, to avoid compressing them twice,
+// and so are the range requests, for the ranges to stay meaningful
+func shouldCompress(r *http.Request, id string, gzipped bool) bool {
+	return compressInitrd && id == "initrd" && !gzipped &&
+		strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") &&
+		r.Header.Get("Range") == ""
+}
+
+// serveCompressed sends the contents of the reader gzip encoded
+func serveCompressed(w http.ResponseWriter, r io.Reader) error {
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, r); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -1,19 +1,21 @@
 package pxe
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/logging"
 	"github.com/cafebazaar/blacksmith/templating"
+	"github.com/cafebazaar/blacksmith/tracing"
 )
 
 const bootMessageTemplate = `
@@ -21,6 +23,28 @@ const bootMessageTemplate = `
 		+ MAC ADDR:	$MAC
 `
 
+// DefaultCmdlineTemplate points the machines at the cloudconfig and ignition
+// endpoints of the web server of blacksmith
+const DefaultCmdlineTemplate = "cloud-config-url=http://{{.ServerIP}}:{{.HTTPPort}}/t/cc/{{.Mac}} " +
+	"coreos.config.url=http://{{.ServerIP}}:{{.HTTPPort}}/t/ig/{{.Mac}}"
+
+// cmdlineContext is passed to the cmdline template
+type cmdlineContext struct {
+	ServerIP string
+	HTTPPort int
+	Mac      string
+}
+
+// ParseCmdlineTemplate parses the template of the kernel cmdline, which the
+// bootparams of the machine are appended to. An empty text results in
+// DefaultCmdlineTemplate
+func ParseCmdlineTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultCmdlineTemplate
+	}
+	return template.New("cmdline").Option("missingkey=error").Parse(text)
+}
+
 type nodeContext struct {
 	IP string
 }
@@ -32,10 +56,21 @@ type HTTPBooter struct {
 	bootParamsTemplates *template.Template
 	webPort             int
 	bootMessageTemplate string
+	breaker             *datasource.Breaker
+	cmdlineTemplate     *template.Template
 }
 
+// NewHTTPBooter creates a booter which serves the pxelinux configs, with the
+// kernel cmdline generated by cmdlineTemplate, or DefaultCmdlineTemplate if
+// it's nil
 func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
-	ds datasource.DataSource, webPort int) (*HTTPBooter, error) {
+	ds datasource.DataSource, webPort int, cmdlineTemplate *template.Template) (*HTTPBooter, error) {
+	if cmdlineTemplate == nil {
+		var err error
+		if cmdlineTemplate, err = ParseCmdlineTemplate(""); err != nil {
+			return nil, err
+		}
+	}
 	bootMessageVersionedTemplate := strings.Replace(bootMessageTemplate, "$VERSION", ds.Version().Version, -1)
 	booter := &HTTPBooter{
 		listenAddr:          listenAddr,
@@ -43,6 +78,8 @@ func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
 		datasource:          ds,
 		webPort:             webPort,
 		bootMessageTemplate: bootMessageVersionedTemplate,
+		breaker:             datasource.NewBreaker(datasource.DefaultBreakerOpenPeriod),
+		cmdlineTemplate:     cmdlineTemplate,
 	}
 	return booter, nil
 }
@@ -63,24 +100,41 @@ func (b *HTTPBooter) ldlinuxHandler(w http.ResponseWriter, r *http.Request) {
 
 func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
+	// rendered per machine and boot, so a cached copy could point a
+	// reimaged machine to stale configs
+	w.Header().Set("Cache-Control", "no-store")
 
 	macStr := filepath.Base(r.URL.Path)
 	errStr := fmt.Sprintf("%s requested a pxelinux config from URL %q, which does not include a correct MAC address", r.RemoteAddr, r.URL)
 	if !strings.HasPrefix(macStr, "01-") {
-		logging.Debug("HTTPBOOTER", errStr)
+		logging.DebugRequest("HTTPBOOTER", r, "%s", errStr)
 		http.Error(w, "Missing MAC address in request", http.StatusBadRequest)
 		return
 	}
 	mac, err := net.ParseMAC(macStr[3:])
 	if err != nil {
-		logging.Debug("HTTPBOOTER", errStr)
+		logging.DebugRequest("HTTPBOOTER", r, "%s", errStr)
 		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
 		return
 	}
 
+	// the version is read first, so a missing machine isn't reported while
+	// etcd is unavailable
+	var coreOSVersion string
+	err = b.breaker.Do(func() error {
+		var err error
+		coreOSVersion, err = b.datasource.CoreOSVersion()
+		return err
+	})
+	if datasource.IsUnavailable(err) {
+		logging.LogRequest("HTTPBOOTER", r, "Etcd is unavailable: %s", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
 	machine, exist := b.datasource.GetMachine(mac)
 	if !exist {
-		logging.Debug("HTTPBOOTER", "Machine not found. mac=%s", mac)
+		logging.DebugRequest("HTTPBOOTER", r, "Machine not found. mac=%s", mac)
 		http.Error(w, "Machine not found", http.StatusNotFound)
 		return
 	}
@@ -89,39 +143,43 @@ func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 		r.Host = fmt.Sprintf("%s:%d", r.Host, b.listenAddr.Port)
 	}
 
-	coreOSVersion, _ := b.datasource.CoreOSVersion()
+	// the rescue images take the place of the CoreOS version
+	rescue := datasource.MachineBootMode(machine) == datasource.BootModeRescue
+	version := coreOSVersion
+	if rescue {
+		version = datasource.RescueImage
+	}
 
-	KernelURL := "http://" + r.Host + "/f/" + coreOSVersion + "/kernel"
-	InitrdURL := "http://" + r.Host + "/f/" + coreOSVersion + "/initrd"
+	// the images of amd64 keep their urls from before the arch was known
+	arch := datasource.MachineArch(machine)
+	blobsURL := "http://" + r.Host + "/f/" + version + "/"
+	if arch != datasource.ArchAMD64 {
+		blobsURL += arch + "/"
+	}
+	KernelURL := blobsURL + "kernel"
+	InitrdURL := blobsURL + "initrd"
 
 	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		logging.Log("HTTPBOOTER", "error in parsing host and port")
+		logging.LogRequest("HTTPBOOTER", r, "error in parsing host and port")
 		http.Error(w, "error in parsing host and port", 500)
 		return
 	}
 
-	params, err := templating.ExecuteTemplateFolder(
-		path.Join(b.datasource.WorkspacePath(), "config", "bootparams"), machine, r.Host)
-	if err != nil {
-		logging.Log("HTTPBOOTER", `Error while executing the template: %q`, err)
-		http.Error(w, fmt.Sprintf(`Error while executing the template: %q`, err),
-			http.StatusInternalServerError)
-		return
-	}
-
-	if err != nil {
-		logging.Log("HTTPBOOTER", "error in bootparam template - %s", err.Error())
-		http.Error(w, "error in bootparam template", 500)
-		return
+	var Cmdline string
+	if rescue {
+		Cmdline, err = datasource.RescueCmdline(b.datasource.WorkspacePath(), arch)
+		if err != nil {
+			logging.LogRequest("HTTPBOOTER", r, "Error while reading the rescue cmdline: %s", err)
+			http.Error(w, "error in rescue cmdline", 500)
+			return
+		}
+	} else {
+		var ok bool
+		if Cmdline, ok = b.machineCmdline(w, r, machine, mac, host); !ok {
+			return
+		}
 	}
-	params = strings.Replace(params, "\n", " ", -1)
-
-	Cmdline := fmt.Sprintf(
-		"cloud-config-url=http://%s:%d/t/cc/%s "+
-			"coreos.config.url=http://%s:%d/t/ig/%s %s",
-		host, b.webPort, mac.String(),
-		host, b.webPort, mac.String(), params)
 	bootMessage := strings.Replace(b.bootMessageTemplate, "$MAC", macStr, -1)
 	cfg := fmt.Sprintf(`
 SAY %s
@@ -131,72 +189,213 @@ LINUX %s
 APPEND initrd=%s %s
 `, strings.Replace(bootMessage, "\n", "\nSAY ", -1), KernelURL, InitrdURL, Cmdline)
 	w.Write([]byte(cfg))
-	logging.Log("HTTPBOOTER", "Sent pxelinux config to %s (%s)", mac, r.RemoteAddr)
+	logging.LogRequest("HTTPBOOTER", r, "Sent pxelinux config to %s (%s)", mac, r.RemoteAddr)
+}
+
+// machineCmdline renders the kernel cmdline of the machine, from the cmdline
+// template and the bootparams. Returns false if it has written an error
+func (b *HTTPBooter) machineCmdline(w http.ResponseWriter, r *http.Request, machine datasource.Machine, mac net.HardwareAddr, host string) (string, bool) {
+	folder, err := templating.ConfigFolder(b.datasource.WorkspacePath(), "bootparams", machine)
+	if err != nil {
+		logging.LogRequest("HTTPBOOTER", r, `Error while selecting the profile: %q`, err)
+		http.Error(w, fmt.Sprintf(`Error while selecting the profile: %q`, err),
+			http.StatusInternalServerError)
+		return "", false
+	}
+
+	params, err := templating.ExecuteTemplateFolder(folder, b.datasource, machine, r.Host)
+	if err == templating.ErrTooManyRenders {
+		logging.LogRequest("HTTPBOOTER", r, "Too many renders, rejected the bootparams")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return "", false
+	}
+	if errors.Is(err, templating.ErrMissingConfig) {
+		logging.LogRequest("HTTPBOOTER", r, "No bootparams: %s", err)
+		http.Error(w, "No bootparams for the machine", http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		logging.LogRequest("HTTPBOOTER", r, `Error while executing the template: %q`, err)
+		http.Error(w, fmt.Sprintf(`Error while executing the template: %q`, err),
+			http.StatusInternalServerError)
+		return "", false
+	}
+
+	params = strings.Replace(params, "\n", " ", -1)
+
+	var cmdline bytes.Buffer
+	err = b.cmdlineTemplate.Execute(&cmdline, &cmdlineContext{
+		ServerIP: host,
+		HTTPPort: b.webPort,
+		Mac:      mac.String(),
+	})
+	if err != nil {
+		logging.LogRequest("HTTPBOOTER", r, "error in cmdline template - %s", err)
+		http.Error(w, "error in cmdline template", 500)
+		return "", false
+	}
+	return strings.TrimSpace(cmdline.String() + " " + params), true
 }
 
+var (
+	fileOpenRetries = 3
+	fileOpenBackoff = 200 * time.Millisecond
+)
+
+// ConfigureFileRetries sets how many times the booter retries opening an
+// image file which exists but can't be opened, like on a busy NFS mount,
+// and the backoff before the first retry, which doubles on each retry
+func ConfigureFileRetries(retries int, backoff time.Duration) {
+	fileOpenRetries = retries
+	fileOpenBackoff = backoff
+}
+
+var (
+	readHeaderTimeout = 10 * time.Second
+	writeTimeout      = 30 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// ConfigureTimeouts sets how long ServeHTTPBooter waits for the headers of a
+// request, how long sending a response, like an image, may take, and how
+// long an idle keep-alive connection is kept open. A zero one means no
+// timeout
+func ConfigureTimeouts(readHeader, write, idle time.Duration) {
+	readHeaderTimeout = readHeader
+	writeTimeout = write
+	idleTimeout = idle
+}
+
+// errUnknownBlob is returned by coreOS for the ids other than kernel and
+// initrd
+var errUnknownBlob = errors.New("unknown blob")
+
 // Get the contents of a blob mentioned in a previously issued
-// BootSpec. Additionally returns a pretty name for the blob for
-// logging purposes.
-func (b *HTTPBooter) coreOS(version string, id string) (io.ReadCloser, error) {
-	imagePath := filepath.Join(b.datasource.WorkspacePath(), "images")
+// BootSpec. Missing files aren't retried, since they won't appear by
+// waiting a few hundred milliseconds.
+func (b *HTTPBooter) coreOS(version, arch, id string) (*os.File, error) {
+	imagePath := datasource.ImageDir(b.datasource.WorkspacePath(), version, arch)
+	var path string
 	switch id {
 	case "kernel":
-		path := filepath.Join(imagePath, version, "coreos_production_pxe.vmlinuz")
+		path = filepath.Join(imagePath, "coreos_production_pxe.vmlinuz")
 		logging.Debug("HTTPBOOTER", "path=<%q>", path)
-		return os.Open(path)
 	case "initrd":
-		return os.Open(filepath.Join(imagePath, version, "coreos_production_pxe_image.cpio.gz"))
+		path = filepath.Join(imagePath, "coreos_production_pxe_image.cpio.gz")
+	default:
+		return nil, errUnknownBlob
+	}
+
+	backoff := fileOpenBackoff
+	for i := 0; ; i++ {
+		f, err := os.Open(path)
+		if err == nil || os.IsNotExist(err) || i >= fileOpenRetries {
+			return f, err
+		}
+		logging.Debug("HTTPBOOTER", "Retrying to open %s in %s: %s", path, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	return nil, fmt.Errorf("id=<%q> wasn't expected", id)
 }
 
 func (b *HTTPBooter) fileHandler(w http.ResponseWriter, r *http.Request) {
-	splitPath := strings.SplitN(r.URL.Path, "/", 4)
+	// /f/<version>/<id> for amd64, or /f/<version>/<arch>/<id>
+	splitPath := strings.Split(r.URL.Path, "/")
+	if len(splitPath) < 4 || len(splitPath) > 5 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	version := splitPath[2]
-	id := splitPath[3]
+	arch, id := datasource.ArchAMD64, splitPath[3]
+	if len(splitPath) == 5 {
+		arch, id = splitPath[3], splitPath[4]
+		if !datasource.ValidArch(arch) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
 
-	logging.Debug("HTTPBOOTER", "Got request for %s", r.URL.Path)
+	logging.DebugRequest("HTTPBOOTER", r, "Got request for %s", r.URL.Path)
 
-	var (
-		f   io.ReadCloser
-		err error
-	)
+	f, err := b.coreOS(version, arch, id)
+	if err != nil {
+		logging.LogRequest("HTTPBOOTER", r, "Couldn't get byte stream for %q from %s: %s", r.URL, r.RemoteAddr, err)
+		if err == errUnknownBlob || os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Couldn't get byte stream", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer f.Close()
 
-	f, err = b.coreOS(version, id)
+	fi, err := f.Stat()
+	if err != nil {
+		logging.LogRequest("HTTPBOOTER", r, "Couldn't stat %s for %s: %s", id, r.RemoteAddr, err)
+		http.Error(w, "Couldn't get byte stream", http.StatusInternalServerError)
+		return
+	}
 
+	gzipped, err := isGzipped(f)
 	if err != nil {
-		logging.Log("HTTPBOOTER", "Couldn't get byte stream for %q from %s: %s", r.URL, r.RemoteAddr, err)
+		logging.LogRequest("HTTPBOOTER", r, "Couldn't read %s for %s: %s", id, r.RemoteAddr, err)
 		http.Error(w, "Couldn't get byte stream", http.StatusInternalServerError)
 		return
 	}
-	defer f.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	written, err := io.Copy(w, f)
-	if err != nil {
-		logging.Log("HTTPBOOTER", "Error serving %s to %s: %s", id, r.RemoteAddr, err)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if shouldCompress(r, id, gzipped) {
+		if err := serveCompressed(w, f); err != nil {
+			logging.LogRequest("HTTPBOOTER", r, "Couldn't send the compressed %s to %s: %s", id, r.RemoteAddr, err)
+			return
+		}
+		logging.LogRequest("HTTPBOOTER", r, "Sent the compressed %s to %s (%d bytes uncompressed)",
+			id, r.RemoteAddr, fi.Size())
 		return
 	}
-	logging.Log("HTTPBOOTER", "Sent %s to %s (%d bytes)", id, r.RemoteAddr, written)
+
+	// the blobs of a version don't change, so they can be cached and
+	// revalidated. ServeContent handles Range, If-None-Match and
+	// If-Modified-Since, so that a client which retries in the middle of a
+	// download can resume it
+	w.Header().Set("ETag", blobETag(fi))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	logging.LogRequest("HTTPBOOTER", r, "Sent %s to %s (%d bytes, range=%q)",
+		id, r.RemoteAddr, fi.Size(), r.Header.Get("Range"))
+}
+
+// blobETag derives the ETag of an image blob from its modification time and
+// size, so it changes if the file is replaced
+func blobETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
 }
 
-func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) (*http.ServeMux, error) {
+func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int, cmdlineTemplate *template.Template) (*http.ServeMux, error) {
 	ldlinux, err := FSByte(false, "/pxelinux/ldlinux.c32")
 	if err != nil {
 		return nil, err
 	}
-	booter, err := NewHTTPBooter(listenAddr, ldlinux, ds, webPort)
+	booter, err := NewHTTPBooter(listenAddr, ldlinux, ds, webPort, cmdlineTemplate)
 	if err != nil {
 		return nil, err
 	}
 	return booter.Mux(), nil
 }
 
-func ServeHTTPBooter(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) error {
+func ServeHTTPBooter(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int, cmdlineTemplate *template.Template) error {
 	logging.Log("HTTPBOOTER", "Listening on %s", listenAddr.String())
-	mux, err := HTTPBooterMux(listenAddr, ds, webPort)
+	mux, err := HTTPBooterMux(listenAddr, ds, webPort, cmdlineTemplate)
 	if err != nil {
 		return err
 	}
-	return http.ListenAndServe(listenAddr.String(), mux)
+	s := &http.Server{
+		Addr:              listenAddr.String(),
+		Handler:           logging.RequestIDHandler(tracing.Handler("httpbooter", mux)),
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	return s.ListenAndServe()
 }
@@ -0,0 +1,303 @@
+package pxe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+// unavailableDataSource fails like a datasource which can't reach etcd
+type unavailableDataSource struct {
+	*datasourcetest.MemoryDataSource
+	calls int
+}
+
+func (ds *unavailableDataSource) CoreOSVersion() (string, error) {
+	ds.calls++
+	return "", &etcd.ClusterError{}
+}
+
+func TestFileHandlerRange(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	versionDir := filepath.Join(ds.Workspace, "images", "1000.0.0")
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(versionDir, "coreos_production_pxe_image.cpio.gz"),
+		[]byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	booter, _ := NewHTTPBooter(net.TCPAddr{}, nil, ds, 8000, nil)
+	r := httptest.NewRequest("GET", "/f/1000.0.0/initrd", nil)
+	r.Header.Set("Range", "bytes=4-")
+	w := httptest.NewRecorder()
+	booter.fileHandler(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "456789" {
+		t.Errorf("expected the rest of the file, got %q", body)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected the validators of the blob, got %v", w.Header())
+	}
+	r = httptest.NewRequest("GET", "/f/1000.0.0/initrd", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	booter.fileHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status 304 for the same ETag, got %d", w.Code)
+	}
+}
+
+func TestPxelinuxConfigUnavailable(t *testing.T) {
+	ds := &unavailableDataSource{MemoryDataSource: datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)}
+	booter, _ := NewHTTPBooter(net.TCPAddr{}, nil, ds, 8000, nil)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/pxelinux.cfg/01-00-11-22-33-44-55", nil)
+		w := httptest.NewRecorder()
+		booter.pxelinuxConfig(w, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 503, got %d", w.Code)
+		}
+	}
+	if ds.calls != 1 {
+		t.Errorf("expected the open breaker to skip etcd, got %d calls", ds.calls)
+	}
+}
+
+func TestPxelinuxConfigCmdline(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	bootparams := filepath.Join(ds.Workspace, "config", "bootparams")
+	if err := os.MkdirAll(bootparams, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bootparams, "main"), []byte("console=ttyS0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	cmdline, err := ParseCmdlineTemplate("ignition.config.url=http://{{.ServerIP}}:{{.HTTPPort}}/t/ig/{{.Mac}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	booter, _ := NewHTTPBooter(net.TCPAddr{Port: 70}, nil, ds, 8000, cmdline)
+	r := httptest.NewRequest("GET", "http://10.0.0.1/pxelinux.cfg/01-00-11-22-33-44-55", nil)
+	w := httptest.NewRecorder()
+	booter.pxelinuxConfig(w, r)
+
+	expected := "ignition.config.url=http://10.0.0.1:8000/t/ig/00:11:22:33:44:55 console=ttyS0\n"
+	if w.Code != http.StatusOK || !strings.HasSuffix(w.Body.String(), expected) {
+		t.Errorf("expected the cmdline %q, got %d:\n%s", expected, w.Code, w.Body)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("expected the config not to be cached, got %q", cacheControl)
+	}
+
+	if _, err := ParseCmdlineTemplate("{{.ServerIP"); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+func TestArchImages(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	ds.CoreOS = "1000.0.0"
+	versionDir := filepath.Join(ds.Workspace, "images", "1000.0.0")
+	bootparams := filepath.Join(ds.Workspace, "config", "bootparams")
+	for _, dir := range []string{filepath.Join(versionDir, "arm64"), bootparams} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(versionDir, "coreos_production_pxe.vmlinuz"):          "amd64 kernel",
+		filepath.Join(versionDir, "arm64", "coreos_production_pxe.vmlinuz"): "arm64 kernel",
+		filepath.Join(bootparams, "main"):                                   "",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag(datasource.ArchFlag, datasource.ArchARM64)
+
+	booter, _ := NewHTTPBooter(net.TCPAddr{Port: 70}, nil, ds, 8000, nil)
+	w := httptest.NewRecorder()
+	booter.pxelinuxConfig(w, httptest.NewRequest("GET", "http://10.0.0.1/pxelinux.cfg/01-00-11-22-33-44-55", nil))
+	if !strings.Contains(w.Body.String(), "LINUX http://10.0.0.1:70/f/1000.0.0/arm64/kernel\n") {
+		t.Errorf("expected the arm64 kernel, got %d:\n%s", w.Code, w.Body)
+	}
+
+	for path, expected := range map[string]string{
+		"/f/1000.0.0/arm64/kernel": "arm64 kernel",
+		"/f/1000.0.0/kernel":       "amd64 kernel",
+		"/f/1000.0.0/amd64/kernel": "amd64 kernel",
+	} {
+		w := httptest.NewRecorder()
+		booter.fileHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %d: %q", path, expected, w.Code, w.Body)
+		}
+	}
+	for _, path := range []string{"/f/1000.0.0/..", "/f/1000.0.0/../kernel", "/f/1000.0.0/arm64/kernel/x"} {
+		w := httptest.NewRecorder()
+		booter.fileHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestRescueBootMode(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	ds.CoreOS = "1000.0.0"
+	rescueDir := filepath.Join(ds.Workspace, "images", datasource.RescueImage)
+	bootparams := filepath.Join(ds.Workspace, "config", "bootparams")
+	for _, dir := range []string{rescueDir, bootparams} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(rescueDir, "coreos_production_pxe.vmlinuz"): "rescue kernel",
+		filepath.Join(rescueDir, "cmdline"):                       "rescue\nconsole=ttyS0\n",
+		filepath.Join(bootparams, "main"):                         "coreos.autologin",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	booter, _ := NewHTTPBooter(net.TCPAddr{Port: 70}, nil, ds, 8000, nil)
+
+	config := func() string {
+		w := httptest.NewRecorder()
+		booter.pxelinuxConfig(w, httptest.NewRequest("GET", "http://10.0.0.1/pxelinux.cfg/01-00-11-22-33-44-55", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	if cfg := config(); !strings.Contains(cfg, "/f/1000.0.0/kernel\n") || !strings.Contains(cfg, "coreos.autologin") {
+		t.Errorf("expected the CoreOS image without a boot mode, got:\n%s", cfg)
+	}
+
+	machine.SetFlag(datasource.BootModeFlag, datasource.BootModeRescue)
+	cfg := config()
+	if !strings.Contains(cfg, "LINUX http://10.0.0.1:70/f/rescue/kernel\n") {
+		t.Errorf("expected the rescue kernel, got:\n%s", cfg)
+	}
+	if !strings.Contains(cfg, "/f/rescue/initrd rescue console=ttyS0\n") || strings.Contains(cfg, "coreos.autologin") {
+		t.Errorf("expected the rescue cmdline instead of the bootparams, got:\n%s", cfg)
+	}
+
+	w := httptest.NewRecorder()
+	booter.fileHandler(w, httptest.NewRequest("GET", "/f/rescue/kernel", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "rescue kernel" {
+		t.Errorf("expected the rescue kernel, got %d: %q", w.Code, w.Body)
+	}
+}
+
+func TestFileHandlerErrors(t *testing.T) {
+	defer ConfigureFileRetries(fileOpenRetries, fileOpenBackoff)
+	ConfigureFileRetries(2, time.Millisecond)
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ds.Workspace, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a file in place of the version directory fails the open with ENOTDIR,
+	// which isn't a missing file
+	if err := os.WriteFile(filepath.Join(ds.Workspace, "images", "broken"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	booter, _ := NewHTTPBooter(net.TCPAddr{}, nil, ds, 8000, nil)
+	for path, status := range map[string]int{
+		"/f/1000.0.0/kernel": http.StatusNotFound,
+		"/f/1000.0.0/other":  http.StatusNotFound,
+		"/f/broken/kernel":   http.StatusServiceUnavailable,
+	} {
+		w := httptest.NewRecorder()
+		booter.fileHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, w.Code)
+		}
+	}
+}
+
+func TestFileHandlerCompression(t *testing.T) {
+	defer ConfigureInitrdCompression(compressInitrd)
+	ConfigureInitrdCompression(true)
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	versionDir := filepath.Join(ds.Workspace, "images", "1000.0.0")
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	initrdPath := filepath.Join(versionDir, "coreos_production_pxe_image.cpio.gz")
+	booter, _ := NewHTTPBooter(net.TCPAddr{}, nil, ds, 8000, nil)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/f/1000.0.0/initrd", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		booter.fileHandler(w, r)
+		return w
+	}
+
+	// an uncompressed cpio is compressed on the fly
+	if err := os.WriteFile(initrdPath, []byte("070701 uncompressed cpio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := get()
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip encoded response, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(gz); string(body) != "070701 uncompressed cpio" {
+		t.Errorf("unexpected decompressed body: %q", body)
+	}
+
+	// a gzipped one is sent as is
+	gzipped := []byte{0x1f, 0x8b, 0x08, 0x00}
+	if err := os.WriteFile(initrdPath, gzipped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w = get()
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), gzipped) {
+		t.Errorf("expected the gzipped initrd as is, got %q encoded %x",
+			w.Header().Get("Content-Encoding"), w.Body.Bytes())
+	}
+}
@@ -2,6 +2,7 @@ package pxe // import "github.com/cafebazaar/blacksmith/pxe"
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -26,8 +27,13 @@ type PXEPacket struct {
 	// The boot type requested by the client. We need to mirror this
 	// in the PXE reply.
 	BootType []byte
+	// The client system architecture from option 93, 0 (x86 BIOS) if the
+	// client didn't send it
+	Arch uint16
 
 	HTTPServer string
+	// The network boot program advertised to the client
+	BootFile string
 }
 
 func dhcpOption(b []byte) (typ byte, val []byte, next []byte) {
@@ -41,7 +47,9 @@ func dhcpOption(b []byte) (typ byte, val []byte, next []byte) {
 	return typ, b[2 : 2+l], b[2+l:]
 }
 
-func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr) error {
+// ServePXE answers the PXE requests, advertising the boot file mapped to the
+// architecture of the client in bootFiles
+func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr, bootFiles map[uint16]string) error {
 	conn, err := net.ListenPacket("udp4", listenAddr.String())
 	if err != nil {
 		return err
@@ -61,26 +69,38 @@ func ServePXE(listenAddr net.UDPAddr, serverIP net.IP, httpAddr net.TCPAddr) err
 			continue
 		}
 
-		req, err := ParsePXE(buf[:n])
+		reply, err := AnswerPXE(buf[:n], serverIP, httpAddr, bootFiles)
 		if err != nil {
 			logging.Debug("PXE", "ParsePXE: %s", err)
 			continue
 		}
 
-		req.ServerIP = serverIP
-		req.HTTPServer = fmt.Sprintf("http://%s/", httpAddr.String())
-
-		logging.Log("PXE", "Chainloading %s (%s) to pxelinux (via %s)", req.MAC, req.ClientIP, req.ServerIP)
-
-		if _, err := l.WriteTo(ReplyPXE(req), &ipv4.ControlMessage{
+		if _, err := l.WriteTo(reply, &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
 		}, addr); err != nil {
-			logging.Log("PXE", "Responding to %s: %s", req.MAC, err)
+			logging.Log("PXE", "Responding to %s: %s", addr, err)
 			continue
 		}
 	}
 }
 
+// AnswerPXE returns the reply to the PXE request b, which chainloads the boot
+// file mapped to the architecture of the client in bootFiles, and points
+// pxelinux to the http booter at httpAddr
+func AnswerPXE(b []byte, serverIP net.IP, httpAddr net.TCPAddr, bootFiles map[uint16]string) ([]byte, error) {
+	req, err := ParsePXE(b)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ServerIP = serverIP
+	req.HTTPServer = fmt.Sprintf("http://%s/", httpAddr.String())
+	req.BootFile = bootFileForArch(bootFiles, req.Arch)
+
+	logging.Log("PXE", "Chainloading %s (%s, arch=%d) to %s (via %s)", req.MAC, req.ClientIP, req.Arch, req.BootFile, req.ServerIP)
+	return ReplyPXE(req), nil
+}
+
 func ReplyPXE(p *PXEPacket) []byte {
 	var b bytes.Buffer
 
@@ -94,10 +114,14 @@ func ReplyPXE(p *PXEPacket) []byte {
 	copy(bootp[16:], p.ClientIP)
 	copy(bootp[20:], p.ServerIP)
 	copy(bootp[28:], p.MAC)
-	// Boot file name. Our TFTP server unconditionally serves up
-	// pxelinux no matter the name, so we just put something that
-	// looks nice in packet dumps.
-	copy(bootp[108:], "boot")
+	// Boot file name. Our TFTP server serves up pxelinux for the
+	// names it doesn't have, so "boot" is used when nothing is mapped
+	// to the architecture of the client.
+	bootFile := p.BootFile
+	if bootFile == "" {
+		bootFile = fallbackBootFile
+	}
+	copy(bootp[108:236], bootFile)
 	b.Write(bootp[:])
 
 	// DHCP magic
@@ -168,6 +192,12 @@ func ParsePXE(b []byte) (req *PXEPacket, err error) {
 				return nil, fmt.Errorf("packet from %s (%s) has malformed option 97", ret.MAC, ret.ClientIP)
 			}
 			ret.GUID = val[1:]
+		case 93:
+			// a list of architectures, the first one is used
+			if len(val) < 2 {
+				return nil, fmt.Errorf("packet from %s (%s) has malformed option 93", ret.MAC, ret.ClientIP)
+			}
+			ret.Arch = binary.BigEndian.Uint16(val)
 		}
 		typ, val, opts = dhcpOption(opts)
 	}
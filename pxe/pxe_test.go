@@ -1,7 +1,10 @@
 package pxe
 
 import (
+	"bytes"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -20,3 +23,66 @@ func TestReplyPXE(t *testing.T) {
 		t.Errorf("PXE packets end with 255, this one ends with %d", response[n-1])
 	}
 }
+
+func TestParsePXEArch(t *testing.T) {
+	packet := make([]byte, 240)
+	copy(packet[28:], []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	copy(packet[236:], dhcpMagic)
+	packet = append(packet, 97, 17, 0)
+	packet = append(packet, make([]byte, 16)...)
+	packet = append(packet, 43, 6, 71, 4, 0x80, 0, 0, 0)
+	packet = append(packet, 93, 2, 0, 7, 255)
+
+	req, err := ParsePXE(packet)
+	if err != nil {
+		t.Fatalf("ParsePXE: %s", err)
+	}
+	if req.Arch != 7 {
+		t.Errorf("expected arch 7, got %d", req.Arch)
+	}
+
+	req.BootFile = bootFileForArch(DefaultArchBootFiles, req.Arch)
+	response := ReplyPXE(req)
+	if file := string(bytes.TrimRight(response[108:236], "\x00")); file != "ipxe.efi" {
+		t.Errorf("expected ipxe.efi to be advertised, got %q", file)
+	}
+}
+
+func TestParseArchBootFiles(t *testing.T) {
+	bootFiles, err := ParseArchBootFiles("0=undionly.kpxe, 7=snponly.efi")
+	if err != nil {
+		t.Fatalf("ParseArchBootFiles: %s", err)
+	}
+	if bootFiles[0] != "undionly.kpxe" || bootFiles[7] != "snponly.efi" || len(bootFiles) != 2 {
+		t.Errorf("unexpected mapping: %v", bootFiles)
+	}
+	if bootFileForArch(bootFiles, 11) != fallbackBootFile {
+		t.Error("expected the fallback boot file for an unmapped arch")
+	}
+
+	for _, invalid := range []string{"7", "x=ipxe.efi", "7=", "70000=ipxe.efi"} {
+		if _, err := ParseArchBootFiles(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestOpenBootFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ipxe.efi"), []byte("efi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openBootFile(dir, "/ipxe.efi")
+	if err != nil {
+		t.Fatalf("openBootFile: %s", err)
+	}
+	f.Close()
+
+	for _, name := range []string{"", "/", "..", "lpxelinux.0"} {
+		if f, err := openBootFile(dir, name); err == nil {
+			f.Close()
+			t.Errorf("expected no file for %q", name)
+		}
+	}
+}
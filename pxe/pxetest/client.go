@@ -0,0 +1,303 @@
+// Package pxetest simulates a PXE client booting from blacksmith, without
+// any sockets, for the end-to-end tests of the boot path
+package pxetest // import "github.com/cafebazaar/blacksmith/pxe/pxetest"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// Client walks through the steps of a PXE boot: the DHCP Discover and
+// Request, the PXE request to the boot server, the TFTP fetch of the network
+// boot program, the pxelinux config and the kernel from the http booter, and
+// the cloud-config from the web server
+type Client struct {
+	MAC net.HardwareAddr
+	// GUID is sent as option 97. Defaults to zeros
+	GUID []byte
+	// Arch is the client system architecture sent as option 93 (RFC 4578)
+	Arch uint16
+
+	// DHCP answers the DHCP packets, like the handler of dhcp.NewHandler
+	DHCP dhcp4.Handler
+	// PXE answers the requests to the boot server, like pxe.AnswerPXE
+	PXE func(request []byte) ([]byte, error)
+	// TFTP opens the files, like the handler of pxe.NewTFTPHandler
+	TFTP func(filename string, addr net.Addr) (io.ReadCloser, error)
+	// Booter serves the pxelinux configs and the images, like the mux of
+	// pxe.NewHTTPBooter
+	Booter http.Handler
+	// Web serves the templates, like web.NewHandler
+	Web http.Handler
+}
+
+// Boot is what the client got at each step of the boot
+type Boot struct {
+	IP       net.IP
+	ServerID net.IP
+	// BootType is the first entry of the PXE boot menu of the offer
+	BootType uint16
+	// BootFile is the network boot program named by the boot server
+	BootFile string
+	NBP      []byte
+	// HTTPServer is the path prefix of pxelinux, option 210
+	HTTPServer     string
+	PxelinuxConfig string
+	Kernel         []byte
+	CloudConfig    string
+}
+
+// Boot runs all the steps, failing the test at the first one which fails
+func (c *Client) Boot(t testing.TB) *Boot {
+	t.Helper()
+	boot := &Boot{}
+	for _, step := range []struct {
+		name string
+		run  func(*Boot) error
+	}{
+		{"discover", c.Discover},
+		{"request", c.Request},
+		{"pxe", c.RequestPXE},
+		{"tftp", c.FetchNBP},
+		{"pxelinux config", c.FetchPxelinuxConfig},
+		{"kernel", c.FetchKernel},
+		{"cloud-config", c.FetchCloudConfig},
+	} {
+		if err := step.run(boot); err != nil {
+			t.Fatalf("%s of %s: %s", step.name, c.MAC, err)
+		}
+	}
+	return boot
+}
+
+func (c *Client) guid() []byte {
+	if c.GUID != nil {
+		return c.GUID
+	}
+	return make([]byte, 16)
+}
+
+// dhcpPacket returns a packet of the client with the PXE options, option 97
+// and 93
+func (c *Client) dhcpPacket() dhcp4.Packet {
+	p := dhcp4.NewPacket(dhcp4.BootRequest)
+	p.SetCHAddr(c.MAC)
+	p.SetXId([]byte{1, 2, 3, 4})
+	p.SetBroadcast(true)
+	p.AddOption(dhcp4.OptionVendorClassIdentifier, []byte("PXEClient"))
+	p.AddOption(97, append([]byte{0}, c.guid()...))
+	arch := make([]byte, 2)
+	binary.BigEndian.PutUint16(arch, c.Arch)
+	p.AddOption(93, arch)
+	return p
+}
+
+func messageType(options dhcp4.Options) dhcp4.MessageType {
+	if value := options[dhcp4.OptionDHCPMessageType]; len(value) == 1 {
+		return dhcp4.MessageType(value[0])
+	}
+	return 0
+}
+
+// Discover expects an offer with the PXE vendor options and a boot menu
+func (c *Client) Discover(boot *Boot) error {
+	p := c.dhcpPacket()
+	reply := c.DHCP.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		return fmt.Errorf("no offer")
+	}
+	options := reply.ParseOptions()
+	if messageType(options) != dhcp4.Offer {
+		return fmt.Errorf("expected an offer, got %v", messageType(options))
+	}
+	if string(options[dhcp4.OptionVendorClassIdentifier]) != "PXEClient" {
+		return fmt.Errorf("the offer has no PXEClient vendor class")
+	}
+	bootType, found := firstMenuEntry(options[dhcp4.OptionVendorSpecificInformation])
+	if !found {
+		return fmt.Errorf("the offer has no PXE boot menu")
+	}
+
+	boot.IP = reply.YIAddr()
+	boot.ServerID = net.IP(options[dhcp4.OptionServerIdentifier])
+	boot.BootType = bootType
+	return nil
+}
+
+// firstMenuEntry returns the type of the first entry of the boot menu,
+// option 9 of the PXE vendor options
+func firstMenuEntry(vendor []byte) (uint16, bool) {
+	for len(vendor) >= 2 && vendor[0] != 255 {
+		code, length := vendor[0], int(vendor[1])
+		if len(vendor) < 2+length {
+			break
+		}
+		if code == 9 && length >= 2 {
+			return binary.BigEndian.Uint16(vendor[2:4]), true
+		}
+		vendor = vendor[2+length:]
+	}
+	return 0, false
+}
+
+// Request expects the offered ip to be acked
+func (c *Client) Request(boot *Boot) error {
+	p := c.dhcpPacket()
+	p.AddOption(dhcp4.OptionRequestedIPAddress, boot.IP.To4())
+	p.AddOption(dhcp4.OptionServerIdentifier, boot.ServerID.To4())
+	reply := c.DHCP.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	if reply == nil {
+		return fmt.Errorf("no reply")
+	}
+	if messageType(reply.ParseOptions()) != dhcp4.ACK {
+		return fmt.Errorf("expected an ACK of %s, got %v", boot.IP, messageType(reply.ParseOptions()))
+	}
+	if !reply.YIAddr().Equal(boot.IP) {
+		return fmt.Errorf("expected %s to be acked, got %s", boot.IP, reply.YIAddr())
+	}
+	return nil
+}
+
+// RequestPXE selects the first entry of the boot menu from the boot server,
+// and expects the network boot program and the path prefix of pxelinux
+func (c *Client) RequestPXE(boot *Boot) error {
+	var b bytes.Buffer
+	var bootp [236]byte
+	bootp[0] = 1 // BOOTP request
+	bootp[1] = 1 // PHY = ethernet
+	bootp[2] = 6 // Hardware address length
+	copy(bootp[4:], []byte{1, 2, 3, 4})
+	copy(bootp[12:], boot.IP.To4())
+	copy(bootp[28:], c.MAC)
+	b.Write(bootp[:])
+	b.Write(dhcpMagic)
+	b.Write([]byte{53, 1, byte(dhcp4.Request)})
+	b.Write([]byte{43, 7, 71, 4, byte(boot.BootType >> 8), byte(boot.BootType), 0, 0, 255})
+	b.Write([]byte{97, 17, 0})
+	b.Write(c.guid())
+	b.Write([]byte{93, 2, byte(c.Arch >> 8), byte(c.Arch)})
+	b.WriteByte(255)
+
+	reply, err := c.PXE(b.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(reply) < 240 || !bytes.Equal(reply[236:240], dhcpMagic) {
+		return fmt.Errorf("malformed reply: %x", reply)
+	}
+	boot.BootFile = string(bytes.TrimRight(reply[108:236], "\x00"))
+	if boot.BootFile == "" {
+		return fmt.Errorf("the reply names no boot file")
+	}
+	options := reply[240:]
+	for len(options) >= 2 && options[0] != 255 {
+		code, length := options[0], int(options[1])
+		if len(options) < 2+length {
+			break
+		}
+		if code == 210 {
+			boot.HTTPServer = string(options[2 : 2+length])
+		}
+		options = options[2+length:]
+	}
+	if boot.HTTPServer == "" {
+		return fmt.Errorf("the reply has no pxelinux path prefix (option 210)")
+	}
+	return nil
+}
+
+// FetchNBP fetches the network boot program over TFTP
+func (c *Client) FetchNBP(boot *Boot) error {
+	f, err := c.TFTP(boot.BootFile, &net.UDPAddr{IP: boot.IP, Port: 2070})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	boot.NBP, err = ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(boot.NBP) == 0 {
+		return fmt.Errorf("%s is empty", boot.BootFile)
+	}
+	return nil
+}
+
+// get expects the handler to serve the url
+func (c *Client) get(handler http.Handler, url string) ([]byte, error) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d: %s", url, w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	return w.Body.Bytes(), nil
+}
+
+// FetchPxelinuxConfig fetches the pxelinux config of the machine, the way
+// pxelinux does with the path prefix
+func (c *Client) FetchPxelinuxConfig(boot *Boot) error {
+	name := "01-" + strings.Replace(c.MAC.String(), ":", "-", -1)
+	config, err := c.get(c.Booter, boot.HTTPServer+"pxelinux.cfg/"+name)
+	if err != nil {
+		return err
+	}
+	boot.PxelinuxConfig = string(config)
+	return nil
+}
+
+// pxelinuxDirective returns the value of the first line of the config which
+// starts with the directive, like LINUX
+func pxelinuxDirective(config, directive string) string {
+	for _, line := range strings.Split(config, "\n") {
+		if strings.HasPrefix(line, directive+" ") {
+			return strings.TrimSpace(line[len(directive)+1:])
+		}
+	}
+	return ""
+}
+
+// FetchKernel fetches the kernel named by the pxelinux config
+func (c *Client) FetchKernel(boot *Boot) error {
+	kernelURL := pxelinuxDirective(boot.PxelinuxConfig, "LINUX")
+	if kernelURL == "" {
+		return fmt.Errorf("the pxelinux config names no kernel:\n%s", boot.PxelinuxConfig)
+	}
+	kernel, err := c.get(c.Booter, kernelURL)
+	if err != nil {
+		return err
+	}
+	boot.Kernel = kernel
+	return nil
+}
+
+// FetchCloudConfig fetches the cloud-config from the cloud-config-url of the
+// kernel cmdline, the way coreos-cloudinit does
+func (c *Client) FetchCloudConfig(boot *Boot) error {
+	var cloudConfigURL string
+	for _, param := range strings.Fields(pxelinuxDirective(boot.PxelinuxConfig, "APPEND")) {
+		if strings.HasPrefix(param, "cloud-config-url=") {
+			cloudConfigURL = param[len("cloud-config-url="):]
+		}
+	}
+	if cloudConfigURL == "" {
+		return fmt.Errorf("the kernel cmdline has no cloud-config-url:\n%s", boot.PxelinuxConfig)
+	}
+	cloudConfig, err := c.get(c.Web, cloudConfigURL)
+	if err != nil {
+		return err
+	}
+	boot.CloudConfig = string(cloudConfig)
+	return nil
+}
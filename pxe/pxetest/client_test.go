@@ -0,0 +1,86 @@
+package pxetest
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+	"github.com/cafebazaar/blacksmith/dhcp"
+	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/web"
+)
+
+func TestBoot(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	ds.CoreOS = "1000.0.0"
+	bootFilesDir := t.TempDir()
+	versionDir := filepath.Join(ds.Workspace, "images", "1000.0.0")
+	for path, content := range map[string]string{
+		filepath.Join(versionDir, "coreos_production_pxe.vmlinuz"):          "amd64 kernel",
+		filepath.Join(versionDir, "arm64", "coreos_production_pxe.vmlinuz"): "arm64 kernel",
+		filepath.Join(ds.Workspace, "config", "bootparams", "main"):         "",
+		filepath.Join(ds.Workspace, "config", "cloudconfig", "main"):        "hostname: << .Hostname >>",
+		filepath.Join(bootFilesDir, "undionly.kpxe"):                        "bios nbp",
+		filepath.Join(bootFilesDir, "snp-arm64.efi"):                        "arm64 nbp",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverIP := net.IPv4(10, 0, 0, 1)
+	booterAddr := net.TCPAddr{IP: serverIP, Port: 70}
+	bootFiles, err := pxe.ParseArchBootFiles("0=undionly.kpxe,11=snp-arm64.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := dhcp.NewHandler(&dhcp.DHCPSetting{ServerIP: serverIP}, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	booter, err := pxe.NewHTTPBooter(booterAddr, nil, ds, 8000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mac    string
+		arch   uint16
+		nbp    string
+		kernel string
+	}{
+		{"00:11:22:33:44:01", 0, "bios nbp", "amd64 kernel"},
+		{"00:11:22:33:44:02", 11, "arm64 nbp", "arm64 kernel"},
+	} {
+		mac, _ := net.ParseMAC(tc.mac)
+		client := &Client{
+			MAC:  mac,
+			Arch: tc.arch,
+			DHCP: handler,
+			PXE: func(request []byte) ([]byte, error) {
+				return pxe.AnswerPXE(request, serverIP, booterAddr, bootFiles)
+			},
+			TFTP:   pxe.NewTFTPHandler(bootFilesDir),
+			Booter: booter.Mux(),
+			Web:    web.NewHandler(ds, "", nil, nil, nil, nil, 0),
+		}
+		boot := client.Boot(t)
+
+		if string(boot.NBP) != tc.nbp {
+			t.Errorf("%s: expected %q, got %q", tc.mac, tc.nbp, boot.NBP)
+		}
+		if string(boot.Kernel) != tc.kernel {
+			t.Errorf("%s: expected %q, got %q", tc.mac, tc.kernel, boot.Kernel)
+		}
+		if expected := "hostname: node" + strings.Replace(tc.mac, ":", "", -1); boot.CloudConfig != expected {
+			t.Errorf("%s: expected %q, got %q", tc.mac, expected, boot.CloudConfig)
+		}
+	}
+}
@@ -8,18 +8,28 @@ import (
 	"github.com/danderson/pixiecore/tftp"
 )
 
-func ServeTFTP(listenAddr net.UDPAddr) error {
-	pxelinuxDir := FS(false)
+// ServeTFTP serves the requested files from bootFilesDir, and pxelinux for
+// the names which aren't found there
+func ServeTFTP(listenAddr net.UDPAddr, bootFilesDir string) error {
 	tftp.Logf = func(msg string, args ...interface{}) { logging.Log("TFTP", msg, args...) }
 	tftp.Debug = func(msg string, args ...interface{}) { logging.Debug("TFTP", msg, args...) }
 
-	handler := func(string, net.Addr) (io.ReadCloser, error) {
+	return tftp.ListenAndServe("udp4", listenAddr.String(), NewTFTPHandler(bootFilesDir))
+}
+
+// NewTFTPHandler returns the handler of ServeTFTP, which opens the requested
+// files from bootFilesDir, and pxelinux for the names which aren't found there
+func NewTFTPHandler(bootFilesDir string) func(filename string, addr net.Addr) (io.ReadCloser, error) {
+	pxelinuxDir := FS(false)
+	return func(filename string, addr net.Addr) (io.ReadCloser, error) {
+		if f, err := openBootFile(bootFilesDir, filename); err == nil {
+			logging.Debug("TFTP", "Serving %s to %s", filename, addr)
+			return f, nil
+		}
 		pxelinux, err := pxelinuxDir.Open("/pxelinux/lpxelinux.0")
 		if err != nil {
 			return nil, err
 		}
 		return pxelinux, nil
 	}
-
-	return tftp.ListenAndServe("udp4", listenAddr.String(), handler)
 }
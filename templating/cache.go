@@ -0,0 +1,84 @@
+package templating
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// renderCacheSize bounds the renders kept by the cache, one per folder and
+// machine. The least recently used ones are evicted beyond it
+const renderCacheSize = 4096
+
+// cachedRender is the output of a template folder executed for a machine,
+// which is valid as long as the stamp stays the same
+type cachedRender struct {
+	key     string
+	stamp   string
+	text    string
+	headers map[string]string
+}
+
+var (
+	renderCacheLock sync.Mutex
+	// renderCache maps the keys to the elements of renderCacheLRU, whose
+	// values are the cachedRenders, the most recently used first
+	renderCache    = make(map[string]*list.Element)
+	renderCacheLRU = list.New()
+)
+
+// renderStamp returns a value which changes whenever anything that affects
+// the rendering of the folder for the machine changes, from the listing of
+// the folder and the CoreOS version which the caller has read. The IP is
+// read on its own, since the flags revision doesn't cover it. The output
+// isn't cacheable if the stamp can't be determined
+func renderStamp(infos []os.FileInfo, machine datasource.Machine, coreOSVersion, hostAddr string) (string, bool) {
+	revision, err := machine.FlagsRevision()
+	if err != nil {
+		return "", false
+	}
+	ip, err := machine.IP()
+	if err != nil {
+		return "", false
+	}
+
+	stamp := fmt.Sprintf("%s|%s|%s|%s", revision, ip, coreOSVersion, hostAddr)
+	for _, info := range infos {
+		stamp += fmt.Sprintf("|%s:%d:%d", info.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, true
+}
+
+func lookupRender(key, stamp string) (cachedRender, bool) {
+	renderCacheLock.Lock()
+	defer renderCacheLock.Unlock()
+	element, exists := renderCache[key]
+	if !exists {
+		return cachedRender{}, false
+	}
+	cached := element.Value.(cachedRender)
+	if cached.stamp != stamp {
+		return cachedRender{}, false
+	}
+	renderCacheLRU.MoveToFront(element)
+	return cached, true
+}
+
+func storeRender(cached cachedRender) {
+	renderCacheLock.Lock()
+	defer renderCacheLock.Unlock()
+	if element, exists := renderCache[cached.key]; exists {
+		element.Value = cached
+		renderCacheLRU.MoveToFront(element)
+		return
+	}
+	renderCache[cached.key] = renderCacheLRU.PushFront(cached)
+	for renderCacheLRU.Len() > renderCacheSize {
+		oldest := renderCacheLRU.Back()
+		renderCacheLRU.Remove(oldest)
+		delete(renderCache, oldest.Value.(cachedRender).key)
+	}
+}
@@ -0,0 +1,122 @@
+package templating
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+// countingMachine counts the flag lookups, which are skipped on cache hits
+type countingMachine struct {
+	*datasourcetest.MemoryMachine
+	lookups int
+}
+
+func (m *countingMachine) GetFlag(key string) (string, error) {
+	m.lookups++
+	return m.MemoryMachine.GetFlag(key)
+}
+
+func TestRenderCache(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(`<< V "name" >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	created, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	machine := &countingMachine{MemoryMachine: created.(*datasourcetest.MemoryMachine)}
+	machine.SetFlag("name", "first")
+
+	render := func(expected string) {
+		out, err := ExecuteTemplateFolder(dir, ds, machine, "")
+		if err != nil || out != expected {
+			t.Errorf("expected %q, got %q (%v)", expected, out, err)
+		}
+	}
+
+	render("first")
+	render("first")
+	if machine.lookups != 1 {
+		t.Errorf("expected the second render to be cached, got %d lookups", machine.lookups)
+	}
+
+	machine.SetFlag("name", "second")
+	render("second")
+	if machine.lookups != 2 {
+		t.Errorf("expected a changed flag to invalidate the cache, got %d lookups", machine.lookups)
+	}
+
+	t.Setenv("BLACKSMITH_TEST_NAME", "env")
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(`<< V "name" >> << env "BLACKSMITH_TEST_NAME" >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	render("second env")
+	render("second env")
+	if machine.lookups != 4 {
+		t.Errorf("expected templates using env not to be cached, got %d lookups", machine.lookups)
+	}
+}
+
+// staticRevisionMachine has a flags revision which doesn't change with its
+// IP, like EtcdMachine
+type staticRevisionMachine struct {
+	*datasourcetest.MemoryMachine
+	ip net.IP
+}
+
+func (m *staticRevisionMachine) FlagsRevision() (string, error) {
+	return "1", nil
+}
+
+func (m *staticRevisionMachine) IP() (net.IP, error) {
+	return m.ip, nil
+}
+
+func TestRenderCacheIP(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(`<< .IP >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	created, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 10))
+	machine := &staticRevisionMachine{MemoryMachine: created.(*datasourcetest.MemoryMachine), ip: net.IPv4(10, 0, 0, 10)}
+
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "10.0.0.10" {
+		t.Fatalf("unexpected output: %q (%v)", out, err)
+	}
+	machine.ip = net.IPv4(10, 0, 0, 11)
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "10.0.0.11" {
+		t.Errorf("expected a changed IP to invalidate the cache, got %q (%v)", out, err)
+	}
+}
+
+func TestRenderCacheEviction(t *testing.T) {
+	for i := 0; i < renderCacheSize; i++ {
+		storeRender(cachedRender{key: fmt.Sprintf("eviction|%d", i), stamp: "s"})
+	}
+	// the first one is used, so the second is the least recently used
+	if _, hit := lookupRender("eviction|0", "s"); !hit {
+		t.Fatal("expected the first render to be cached")
+	}
+	storeRender(cachedRender{key: "eviction|new", stamp: "s"})
+
+	if _, hit := lookupRender("eviction|1", "s"); hit {
+		t.Error("expected the least recently used render to be evicted")
+	}
+	for _, key := range []string{"eviction|0", "eviction|new"} {
+		if _, hit := lookupRender(key, "s"); !hit {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+	renderCacheLock.Lock()
+	defer renderCacheLock.Unlock()
+	if len(renderCache) != renderCacheSize || renderCacheLRU.Len() != renderCacheSize {
+		t.Errorf("expected %d renders, got %d (%d)", renderCacheSize, len(renderCache), renderCacheLRU.Len())
+	}
+}
@@ -0,0 +1,51 @@
+package templating
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+const frontMatterDelimiter = "---"
+
+// splitFrontMatter separates the leading front matter block of a template
+// from its body. The block declares the HTTP headers which the rendered
+// template should be served with, one "Name: value" per line:
+//
+//	---
+//	Content-Type: text/plain
+//	---
+//	<< the template >>
+//
+// A leading "---" is also the start of a YAML document, so the block is only
+// taken as front matter if it's closed and each of its lines is a header in
+// the canonical form, like Content-Type. Otherwise the text is left untouched
+func splitFrontMatter(text string) (map[string]string, string) {
+	headers := make(map[string]string)
+	if !strings.HasPrefix(text, frontMatterDelimiter+"\n") {
+		return headers, text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == frontMatterDelimiter {
+			if len(headers) == 0 {
+				break
+			}
+			return headers, strings.Join(lines[i+1:], "")
+		}
+		if line == "" {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			break
+		}
+		name := strings.TrimSpace(line[:colon])
+		if strings.ContainsAny(name, " \t") || textproto.CanonicalMIMEHeaderKey(name) != name {
+			break
+		}
+		headers[name] = strings.TrimSpace(line[colon+1:])
+	}
+	return make(map[string]string), text
+}
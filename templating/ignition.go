@@ -0,0 +1,82 @@
+package templating
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignitionBaseFile is the base ignition config, next to the ignition folder
+// of the workspace or of the profile, which the rendered ignition of each
+// machine is merged into
+const ignitionBaseFile = "ignition-base.json"
+
+// MergeIgnitionBase merges the ignition rendered from the folder into the
+// ignition-base.json next to the folder, if it exists. The rendered ignition
+// is returned as-is if there's no base, and the base if it renders empty
+func MergeIgnitionBase(folder, rendered string) (string, error) {
+	basePath := filepath.Join(filepath.Dir(folder), ignitionBaseFile)
+	base, err := ioutil.ReadFile(basePath)
+	if os.IsNotExist(err) {
+		return rendered, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(rendered) == "" {
+		return string(base), nil
+	}
+
+	merged, err := MergeIgnition(base, []byte(rendered))
+	if err != nil {
+		return "", fmt.Errorf("Error while merging into %s: %s", basePath, err)
+	}
+	return string(merged), nil
+}
+
+// MergeIgnition merges the overlay ignition config into the base, the way
+// ignition merges the appended configs: the objects are merged key by key,
+// the arrays of the overlay are appended to the ones of the base, and the
+// other values of the overlay replace the ones of the base
+func MergeIgnition(base, overlay []byte) ([]byte, error) {
+	var baseValue, overlayValue interface{}
+	if err := json.Unmarshal(base, &baseValue); err != nil {
+		return nil, fmt.Errorf("invalid base: %s", err)
+	}
+	if err := json.Unmarshal(overlay, &overlayValue); err != nil {
+		return nil, fmt.Errorf("invalid overlay: %s", err)
+	}
+	return json.Marshal(mergeJSON(baseValue, overlayValue))
+}
+
+func mergeJSON(base, overlay interface{}) interface{} {
+	switch overlay := overlay.(type) {
+	case map[string]interface{}:
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			return overlay
+		}
+		merged := make(map[string]interface{}, len(baseMap)+len(overlay))
+		for key, value := range baseMap {
+			merged[key] = value
+		}
+		for key, value := range overlay {
+			if baseValue, exists := merged[key]; exists {
+				merged[key] = mergeJSON(baseValue, value)
+			} else {
+				merged[key] = value
+			}
+		}
+		return merged
+	case []interface{}:
+		baseSlice, ok := base.([]interface{})
+		if !ok {
+			return overlay
+		}
+		return append(append([]interface{}{}, baseSlice...), overlay...)
+	}
+	return overlay
+}
@@ -0,0 +1,44 @@
+package templating
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeIgnition(t *testing.T) {
+	base := `{"ignition": {"version": "2.2.0"}, "passwd": {"users": [{"name": "core"}]}, "storage": {"files": [{"path": "/etc/motd"}]}}`
+	overlay := `{"storage": {"files": [{"path": "/etc/hostname"}]}, "passwd": {"users": [{"name": "admin"}]}, "ignition": {"version": "2.3.0"}}`
+
+	merged, err := MergeIgnition([]byte(base), []byte(overlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ignition":{"version":"2.3.0"},"passwd":{"users":[{"name":"core"},{"name":"admin"}]},"storage":{"files":[{"path":"/etc/motd"},{"path":"/etc/hostname"}]}}`
+	if string(merged) != expected {
+		t.Errorf("expected %s, got %s", expected, merged)
+	}
+
+	if _, err := MergeIgnition([]byte(base), []byte(`{"storage": `)); err == nil {
+		t.Error("expected an error for an invalid overlay")
+	}
+}
+
+func TestMergeIgnitionBase(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ignition")
+
+	if merged, err := MergeIgnitionBase(folder, `{"a": 1}`); err != nil || merged != `{"a": 1}` {
+		t.Errorf("expected the rendered ignition without a base, got %q (%v)", merged, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ignitionBaseFile), []byte(`{"b": [1]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if merged, err := MergeIgnitionBase(folder, "\n"); err != nil || merged != `{"b": [1]}` {
+		t.Errorf("expected the base for an empty render, got %q (%v)", merged, err)
+	}
+	if merged, err := MergeIgnitionBase(folder, `{"a": 1, "b": [2]}`); err != nil || merged != `{"a":1,"b":[1,2]}` {
+		t.Errorf("unexpected merge: %q (%v)", merged, err)
+	}
+}
@@ -0,0 +1,42 @@
+package templating
+
+import "errors"
+
+// ErrTooManyRenders is returned by the executions of the templates while the
+// maximum number of them are running already
+var ErrTooManyRenders = errors.New("too many templates are being rendered")
+
+// renderSlots bounds the concurrent executions of the templates, each of
+// which can make many requests to etcd. nil means no limit
+var renderSlots chan struct{}
+
+// ConfigureMaxRenders sets how many templates can be executed at the same
+// time. The executions beyond it fail with ErrTooManyRenders, instead of
+// piling up on etcd. Zero means no limit. It must be called before serving
+func ConfigureMaxRenders(max int) {
+	if max <= 0 {
+		renderSlots = nil
+		return
+	}
+	renderSlots = make(chan struct{}, max)
+}
+
+// acquireRender takes a slot for an execution of a template, without
+// waiting. Returns false if all the slots are taken
+func acquireRender() bool {
+	if renderSlots == nil {
+		return true
+	}
+	select {
+	case renderSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseRender() {
+	if renderSlots != nil {
+		<-renderSlots
+	}
+}
@@ -0,0 +1,59 @@
+package templating
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+// blockingMachine blocks the flag lookups until unblocked
+type blockingMachine struct {
+	*datasourcetest.MemoryMachine
+	started, unblock chan struct{}
+}
+
+func (m *blockingMachine) GetFlag(key string) (string, error) {
+	m.started <- struct{}{}
+	<-m.unblock
+	return m.MemoryMachine.GetFlag(key)
+}
+
+func TestMaxRenders(t *testing.T) {
+	ConfigureMaxRenders(1)
+	defer ConfigureMaxRenders(0)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(`<< V "name" >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	first, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	second, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 11))
+
+	blocking := &blockingMachine{
+		MemoryMachine: first.(*datasourcetest.MemoryMachine),
+		started:       make(chan struct{}, 10),
+		unblock:       make(chan struct{}),
+	}
+	done := make(chan error)
+	go func() {
+		_, err := ExecuteTemplateFolder(dir, ds, blocking, "")
+		done <- err
+	}()
+	<-blocking.started
+
+	if _, err := ExecuteTemplateFolder(dir, ds, second, ""); err != ErrTooManyRenders {
+		t.Errorf("expected ErrTooManyRenders while the slot is taken, got %v", err)
+	}
+
+	close(blocking.unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExecuteTemplateFolder(dir, ds, second, ""); err != nil {
+		t.Errorf("expected the slot to be released, got %v", err)
+	}
+}
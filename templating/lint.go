@@ -0,0 +1,121 @@
+package templating
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// flagFuncs are the template funcs whose first argument is the key of a
+// flag of the machine
+var flagFuncs = map[string]bool{
+	"V":            true,
+	"hasFlag":      true,
+	"flagEq":       true,
+	"vint":         true,
+	"vbool":        true,
+	"stableRandom": true,
+	"uuid":         true,
+}
+
+// LintResult is the outcome of LintTemplate
+type LintResult struct {
+	// Keys are the flag keys which the template references, sorted
+	Keys []string `json:"keys"`
+	// Errors are the errors of parsing the template
+	Errors []string `json:"errors"`
+}
+
+// LintTemplate parses the template text, which may start with a front
+// matter, and returns the keys of the flags which it passes to the flag
+// funcs, like V, as literals
+func LintTemplate(text string) LintResult {
+	result := LintResult{Keys: []string{}, Errors: []string{}}
+
+	_, body := splitFrontMatter(text)
+	t := template.New("lint")
+	t.Delims("<<", ">>")
+	t.Funcs(placeholderFuncs)
+	if _, err := t.Parse(body); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	keys := make(map[string]bool)
+	for _, defined := range t.Templates() {
+		if defined.Tree != nil {
+			collectFlagKeys(defined.Tree.Root, keys)
+		}
+	}
+	for key := range keys {
+		result.Keys = append(result.Keys, key)
+	}
+	sort.Strings(result.Keys)
+	return result
+}
+
+// LintTemplateFile lints the template at the path relative to the config
+// folder of the workspace, like cloudconfig/main
+func LintTemplateFile(workspacePath, name string) (LintResult, error) {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "..") {
+		return LintResult{}, fmt.Errorf("invalid template name: %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(workspacePath, "config", filepath.FromSlash(name)))
+	if err != nil {
+		return LintResult{}, err
+	}
+	return LintTemplate(string(data)), nil
+}
+
+// collectFlagKeys adds the literal keys passed to the flag funcs under node
+// to keys
+func collectFlagKeys(node parse.Node, keys map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectFlagKeys(child, keys)
+		}
+	case *parse.ActionNode:
+		collectFlagKeys(n.Pipe, keys)
+	case *parse.IfNode:
+		collectBranchKeys(&n.BranchNode, keys)
+	case *parse.RangeNode:
+		collectBranchKeys(&n.BranchNode, keys)
+	case *parse.WithNode:
+		collectBranchKeys(&n.BranchNode, keys)
+	case *parse.TemplateNode:
+		collectFlagKeys(n.Pipe, keys)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectFlagKeys(cmd, keys)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			if ident, ok := n.Args[0].(*parse.IdentifierNode); ok && flagFuncs[ident.Ident] {
+				if key, ok := n.Args[1].(*parse.StringNode); ok {
+					keys[key.Text] = true
+				}
+			}
+		}
+		for _, arg := range n.Args {
+			collectFlagKeys(arg, keys)
+		}
+	}
+}
+
+func collectBranchKeys(n *parse.BranchNode, keys map[string]bool) {
+	collectFlagKeys(n.Pipe, keys)
+	collectFlagKeys(n.List, keys)
+	collectFlagKeys(n.ElseList, keys)
+}
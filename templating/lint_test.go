@@ -0,0 +1,58 @@
+package templating
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLintTemplate(t *testing.T) {
+	text := `---
+Content-Type: text/plain
+---
+<< if vbool "state" >><< V "disk" >><< else >><< vint "disks" >><< end >>
+<< define "inner" >><< b64 (V "role") >><< end >>
+<< with vint "gpu" >><< uuid "cluster-id" >><< end >><< V "disk" >>`
+
+	result := LintTemplate(text)
+	if len(result.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+	expected := []string{"cluster-id", "disk", "disks", "gpu", "role", "state"}
+	if !reflect.DeepEqual(result.Keys, expected) {
+		t.Errorf("expected %v, got %v", expected, result.Keys)
+	}
+
+	result = LintTemplate(`<< V "disk" >><< if >>`)
+	if len(result.Errors) != 1 || len(result.Keys) != 0 {
+		t.Errorf("expected a parse error, got %+v", result)
+	}
+	result = LintTemplate(`<< unknownFunc "disk" >>`)
+	if len(result.Errors) != 1 {
+		t.Errorf("expected an error for an undefined func, got %+v", result)
+	}
+}
+
+func TestLintTemplateFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "config", "cloudconfig"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config", "cloudconfig", "main"), []byte(`<< V "role" >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := LintTemplateFile(dir, "cloudconfig/main")
+	if err != nil || !reflect.DeepEqual(result.Keys, []string{"role"}) {
+		t.Errorf("unexpected result: %+v (%v)", result, err)
+	}
+	for _, name := range []string{"", "../secrets", "/etc/passwd", "cloudconfig/../../x"} {
+		if _, err := LintTemplateFile(dir, name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+	if _, err := LintTemplateFile(dir, "ignition/main"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing template, got %v", err)
+	}
+}
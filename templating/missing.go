@@ -0,0 +1,55 @@
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrMissingConfig is returned by the executions of the template folders
+// which have neither a main template nor one for the vendor of the machine,
+// unless a fallback config is configured
+var ErrMissingConfig = errors.New("no main template")
+
+// fallbackDir is the directory of the fallback configs, named by the kind of
+// the config, like cloudconfig. Empty means ErrMissingConfig is returned
+var fallbackDir string
+
+// ConfigureOnMissingConfig sets what's served for the template folders
+// without a main template: 404 returns ErrMissingConfig, and otherwise the
+// value is a directory of fallback configs, named by the kind of the config
+// like <dir>/cloudconfig, which are served as-is
+func ConfigureOnMissingConfig(value string) error {
+	if value == "404" {
+		fallbackDir = ""
+		return nil
+	}
+	info, err := os.Stat(value)
+	if err != nil {
+		return fmt.Errorf("invalid fallback config directory: %s", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", value)
+	}
+	fallbackDir = value
+	return nil
+}
+
+// missingConfig returns the fallback config for the folder of the templates,
+// or ErrMissingConfig if there's none
+func missingConfig(tmplFolder string) (string, error) {
+	if fallbackDir == "" {
+		return "", fmt.Errorf("%w in %s", ErrMissingConfig, tmplFolder)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(fallbackDir, filepath.Base(tmplFolder)))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w in %s, nor a fallback config", ErrMissingConfig, tmplFolder)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(string(data), "\n"), nil
+}
@@ -0,0 +1,50 @@
+package templating
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestMissingConfig(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "cloudconfig")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "other"), []byte(`x`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+
+	defer ConfigureOnMissingConfig("404")
+	for _, tmplFolder := range []string{folder, filepath.Join(dir, "ignition")} {
+		if _, err := ExecuteTemplateFolder(tmplFolder, ds, machine, ""); !errors.Is(err, ErrMissingConfig) {
+			t.Errorf("%s: expected ErrMissingConfig, got %v", tmplFolder, err)
+		}
+	}
+
+	fallback := t.TempDir()
+	if err := os.WriteFile(filepath.Join(fallback, "cloudconfig"), []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureOnMissingConfig(fallback); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ExecuteTemplateFolder(folder, ds, machine, ""); err != nil || out != "#cloud-config" {
+		t.Errorf("expected the fallback config, got %q (%v)", out, err)
+	}
+	if _, err := ExecuteTemplateFolder(filepath.Join(dir, "ignition"), ds, machine, ""); !errors.Is(err, ErrMissingConfig) {
+		t.Errorf("expected ErrMissingConfig without a fallback of the kind, got %v", err)
+	}
+
+	if err := ConfigureOnMissingConfig(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("expected an error for a nonexistent fallback directory")
+	}
+}
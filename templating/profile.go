@@ -0,0 +1,28 @@
+package templating
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+const (
+	// profileFlag is the flag of a machine which selects its config profile
+	profileFlag    = "profile"
+	defaultProfile = "main"
+)
+
+// ConfigFolder returns the folder of the templates of the given kind, like
+// cloudconfig, for the machine. The machines whose profile flag is set to
+// anything but main use the folder of the profile under config/profiles
+func ConfigFolder(workspacePath, kind string, machine datasource.Machine) (string, error) {
+	profile, err := machine.GetFlag(profileFlag)
+	if err != nil || profile == "" || profile == defaultProfile {
+		return path.Join(workspacePath, "config", kind), nil
+	}
+	if profile == "." || profile == ".." || profile != path.Base(profile) {
+		return "", fmt.Errorf("invalid profile name: %q", profile)
+	}
+	return path.Join(workspacePath, "config", "profiles", profile, kind), nil
+}
@@ -0,0 +1,29 @@
+package templating
+
+import (
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// readOnlyDataSource renders the templates without acquiring or releasing
+// the locks, as if each lock were acquired
+type readOnlyDataSource struct {
+	datasource.DataSource
+}
+
+func (ds readOnlyDataSource) AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	return true, datasource.ValidateLockName(name)
+}
+
+func (ds readOnlyDataSource) ReleaseLock(name, owner string) error {
+	return datasource.ValidateLockName(name)
+}
+
+// ExecuteTemplateFolderReadOnly is like ExecuteTemplateFolder, but never
+// writes to the datasource, e.g. for inspecting the configs of a machine.
+// The lock template func acts as if the lock were acquired, without
+// acquiring it
+func ExecuteTemplateFolderReadOnly(tmplFolder string, ds datasource.DataSource, machine datasource.Machine, hostAddr string) (string, error) {
+	return ExecuteTemplateFolder(tmplFolder, readOnlyDataSource{datasource.ReadOnly(ds)}, datasource.ReadOnlyMachine(machine), hostAddr)
+}
@@ -0,0 +1,78 @@
+package templating
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// stableAlphabet is the alphabet of the values of stableRandom
+const stableAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// maxStableLength bounds the length of the values of stableRandom
+const maxStableLength = 1024
+
+// stableValue returns the flag of the machine under key if it's set, or
+// else generates it and keeps it in the flag, so the following renders of
+// the machine return the same value. The flag is created atomically, so if
+// concurrent renders race, the value of the winner is returned by all of
+// them. generated reports whether it was generated by this call
+func stableValue(machine datasource.Machine, key string, generate func() (string, error)) (value string, generated bool, err error) {
+	if key == "" || strings.HasPrefix(key, "_") {
+		return "", false, fmt.Errorf("Invalid key %q for a stable value", key)
+	}
+	value, found, err := lookupFlag(machine, key)
+	if err != nil || found {
+		return value, false, err
+	}
+
+	value, err = generate()
+	if err != nil {
+		return "", false, err
+	}
+	created, err := machine.CreateFlag(key, value)
+	if err != nil {
+		return "", false, fmt.Errorf("Error while keeping the stable value %s: %s", key, err)
+	}
+	if created {
+		return value, true, nil
+	}
+
+	// another render set it first
+	value, found, err = lookupFlag(machine, key)
+	if err == nil && !found {
+		err = fmt.Errorf("The stable value %s was deleted while being set", key)
+	}
+	return value, false, err
+}
+
+// randomString returns a random alphanumeric text of the length
+func randomString(length int) (string, error) {
+	if length <= 0 || length > maxStableLength {
+		return "", fmt.Errorf("Invalid length %d, expected 1 to %d", length, maxStableLength)
+	}
+	max := big.NewInt(int64(len(stableAlphabet)))
+	value := make([]byte, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		value[i] = stableAlphabet[n.Int64()]
+	}
+	return string(value), nil
+}
+
+// randomUUID returns a random (version 4) UUID
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
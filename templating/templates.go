@@ -3,93 +3,247 @@ package templating // import "github.com/cafebazaar/blacksmith/templating"
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/logging"
+	"github.com/cafebazaar/blacksmith/tracing"
 )
 
 const (
 	templatesDebugTag = "TEMPLATING"
 )
 
-func findFiles(path string) ([]string, error) {
-	infos, err := ioutil.ReadDir(path)
+var (
+	secretsDir = "/run/secrets"
+	strictMode = false
+)
+
+// Configure sets the directory which the secret template func reads from.
+// In strict mode, the env and secret template funcs fail the execution of
+// the template if the value is missing, instead of returning an empty string
+func Configure(secretsPath string, strict bool) {
+	secretsDir = secretsPath
+	strictMode = strict
+}
+
+// env returns the value of the environment variable of the blacksmith process
+func env(name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" && strictMode {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// secret returns the content of the file with the given name in the secrets
+// directory, without the trailing newlines
+func secret(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return "", fmt.Errorf("invalid secret name: %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(secretsDir, name))
 	if err != nil {
-		return nil, err
+		if strictMode {
+			return "", fmt.Errorf("Error while reading secret %s: %s", name, err)
+		}
+		logging.Log(templatesDebugTag, "Error while reading secret %s: %s", name, err)
+		return "", nil
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" && strictMode {
+		return "", fmt.Errorf("secret %s is empty", name)
 	}
+	return value, nil
+}
+
+// b64decode decodes the standard base64 encoded text
+func b64decode(text string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", fmt.Errorf("Error while decoding base64: %s", err)
+	}
+	return string(data), nil
+}
 
+func findFiles(infos []os.FileInfo) []string {
 	files := make([]string, 0)
 	for i := range infos {
 		if !infos[i].IsDir() && infos[i].Name()[0] != '.' {
 			files = append(files, infos[i].Name())
 		}
 	}
-	return files, nil
+	return files
+}
+
+// placeholderFuncs are the funcs which the templates are parsed with. They
+// are bound to the machine on each render by renderTemplate
+var placeholderFuncs = map[string]interface{}{
+	"V": func(key string) string {
+		return ""
+	},
+	"hasFlag": func(key string) (bool, error) {
+		return false, nil
+	},
+	"flagEq": func(key, expected string) (bool, error) {
+		return false, nil
+	},
+	"vint": func(key string) (int, error) {
+		return 0, nil
+	},
+	"vbool": func(key string) (bool, error) {
+		return false, nil
+	},
+	"b64": func(text string) string {
+		return ""
+	},
+	"b64template": func(templateName string) string {
+		return ""
+	},
+	"version": func() string {
+		return ""
+	},
+	"lock": func(name string, ttlSeconds int) (bool, error) {
+		return false, nil
+	},
+	"unlock": func(name string) (string, error) {
+		return "", nil
+	},
+	"stableRandom": func(key string, length int) string {
+		return ""
+	},
+	"uuid": func(key string) string {
+		return ""
+	},
+	"env":       env,
+	"secret":    secret,
+	"b64decode": b64decode,
+	"trim":      strings.TrimSpace,
+	// urlquery is a builtin of text/template
+}
+
+//FromPath creates templates from the files located in the specifed path.
+// The headers declared in the front matter of each file are returned by the
+// name of the template
+func templateFromPath(tmplPath string) (*template.Template, map[string]map[string]string, error) {
+	infos, err := ioutil.ReadDir(tmplPath)
+	return templateFromDir(tmplPath, infos, err)
 }
 
-//FromPath creates templates from the files located in the specifed path
-func templateFromPath(tmplPath string) (*template.Template, error) {
-	files, err := findFiles(tmplPath)
+// templateFromDir is templateFromPath for the listing of the folder, and the
+// error of listing it, which the caller has read already
+func templateFromDir(tmplPath string, infos []os.FileInfo, err error) (*template.Template, map[string]map[string]string, error) {
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%w: %s doesn't exist", ErrMissingConfig, tmplPath)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Error while trying to list files in%s: %s", tmplPath, err)
+		return nil, nil, fmt.Errorf("Error while trying to list files in%s: %s", tmplPath, err)
+	}
+	files := findFiles(infos)
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("%w: no template files found in %s", ErrMissingConfig, tmplPath)
 	}
 
 	t := template.New("")
 	t.Delims("<<", ">>")
-	t.Funcs(map[string]interface{}{
-		"V": func(key string) string {
-			return ""
-		},
-		"b64": func(text string) string {
-			return ""
-		},
-		"b64template": func(templateName string) string {
-			return ""
-		},
-	})
+	t.Funcs(placeholderFuncs)
 
+	headers := make(map[string]map[string]string)
 	for i := range files {
-		files[i] = path.Join(tmplPath, files[i])
+		data, err := ioutil.ReadFile(path.Join(tmplPath, files[i]))
+		if err != nil {
+			return nil, nil, err
+		}
+		fileHeaders, body := splitFrontMatter(string(data))
+		if _, err := t.New(files[i]).Parse(body); err != nil {
+			return nil, nil, err
+		}
+		headers[files[i]] = fileHeaders
 	}
 
-	t, err = t.ParseFiles(files...)
-	if err != nil {
-		return nil, err
-	}
+	return t, headers, nil
+}
 
-	return t, nil
+func executeTemplate(rootTemplte *template.Template, templateName string, ds datasource.DataSource, machine datasource.Machine, hostAddr string) (string, error) {
+	var volatile bool
+	// falls back to the initial version on errors
+	coreOSVersion, _ := ds.CoreOSVersion()
+	return renderTemplate(rootTemplte, templateName, ds, machine, hostAddr, coreOSVersion, &volatile)
 }
 
-func executeTemplate(rootTemplte *template.Template, templateName string, machine datasource.Machine, hostAddr string) (string, error) {
-	template := rootTemplte.Lookup(templateName)
+// lookupFlag returns the value of the flag of the machine, and whether it's
+// set. A flag which isn't set isn't an error, but a failure to read it is,
+// so that the conditionals don't silently take the wrong branch. The
+// internal keys, like the note, are never found
+func lookupFlag(machine datasource.Machine, key string) (string, bool, error) {
+	if strings.HasPrefix(key, "_") {
+		return "", false, nil
+	}
+	value, err := machine.GetFlag(key)
+	if datasource.IsFlagNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		logging.Log(templatesDebugTag,
+			"Error while getting flag key=%s for machine=%s: %s",
+			key, machine.Name(), err)
+		return "", false, err
+	}
+	return value, true, nil
+}
 
-	if template == nil {
+// renderTemplate executes the template, and sets volatile if the output
+// depends on something other than the machine, the CoreOS version, the
+// host address and the template files, like the env and secret funcs. The
+// CoreOS version is read once by the caller, rather than by each nested
+// b64template
+func renderTemplate(rootTemplte *template.Template, templateName string, ds datasource.DataSource, machine datasource.Machine, hostAddr, coreOSVersion string, volatile *bool) (string, error) {
+	if rootTemplte.Lookup(templateName) == nil {
 		return "", fmt.Errorf("template with name=%s wasn't found for root=%s",
-			templateName, rootTemplte)
+			templateName, rootTemplte.Name())
+	}
+
+	// Funcs mutates the func map shared by all the templates associated with
+	// the root, so the funcs are bound on a per-render clone instead
+	template, err := rootTemplte.Clone()
+	if err != nil {
+		return "", err
 	}
 
 	buf := new(bytes.Buffer)
 	template.Funcs(map[string]interface{}{
-		"V": func(key string) string {
-			flag, err := machine.GetFlag(key)
-			if err != nil { // TODO excepts Not-Found
-				logging.Log(templatesDebugTag,
-					"Error while getting flag key=%s for machine=%s: %s",
-					key, machine.Name(), err)
-				return ""
-			}
-			return flag
+		"V": func(key string) (string, error) {
+			value, _, err := lookupFlag(machine, key)
+			return value, err
+		},
+		"hasFlag": func(key string) (bool, error) {
+			_, found, err := lookupFlag(machine, key)
+			return found, err
+		},
+		"flagEq": func(key, expected string) (bool, error) {
+			value, found, err := lookupFlag(machine, key)
+			return found && value == expected, err
+		},
+		"vint": func(key string) (int, error) {
+			return machine.GetIntFlag(key)
+		},
+		"vbool": func(key string) (bool, error) {
+			return machine.GetBoolFlag(key)
 		},
 		"b64": func(text string) string {
 			return base64.StdEncoding.EncodeToString([]byte(text))
 		},
 		"b64template": func(templateName string) string {
-			text, err := executeTemplate(rootTemplte, templateName, machine, hostAddr)
+			text, err := renderTemplate(rootTemplte, templateName, ds, machine, hostAddr, coreOSVersion, volatile)
 			if err != nil {
 				logging.Log(templatesDebugTag,
 					"Error while b64template for templateName=%s machine=%s: %s",
@@ -98,22 +252,59 @@ func executeTemplate(rootTemplte *template.Template, templateName string, machin
 			}
 			return base64.StdEncoding.EncodeToString([]byte(text))
 		},
+		"version": func() string {
+			return coreOSVersion
+		},
+		"lock": func(name string, ttlSeconds int) (bool, error) {
+			*volatile = true
+			return ds.AcquireLock(name, machine.Name(), time.Duration(ttlSeconds)*time.Second)
+		},
+		"unlock": func(name string) (string, error) {
+			*volatile = true
+			return "", ds.ReleaseLock(name, machine.Name())
+		},
+		"stableRandom": func(key string, length int) (string, error) {
+			value, generated, err := stableValue(machine, key, func() (string, error) {
+				return randomString(length)
+			})
+			*volatile = *volatile || generated
+			return value, err
+		},
+		"uuid": func(key string) (string, error) {
+			value, generated, err := stableValue(machine, key, randomUUID)
+			*volatile = *volatile || generated
+			return value, err
+		},
+		"env": func(name string) (string, error) {
+			*volatile = true
+			return env(name)
+		},
+		"secret": func(name string) (string, error) {
+			*volatile = true
+			return secret(name)
+		},
 	})
-	ip, _ := machine.IP()
+	// an expired lease leaves the IP empty, rather than "<nil>"
+	var ipString string
+	if ip, _ := machine.IP(); ip != nil {
+		ipString = ip.String()
+	}
 	data := struct {
-		Mac      string
-		IP       string
-		Hostname string
-		Domain   string
-		HostAddr string
+		Mac           string
+		IP            string
+		Hostname      string
+		Domain        string
+		HostAddr      string
+		CoreOSVersion string
 	}{
 		machine.Mac().String(),
-		ip.String(),
+		ipString,
 		machine.Name(),
 		machine.Domain(),
 		hostAddr,
+		coreOSVersion,
 	}
-	err := template.ExecuteTemplate(buf, templateName, &data)
+	err = template.ExecuteTemplate(buf, templateName, &data)
 	if err != nil {
 		return "", err
 	}
@@ -122,12 +313,88 @@ func executeTemplate(rootTemplte *template.Template, templateName string, machin
 	return str, nil
 }
 
-func ExecuteTemplateFolder(tmplFolder string, machine datasource.Machine, hostAddr string) (string, error) {
-	template, err := templateFromPath(tmplFolder)
+// ExecuteTemplateFolder executes the template named by the OUI of the machine
+// in the folder if it exists, or else the main template
+func ExecuteTemplateFolder(tmplFolder string, ds datasource.DataSource, machine datasource.Machine, hostAddr string) (string, error) {
+	text, _, err := ExecuteTemplateFolderWithHeaders(tmplFolder, ds, machine, hostAddr)
+	return text, err
+}
+
+// ExecuteTemplateFolderWithHeaders is like ExecuteTemplateFolder, and also
+// returns the HTTP headers declared in the front matter of the executed
+// template
+func ExecuteTemplateFolderWithHeaders(tmplFolder string, ds datasource.DataSource, machine datasource.Machine, hostAddr string) (string, map[string]string, error) {
+	span := tracing.Start("templating.Render",
+		"template.folder", tmplFolder, "machine.mac", machine.Mac().String())
+	defer span.End()
+
+	// the listing of the folder and the CoreOS version are read once, for
+	// both the stamp and the render
+	infos, dirErr := ioutil.ReadDir(tmplFolder)
+	coreOSVersion, coreOSErr := ds.CoreOSVersion()
+
+	cacheKey := tmplFolder + "|" + machine.Mac().String()
+	var stamp string
+	cacheable := dirErr == nil && coreOSErr == nil
+	if cacheable {
+		stamp, cacheable = renderStamp(infos, machine, coreOSVersion, hostAddr)
+	}
+	if cacheable {
+		if cached, hit := lookupRender(cacheKey, stamp); hit {
+			span.SetAttributes("cache", "hit")
+			return cached.text, cached.headers, nil
+		}
+	}
+
+	template, headers, err := templateFromDir(tmplFolder, infos, dirErr)
+	if errors.Is(err, ErrMissingConfig) {
+		text, err := missingConfig(tmplFolder)
+		if err != nil {
+			span.SetError(err)
+		}
+		return text, nil, err
+	}
 	if err != nil {
-		return "", fmt.Errorf("Error while reading the template with path=%s: %s",
+		err = fmt.Errorf("Error while reading the template with path=%s: %s",
 			tmplFolder, err)
+		span.SetError(err)
+		return "", nil, err
 	}
 
-	return executeTemplate(template, "main", machine, hostAddr)
+	templateName := "main"
+	if oui := ouiTemplateName(machine.Mac()); template.Lookup(oui) != nil {
+		templateName = oui
+	} else if template.Lookup(templateName) == nil {
+		text, err := missingConfig(tmplFolder)
+		if err != nil {
+			span.SetError(err)
+		}
+		return text, nil, err
+	}
+
+	if !acquireRender() {
+		span.SetError(ErrTooManyRenders)
+		return "", nil, ErrTooManyRenders
+	}
+	var volatile bool
+	text, err := renderTemplate(template, templateName, ds, machine, hostAddr, coreOSVersion, &volatile)
+	releaseRender()
+	if err != nil {
+		span.SetError(err)
+		return "", nil, err
+	}
+	if cacheable && !volatile {
+		storeRender(cachedRender{cacheKey, stamp, text, headers[templateName]})
+	}
+	return text, headers[templateName], nil
+}
+
+// ouiTemplateName returns the name of the template for the vendor of the
+// hardware address, e.g. oui-001122 for 00:11:22:33:44:55, which takes
+// precedence over the main template
+func ouiTemplateName(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	return fmt.Sprintf("oui-%02x%02x%02x", mac[0], mac[1], mac[2])
 }
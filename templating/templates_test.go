@@ -0,0 +1,394 @@
+package templating
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestExecuteTemplateConcurrent(t *testing.T) {
+	root := template.New("")
+	root.Delims("<<", ">>")
+	root.Funcs(map[string]interface{}{
+		"V":           func(key string) string { return "" },
+		"b64":         func(text string) string { return "" },
+		"b64template": func(templateName string) string { return "" },
+	})
+	root = template.Must(root.New("main").Parse(`<< V "name" >> << b64template "inner" >>`))
+	template.Must(root.New("inner").Parse(`<< V "name" >>`))
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i)}
+			machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, byte(10+i)))
+			machine.SetFlag("name", mac.String())
+			out, err := executeTemplate(root, "main", ds, machine, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			expected := mac.String() + " " +
+				base64.StdEncoding.EncodeToString([]byte(mac.String()))
+			if out != expected {
+				t.Errorf("expected %q, got %q", expected, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEnvAndSecret(t *testing.T) {
+	defer Configure(secretsDir, strictMode)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BLACKSMITH_TEST_TOKEN", "t0ken")
+
+	Configure(dir, false)
+	if value, err := env("BLACKSMITH_TEST_TOKEN"); err != nil || value != "t0ken" {
+		t.Errorf("unexpected env value: %q (%v)", value, err)
+	}
+	if value, err := secret("token"); err != nil || value != "s3cret" {
+		t.Errorf("unexpected secret value: %q (%v)", value, err)
+	}
+	if value, err := secret("missing"); err != nil || value != "" {
+		t.Errorf("expected an empty missing secret out of strict mode: %q (%v)", value, err)
+	}
+	if _, err := secret("../token"); err == nil {
+		t.Error("expected an error for a secret name out of the secrets directory")
+	}
+
+	Configure(dir, true)
+	if _, err := env("BLACKSMITH_TEST_MISSING"); err == nil {
+		t.Error("expected an error for a missing env in strict mode")
+	}
+	if _, err := secret("missing"); err == nil {
+		t.Error("expected an error for a missing secret in strict mode")
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	headers, body := splitFrontMatter("---\nContent-Type: text/plain\nX-Node:  a:b \n---\nbody\n")
+	if body != "body\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if headers["Content-Type"] != "text/plain" || headers["X-Node"] != "a:b" || len(headers) != 2 {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+
+	headers, body = splitFrontMatter("no front matter\n---\n")
+	if len(headers) != 0 || body != "no front matter\n---\n" {
+		t.Errorf("expected the text to be left untouched: %v %q", headers, body)
+	}
+
+	// YAML documents, and blocks which aren't only headers, are the body
+	for _, text := range []string{
+		"---\nContent-Type\n---\n",
+		"---\nContent-Type: text/plain\n",
+		"---\nhostname: node1\n---\n",
+		"---\n#cloud-config\nContent-Type: text/plain\n---\n",
+		"---\n---\nbody\n",
+	} {
+		headers, body := splitFrontMatter(text)
+		if len(headers) != 0 || body != text {
+			t.Errorf("expected %q to be left untouched: %v %q", text, headers, body)
+		}
+	}
+}
+
+func TestExecuteTemplateExpiredLease(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte("ip=<< .IP >>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if _, err := ds.ExpireLease(mac); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "ip=" {
+		t.Errorf("expected an empty ip for an expired lease, got %q (%v)", out, err)
+	}
+}
+
+func TestExecuteTemplateFolderOUI(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"main":       "generic << .Mac >>",
+		"oui-001122": "---\nX-Vendor: acme\n---\nvendor << .Mac >>",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	vendor, _ := ds.CreateMachine(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}, net.IPv4(10, 0, 0, 10))
+	other, _ := ds.CreateMachine(net.HardwareAddr{0x00, 0x11, 0x23, 0x33, 0x44, 0x55}, net.IPv4(10, 0, 0, 11))
+
+	out, headers, err := ExecuteTemplateFolderWithHeaders(dir, ds, vendor, "")
+	if err != nil || out != "vendor 00:11:22:33:44:55" || headers["X-Vendor"] != "acme" {
+		t.Errorf("expected the oui template: %q %v (%v)", out, headers, err)
+	}
+	out, err = ExecuteTemplateFolder(dir, ds, other, "")
+	if err != nil || out != "generic 00:11:23:33:44:55" {
+		t.Errorf("expected the main template: %q (%v)", out, err)
+	}
+}
+
+func TestTemplateCoreOSVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(`<< .CoreOSVersion >> << version >>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	ds.CoreOS = "1010.5.0"
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+
+	out, err := ExecuteTemplateFolder(dir, ds, machine, "")
+	if err != nil || out != "1010.5.0 1010.5.0" {
+		t.Errorf("expected the coreos version, got %q (%v)", out, err)
+	}
+}
+
+func TestStringFuncs(t *testing.T) {
+	dir := t.TempDir()
+	text := `<< b64decode "aGVsbG8=" >>|<< urlquery "a b&c" >>|<< trim "  x\n" >>`
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+
+	out, err := ExecuteTemplateFolder(dir, ds, machine, "")
+	if err != nil || out != "hello|a+b%26c|x" {
+		t.Errorf("unexpected output: %q (%v)", out, err)
+	}
+
+	if _, err := b64decode("not base64"); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+}
+
+func TestConfigFolder(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+
+	for profile, expected := range map[string]string{
+		"":        "/ws/config/cloudconfig",
+		"main":    "/ws/config/cloudconfig",
+		"storage": "/ws/config/profiles/storage/cloudconfig",
+	} {
+		machine.SetFlag("profile", profile)
+		if folder, err := ConfigFolder("/ws", "cloudconfig", machine); err != nil || folder != expected {
+			t.Errorf("%q: expected %s, got %s (%v)", profile, expected, folder, err)
+		}
+	}
+
+	machine.SetFlag("profile", "../secrets")
+	if _, err := ConfigFolder("/ws", "cloudconfig", machine); err == nil {
+		t.Error("expected an error for a profile outside the profiles folder")
+	}
+}
+
+func TestTypedFlagFuncs(t *testing.T) {
+	dir := t.TempDir()
+	text := `<< if vbool "ssd" >>ssd<< end >> << vint "disks" >>`
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("ssd", "true")
+	machine.SetFlag("disks", "3")
+
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "ssd 3" {
+		t.Errorf("unexpected output: %q (%v)", out, err)
+	}
+
+	machine.SetFlag("disks", "three")
+	if _, err := ExecuteTemplateFolder(dir, ds, machine, ""); err == nil {
+		t.Error("expected a malformed flag to fail the execution")
+	}
+}
+
+// failingMachine fails reading its flags, like a machine of an unreachable
+// etcd
+type failingMachine struct {
+	*datasourcetest.MemoryMachine
+}
+
+func (m *failingMachine) GetFlag(key string) (string, error) {
+	return "", errors.New("etcd is unreachable")
+}
+
+func TestFlagConditionals(t *testing.T) {
+	dir := t.TempDir()
+	text := `<< if flagEq "state" "installing" >>install<< else >>run<< end >>|` +
+		`<< hasFlag "role" >>|<< V "missing" >>|<< hasFlag "_note" >>`
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	machine.SetNote("a note")
+	machine.SetFlag("role", "worker")
+
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "run|true||false" {
+		t.Errorf("unexpected output: %q (%v)", out, err)
+	}
+	machine.SetFlag("state", datasource.StateInstalling)
+	machine.DeleteFlag("role")
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "install|false||false" {
+		t.Errorf("unexpected output: %q (%v)", out, err)
+	}
+
+	// another folder, so the render isn't served from the cache
+	failingDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(failingDir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingMachine{machine.(*datasourcetest.MemoryMachine)}
+	if _, err := ExecuteTemplateFolder(failingDir, ds, failing, ""); err == nil {
+		t.Error("expected a failure to read the flags to fail the execution")
+	}
+}
+
+func TestLockFuncs(t *testing.T) {
+	dir := t.TempDir()
+	text := `<< if lock "disk" 300 >>format<< unlock "disk" >><< else >>wait<< end >>`
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	other, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 11))
+
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "format" {
+		t.Errorf("unexpected output: %q (%v)", out, err)
+	}
+
+	ds.AcquireLock("disk", other.Name(), time.Minute)
+	if out, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || out != "wait" {
+		t.Errorf("expected the render not to be cached while the lock is held, got %q (%v)", out, err)
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestStableFuncs(t *testing.T) {
+	dir := t.TempDir()
+	text := `<< stableRandom "join-token" 32 >> << uuid "cluster-id" >>`
+	if err := os.WriteFile(filepath.Join(dir, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	other, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 11))
+
+	first, err := ExecuteTemplateFolder(dir, ds, machine, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := strings.Split(first, " ")
+	if len(values) != 2 || len(values[0]) != 32 || !uuidPattern.MatchString(values[1]) {
+		t.Fatalf("unexpected output: %q", first)
+	}
+	if token, _ := machine.GetFlag("join-token"); token != values[0] {
+		t.Errorf("expected the token to be kept in the flag, got %q", token)
+	}
+	if again, err := ExecuteTemplateFolder(dir, ds, machine, ""); err != nil || again != first {
+		t.Errorf("expected the same values on the next render, got %q (%v)", again, err)
+	}
+	if out, err := ExecuteTemplateFolder(dir, ds, other, ""); err != nil || out == first {
+		t.Errorf("expected other values for another machine, got %q (%v)", out, err)
+	}
+
+	machine.SetFlag("join-token", "preset")
+	if out, _ := ExecuteTemplateFolder(dir, ds, machine, ""); !strings.HasPrefix(out, "preset ") {
+		t.Errorf("expected the value of the flag, got %q", out)
+	}
+}
+
+// racingMachine sets the flag, as another render would, right before its
+// first CreateFlag
+type racingMachine struct {
+	datasource.Machine
+	value string
+}
+
+func (m *racingMachine) CreateFlag(key, value string) (bool, error) {
+	if m.value != "" {
+		m.Machine.SetFlag(key, m.value)
+		m.value = ""
+	}
+	return m.Machine.CreateFlag(key, value)
+}
+
+func TestStableValueRace(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	machine, _ := ds.CreateMachine(net.HardwareAddr{0, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+
+	racing := &racingMachine{Machine: machine, value: "winner"}
+	value, generated, err := stableValue(racing, "join-token", func() (string, error) {
+		return "loser", nil
+	})
+	if err != nil || generated || value != "winner" {
+		t.Errorf("expected the value of the other render, got %q, %v (%v)", value, generated, err)
+	}
+	if token, _ := machine.GetFlag("join-token"); token != "winner" {
+		t.Errorf("expected the flag to be kept, got %q", token)
+	}
+}
+
+func TestValidateWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, kind := range templateKinds {
+		write(filepath.Join("config", kind, "main"), `<< V "name" >>`)
+	}
+	if errs := ValidateWorkspace(dir); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	write("config/cloudconfig/main", `<< V "name" `)
+	write("config/profiles/storage/ignition/other", `x`)
+	errs := ValidateWorkspace(dir)
+	// the broken template, and the missing main and folders of the profile
+	if len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+}
@@ -0,0 +1,43 @@
+package templating
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// templateKinds are the template folders of a config folder
+var templateKinds = []string{"bootparams", "cloudconfig", "ignition"}
+
+// ValidateWorkspace parses the templates of the config folder of the
+// workspace and of each of its profiles, and checks that every folder has a
+// main template
+func ValidateWorkspace(workspacePath string) []error {
+	configPath := filepath.Join(workspacePath, "config")
+	configFolders := []string{configPath}
+
+	profiles, err := ioutil.ReadDir(filepath.Join(configPath, "profiles"))
+	if err == nil {
+		for _, profile := range profiles {
+			if profile.IsDir() {
+				configFolders = append(configFolders, filepath.Join(configPath, "profiles", profile.Name()))
+			}
+		}
+	}
+
+	var errs []error
+	for _, configFolder := range configFolders {
+		for _, kind := range templateKinds {
+			folder := filepath.Join(configFolder, kind)
+			t, _, err := templateFromPath(folder)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", folder, err))
+				continue
+			}
+			if t.Lookup("main") == nil {
+				errs = append(errs, fmt.Errorf("%s: the main template is missing", folder))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,123 @@
+// Package tracing wraps the OpenTelemetry instrumentation of blacksmith. Until
+// Configure is called with an endpoint, the spans are no-ops
+package tracing // import "github.com/cafebazaar/blacksmith/tracing"
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "blacksmith"
+
+var provider *sdktrace.TracerProvider
+
+// tracer returns the tracer of the current global provider. It's looked up
+// on each span, since a tracer stays bound to the provider it was taken
+// from, even if another one is set later
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(serviceName)
+}
+
+// Configure exports the spans over OTLP/HTTP to the endpoint, e.g.
+// localhost:4318. An empty endpoint leaves the tracing disabled
+func Configure(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return err
+	}
+	setProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName))),
+	))
+	return nil
+}
+
+// setProvider makes the provider the destination of the spans
+func setProvider(p *sdktrace.TracerProvider) {
+	provider = p
+	otel.SetTracerProvider(p)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Shutdown flushes the spans which aren't exported yet
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	provider.Shutdown(ctx)
+}
+
+// Span is a traced operation
+type Span struct {
+	span trace.Span
+}
+
+// Start starts a root span, with the attributes given as key, value pairs.
+// The operations which don't carry a context, like the calls to the
+// datasource, are traced as roots
+func Start(name string, attrs ...string) *Span {
+	_, span := tracer().Start(context.Background(), name,
+		trace.WithAttributes(keyValues(attrs)...))
+	return &Span{span}
+}
+
+// SetAttributes adds the attributes given as key, value pairs to the span
+func (s *Span) SetAttributes(attrs ...string) {
+	s.span.SetAttributes(keyValues(attrs)...)
+}
+
+// SetError marks the span as failed with the err, if it's not nil
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span
+func (s *Span) End() {
+	s.span.End()
+}
+
+func keyValues(attrs []string) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		kvs = append(kvs, attribute.String(attrs[i], attrs[i+1]))
+	}
+	return kvs
+}
+
+// Handler traces each request in a server span named after the path,
+// continuing the trace of the client if the request carries a trace context
+func Handler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(),
+			propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, name+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+			))
+		defer span.End()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestRecorder() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	setProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+}
+
+func TestStart(t *testing.T) {
+	recorder := newTestRecorder()
+
+	span := Start("etcd.get", "key", "machines")
+	span.SetError(errors.New("timeout"))
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Name() != "etcd.get" {
+		t.Errorf("unexpected name: %s", spans[0].Name())
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("expected the span to be failed, got %v", spans[0].Status())
+	}
+	attrs := spans[0].Attributes()
+	if len(attrs) != 1 || string(attrs[0].Key) != "key" || attrs[0].Value.AsString() != "machines" {
+		t.Errorf("unexpected attributes: %v", attrs)
+	}
+}
+
+func TestHandlerContinuesTrace(t *testing.T) {
+	recorder := newTestRecorder()
+
+	handler := Handler("httpbooter", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/pxelinux.cfg/01-00-11-22-33-44-55", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if traceID := spans[0].SpanContext().TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("the trace of the client isn't continued, got trace id %s", traceID)
+	}
+	if parent := spans[0].Parent().SpanID().String(); parent != "00f067aa0ba902b7" {
+		t.Errorf("unexpected parent span: %s", parent)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/templating"
+)
+
+// validate checks the workspace, the templates and the connection to etcd,
+// without writing anything to etcd or starting the servers, and returns the
+// exit code
+func validate() int {
+	var errs []error
+	errs = append(errs, datasource.ValidateWorkspace(*workspacePathFlag)...)
+	errs = append(errs, templating.ValidateWorkspace(*workspacePathFlag)...)
+	if _, err := pxe.ParseCmdlineTemplate(*cmdlineTplFlag); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid cmdline template: %s", err))
+	}
+	if _, err := dhcp.ParseHostnameTemplate(*hostnameTplFlag); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid hostname template: %s", err))
+	}
+	if _, err := dhcp.ParseBootMenu(*pxeMenuFlag); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid pxe menu: %s", err))
+	}
+	if *poolFlag != "" {
+		if _, err := parsePools(*poolFlag); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid pool: %s", err))
+		}
+	}
+	if _, err := customDHCPOptions(); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid dhcp options: %s", err))
+	}
+	if _, err := dhcpLabelOverrides(); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid dhcp label options: %s", err))
+	}
+
+	if etcdClient, err := newEtcdClient(); err != nil {
+		errs = append(errs, fmt.Errorf("Couldn't create etcd connection: %s", err))
+	} else if err := checkEtcd(etcdClient); err != nil {
+		errs = append(errs, fmt.Errorf("Couldn't read from etcd: %s", err))
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d problems found\n", len(errs))
+		return 1
+	}
+	fmt.Println("The workspace and etcd are fine")
+	return 0
+}
+
+// checkEtcd reads the tree of the cluster, which doesn't need to exist yet
+func checkEtcd(etcdClient etcd.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := etcd.NewKeysAPI(etcdClient).Get(ctx, *clusterNameFlag, nil)
+	if etcdError, found := err.(etcd.Error); found && etcdError.Code == etcd.ErrorCodeKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return describeEtcdError(err)
+	}
+	return nil
+}
@@ -8,27 +8,101 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"runtime"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
+
 	"github.com/cafebazaar/blacksmith/datasource"
 )
 
-// Version returns json encoded version details
+// writeJSONError writes the error as {"error": "..."} with the given status
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	errorJSON, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(errorJSON)
+}
+
+// startTime is used for the uptime reported by Version
+var startTime = time.Now()
+
+type versionDetails struct {
+	datasource.BlacksmithVersion
+	GoVersion   string `json:"goVersion"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	Uptime      string `json:"uptime"`
+	ClusterName string `json:"clusterName"`
+}
+
+// Version returns json encoded version details, along with the runtime and
+// the cluster name, which is the etcd prefix of the cluster
 func (ws *webServer) Version(w http.ResponseWriter, r *http.Request) {
-	versionJSON, err := json.Marshal(ws.ds.Version())
+	versionJSON, err := json.Marshal(&versionDetails{
+		BlacksmithVersion: ws.ds.Version(),
+		GoVersion:         runtime.Version(),
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+		Uptime:            time.Since(startTime).String(),
+		ClusterName:       ws.ds.ClusterName(),
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), 500)
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 	io.WriteString(w, string(versionJSON))
 }
 
+// EtcdEndpoints returns json encoded health of the etcd endpoints
+func (ws *webServer) EtcdEndpoints(w http.ResponseWriter, r *http.Request) {
+	endpointsJSON, err := json.Marshal(ws.ds.EtcdEndpoints())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(endpointsJSON))
+}
+
+// LeasePool returns json encoded utilization of the dhcp lease pool
+func (ws *webServer) LeasePool(w http.ResponseWriter, r *http.Request) {
+	stats, err := ws.ds.PoolStats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(statsJSON))
+}
+
+// DHCPEvents returns the recent decisions of the DHCP handler, oldest first
+func (ws *webServer) DHCPEvents(w http.ResponseWriter, r *http.Request) {
+	eventsJSON, err := json.Marshal(ws.dhcpEvents.Events())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(eventsJSON))
+}
+
 type nodeDetails struct {
 	Name          string    `json:"name"`
 	Nic           string    `json:"nic"`
 	IP            net.IP    `json:"ip"`
 	FirstAssigned time.Time `json:"firstAssigned"`
 	LastAssigned  time.Time `json:"lastAssigned"`
+	Note          string    `json:"note"`
+	BootCount     int       `json:"bootCount"`
+	LastBoot      time.Time `json:"lastBoot"`
 }
 
 func nodeToDetails(node datasource.Machine) (*nodeDetails, error) {
@@ -46,7 +120,15 @@ func nodeToDetails(node datasource.Machine) (*nodeDetails, error) {
 	if err != nil {
 		return nil, errors.New("LAST")
 	}
-	return &nodeDetails{name, mac.String(), ip, first, last}, nil
+	note, err := node.Note()
+	if err != nil {
+		return nil, errors.New("NOTE")
+	}
+	bootCount, lastBoot, err := node.Boots()
+	if err != nil {
+		return nil, errors.New("BOOTS")
+	}
+	return &nodeDetails{name, mac.String(), ip, first, last, note, bootCount, lastBoot}, nil
 }
 
 // NodesList creates a list of the currently known nodes based on the etcd
@@ -54,14 +136,14 @@ func nodeToDetails(node datasource.Machine) (*nodeDetails, error) {
 func (ws *webServer) NodesList(w http.ResponseWriter, r *http.Request) {
 	machines, err := ws.ds.Machines()
 	if err != nil || machines == nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 	nodes := make([]*nodeDetails, 0, len(machines))
 	for _, node := range machines {
 		l, err := nodeToDetails(node)
 		if err != nil {
-			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, err)
 			return
 		}
 		if l != nil {
@@ -71,45 +153,252 @@ func (ws *webServer) NodesList(w http.ResponseWriter, r *http.Request) {
 
 	nodesJSON, err := json.Marshal(nodes)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 	io.WriteString(w, string(nodesJSON))
 }
 
-// NodeFlags returns all the flags set for the node
-func (ws *webServer) NodeFlags(w http.ResponseWriter, r *http.Request) {
-	_, macStr := path.Split(r.URL.Path)
+// MachineInfo is everything known about a machine, for the detail view. Its
+// Flags leave out the reserved ones, which are served by their own fields
+type MachineInfo struct {
+	Name      string            `json:"name"`
+	Domain    string            `json:"domain"`
+	Nic       string            `json:"nic"`
+	IP        net.IP            `json:"ip"`
+	FirstSeen time.Time         `json:"firstSeen"`
+	LastSeen  time.Time         `json:"lastSeen"`
+	State     string            `json:"state"`
+	Note      string            `json:"note"`
+	BootCount int               `json:"bootCount"`
+	LastBoot  time.Time         `json:"lastBoot"`
+	Flags     map[string]string `json:"flags"`
+}
+
+func machineToInfo(machine datasource.Machine) (*MachineInfo, error) {
+	ip, err := machine.IP()
+	if err != nil {
+		return nil, err
+	}
+	// the machines created before the seen times were recorded have none,
+	// which are left zero
+	first, err := machine.FirstSeen()
+	if datasource.IsFlagNotFound(err) {
+		first, err = time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	last, err := machine.LastSeen()
+	if datasource.IsFlagNotFound(err) {
+		last, err = time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	note, err := machine.Note()
+	if err != nil {
+		return nil, err
+	}
+	bootCount, lastBoot, err := machine.Boots()
+	if err != nil {
+		return nil, err
+	}
+	flags, err := machine.ListFlags()
+	if err != nil {
+		return nil, err
+	}
+	for key := range flags {
+		if datasource.IsReservedFlag(key) {
+			delete(flags, key)
+		}
+	}
+	return &MachineInfo{
+		Name:      machine.Name(),
+		Domain:    machine.Domain(),
+		Nic:       machine.Mac().String(),
+		IP:        ip,
+		FirstSeen: first,
+		LastSeen:  last,
+		State:     flags["state"],
+		Note:      note,
+		BootCount: bootCount,
+		LastBoot:  lastBoot,
+		Flags:     flags,
+	}, nil
+}
 
-	mac, err := net.ParseMAC(macStr)
+// NodeInfo returns everything known about the node in one object
+func (ws *webServer) NodeInfo(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	machine, exists := ws.ds.GetMachine(mac)
 	if !exists {
-		http.Error(w, fmt.Sprintf(`{"error": "Machine not found"}`), http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
 		return
 	}
 
-	flags, err := machine.ListFlags()
+	info, err := machineToInfo(machine)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(infoJSON))
+}
+
+type resolveResult struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+	Nic    string `json:"nic"`
+	IP     net.IP `json:"ip"`
+}
+
+// Resolve finds the machine of an ip, ?ip=10.0.0.10, or of a hostname,
+// ?host=node001122334455 or its fqdn, and returns its name and address
+func (ws *webServer) Resolve(w http.ResponseWriter, r *http.Request) {
+	ipStr, host := r.FormValue("ip"), r.FormValue("host")
+	if (ipStr == "") == (host == "") {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Exactly one of ip and host is required"))
+		return
+	}
+
+	var machine datasource.Machine
+	var exists bool
+	if ipStr != "" {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the ip"))
+			return
+		}
+		machine, exists = ws.ds.GetMachineByIP(ip)
+	} else {
+		mac, err := datasource.ParseMachineName(host)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		machine, exists = ws.ds.GetMachine(mac)
+		// the domain of the fqdn is the cluster name
+		if parts := strings.SplitN(host, ".", 2); exists && len(parts) == 2 &&
+			parts[1] != ws.ds.ClusterName() {
+			exists = false
+		}
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	ip, err := machine.IP()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resultJSON, err := json.Marshal(resolveResult{
+		Name:   machine.Name(),
+		Domain: machine.Domain(),
+		Nic:    machine.Mac().String(),
+		IP:     ip,
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(resultJSON))
+}
+
+// NodeFlags returns all the flags set for the node, without the internal
+// ones like _IP if internal=false
+func (ws *webServer) NodeFlags(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, exists := ws.ds.GetMachine(mac); !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	flags, err := ws.ds.ExportFlags(mac)
+	if errors.Is(err, datasource.ErrMachineNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if r.FormValue("internal") == "false" {
+		for key := range flags {
+			if datasource.IsReservedFlag(key) {
+				delete(flags, key)
+			}
+		}
+	}
+
 	flagsJSON, err := json.Marshal(flags)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 	io.WriteString(w, string(flagsJSON))
 }
 
+// ImportNodeFlags sets the flags of the json object in the body on the node,
+// e.g. the ones exported from the node it replaces. The internal flags are
+// skipped, and so are the ones the node has already unless overwrite=true
+func (ws *webServer) ImportNodeFlags(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var flags map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&flags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Error while parsing the body: %s", err))
+		return
+	}
+
+	if _, exists := ws.ds.GetMachine(mac); !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	err = ws.ds.ImportFlags(mac, flags, r.FormValue("overwrite") == "true")
+	if errors.Is(err, datasource.ErrMachineNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
 func (ws *webServer) SetFlag(w http.ResponseWriter, r *http.Request) {
 	_, name := path.Split(r.URL.Path)
 	value := r.FormValue("value")
+	if datasource.IsReservedFlag(name) {
+		// the internal keys, like the BMC of the machine, are set only by
+		// their own apis
+		writeJSONError(w, http.StatusForbidden, fmt.Errorf("%w: %s", datasource.ErrReservedFlag, name))
+		return
+	}
 
 	macStr := r.FormValue("mac")
 	var machine datasource.Machine
@@ -117,27 +406,62 @@ func (ws *webServer) SetFlag(w http.ResponseWriter, r *http.Request) {
 	if macStr != "" {
 		mac, err := net.ParseMAC(macStr)
 		if err != nil {
-			http.Error(w, `{"error": "Error while parsing the mac"}`, http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
 			return
 		}
 
 		machine, exist = ws.ds.GetMachine(mac)
 		if !exist {
-			http.Error(w, `{"error": "Machine not found"}`, http.StatusInternalServerError)
+			writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
 			return
 		}
 	}
 
+	if machine != nil && name == datasource.StateFlag {
+		// the state moves only along the valid transitions, like on
+		// PUT /api/node/<mac>/state
+		old, _ := machine.GetFlag(name)
+		err := ws.ds.SetState(machine.Mac(), value)
+		if errors.Is(err, datasource.ErrInvalidStateTransition) {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, errors.New("Error while setting value"))
+			return
+		}
+		datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+			Mac:      machine.Mac().String(),
+			Key:      name,
+			OldValue: old,
+			NewValue: value,
+			Source:   "api " + r.RemoteAddr,
+		})
+		io.WriteString(w, `"OK"`)
+		return
+	}
+
 	var err error
 	if machine != nil {
+		old, _ := machine.GetFlag(name)
 		err = machine.SetFlag(name, value)
+		if err == nil {
+			datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+				Mac:      machine.Mac().String(),
+				Key:      name,
+				OldValue: old,
+				NewValue: value,
+				Source:   "api " + r.RemoteAddr,
+			})
+		}
 	} else {
 		// TODO deafult flags
-		http.Error(w, `{"error": "Default flags not supported yet"}`, http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Default flags not supported yet"))
+		return
 	}
 
 	if err != nil {
-		http.Error(w, `{"error": "Error while setting value"}`, http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Error while setting value"))
 		return
 	}
 
@@ -153,29 +477,660 @@ func (ws *webServer) DelFlag(w http.ResponseWriter, r *http.Request) {
 	if macStr != "" {
 		mac, err := net.ParseMAC(macStr)
 		if err != nil {
-			http.Error(w, `{"error": "Error while parsing the mac"}`, http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
 			return
 		}
 
 		machine, exist = ws.ds.GetMachine(mac)
 		if !exist {
-			http.Error(w, `{"error": "Machine not found"}`, http.StatusInternalServerError)
+			writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
 			return
 		}
 	}
 
 	var err error
 	if machine != nil {
-		err = machine.DeleteFlag(name)
+		old, _ := machine.GetFlag(name)
+		// the internal keys of the machine are only deleted with force=true
+		if r.FormValue("force") == "true" {
+			err = machine.ForceDeleteFlag(name)
+		} else {
+			err = machine.DeleteFlag(name)
+		}
+		if err == nil {
+			datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+				Mac:      machine.Mac().String(),
+				Key:      name,
+				OldValue: old,
+				Deleted:  true,
+				Source:   "api " + r.RemoteAddr,
+			})
+		}
 	} else {
 		// TODO deafult flags
-		http.Error(w, `{"error": "Default flags not supported yet"}`, http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Default flags not supported yet"))
+		return
 	}
 
+	if errors.Is(err, datasource.ErrReservedFlag) {
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, `{"error": "Error while delleting value"}`, http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Error while delleting value"))
 		return
 	}
 
 	io.WriteString(w, `"OK"`)
 }
+
+// Audit returns the audit log of flag changes, only of the node specified by
+// the mac query parameter if it's present
+func (ws *webServer) Audit(w http.ResponseWriter, r *http.Request) {
+	var mac net.HardwareAddr
+	if macStr := r.FormValue("mac"); macStr != "" {
+		var err error
+		mac, err = net.ParseMAC(macStr)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	entries, err := ws.ds.AuditEntries(mac)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(entriesJSON))
+}
+
+// Reconcile repairs the claims on the ips which drifted from the machines,
+// and returns what it repaired
+func (ws *webServer) Reconcile(w http.ResponseWriter, r *http.Request) {
+	// only the master reconciles, so two instances don't repair the same
+	// claims at once
+	if !ws.ds.IsMaster() {
+		writeJSONError(w, http.StatusConflict, errors.New("Reconcile runs only on the master instance"))
+		return
+	}
+	report, err := ws.ds.Reconcile()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(reportJSON))
+}
+
+// ReconcileStats returns the totals of the runs of Reconcile, periodic or
+// through the API, like how many orphaned claims were removed
+func (ws *webServer) ReconcileStats(w http.ResponseWriter, r *http.Request) {
+	statsJSON, err := json.Marshal(ws.ds.ReconcileStats())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(statsJSON))
+}
+
+type maintenanceMode struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Maintenance returns whether the maintenance mode is on
+func (ws *webServer) Maintenance(w http.ResponseWriter, r *http.Request) {
+	enabled, err := ws.ds.Maintenance()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	modeJSON, err := json.Marshal(maintenanceMode{enabled})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(modeJSON))
+}
+
+// SetMaintenance turns the maintenance mode on or off, with a body like
+// {"enabled": true}. While it's on, the Discovers get no offers, and the
+// renewals keep working
+func (ws *webServer) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var mode maintenanceMode
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Error while parsing the body: %s", err))
+		return
+	}
+
+	if err := ws.ds.SetMaintenance(mode.Enabled); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// Config returns the runtime configuration, merged from the initial values
+// and the etcd overrides
+func (ws *webServer) Config(w http.ResponseWriter, r *http.Request) {
+	config, err := ws.ds.Config()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(configJSON))
+}
+
+// SetConfig updates a mutable runtime configuration value
+func (ws *webServer) SetConfig(w http.ResponseWriter, r *http.Request) {
+	_, name := path.Split(r.URL.Path)
+	value := r.FormValue("value")
+
+	if err := ws.ds.SetConfig(name, value); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// NodeState returns the boot state of the node
+func (ws *webServer) NodeState(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	state, err := machine.GetFlag("state")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(stateJSON))
+}
+
+// SetNodeState moves the node to the requested boot state, if the transition
+// is valid
+func (ws *webServer) SetNodeState(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+
+	if _, exists := ws.ds.GetMachine(mac); !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	err = ws.ds.SetState(mac, r.FormValue("value"))
+	if errors.Is(err, datasource.ErrMachineNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// NodeNote returns the note of the node
+func (ws *webServer) NodeNote(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	note, err := machine.Note()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	noteJSON, err := json.Marshal(note)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(noteJSON))
+}
+
+type bootsSummary struct {
+	Count    int       `json:"count"`
+	LastBoot time.Time `json:"lastBoot"`
+}
+
+// NodeBoots returns the boot attempts of the node, counted on its DHCP
+// Discovers, to spot the reboot loops
+func (ws *webServer) NodeBoots(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	count, lastBoot, err := machine.Boots()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	bootsJSON, err := json.Marshal(&bootsSummary{count, lastBoot})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(bootsJSON))
+}
+
+// NodeFlagHistory returns the recorded values of a flag of the node in
+// chronological order, for the timelines
+func (ws *webServer) NodeFlagHistory(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	history, err := machine.FlagHistory(mux.Vars(r)["key"])
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(historyJSON))
+}
+
+// SetNodeNote sets the note of the node
+func (ws *webServer) SetNodeNote(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	if err := machine.SetNote(r.FormValue("value")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+type reimageResult struct {
+	State        string `json:"state"`
+	PowerCycled  bool   `json:"powerCycled"`
+	Instructions string `json:"instructions,omitempty"`
+}
+
+// Reimage moves the node back to the installing state, so its next boot
+// serves the installer, and power-cycles it if its BMC is known
+func (ws *webServer) Reimage(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	old, _ := machine.GetFlag("state")
+	if err := ws.ds.SetState(mac, datasource.StateInstalling); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+		Mac:      mac.String(),
+		Key:      "state",
+		OldValue: old,
+		NewValue: datasource.StateInstalling,
+		Source:   "api reimage " + r.RemoteAddr,
+	})
+
+	result := reimageResult{State: datasource.StateInstalling}
+	bmc, _ := machine.BMC()
+	if ws.bmc == nil || bmc.Address == "" {
+		result.Instructions = "Power-cycle the machine manually to reinstall it"
+	} else {
+		err := ws.bmc.PowerCycle(bmc.Address, bmc.User, bmc.Password)
+		switch {
+		case err == ErrNoBMC:
+			result.Instructions = "Power-cycle the machine manually to reinstall it"
+		case err != nil:
+			writeJSONError(w, http.StatusBadGateway,
+				fmt.Errorf("The state is set, but power-cycling failed: %s", err))
+			return
+		default:
+			result.PowerCycled = true
+		}
+	}
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(resultJSON))
+}
+
+type powerStatus struct {
+	State string `json:"state"`
+}
+
+// nodeBMC returns the machine of the request and the details of its BMC,
+// writing the error if there's none
+func (ws *webServer) nodeBMC(w http.ResponseWriter, r *http.Request) (address, user, password string, ok bool) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return "", "", "", false
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return "", "", "", false
+	}
+
+	bmc, err := machine.BMC()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return "", "", "", false
+	}
+	if ws.bmc == nil || bmc.Address == "" {
+		writeJSONError(w, http.StatusConflict, errors.New("The BMC of the machine isn't known"))
+		return "", "", "", false
+	}
+	if err := datasource.ValidateBMCAddress(bmc.Address); err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return "", "", "", false
+	}
+	return bmc.Address, bmc.User, bmc.Password, true
+}
+
+type nodeBMCDetails struct {
+	Address  string `json:"address"`
+	User     string `json:"user"`
+	Password string `json:"password,omitempty"`
+	// HasPassword is returned instead of the password, which is never read
+	// back
+	HasPassword bool `json:"hasPassword"`
+}
+
+// NodeBMC returns the address and the user of the BMC of the node, and
+// whether its password is set
+func (ws *webServer) NodeBMC(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	bmc, err := machine.BMC()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	detailsJSON, err := json.Marshal(&nodeBMCDetails{
+		Address:     bmc.Address,
+		User:        bmc.User,
+		HasPassword: bmc.Password != "",
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(detailsJSON))
+}
+
+// SetNodeBMC sets the BMC of the node, with a body like {"address":
+// "https://10.0.1.10", "user": "admin", "password": "..."}. The details are
+// kept out of the flags, so the password is never served back. An empty
+// address removes them
+func (ws *webServer) SetNodeBMC(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	var details nodeBMCDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Error while parsing the body: %s", err))
+		return
+	}
+	err = machine.SetBMC(datasource.BMCCredentials{
+		Address:  details.Address,
+		User:     details.User,
+		Password: details.Password,
+	})
+	if errors.Is(err, datasource.ErrInvalidBMCAddress) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+		Mac:      mac.String(),
+		Key:      "_bmc_address",
+		NewValue: details.Address,
+		Source:   "api " + r.RemoteAddr,
+	})
+
+	io.WriteString(w, `"OK"`)
+}
+
+// NodePower returns the power state of the node, read from its BMC
+func (ws *webServer) NodePower(w http.ResponseWriter, r *http.Request) {
+	address, user, password, ok := ws.nodeBMC(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := ws.bmc.PowerStatus(address, user, password)
+	if err == ErrNoBMC {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	stateJSON, err := json.Marshal(&powerStatus{state})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(stateJSON))
+}
+
+// SetNodePower controls the power of the node through its BMC. The action
+// is cycle, to power-cycle it, or boot-once with device set to pxe or disk,
+// to pick the device of its next boot only
+func (ws *webServer) SetNodePower(w http.ResponseWriter, r *http.Request) {
+	address, user, password, ok := ws.nodeBMC(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "cycle":
+		err = ws.bmc.PowerCycle(address, user, password)
+	case "boot-once":
+		device := r.FormValue("device")
+		if device != "pxe" && device != "disk" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Invalid boot device %q, expected pxe or disk", device))
+			return
+		}
+		err = ws.bmc.SetBootOnce(address, user, password, device == "pxe")
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Invalid power action %q, expected cycle or boot-once", action))
+		return
+	}
+	if err == ErrNoBMC {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// WakeNode boots the node with a wake-on-LAN magic packet, for the machines
+// without a BMC
+func (ws *webServer) WakeNode(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil || len(mac) != 6 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+
+	if _, exists := ws.ds.GetMachine(mac); !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+	if ws.waker == nil {
+		writeJSONError(w, http.StatusConflict, errors.New("Wake-on-LAN isn't available"))
+		return
+	}
+
+	err = ws.waker.Wake(mac)
+	if err == ErrNoBroadcast {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// ExpireLease takes the IP of the node back to the pool, keeping its flags
+// and history, so its next Discover gets a fresh assignment
+func (ws *webServer) ExpireLease(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Error while parsing the mac"))
+		return
+	}
+
+	if _, exists := ws.ds.GetMachine(mac); !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	ip, err := ws.ds.ExpireLease(mac)
+	if errors.Is(err, datasource.ErrMachineNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err == datasource.ErrNoLease {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	datasource.AuditFlagChange(ws.ds, datasource.AuditEntry{
+		Mac:      mac.String(),
+		Key:      "_IP",
+		OldValue: ip.String(),
+		Deleted:  true,
+		Source:   "api expire-lease " + r.RemoteAddr,
+	})
+
+	ipJSON, err := json.Marshal(map[string]net.IP{"ip": ip})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(ipJSON))
+}
@@ -0,0 +1,674 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+	"github.com/cafebazaar/blacksmith/dhcp"
+)
+
+func TestNodeFlagsJSONError(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	for path, status := range map[string]int{
+		"/api/node/not-a-mac/flags":         http.StatusBadRequest,
+		"/api/node/00:11:22:33:44:01/flags": http.StatusNotFound,
+		"/api/node/00:11:22:33:44:01":       http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: expected a json content type, got %q", path, contentType)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("%s: expected a json error, got %q (%v)", path, w.Body, err)
+		}
+	}
+}
+
+type fakeBMC struct {
+	address, user, password string
+	bootOnce                string
+}
+
+func (b *fakeBMC) PowerCycle(address, user, password string) error {
+	b.address, b.user, b.password = address, user, password
+	return nil
+}
+
+func (b *fakeBMC) PowerStatus(address, user, password string) (string, error) {
+	return PowerOn, nil
+}
+
+func (b *fakeBMC) SetBootOnce(address, user, password string, pxe bool) error {
+	b.bootOnce = "disk"
+	if pxe {
+		b.bootOnce = "pxe"
+	}
+	return nil
+}
+
+func TestReimage(t *testing.T) {
+	ws := newTestWebServer(t)
+	bmc := &fakeBMC{}
+	ws.bmc = bmc
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, created := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	if !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	reimage := func() reimageResult {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/node/00:11:22:33:44:55/reimage", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		var result reimageResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := reimage(); result.PowerCycled || result.Instructions == "" {
+		t.Errorf("expected manual instructions without a bmc, got %+v", result)
+	}
+	if state, _ := machine.GetFlag("state"); state != datasource.StateInstalling {
+		t.Errorf("expected the installing state, got %q", state)
+	}
+
+	machine.SetBMC(datasource.BMCCredentials{Address: "10.0.1.10", User: "admin", Password: "secret"})
+	if result := reimage(); !result.PowerCycled {
+		t.Errorf("expected the machine to be power-cycled, got %+v", result)
+	}
+	if *bmc != (fakeBMC{"10.0.1.10", "admin", "secret", ""}) {
+		t.Errorf("unexpected bmc call: %+v", *bmc)
+	}
+}
+
+func TestNodePower(t *testing.T) {
+	ws := newTestWebServer(t)
+	bmc := &fakeBMC{}
+	ws.bmc = bmc
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/node/00:11:22:33:44:55/power", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("GET", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 without a bmc, got %d", w.Code)
+	}
+
+	machine.SetBMC(datasource.BMCCredentials{Address: "10.0.1.10"})
+	w := request("GET", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var status powerStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.State != PowerOn {
+		t.Errorf("unexpected power status: %s (%v)", w.Body, err)
+	}
+
+	if w := request("POST", "action=boot-once&device=pxe"); w.Code != http.StatusOK || bmc.bootOnce != "pxe" {
+		t.Errorf("expected the next boot from pxe, got %d, %q", w.Code, bmc.bootOnce)
+	}
+	if w := request("POST", "action=cycle"); w.Code != http.StatusOK || bmc.address != "10.0.1.10" {
+		t.Errorf("expected a power cycle, got %d, %+v", w.Code, *bmc)
+	}
+	for _, body := range []string{"action=off", "action=boot-once&device=cdrom"} {
+		if w := request("POST", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestNodeBMCRedacted(t *testing.T) {
+	ws := newTestWebServer(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("role", "storage")
+
+	w := httptest.NewRecorder()
+	body := `{"address": "10.0.1.10", "user": "admin", "password": "s3cret-pw"}`
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("PUT", "/api/node/00:11:22:33:44:55/bmc", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if bmc, _ := machine.BMC(); bmc.Password != "s3cret-pw" {
+		t.Fatalf("expected the bmc to be set, got %+v", bmc)
+	}
+
+	for _, path := range []string{
+		"/api/node/00:11:22:33:44:55",
+		"/api/node/00:11:22:33:44:55/bmc",
+		"/api/node/00:11:22:33:44:55/flags",
+		"/api/node/00:11:22:33:44:55/bundle.tar",
+		"/api/nodes",
+	} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d: %s", path, w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "s3cret-pw") {
+			t.Errorf("%s: the bmc password was served: %s", path, w.Body)
+		}
+	}
+
+	flags, err := ws.ds.ExportFlags(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range flags {
+		if value == "s3cret-pw" || datasource.IsCredentialFlag(key) {
+			t.Errorf("expected the credentials not to be exported, got %s=%s", key, value)
+		}
+	}
+	if _, err := machine.GetFlag("_bmc_password"); err == nil {
+		t.Error("expected the password not to be readable as a flag")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	w := httptest.NewRecorder()
+	ws.Version(w, httptest.NewRequest("GET", "/api/version", nil))
+
+	var details map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "commit", "buildTime", "goVersion", "os", "arch", "uptime", "clusterName"} {
+		if _, exists := details[key]; !exists {
+			t.Errorf("expected %s in the version details: %v", key, details)
+		}
+	}
+	if details["goVersion"] != runtime.Version() {
+		t.Errorf("unexpected go version: %q", details["goVersion"])
+	}
+}
+
+func TestNodeBoots(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.RecordBoot()
+	machine.RecordBoot()
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/boots", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var summary bootsSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count != 2 || summary.LastBoot.IsZero() {
+		t.Errorf("unexpected boots summary: %+v", summary)
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("role", "worker")
+	machine.SetNote("rack 4")
+	machine.SetFlag("_internal", "x")
+	machine.RecordBoot()
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var info MachineInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Nic != "00:11:22:33:44:55" || !info.IP.Equal(net.IPv4(10, 0, 0, 10)) || info.Name != machine.Name() {
+		t.Errorf("unexpected machine: %+v", info)
+	}
+	if info.State != datasource.StateUnknown || info.Note != "rack 4" || info.BootCount != 1 {
+		t.Errorf("unexpected details: %+v", info)
+	}
+	if info.Flags["role"] != "worker" {
+		t.Errorf("unexpected flags: %v", info.Flags)
+	}
+	for key := range info.Flags {
+		if datasource.IsReservedFlag(key) {
+			t.Errorf("expected the reserved flags to be left out, got %v", info.Flags)
+		}
+	}
+
+	// the flags alone are served by /flags
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/flags", nil))
+	var flags map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &flags); err != nil || flags["role"] != "worker" {
+		t.Errorf("unexpected flags: %s (%v)", w.Body, err)
+	}
+}
+
+// unseenMachine is a machine whose seen times were never recorded
+type unseenMachine struct {
+	*datasourcetest.MemoryMachine
+}
+
+func (m unseenMachine) FirstSeen() (time.Time, error) {
+	return time.Time{}, datasource.ErrFlagNotFound
+}
+
+func (m unseenMachine) LastSeen() (time.Time, error) {
+	return time.Time{}, datasource.ErrFlagNotFound
+}
+
+func TestMachineToInfoUnseen(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 20)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	info, err := machineToInfo(unseenMachine{machine.(*datasourcetest.MemoryMachine)})
+	if err != nil {
+		t.Fatalf("expected the missing seen times not to fail, got %s", err)
+	}
+	if !info.FirstSeen.IsZero() || !info.LastSeen.IsZero() {
+		t.Errorf("expected zero seen times, got %s, %s", info.FirstSeen, info.LastSeen)
+	}
+}
+
+func TestExpireLease(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	for _, status := range []int{http.StatusOK, http.StatusConflict} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/node/00:11:22:33:44:55/expire-lease", nil))
+		if w.Code != status {
+			t.Errorf("expected status %d, got %d: %s", status, w.Code, w.Body)
+		}
+	}
+
+	entries, _ := ws.ds.AuditEntries(mac)
+	if len(entries) != 1 || entries[0].OldValue != "10.0.0.10" || !entries[0].Deleted {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+}
+
+func TestDHCPEvents(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	events := func() []dhcp.Event {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/dhcp/events", nil))
+		var events []dhcp.Event
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("%s: %s", w.Body, err)
+		}
+		return events
+	}
+
+	if e := events(); e == nil || len(e) != 0 {
+		t.Errorf("expected an empty list without an event log, got %+v", e)
+	}
+
+	ws.dhcpEvents = dhcp.NewEventLog(10)
+	ws.dhcpEvents.Add(dhcp.Event{Type: dhcp.EventOffer, Mac: "00:11:22:33:44:55", IP: net.IPv4(10, 0, 0, 10)})
+	if e := events(); len(e) != 1 || e[0].Type != dhcp.EventOffer || !e[0].IP.Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("unexpected events: %+v", e)
+	}
+}
+
+func TestNodeFlagHistory(t *testing.T) {
+	ws := newTestWebServer(t)
+	ws.ds.(*datasourcetest.MemoryDataSource).FlagHistory = 10
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("state", "installing")
+	machine.SetFlag("state", "installed")
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/flag/state/history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var history []datasource.FlagHistoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Value != "installing" || history[1].Value != "installed" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/reconcile", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var report datasource.ReconcileReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored == nil || report.Removed == nil {
+		t.Errorf("expected empty lists, got %s", w.Body)
+	}
+
+	ws.ds.(*datasourcetest.MemoryDataSource).Master = false
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/reconcile", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 on a standby instance, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDelReservedFlag(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/api/flag/_first_seen?mac=00:11:22:33:44:55", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "_first_seen") {
+		t.Errorf("expected the error to name the flag, got %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/api/flag/_first_seen?mac=00:11:22:33:44:55&force=true", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 with force, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSetStateFlag(t *testing.T) {
+	ws := newTestWebServer(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	put := func(path, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", path, strings.NewReader("value="+value))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	for _, path := range []string{"/api/flag/state?mac=00:11:22:33:44:55", "/api/node/00:11:22:33:44:55/state"} {
+		if w := put(path, datasource.StateRunning); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400 for an invalid transition, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+	if state, _ := machine.GetFlag("state"); state != datasource.StateUnknown {
+		t.Errorf("expected the state to be kept, got %q", state)
+	}
+
+	if w := put("/api/flag/state?mac=00:11:22:33:44:55", datasource.StateInstalling); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := put("/api/node/00:11:22:33:44:55/state", datasource.StateInstalled); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if state, _ := machine.GetFlag("state"); state != datasource.StateInstalled {
+		t.Errorf("expected the installed state, got %q", state)
+	}
+}
+
+func TestSetReservedFlag(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	r := httptest.NewRequest("PUT", "/api/flag/_bmc_address?mac=00:11:22:33:44:55", strings.NewReader("value=https://attacker.example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := machine.GetFlag("_bmc_address"); err == nil {
+		t.Error("expected the reserved flag not to be set")
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("PUT", "/api/node/00:11:22:33:44:55/bmc", strings.NewReader(`{"address": "ftp://10.0.1.10"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid bmc address, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestExportImportFlags(t *testing.T) {
+	ws := newTestWebServer(t)
+	oldMac, _ := net.ParseMAC("00:11:22:33:44:55")
+	newMac, _ := net.ParseMAC("00:11:22:33:44:66")
+	old, _ := ws.ds.CreateMachine(oldMac, net.IPv4(10, 0, 0, 10))
+	replacement, _ := ws.ds.CreateMachine(newMac, net.IPv4(10, 0, 0, 11))
+	old.SetFlag("role", "storage")
+	old.SetFlag("disk", "sdb")
+	old.SetFlag("_note", "internal")
+	replacement.SetFlag("disk", "sda")
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/flags", nil))
+	if !strings.Contains(w.Body.String(), "_note") {
+		t.Errorf("expected the internal flags to be exported, got %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/flags?internal=false", nil))
+	exported := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(exported, "_note") {
+		t.Fatalf("expected the flags without the internal ones, got %d: %s", w.Code, exported)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/node/00:11:22:33:44:66/flags", strings.NewReader(exported)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if role, _ := replacement.GetFlag("role"); role != "storage" {
+		t.Errorf("expected the role to be imported, got %q", role)
+	}
+	if disk, _ := replacement.GetFlag("disk"); disk != "sda" {
+		t.Errorf("expected the existing flag to be kept without overwrite, got %q", disk)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/node/00:11:22:33:44:66/flags?overwrite=true", strings.NewReader(`{"disk": "sdb", "_IP": "10.0.0.10"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if disk, _ := replacement.GetFlag("disk"); disk != "sdb" {
+		t.Errorf("expected the flag to be overwritten, got %q", disk)
+	}
+	if _, err := replacement.GetFlag("_IP"); err == nil {
+		t.Error("expected the internal flags to be skipped on import")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ws := newTestWebServer(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	for _, query := range []string{
+		"ip=10.0.0.10",
+		"host=node001122334455",
+		"host=node001122334455.test",
+	} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/resolve?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d: %s", query, w.Code, w.Body)
+			continue
+		}
+		var result resolveResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Name != "node001122334455" || result.Domain != "test" ||
+			result.Nic != "00:11:22:33:44:55" || !result.IP.Equal(net.IPv4(10, 0, 0, 10)) {
+			t.Errorf("%s: unexpected result: %+v", query, result)
+		}
+	}
+
+	for query, status := range map[string]int{
+		"":                                   http.StatusBadRequest,
+		"ip=10.0.0.10&host=node001122334455": http.StatusBadRequest,
+		"ip=not-an-ip":                       http.StatusBadRequest,
+		"host=web1":                          http.StatusBadRequest,
+		"ip=10.0.0.11":                       http.StatusNotFound,
+		"host=node001122334456":              http.StatusNotFound,
+		"host=node001122334455.prod":         http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/resolve?"+query, nil))
+		if w.Code != status {
+			t.Errorf("%q: expected status %d, got %d: %s", query, status, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/maintenance", strings.NewReader(`{"enabled": true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := ws.ds.Assign("00:11:22:33:44:55"); err != datasource.ErrMaintenance {
+		t.Errorf("expected ErrMaintenance, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/maintenance", nil))
+	if w.Body.String() != `{"enabled":true}` {
+		t.Errorf("unexpected maintenance mode: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/maintenance", strings.NewReader(`enabled`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a malformed body, got %d", w.Code)
+	}
+}
+
+func TestLint(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	lint := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/lint", strings.NewReader(body)))
+		return w
+	}
+
+	w := lint(`{"text": "<< V \"role\" >><< if vbool \"gpu\" >>gpu<< end >>"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var result struct {
+		Keys   []string `json:"keys"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Keys, ",") != "gpu,role" || len(result.Errors) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	for body, status := range map[string]int{
+		`{"text": "<< if >>"}`:                http.StatusOK,
+		`{"template": "cloudconfig/main"}`:    http.StatusNotFound,
+		`{"template": "../cloudconfig/main"}`: http.StatusBadRequest,
+		`{}`:                                  http.StatusBadRequest,
+		`{"text": "x", "template": "x"}`:      http.StatusBadRequest,
+		`not json`:                            http.StatusBadRequest,
+	} {
+		if w := lint(body); w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", body, status, w.Code)
+		}
+	}
+}
+
+func TestConfigAPI(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	config := func() map[string]datasource.ConfigValue {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/config", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		var config map[string]datasource.ConfigValue
+		if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	if name := config()["cluster-name"]; name.Value != ws.ds.ClusterName() || !name.ReadOnly {
+		t.Errorf("unexpected cluster name: %+v", name)
+	}
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("PUT", "/api/config/coreos-version?value=1100.0.0", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if version := config()["coreos-version"]; version.Value != "1100.0.0" {
+		t.Errorf("expected the CoreOS version to be updated, got %+v", version)
+	}
+
+	for _, path := range []string{
+		"/api/config/unknown?value=x",
+		"/api/config/lease-range?value=20",
+		"/api/config/cluster-name?value=other",
+	} {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("PUT", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, w.Code)
+		}
+	}
+	if leaseRange := config()["lease-range"]; leaseRange.Value != "10" {
+		t.Errorf("expected the lease range to be kept, got %+v", leaseRange)
+	}
+}
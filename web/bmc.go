@@ -0,0 +1,143 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// Power states returned by BMC.PowerStatus
+const (
+	PowerOn  = "on"
+	PowerOff = "off"
+)
+
+// ErrNoBMC is returned by BMCs for an address whose kind of BMC isn't
+// configured
+var ErrNoBMC = errors.New("no BMC is configured for the address")
+
+// BMC controls the power of machines through their baseboard management
+// controllers
+type BMC interface {
+	// PowerCycle power-cycles the machine
+	PowerCycle(address, user, password string) error
+	// PowerStatus returns PowerOn or PowerOff
+	PowerStatus(address, user, password string) (string, error)
+	// SetBootOnce makes only the next boot of the machine from the network
+	// if pxe is set, or from the disk otherwise, without changing the boot
+	// order of the BIOS
+	SetBootOnce(address, user, password string, pxe bool) error
+}
+
+// BMCs dispatches to Redfish for the addresses which are http(s) urls, like
+// https://10.0.1.10, and to IPMI for the rest. Either can be nil, in which
+// case its addresses fail with ErrNoBMC
+type BMCs struct {
+	IPMI    BMC
+	Redfish BMC
+}
+
+func (b *BMCs) pick(address string) (BMC, error) {
+	// the address is validated again before any credentials are sent to it,
+	// in case it was stored before the validation
+	if err := datasource.ValidateBMCAddress(address); err != nil {
+		return nil, err
+	}
+	bmc := b.IPMI
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		bmc = b.Redfish
+	}
+	if bmc == nil {
+		return nil, ErrNoBMC
+	}
+	return bmc, nil
+}
+
+// PowerCycle power-cycles the machine through the BMC of the address
+// part of BMC interface implementation
+func (b *BMCs) PowerCycle(address, user, password string) error {
+	bmc, err := b.pick(address)
+	if err != nil {
+		return err
+	}
+	return bmc.PowerCycle(address, user, password)
+}
+
+// PowerStatus returns the power state from the BMC of the address
+// part of BMC interface implementation
+func (b *BMCs) PowerStatus(address, user, password string) (string, error) {
+	bmc, err := b.pick(address)
+	if err != nil {
+		return "", err
+	}
+	return bmc.PowerStatus(address, user, password)
+}
+
+// SetBootOnce sets the next boot device through the BMC of the address
+// part of BMC interface implementation
+func (b *BMCs) SetBootOnce(address, user, password string, pxe bool) error {
+	bmc, err := b.pick(address)
+	if err != nil {
+		return err
+	}
+	return bmc.SetBootOnce(address, user, password, pxe)
+}
+
+// IPMITool is a BMC which runs ipmitool over the lanplus interface
+type IPMITool struct {
+	// Path of the ipmitool binary
+	Path string
+}
+
+func (t *IPMITool) run(address, user, password string, args ...string) (string, error) {
+	cmd := exec.Command(t.Path, append([]string{"-I", "lanplus", "-H", address, "-U", user, "-E"}, args...)...)
+	// -E makes ipmitool read the password from the environment, so it's not
+	// visible in the process list
+	cmd.Env = []string{"IPMI_PASSWORD=" + password}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipmitool: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// PowerCycle issues a chassis power cycle to the BMC at address
+// part of BMC interface implementation
+func (t *IPMITool) PowerCycle(address, user, password string) error {
+	_, err := t.run(address, user, password, "chassis", "power", "cycle")
+	return err
+}
+
+// PowerStatus parses the output of chassis power status, which is like
+// "Chassis Power is on"
+// part of BMC interface implementation
+func (t *IPMITool) PowerStatus(address, user, password string) (string, error) {
+	output, err := t.run(address, user, password, "chassis", "power", "status")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(output)
+	if len(fields) > 0 {
+		switch fields[len(fields)-1] {
+		case "on":
+			return PowerOn, nil
+		case "off":
+			return PowerOff, nil
+		}
+	}
+	return "", fmt.Errorf("ipmitool: unexpected power status: %q", strings.TrimSpace(output))
+}
+
+// SetBootOnce issues a chassis bootdev, which applies to the next boot only
+// part of BMC interface implementation
+func (t *IPMITool) SetBootOnce(address, user, password string, pxe bool) error {
+	device := "disk"
+	if pxe {
+		device = "pxe"
+	}
+	_, err := t.run(address, user, password, "chassis", "bootdev", device)
+	return err
+}
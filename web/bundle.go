@@ -0,0 +1,115 @@
+package web
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/cafebazaar/blacksmith/logging"
+	"github.com/cafebazaar/blacksmith/templating"
+)
+
+// bundleConfigs are the configs of a bundle, by the kinds of their templates
+var bundleConfigs = []struct {
+	kind string
+	name string
+}{
+	{"cloudconfig", "cloudconfig.yaml"},
+	{"ignition", "ignition.json"},
+	{"bootparams", "bootparams.txt"},
+}
+
+// bundleFile is a file of a bundle
+type bundleFile struct {
+	name    string
+	content string
+}
+
+// bundleMachine is the machine.json of a bundle
+type bundleMachine struct {
+	Mac   string            `json:"mac"`
+	IP    string            `json:"ip"`
+	Name  string            `json:"name"`
+	Flags map[string]string `json:"flags"`
+}
+
+// NodeBundle serves a tarball of the rendered configs of the machine and a
+// dump of its flags, for attaching to the tickets. The templates are rendered
+// read-only, so building a bundle never changes the datasource. A config
+// which fails to render is replaced by a .error file with the error
+func (ws *webServer) NodeBundle(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	machine, exists := ws.ds.GetMachine(mac)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errors.New("Machine not found"))
+		return
+	}
+
+	flags, err := machine.ListFlags()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var ipString string
+	if ip, _ := machine.IP(); ip != nil {
+		ipString = ip.String()
+	}
+	machineJSON, err := json.MarshalIndent(&bundleMachine{mac.String(), ipString, machine.Name(), flags}, "", "  ")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	files := []bundleFile{{"machine.json", string(machineJSON)}}
+	for _, config := range bundleConfigs {
+		folder, err := templating.ConfigFolder(ws.ds.WorkspacePath(), config.kind, machine)
+		if err == nil {
+			var text string
+			text, err = templating.ExecuteTemplateFolderReadOnly(folder, ws.ds, machine, r.Host)
+			if err == nil && config.kind == "ignition" {
+				text, err = templating.MergeIgnitionBase(folder, text)
+			}
+			if err == nil {
+				files = append(files, bundleFile{config.name, text})
+				continue
+			}
+		}
+		files = append(files, bundleFile{config.name + ".error", err.Error()})
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+machine.Name()+`.tar"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    machine.Name() + "/" + file.name,
+			Mode:    0644,
+			Size:    int64(len(file.content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			logging.LogRequest(templatesDebugTag, r, "Error while writing the bundle of %s: %s", mac, err)
+			return
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			logging.LogRequest(templatesDebugTag, r, "Error while writing the bundle of %s: %s", mac, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		logging.LogRequest(templatesDebugTag, r, "Error while writing the bundle of %s: %s", mac, err)
+	}
+}
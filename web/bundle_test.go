@@ -0,0 +1,65 @@
+package web
+
+import (
+	"archive/tar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeBundle(t *testing.T) {
+	ws := newTestWebServer(t)
+	folder := filepath.Join(ws.ds.WorkspacePath(), "config", "cloudconfig")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	text := `hostname: << .Hostname >><< if lock "disk" 60 >> locked<< end >>`
+	if err := os.WriteFile(filepath.Join(folder, "main"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	machine, _ := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	machine.SetFlag("role", "master")
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/node/00:11:22:33:44:55/bundle.tar", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(w.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[strings.TrimPrefix(header.Name, machine.Name()+"/")] = string(content)
+	}
+
+	if files["cloudconfig.yaml"] != "hostname: "+machine.Name()+" locked" {
+		t.Errorf("unexpected cloudconfig: %q", files["cloudconfig.yaml"])
+	}
+	if _, exists := files["ignition.json.error"]; !exists {
+		t.Errorf("expected an error file for the missing ignition template, got %v", files)
+	}
+	if !strings.Contains(files["machine.json"], `"role": "master"`) {
+		t.Errorf("expected the flags in machine.json, got %s", files["machine.json"])
+	}
+
+	// the lock isn't acquired by the read-only render
+	if acquired, _ := ws.ds.AcquireLock("disk", "other", time.Minute); !acquired {
+		t.Error("expected building the bundle not to acquire the lock")
+	}
+}
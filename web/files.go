@@ -2,28 +2,66 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
+const (
+	// defaultMaxUploadSize is the largest file accepted by Upload, unless
+	// webServer.maxUploadSize says otherwise
+	defaultMaxUploadSize = 1 << 30
+	// uploadEnvelopeSize is the room left in the request body for the
+	// multipart headers and boundaries around the uploaded file
+	uploadEnvelopeSize = 1 << 20
+)
+
 type uploadedFile struct {
 	Name                 string    `json:"name"`
 	Size                 int64     `json:"size"`
 	LastModificationDate time.Time `json:"lastModifiedDate"`
 }
 
+// filePath returns the path of the uploaded file with the given name, making
+// sure the name can't be used to escape the files directory
+func (ws *webServer) filePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return "", errors.New("Invalid file name")
+	}
+	return filepath.Join(ws.ds.WorkspacePath(), "files", name), nil
+}
+
+// filesDir returns the path of the files directory of the workspace,
+// creating it if it doesn't exist yet
+func (ws *webServer) filesDir() (string, error) {
+	dir := filepath.Join(ws.ds.WorkspacePath(), "files")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Error while creating the files directory: %s", err)
+	}
+	return dir, nil
+}
+
 // Files allows utilization of the uploaded/shared files through http requests
 func (ws *webServer) Files(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir(filepath.Join(ws.ds.WorkspacePath(), "files"))
+	dir, err := ws.filesDir()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	var filesList []uploadedFile
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	filesList := make([]uploadedFile, 0, len(files))
 	for _, f := range files {
 		if f.Name()[0] == '.' {
 			continue
@@ -41,57 +79,144 @@ func (ws *webServer) Files(w http.ResponseWriter, r *http.Request) {
 
 // Upload does what it is supposed to do!
 func (ws *webServer) Upload(w http.ResponseWriter, r *http.Request) {
-	const MaxFileSize = 1 << 30
-	// This feels like a bad hack...
-	if r.ContentLength > MaxFileSize {
-		http.Error(w, "Request too large", 400)
-		return
+	maxFileSize := ws.maxUploadSize
+	if maxFileSize <= 0 {
+		maxFileSize = defaultMaxUploadSize
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize)
+	// the body also carries the multipart envelope, so it's allowed to be
+	// a bit larger than the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+uploadEnvelopeSize)
 
 	err := r.ParseMultipartForm(1024)
 	if err != nil {
-		http.Error(w, "File too large", 400)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errors.New("Request Entity Too Large"))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, err)
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		panic(err)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
 	}
+	defer file.Close()
 
-	dst, err := os.Create(filepath.Join(ws.ds.WorkspacePath(), "files", header.Filename))
-	defer dst.Close()
+	dstPath, err := ws.filePath(header.Filename)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := ws.filesDir(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	written, err := io.Copy(dst, io.LimitReader(file, MaxFileSize))
+	// the same name can't be uploaded concurrently, for the uploads not to
+	// clobber each other
+	if !ws.uploads.acquire(header.Filename) {
+		writeJSONError(w, http.StatusConflict, errors.New("The file is being uploaded by another request"))
+		return
+	}
+	defer ws.uploads.release(header.Filename)
+
+	if r.FormValue("overwrite") == "false" {
+		if _, err := os.Stat(dstPath); err == nil {
+			writeJSONError(w, http.StatusConflict, errors.New("The file already exists"))
+			return
+		}
+	}
+
+	// written to a hidden temp file and renamed into place, so the file is
+	// never seen half written
+	dst, err := ioutil.TempFile(filepath.Dir(dstPath), "."+header.Filename+".upload-")
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	// reading one byte past the limit tells a file which is exactly at the
+	// limit apart from a larger one
+	written, err := io.Copy(dst, io.LimitReader(file, maxFileSize+1))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	if written == MaxFileSize {
-		http.Error(w, "File too large", 400)
+	if written > maxFileSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errors.New("Request Entity Too Large"))
+		return
+	}
+
+	if err := dst.Close(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := os.Chmod(dst.Name(), 0644); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := os.Rename(dst.Name(), dstPath); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
 		return
 	}
 }
 
+// uploadLocks are the names of the files being uploaded. The zero value is
+// ready to use
+type uploadLocks struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// acquire marks the name as being uploaded, and returns false if it's
+// already being uploaded
+func (l *uploadLocks) acquire(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.names[name] {
+		return false
+	}
+	if l.names == nil {
+		l.names = make(map[string]bool)
+	}
+	l.names[name] = true
+	return true
+}
+
+func (l *uploadLocks) release(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.names, name)
+}
+
 // DeleteFile allows the deletion of a file through http Request
 func (ws *webServer) DeleteFile(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 
 	if name != "" {
-		err := os.Remove(filepath.Join(ws.ds.WorkspacePath(), "files", name))
+		filePath, err := ws.filePath(name)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		err = os.Remove(filePath)
 
 		if err != nil {
-			http.Error(w, err.Error(), 404)
+			writeJSONError(w, http.StatusNotFound, err)
 
 			return
 		}
 	} else {
-		http.Error(w, "No file name specified.", 400)
+		writeJSONError(w, http.StatusBadRequest, errors.New("No file name specified."))
 	}
 
 }
@@ -0,0 +1,281 @@
+package web
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func newTestWebServer(t *testing.T) *webServer {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	return &webServer{ds: ds, breaker: datasource.NewBreaker(datasource.DefaultBreakerOpenPeriod)}
+}
+
+func TestFilesWithoutFilesDir(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	w := httptest.NewRecorder()
+	ws.Files(w, httptest.NewRequest("GET", "/files", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("expected an empty list, got %s", body)
+	}
+	if _, err := os.Stat(filepath.Join(ws.ds.WorkspacePath(), "files")); err != nil {
+		t.Errorf("expected the files directory to be created: %s", err)
+	}
+}
+
+func TestUploadWithoutFilesDir(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	ws.Upload(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	data, err := os.ReadFile(filepath.Join(ws.ds.WorkspacePath(), "files", "hello.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected uploaded file: %q, %v", data, err)
+	}
+}
+
+func TestFilesUncreatableFilesDir(t *testing.T) {
+	ws := newTestWebServer(t)
+	// a regular file in place of the directory
+	os.WriteFile(filepath.Join(ws.ds.WorkspacePath(), "files"), nil, 0644)
+
+	w := httptest.NewRecorder()
+	ws.Files(w, httptest.NewRequest("GET", "/files", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+}
+
+func uploadRequest(t *testing.T, name string, content []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	const limit = 64
+	tests := []struct {
+		size     int
+		wantCode int
+	}{
+		{limit - 1, http.StatusOK},
+		{limit, http.StatusOK},
+		{limit + 1, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		ws := newTestWebServer(t)
+		ws.maxUploadSize = limit
+
+		w := httptest.NewRecorder()
+		ws.Upload(w, uploadRequest(t, "blob", bytes.Repeat([]byte("x"), tt.size)))
+		if w.Code != tt.wantCode {
+			t.Errorf("size=%d: expected status %d, got %d: %s", tt.size, tt.wantCode, w.Code, w.Body)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(ws.ds.WorkspacePath(), "files", "blob"))
+		if tt.wantCode == http.StatusOK && len(data) != tt.size {
+			t.Errorf("size=%d: expected the whole file to be stored, got %d bytes (%v)", tt.size, len(data), err)
+		}
+		if tt.wantCode != http.StatusOK && !os.IsNotExist(err) {
+			t.Errorf("size=%d: expected the oversize file to be removed, got %v", tt.size, err)
+		}
+	}
+}
+
+func TestNewHandlerUploadSize(t *testing.T) {
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	handler := NewHandler(ds, "", nil, nil, nil, nil, 64)
+
+	for size, status := range map[int]int{
+		64: http.StatusOK,
+		65: http.StatusRequestEntityTooLarge,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, uploadRequest(t, "blob", bytes.Repeat([]byte("x"), size)))
+		if w.Code != status {
+			t.Errorf("size=%d: expected status %d, got %d: %s", size, status, w.Code, w.Body)
+		}
+	}
+}
+
+func TestUploadConcurrent(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	contents := make([][]byte, 8)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, 64<<10)
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(contents))
+	for i := range contents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			ws.Upload(w, uploadRequest(t, "image", contents[i]))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK && code != http.StatusConflict {
+			t.Errorf("upload #%d: unexpected status %d", i, code)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(ws.ds.WorkspacePath(), "files", "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole := false
+	for _, content := range contents {
+		whole = whole || bytes.Equal(data, content)
+	}
+	if !whole {
+		t.Error("the uploaded file is a mix of the concurrent uploads")
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(ws.ds.WorkspacePath(), "files"))
+	if len(entries) != 1 {
+		t.Errorf("expected the temp files to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestUploadConflicts(t *testing.T) {
+	ws := newTestWebServer(t)
+
+	ws.uploads.acquire("image")
+	w := httptest.NewRecorder()
+	ws.Upload(w, uploadRequest(t, "image", []byte("first")))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 while the name is being uploaded, got %d", w.Code)
+	}
+	ws.uploads.release("image")
+
+	w = httptest.NewRecorder()
+	ws.Upload(w, uploadRequest(t, "image", []byte("first")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	r := uploadRequest(t, "image", []byte("second"))
+	r.URL.RawQuery = "overwrite=false"
+	w = httptest.NewRecorder()
+	ws.Upload(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for an existing file without overwrite, got %d", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(ws.ds.WorkspacePath(), "files", "image")); string(data) != "first" {
+		t.Errorf("expected the existing file to be kept, got %q", data)
+	}
+}
+
+// traversalCases are the file names which point outside the files directory,
+// with the paths they'd reach
+func traversalCases(t *testing.T, ws *webServer) []struct{ name, target string } {
+	workspace := ws.ds.WorkspacePath()
+	absolute := filepath.Join(t.TempDir(), "x")
+	for _, path := range []string{filepath.Join(workspace, "x"), absolute} {
+		if err := os.WriteFile(path, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ws.filesDir(); err != nil {
+		t.Fatal(err)
+	}
+	return []struct{ name, target string }{
+		{"../x", filepath.Join(workspace, "x")},
+		{"a/../../x", filepath.Join(workspace, "x")},
+		{".", filepath.Join(workspace, "files")},
+		{"..", workspace},
+		{absolute, absolute},
+	}
+}
+
+// checkTarget fails if the file or the directory at the path was changed
+func checkTarget(t *testing.T, name, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("%s: expected %s to be kept, got %v", name, path, err)
+		return
+	}
+	if data, _ := os.ReadFile(path); !info.IsDir() && string(data) != "keep" {
+		t.Errorf("%s: expected %s to be left alone, got %q", name, path, data)
+	}
+}
+
+func TestFilePathTraversal(t *testing.T) {
+	ws := newTestWebServer(t)
+	for _, tt := range traversalCases(t, ws) {
+		if path, err := ws.filePath(tt.name); err == nil {
+			t.Errorf("%s: expected an invalid file name, got %s", tt.name, path)
+		}
+	}
+}
+
+func TestUploadTraversal(t *testing.T) {
+	ws := newTestWebServer(t)
+	for _, tt := range traversalCases(t, ws) {
+		w := httptest.NewRecorder()
+		ws.Upload(w, uploadRequest(t, tt.name, []byte("overwritten")))
+		// the multipart reader keeps only the base of the names, so some
+		// land inside the files directory, but none outside
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 200 or 400, got %d: %s", tt.name, w.Code, w.Body)
+		}
+		checkTarget(t, tt.name, tt.target)
+	}
+}
+
+func TestDeleteFileTraversal(t *testing.T) {
+	ws := newTestWebServer(t)
+	for _, tt := range traversalCases(t, ws) {
+		w := httptest.NewRecorder()
+		ws.DeleteFile(w, httptest.NewRequest("DELETE", "/files?name="+url.QueryEscape(tt.name), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", tt.name, w.Code, w.Body)
+		}
+		checkTarget(t, tt.name, tt.target)
+	}
+}
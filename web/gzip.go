@@ -0,0 +1,79 @@
+package web
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// compressibleTypes are the content type prefixes worth compressing. Images
+// and other files, which are usually compressed already, are left as is
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func compressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter decides whether to compress the response once its
+// headers are known
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		header.Add("Vary", "Accept-Encoding")
+		if header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) &&
+			status != http.StatusNoContent && status != http.StatusNotModified {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// gzipHandler compresses the responses for the clients which accept gzip.
+// Range requests are served uncompressed, so the ranges stay meaningful
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(gw, r)
+		if gw.gz != nil {
+			gw.gz.Close()
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	body := strings.Repeat(`{"name": "node"}`, 100)
+	handler := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write([]byte(body))
+	}))
+
+	r := httptest.NewRequest("GET", "/api/nodes", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected a gzip encoded response")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(gz); err != nil || string(data) != body {
+		t.Errorf("unexpected decompressed body: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/image", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Error("expected the image to be served uncompressed")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/nodes", nil))
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Error("expected no compression without Accept-Encoding")
+	}
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// iscTime formats the time the way ISC dhcpd writes it to dhcpd.leases
+func iscTime(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%d %s", t.Weekday(), t.Format("2006/01/02 15:04:05"))
+}
+
+// writeISCLeases writes a lease block in the dhcpd.leases format for each
+// machine. The expiry of the leases isn't stored, so the ends statement is
+// left out
+func writeISCLeases(buf *bytes.Buffer, machines []datasource.Machine) error {
+	for _, machine := range machines {
+		ip, err := machine.IP()
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			// its lease has been expired
+			continue
+		}
+		first, err := machine.FirstSeen()
+		if err != nil {
+			return err
+		}
+		last, err := machine.LastSeen()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(buf, "lease %s {\n", ip)
+		fmt.Fprintf(buf, "  starts %s;\n", iscTime(first))
+		fmt.Fprintf(buf, "  cltt %s;\n", iscTime(last))
+		fmt.Fprintf(buf, "  binding state active;\n")
+		fmt.Fprintf(buf, "  hardware ethernet %s;\n", machine.Mac())
+		fmt.Fprintf(buf, "  client-hostname %q;\n", machine.Name())
+		fmt.Fprintf(buf, "}\n")
+	}
+	return nil
+}
+
+// LeasesText returns the leases of the currently known nodes in the ISC
+// dhcpd.leases format
+func (ws *webServer) LeasesText(w http.ResponseWriter, r *http.Request) {
+	machines, err := ws.ds.Machines()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeISCLeases(&buf, machines); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
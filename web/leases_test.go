@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestISCTime(t *testing.T) {
+	at := time.Date(2016, 5, 4, 10, 11, 12, 0, time.UTC)
+	if s := iscTime(at); s != "3 2016/05/04 10:11:12" {
+		t.Errorf("unexpected time: %q", s)
+	}
+}
+
+func TestLeasesText(t *testing.T) {
+	ws := newTestWebServer(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	if _, created := ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10)); !created {
+		t.Fatal("machine wasn't created")
+	}
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/leases.txt", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, expected := range []string{
+		"lease 10.0.0.10 {\n",
+		"  hardware ethernet 00:11:22:33:44:55;\n",
+		"  client-hostname \"node001122334455\";\n",
+		"  binding state active;\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in:\n%s", expected, body)
+		}
+	}
+	if !strings.HasSuffix(body, "}\n") {
+		t.Errorf("expected the lease block to be closed:\n%s", body)
+	}
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// NetworkInfo is the network configuration which blacksmith resolved on
+// startup, served by /api/network
+type NetworkInfo struct {
+	// Interface is the name of the interface which DHCP and PXE are
+	// served on
+	Interface string `json:"interface"`
+	// Addresses are all the addresses of Interface, including the IPv6 ones,
+	// which ServerIP was picked from
+	Addresses []string `json:"addresses"`
+	// ServerIP is the IPv4 address blacksmith serves on: the first global
+	// unicast, link-local or loopback one, in this order
+	ServerIP net.IP `json:"serverIP"`
+
+	SubnetMask net.IP   `json:"subnetMask"`
+	Router     net.IP   `json:"router"`
+	DNS        []string `json:"dns"`
+}
+
+type networkDetails struct {
+	NetworkInfo
+	LeaseStart net.IP `json:"leaseStart"`
+	LeaseEnd   net.IP `json:"leaseEnd"`
+	LeaseRange int    `json:"leaseRange"`
+}
+
+// Network returns the interface and the address which blacksmith serves on,
+// and the parameters of the lease pool
+func (ws *webServer) Network(w http.ResponseWriter, r *http.Request) {
+	details := networkDetails{
+		LeaseStart: ws.ds.LeaseStart(),
+		LeaseRange: ws.ds.LeaseRange(),
+	}
+	if ws.network != nil {
+		details.NetworkInfo = *ws.network
+	}
+	if details.LeaseStart != nil && details.LeaseRange > 0 {
+		details.LeaseEnd = dhcp4.IPAdd(details.LeaseStart, details.LeaseRange-1)
+	}
+
+	detailsJSON, err := json.Marshal(&details)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(detailsJSON))
+}
@@ -0,0 +1,37 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetwork(t *testing.T) {
+	ws := newTestWebServer(t)
+	ws.network = &NetworkInfo{
+		Interface:  "eth1",
+		Addresses:  []string{"fe80::1/64", "10.0.0.2/24"},
+		ServerIP:   net.IPv4(10, 0, 0, 2),
+		SubnetMask: net.IPv4(255, 255, 255, 0),
+		Router:     net.IPv4(10, 0, 0, 1),
+		DNS:        []string{"8.8.8.8"},
+	}
+
+	w := httptest.NewRecorder()
+	ws.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/network", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var details networkDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatal(err)
+	}
+	if details.Interface != "eth1" || !details.ServerIP.Equal(net.IPv4(10, 0, 0, 2)) || len(details.Addresses) != 2 {
+		t.Errorf("unexpected interface details: %+v", details.NetworkInfo)
+	}
+	if !details.LeaseStart.Equal(net.IPv4(10, 0, 0, 10)) || !details.LeaseEnd.Equal(net.IPv4(10, 0, 0, 19)) || details.LeaseRange != 10 {
+		t.Errorf("unexpected lease pool: %s-%s (%d)", details.LeaseStart, details.LeaseEnd, details.LeaseRange)
+	}
+}
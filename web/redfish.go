@@ -0,0 +1,140 @@
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const redfishTimeout = 10 * time.Second
+
+// Redfish is a BMC which talks to the Redfish API at the address, e.g.
+// https://10.0.1.10, controlling the first system of the BMC
+type Redfish struct {
+	Client *http.Client
+}
+
+// NewRedfish returns a Redfish BMC. insecure skips the verification of the
+// certificates, which are usually self-signed on the BMCs
+func NewRedfish(insecure bool) *Redfish {
+	return &Redfish{
+		Client: &http.Client{
+			Timeout: redfishTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+	}
+}
+
+// do sends the request with the body encoded as json, if it's not nil, and
+// decodes the reply into out, if it's not nil
+func (r *Redfish) do(method, url, user, password string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("redfish: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("redfish: %s %s failed with status %s", method, url, resp.Status)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("redfish: invalid reply of %s: %s", url, err)
+		}
+	}
+	return nil
+}
+
+// system returns the url of the first system of the BMC
+func (r *Redfish) system(address, user, password string) (string, error) {
+	address = strings.TrimRight(address, "/")
+	var systems struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		}
+	}
+	if err := r.do("GET", address+"/redfish/v1/Systems", user, password, nil, &systems); err != nil {
+		return "", err
+	}
+	if len(systems.Members) == 0 || systems.Members[0].ID == "" {
+		return "", errors.New("redfish: the BMC has no systems")
+	}
+	return address + systems.Members[0].ID, nil
+}
+
+// PowerCycle force-restarts the system
+// part of BMC interface implementation
+func (r *Redfish) PowerCycle(address, user, password string) error {
+	system, err := r.system(address, user, password)
+	if err != nil {
+		return err
+	}
+	return r.do("POST", system+"/Actions/ComputerSystem.Reset", user, password,
+		map[string]string{"ResetType": "ForceRestart"}, nil)
+}
+
+// PowerStatus returns the PowerState of the system
+// part of BMC interface implementation
+func (r *Redfish) PowerStatus(address, user, password string) (string, error) {
+	system, err := r.system(address, user, password)
+	if err != nil {
+		return "", err
+	}
+	var state struct {
+		PowerState string
+	}
+	if err := r.do("GET", system, user, password, nil, &state); err != nil {
+		return "", err
+	}
+	switch state.PowerState {
+	case "On", "PoweringOff":
+		return PowerOn, nil
+	case "Off", "PoweringOn":
+		return PowerOff, nil
+	}
+	return "", fmt.Errorf("redfish: unexpected power state: %q", state.PowerState)
+}
+
+// SetBootOnce overrides the boot source of the system for the next boot
+// part of BMC interface implementation
+func (r *Redfish) SetBootOnce(address, user, password string, pxe bool) error {
+	system, err := r.system(address, user, password)
+	if err != nil {
+		return err
+	}
+	target := "Hdd"
+	if pxe {
+		target = "Pxe"
+	}
+	return r.do("PATCH", system, user, password, map[string]interface{}{
+		"Boot": map[string]string{
+			"BootSourceOverrideEnabled": "Once",
+			"BootSourceOverrideTarget":  target,
+		},
+	}, nil)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedfish(t *testing.T) {
+	var reset, boot map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /redfish/v1/Systems":
+			w.Write([]byte(`{"Members": [{"@odata.id": "/redfish/v1/Systems/1"}]}`))
+		case "GET /redfish/v1/Systems/1":
+			w.Write([]byte(`{"PowerState": "On"}`))
+		case "POST /redfish/v1/Systems/1/Actions/ComputerSystem.Reset":
+			json.NewDecoder(r.Body).Decode(&reset)
+		case "PATCH /redfish/v1/Systems/1":
+			json.NewDecoder(r.Body).Decode(&boot)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	bmc := &BMCs{Redfish: NewRedfish(false)}
+	if state, err := bmc.PowerStatus(server.URL, "admin", "secret"); err != nil || state != PowerOn {
+		t.Errorf("unexpected power status: %q (%v)", state, err)
+	}
+	if err := bmc.PowerCycle(server.URL, "admin", "secret"); err != nil || reset["ResetType"] != "ForceRestart" {
+		t.Errorf("unexpected reset: %v (%v)", reset, err)
+	}
+	if err := bmc.SetBootOnce(server.URL, "admin", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	if override, _ := boot["Boot"].(map[string]interface{}); override["BootSourceOverrideEnabled"] != "Once" ||
+		override["BootSourceOverrideTarget"] != "Pxe" {
+		t.Errorf("unexpected boot override: %v", boot)
+	}
+
+	if _, err := bmc.PowerStatus(server.URL, "admin", "wrong"); err == nil {
+		t.Error("expected an error for the rejected credentials")
+	}
+	if err := bmc.PowerCycle("10.0.1.10", "admin", "secret"); err != ErrNoBMC {
+		t.Errorf("expected ErrNoBMC for an ipmi address without ipmitool, got %v", err)
+	}
+}
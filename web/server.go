@@ -1,19 +1,47 @@
 package web // import "github.com/cafebazaar/blacksmith/web"
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+	"github.com/cafebazaar/blacksmith/logging"
 )
 
 type webServer struct {
 	ds datasource.DataSource
+	// maxUploadSize is the largest file accepted by Upload, in bytes.
+	// Zero means defaultMaxUploadSize
+	maxUploadSize int64
+	// uiDir is the directory which the UI is served from. Empty means the
+	// embedded UI
+	uiDir string
+	// breaker short-circuits the template endpoints while etcd is
+	// unavailable
+	breaker *datasource.Breaker
+	// bmc controls the power of the machines, e.g. on reimage. Nil means
+	// the machines should be power-cycled manually
+	bmc BMC
+	// dhcpEvents are the recent decisions of the DHCP handler. Nil means
+	// they aren't recorded
+	dhcpEvents *dhcp.EventLog
+	// waker wakes the machines on POST /api/node/<mac>/wol. Nil means
+	// wake-on-LAN isn't available
+	waker Waker
+	// network is the network configuration served by /api/network. Nil
+	// means it's unknown
+	network *NetworkInfo
+	// uploads are the names of the files being uploaded
+	uploads uploadLocks
 }
 
 // Handler uses a multiplexing router to route http requests
@@ -23,14 +51,45 @@ func (ws *webServer) Handler() http.Handler {
 	mux.PathPrefix("/t/cc/").HandlerFunc(ws.Cloudconfig).Methods("GET")
 	mux.PathPrefix("/t/ig/").HandlerFunc(ws.Ignition).Methods("GET")
 	mux.PathPrefix("/t/bp/").HandlerFunc(ws.Bootparams).Methods("GET")
+	mux.HandleFunc("/api/lint", ws.Lint).Methods("POST")
 
 	mux.HandleFunc("/api/version", ws.Version)
+	mux.HandleFunc("/api/etcd-endpoints", ws.EtcdEndpoints)
+
+	mux.HandleFunc("/api/config", ws.Config).Methods("GET")
+	mux.PathPrefix("/api/config/").HandlerFunc(ws.SetConfig).Methods("PUT")
 
 	mux.HandleFunc("/api/nodes", ws.NodesList)
-	mux.PathPrefix("/api/node/").HandlerFunc(ws.NodeFlags).Methods("GET")
+	mux.HandleFunc("/api/lease-pool", ws.LeasePool)
+	mux.HandleFunc("/api/network", ws.Network).Methods("GET")
+	mux.HandleFunc("/api/dhcp/events", ws.DHCPEvents).Methods("GET")
+	mux.HandleFunc("/api/leases.txt", ws.LeasesText).Methods("GET")
+	mux.HandleFunc("/api/reconcile", ws.Reconcile).Methods("POST")
+	mux.HandleFunc("/api/reconcile", ws.ReconcileStats).Methods("GET")
+	mux.HandleFunc("/api/resolve", ws.Resolve).Methods("GET")
+	mux.HandleFunc("/api/maintenance", ws.Maintenance).Methods("GET")
+	mux.HandleFunc("/api/maintenance", ws.SetMaintenance).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}/state", ws.NodeState).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/state", ws.SetNodeState).Methods("PUT")
+	mux.HandleFunc("/api/node/{mac}/note", ws.NodeNote).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/note", ws.SetNodeNote).Methods("PUT")
+	mux.HandleFunc("/api/node/{mac}/reimage", ws.Reimage).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}/expire-lease", ws.ExpireLease).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}/bmc", ws.NodeBMC).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/bmc", ws.SetNodeBMC).Methods("PUT")
+	mux.HandleFunc("/api/node/{mac}/power", ws.NodePower).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/power", ws.SetNodePower).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}/wol", ws.WakeNode).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}/boots", ws.NodeBoots).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/bundle.tar", ws.NodeBundle).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/flag/{key}/history", ws.NodeFlagHistory).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/flags", ws.NodeFlags).Methods("GET")
+	mux.HandleFunc("/api/node/{mac}/flags", ws.ImportNodeFlags).Methods("POST")
+	mux.HandleFunc("/api/node/{mac}", ws.NodeInfo).Methods("GET")
 
 	mux.PathPrefix("/api/flag/").HandlerFunc(ws.SetFlag).Methods("PUT")
 	mux.PathPrefix("/api/flag/").HandlerFunc(ws.DelFlag).Methods("DELETE")
+	mux.HandleFunc("/api/audit", ws.Audit).Methods("GET")
 
 	mux.HandleFunc("/upload/", ws.Upload)
 	mux.HandleFunc("/files", ws.Files).Methods("GET")
@@ -38,18 +97,130 @@ func (ws *webServer) Handler() http.Handler {
 	mux.PathPrefix("/files/").Handler(http.StripPrefix("/files/",
 		http.FileServer(http.Dir(filepath.Join(ws.ds.WorkspacePath(), "files")))))
 
-	mux.PathPrefix("/ui/").Handler(http.FileServer(FS(false)))
+	if ws.uiDir != "" {
+		mux.PathPrefix("/ui/").Handler(http.StripPrefix("/ui/", http.FileServer(http.Dir(ws.uiDir))))
+	} else {
+		mux.PathPrefix("/ui/").Handler(http.FileServer(FS(false)))
+	}
 
 	return mux
 }
 
-//ServeWeb serves api of Blacksmith and a ui connected to that api
-func ServeWeb(ds datasource.DataSource, listenAddr net.TCPAddr) error {
-	r := &webServer{ds: ds}
-	loggedRouter := handlers.LoggingHandler(os.Stdout, r.Handler())
+// NewHandler returns the routes which ServeWeb serves, without the logging
+// and the compression, e.g. to serve them without a socket in the tests. In
+// the read-only mode, the datasource is wrapped by datasource.ReadOnly
+func NewHandler(ds datasource.DataSource, uiDir string, bmc BMC, waker Waker, network *NetworkInfo, dhcpEvents *dhcp.EventLog, maxUploadSize int64) http.Handler {
+	// the GET requests write too, like the renders using the lock and the
+	// uuid template funcs
+	if readOnly {
+		ds = datasource.ReadOnly(ds)
+	}
+	ws := &webServer{
+		ds:            ds,
+		uiDir:         uiDir,
+		breaker:       datasource.NewBreaker(datasource.DefaultBreakerOpenPeriod),
+		bmc:           bmc,
+		waker:         waker,
+		network:       network,
+		dhcpEvents:    dhcpEvents,
+		maxUploadSize: maxUploadSize,
+	}
+	return ws.Handler()
+}
+
+var (
+	readHeaderTimeout = 10 * time.Second
+	apiTimeout        = time.Minute
+	filesTimeout      = 30 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// ConfigureTimeouts sets how long ServeWeb waits for the headers of a
+// request, how long the api and the templates may take to be handled, how
+// long the uploads and the downloads of the files may take, and how long an
+// idle keep-alive connection is kept open. A zero one means no timeout
+func ConfigureTimeouts(readHeader, api, files, idle time.Duration) {
+	readHeaderTimeout = readHeader
+	apiTimeout = api
+	filesTimeout = files
+	idleTimeout = idle
+}
+
+// isFilesPath reports whether the route of path moves files, which may be
+// large images and need the longer timeout
+func isFilesPath(path string) bool {
+	return path == "/files" || strings.HasPrefix(path, "/files/") || strings.HasPrefix(path, "/upload/")
+}
+
+// withTimeouts bounds the requests other than the files with apiTimeout.
+// The files are bounded by the write timeout of the server instead
+func withTimeouts(h http.Handler) http.Handler {
+	if apiTimeout <= 0 {
+		return h
+	}
+	limited := http.TimeoutHandler(h, apiTimeout, `{"error":"timed out"}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isFilesPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// readOnly makes ServeWeb refuse the requests which change anything
+var readOnly bool
+
+// errReadOnly is returned for the requests refused in the read-only mode
+var errReadOnly = errors.New("this instance is a read-only replica")
+
+// readOnlyPosts are the paths of the POST requests which don't change
+// anything, and are served in the read-only mode too
+var readOnlyPosts = map[string]bool{
+	"/api/lint": true,
+}
+
+// ConfigureReadOnly sets whether ServeWeb refuses the requests other than
+// GET and HEAD, and never writes to the datasource, like on a replica
+func ConfigureReadOnly(enabled bool) {
+	readOnly = enabled
+}
+
+// refuseWrites refuses the requests other than GET, HEAD and readOnlyPosts
+// in the read-only mode
+func refuseWrites(h http.Handler) http.Handler {
+	if !readOnly {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && readOnlyPosts[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeJSONError(w, http.StatusForbidden, errReadOnly)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//ServeWeb serves api of Blacksmith and a ui connected to that api. If uiDir
+// isn't empty, the ui is served from that directory instead of the embedded one.
+// bmc is used to control the power of the machines, and waker to wake the
+// ones without a BMC, and both can be nil. network is served by
+// /api/network, and can be nil too. The
+// recent decisions of the DHCP handler are served from dhcpEvents, which can
+// be nil too. maxUploadSize is the largest file accepted by /upload, in
+// bytes, and zero means 1 GiB
+func ServeWeb(ds datasource.DataSource, listenAddr net.TCPAddr, uiDir string, bmc BMC, waker Waker, network *NetworkInfo, dhcpEvents *dhcp.EventLog, maxUploadSize int64) error {
+	loggedRouter := logging.RequestIDHandler(handlers.LoggingHandler(os.Stdout, gzipHandler(refuseWrites(withTimeouts(NewHandler(ds, uiDir, bmc, waker, network, dhcpEvents, maxUploadSize))))))
 	s := &http.Server{
-		Addr:    listenAddr.String(),
-		Handler: loggedRouter,
+		Addr:              listenAddr.String(),
+		Handler:           loggedRouter,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      filesTimeout,
+		IdleTimeout:       idleTimeout,
 	}
 
 	return s.ListenAndServe()
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/datasource/datasourcetest"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	defer ConfigureTimeouts(readHeaderTimeout, apiTimeout, filesTimeout, idleTimeout)
+	ConfigureTimeouts(time.Second, 10*time.Millisecond, time.Minute, time.Minute)
+
+	slow := withTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+
+	for path, status := range map[string]int{
+		"/api/nodes":              http.StatusServiceUnavailable,
+		"/t/cc/00:11:22:33:44:01": http.StatusServiceUnavailable,
+		"/files":                  http.StatusOK,
+		"/files/coreos.img":       http.StatusOK,
+		"/upload/coreos.img":      http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		slow.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, w.Code)
+		}
+	}
+}
+
+func TestRefuseWrites(t *testing.T) {
+	defer ConfigureReadOnly(readOnly)
+	ConfigureReadOnly(true)
+
+	handler := refuseWrites(newTestWebServer(t).Handler())
+	for method, status := range map[string]int{
+		"GET":    http.StatusOK,
+		"PUT":    http.StatusForbidden,
+		"POST":   http.StatusForbidden,
+		"DELETE": http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/api/lease-pool", nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", method, status, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/lint", strings.NewReader(`{"text": "<< .Hostname >>"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the lint to be served in the read-only mode, got %d", w.Code)
+	}
+}
+
+func TestReadOnlyRender(t *testing.T) {
+	defer ConfigureReadOnly(readOnly)
+	ConfigureReadOnly(true)
+
+	ds := datasourcetest.New(net.IPv4(10, 0, 0, 10), 10)
+	ds.Workspace = t.TempDir()
+	folder := filepath.Join(ds.Workspace, "config", "cloudconfig")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+	machine, _ := ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+	handler := NewHandler(ds, "", nil, nil, nil, nil, 0)
+
+	for name, text := range map[string]string{
+		"lock":         `<< if lock "disk" 60 >>locked<< end >>`,
+		"unlock":       `<< unlock "disk" >>`,
+		"stableRandom": `<< stableRandom "token" 8 >>`,
+		"uuid":         `<< uuid "id" >>`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(folder, "main"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/t/cc/00:11:22:33:44:01", nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("%s: expected the render to fail on a replica, got %q", name, w.Body)
+		}
+	}
+
+	if acquired, err := ds.AcquireLock("disk", "other", time.Minute); !acquired || err != nil {
+		t.Errorf("expected the lock to be left free, got %v (%v)", acquired, err)
+	}
+	for _, key := range []string{"token", "id"} {
+		if value, err := machine.GetFlag(key); !datasource.IsFlagNotFound(err) {
+			t.Errorf("expected the stable value %s not to be written, got %q (%v)", key, value, err)
+		}
+	}
+
+	// the stable values set by the primary are read
+	machine.SetFlag("id", "0d0b3f0e-5c1d-4f0a-9c47-3a7a6b1e9f11")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/t/cc/00:11:22:33:44:01", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "0d0b3f0e-5c1d-4f0a-9c47-3a7a6b1e9f11" {
+		t.Errorf("expected the stored uuid, got %d: %q", w.Code, w.Body)
+	}
+}
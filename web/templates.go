@@ -1,11 +1,17 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
 	"path"
 
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/logging"
 	"github.com/cafebazaar/blacksmith/templating"
 )
 
@@ -13,7 +19,11 @@ const (
 	templatesDebugTag = "WEB-T"
 )
 
-func (ws *webServer) generateTemplateForMachine(templateName string, w http.ResponseWriter, r *http.Request) string {
+// generateTemplateForMachine serves the template with the given content type,
+// unless the front matter of the template declares another one
+func (ws *webServer) generateTemplateForMachine(templateName, contentType string, w http.ResponseWriter, r *http.Request) string {
+	// rendered per machine, and changed by its flags
+	w.Header().Set("Cache-Control", "no-store")
 	_, macStr := path.Split(r.URL.Path)
 
 	mac, err := net.ParseMAC(macStr)
@@ -22,21 +32,56 @@ func (ws *webServer) generateTemplateForMachine(templateName string, w http.Resp
 		return ""
 	}
 
+	err = ws.breaker.Do(func() error {
+		_, err := ws.ds.CoreOSVersion()
+		return err
+	})
+	if datasource.IsUnavailable(err) {
+		logging.LogRequest(templatesDebugTag, r, "Etcd is unavailable: %s", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return ""
+	}
+
 	machine, exist := ws.ds.GetMachine(mac)
 	if !exist {
 		http.Error(w, "Machine not found", 500)
 		return ""
 	}
 
-	cc, err := templating.ExecuteTemplateFolder(
-		path.Join(ws.ds.WorkspacePath(), "config", templateName), machine, r.Host)
+	folder, err := templating.ConfigFolder(ws.ds.WorkspacePath(), templateName, machine)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`Error while selecting the profile: %q`, err), 500)
+		return ""
+	}
+
+	cc, headers, err := templating.ExecuteTemplateFolderWithHeaders(folder, ws.ds, machine, r.Host)
+	if err == nil && templateName == "ignition" {
+		cc, err = templating.MergeIgnitionBase(folder, cc)
+	}
+	if err == templating.ErrTooManyRenders {
+		logging.LogRequest(templatesDebugTag, r, "Too many renders, rejected the %s of %s", templateName, mac)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return ""
+	}
+	if errors.Is(err, templating.ErrMissingConfig) {
+		logging.LogRequest(templatesDebugTag, r, "No %s for %s: %s", templateName, mac, err)
+		http.Error(w, fmt.Sprintf("No %s for the machine", templateName), http.StatusNotFound)
+		return ""
+	}
 	if err != nil {
+		logging.LogRequest(templatesDebugTag, r, "Error while executing the %s template for %s: %s",
+			templateName, mac, err)
 		http.Error(w, fmt.Sprintf(`Error while executing the template: %q`, err), 500)
 		return ""
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", contentType)
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
 	w.Write([]byte(cc))
+	logging.LogRequest(templatesDebugTag, r, "Sent %s to %s (%s)", templateName, mac, r.RemoteAddr)
 
 	return cc
 }
@@ -44,7 +89,7 @@ func (ws *webServer) generateTemplateForMachine(templateName string, w http.Resp
 // Cloudconfig generates and writes cloudconfig for the machine specified by the
 // mac in the request url path
 func (ws *webServer) Cloudconfig(w http.ResponseWriter, r *http.Request) {
-	config := ws.generateTemplateForMachine("cloudconfig", w, r)
+	config := ws.generateTemplateForMachine("cloudconfig", "text/cloud-config", w, r)
 
 	if config != "" && r.FormValue("validate") != "" {
 		w.Write([]byte(templating.ValidateCloudConfig(config)))
@@ -54,11 +99,52 @@ func (ws *webServer) Cloudconfig(w http.ResponseWriter, r *http.Request) {
 // Ignition generates and writes ignition for the machine specified by the
 // mac in the request url path
 func (ws *webServer) Ignition(w http.ResponseWriter, r *http.Request) {
-	ws.generateTemplateForMachine("ignition", w, r)
+	ws.generateTemplateForMachine("ignition", "application/json", w, r)
 }
 
 // Bootparams generates and writes bootparams for the machine specified by the
 // mac in the request url path. (Just for validation purpose)
 func (ws *webServer) Bootparams(w http.ResponseWriter, r *http.Request) {
-	ws.generateTemplateForMachine("bootparams", w, r)
+	ws.generateTemplateForMachine("bootparams", "text/plain", w, r)
+}
+
+type lintRequest struct {
+	Text     string `json:"text"`
+	Template string `json:"template"`
+}
+
+// Lint returns the flag keys which a template references, and its parse
+// errors, with a body like {"text": "..."}, or {"template": "cloudconfig/main"}
+// for a template of the config folder of the workspace
+func (ws *webServer) Lint(w http.ResponseWriter, r *http.Request) {
+	var request lintRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Error while parsing the body: %s", err))
+		return
+	}
+	if (request.Text == "") == (request.Template == "") {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Expected either text or template"))
+		return
+	}
+
+	result := templating.LintTemplate(request.Text)
+	if request.Template != "" {
+		var err error
+		result, err = templating.LintTemplateFile(ws.ds.WorkspacePath(), request.Template)
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("Template %s not found", request.Template))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	resultJSON, err := json.Marshal(&result)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	io.WriteString(w, string(resultJSON))
 }
@@ -1,6 +1,6 @@
 var blacksmithUIControllers = angular.module('blacksmithUIControllers', []);
 
-blacksmithUIControllers.controller('BlacksmithNodesCtrl', ['$scope', 'Nodes', 'Node', 'Flag', function ($scope, Nodes, Node, Flag) {
+blacksmithUIControllers.controller('BlacksmithNodesCtrl', ['$scope', 'Nodes', 'Node', 'NodeNote', 'Flag', function ($scope, Nodes, Node, NodeNote, Flag) {
   $scope.sortType     = 'name';
   $scope.sortReverse  = false;
   $scope.searchTerm   = '';
@@ -32,6 +32,16 @@ blacksmithUIControllers.controller('BlacksmithNodesCtrl', ['$scope', 'Nodes', 'N
     );
   };
 
+  $scope.setNote = function(nic, note) {
+    return NodeNote.set({nic: nic, value: note}).$promise.then(
+      function( value ){},
+      function( error ){
+        $scope.errorMessage = error.data;
+        return error.data.error || "Error while setting the note";
+      }
+    );
+  };
+
   $scope.addFlag = function() {
     var name = prompt("Enter flag name", "");
     var value = prompt("Enter flag value", "");
@@ -74,11 +84,15 @@ blacksmithUIControllers.controller('BlacksmithNodesCtrl', ['$scope', 'Nodes', 'N
 
 }]);
 
-blacksmithUIControllers.controller('BlacksmithAboutCtrl', ['$scope', 'Version', function ($scope, Version) {
+blacksmithUIControllers.controller('BlacksmithAboutCtrl', ['$scope', 'Version', 'EtcdEndpoints', function ($scope, Version, EtcdEndpoints) {
   Version.query().$promise.then(
     function( value ){ $scope.info = value },
     function( error ){ $scope.errorMessage = error.data; $scope.info = {} }
   );
+  EtcdEndpoints.query().$promise.then(
+    function( value ){ $scope.endpoints = value },
+    function( error ){ $scope.errorMessage = error.data; $scope.endpoints = [] }
+  );
 }]);
 
 blacksmithUIControllers.controller('BlacksmithFilesCtrl', ['$scope', 'UploadedFiles', '$http', function ($scope, UploadedFiles, $http) {
@@ -109,3 +123,21 @@ blacksmithUIControllers.controller('BlacksmithFilesCtrl', ['$scope', 'UploadedFi
       }
     }
 }]);
+
+blacksmithUIControllers.controller('BlacksmithMaintenanceCtrl', ['$scope', 'Maintenance', function ($scope, Maintenance) {
+  $scope.maintenance = {enabled: false};
+  $scope.getMaintenance = function () {
+    Maintenance.query().$promise.then(
+      function( value ){ $scope.maintenance = value; },
+      function( error ){}
+    );
+  };
+  $scope.getMaintenance();
+
+  $scope.setMaintenance = function (enabled) {
+    Maintenance.set({enabled: enabled}).$promise.then(
+      function( value ){ $scope.getMaintenance(); },
+      function( error ){ $scope.errorMessage = error.data; }
+    );
+  };
+}]);
@@ -14,10 +14,16 @@ apiServices.factory('Nodes', ['$resource',
   }]);
 apiServices.factory('Node', ['$resource',
     function($resource){
-      return $resource('/api/node/:nic', {nic: '@nic'}, {
+      return $resource('/api/node/:nic/flags', {nic: '@nic'}, {
         query: {method:'GET', params:{nic: '@nic'}, isArray:false}
       });
   }]);
+apiServices.factory('NodeNote', ['$resource',
+    function($resource){
+      return $resource('/api/node/:nic/note', {nic: '@nic'}, {
+        set: {method:'PUT', params:{nic: '@nic', value: '@value'}, isArray:false}
+      });
+  }]);
 apiServices.factory('Flag', ['$resource',
     function($resource){
       return $resource('/api/flag/:name', {name: '@name'}, {
@@ -31,3 +37,16 @@ apiServices.factory('Version', ['$resource',
         query: {method:'GET', params:{}, isArray:false}
       });
   }]);
+apiServices.factory('EtcdEndpoints', ['$resource',
+    function($resource){
+      return $resource('/api/etcd-endpoints', {}, {
+        query: {method:'GET', params:{}, isArray:true}
+      });
+  }]);
+apiServices.factory('Maintenance', ['$resource',
+    function($resource){
+      return $resource('/api/maintenance', {}, {
+        query: {method:'GET', params:{}, isArray:false},
+        set: {method:'POST', params:{}, isArray:false}
+      });
+  }]);
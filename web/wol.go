@@ -0,0 +1,89 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// wolPort is the port which the magic packets are sent to, the discard port
+const wolPort = 9
+
+// ErrNoBroadcast is returned by WakeOnLAN if its interface has no IPv4
+// address with a broadcast address, e.g. a point-to-point link
+var ErrNoBroadcast = errors.New("the interface has no usable broadcast address")
+
+// Waker boots the machines which are off without a BMC
+type Waker interface {
+	// Wake boots the machine with the hardware address
+	Wake(mac net.HardwareAddr) error
+}
+
+// WakeOnLAN wakes the machines by broadcasting the magic packets of
+// wake-on-LAN on Interface
+type WakeOnLAN struct {
+	Interface *net.Interface
+}
+
+// MagicPacket returns the wake-on-LAN packet of mac: 6 bytes of 0xff
+// followed by 16 repetitions of mac
+func MagicPacket(mac net.HardwareAddr) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("Invalid hardware address %q, expected 6 bytes", mac)
+	}
+	return append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...), nil
+}
+
+// broadcastAddr returns the broadcast address of the first IPv4 subnet of
+// addrs which has one
+func broadcastAddr(addrs []net.Addr) (net.IP, error) {
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || len(ipNet.Mask) != net.IPv4len {
+			continue
+		}
+		// /31 and /32 subnets have no broadcast address
+		if ones, _ := ipNet.Mask.Size(); ones > 30 {
+			continue
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range ip {
+			broadcast[i] = ip[i] | ^ipNet.Mask[i]
+		}
+		return broadcast, nil
+	}
+	return nil, ErrNoBroadcast
+}
+
+// Wake broadcasts the magic packet of mac on the interface
+// part of Waker interface implementation
+func (w *WakeOnLAN) Wake(mac net.HardwareAddr) error {
+	packet, err := MagicPacket(mac)
+	if err != nil {
+		return err
+	}
+	if w.Interface.Flags&net.FlagBroadcast == 0 {
+		return ErrNoBroadcast
+	}
+	addrs, err := w.Interface.Addrs()
+	if err != nil {
+		return fmt.Errorf("Error while reading the addresses of %s: %s", w.Interface.Name, err)
+	}
+	broadcast, err := broadcastAddr(addrs)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: broadcast, Port: wolPort})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeWaker struct {
+	woken net.HardwareAddr
+	err   error
+}
+
+func (f *fakeWaker) Wake(mac net.HardwareAddr) error {
+	f.woken = mac
+	return f.err
+}
+
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	packet, err := MagicPacket(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != 102 || !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Fatalf("unexpected header of the packet: % x", packet)
+	}
+	for i := 6; i < len(packet); i += 6 {
+		if !bytes.Equal(packet[i:i+6], mac) {
+			t.Fatalf("expected the mac at %d, got % x", i, packet[i:i+6])
+		}
+	}
+
+	long, _ := net.ParseMAC("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01")
+	if _, err := MagicPacket(long); err == nil {
+		t.Error("expected an error for a 20 bytes hardware address")
+	}
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	_, v6, _ := net.ParseCIDR("fd00::1/64")
+	_, p2p, _ := net.ParseCIDR("10.1.0.0/31")
+	lan := &net.IPNet{IP: net.IPv4(10, 0, 0, 10), Mask: net.CIDRMask(24, 32)}
+
+	broadcast, err := broadcastAddr([]net.Addr{v6, p2p, lan})
+	if err != nil || !broadcast.Equal(net.IPv4(10, 0, 0, 255)) {
+		t.Errorf("expected 10.0.0.255, got %s (%v)", broadcast, err)
+	}
+	if _, err := broadcastAddr([]net.Addr{v6, p2p}); err != ErrNoBroadcast {
+		t.Errorf("expected ErrNoBroadcast, got %v", err)
+	}
+}
+
+func TestWakeNode(t *testing.T) {
+	ws := newTestWebServer(t)
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ws.ds.CreateMachine(mac, net.IPv4(10, 0, 0, 10))
+
+	wake := func(mac string) int {
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/node/"+mac+"/wol", nil))
+		return w.Code
+	}
+
+	if code := wake("00:11:22:33:44:55"); code != http.StatusConflict {
+		t.Errorf("expected status 409 without a waker, got %d", code)
+	}
+
+	waker := &fakeWaker{}
+	ws.waker = waker
+	for mac, status := range map[string]int{
+		"not-a-mac":         http.StatusBadRequest,
+		"00:11:22:33:44:66": http.StatusNotFound,
+		"00:11:22:33:44:55": http.StatusOK,
+	} {
+		if code := wake(mac); code != status {
+			t.Errorf("%s: expected status %d, got %d", mac, status, code)
+		}
+	}
+	if waker.woken.String() != "00:11:22:33:44:55" {
+		t.Errorf("expected the machine to be woken, got %s", waker.woken)
+	}
+
+	waker.err = ErrNoBroadcast
+	if code := wake("00:11:22:33:44:55"); code != http.StatusConflict {
+		t.Errorf("expected status 409 without a broadcast address, got %d", code)
+	}
+	waker.err = errors.New("network is unreachable")
+	if code := wake("00:11:22:33:44:55"); code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", code)
+	}
+}